@@ -0,0 +1,132 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tgulacsi/camproxy/camutil"
+	"perkeep.org/pkg/blob"
+)
+
+// accessLog writes the requests in Apache combined log format,
+// extended with the blobref, the bytes received and the duration (in seconds).
+type accessLog struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+var access *accessLog
+
+// openAccessLog opens the access log file for appending, "-" is stdout,
+// "syslog" is the -syslog.
+func openAccessLog(filename string) (*accessLog, error) {
+	switch filename {
+	case "-":
+		return &accessLog{w: os.Stdout}, nil
+	case "syslog":
+		if *flagSyslog == "" {
+			return nil, errors.New("-access-log=syslog needs -syslog")
+		}
+		w, err := dialSyslog(*flagSyslog, *flagSyslogFacility, "camproxy-access")
+		if err != nil {
+			return nil, err
+		}
+		return &accessLog{w: w}, nil
+	}
+	fh, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return &accessLog{w: fh}, nil
+}
+
+type refNoteKey struct{}
+
+// noteRef notes the blobref of the request for the access log
+// (for the requests without the ref in the path, e.g. uploads).
+func noteRef(r *http.Request, br blob.Ref) {
+	if p, ok := r.Context().Value(refNoteKey{}).(*blob.Ref); ok {
+		*p = br
+	}
+}
+
+// withRefNote returns the request with a place for noteRef.
+func withRefNote(r *http.Request) (*http.Request, *blob.Ref) {
+	p := new(blob.Ref)
+	return r.WithContext(context.WithValue(r.Context(), refNoteKey{}, p)), p
+}
+
+// Log writes the line of the request.
+func (al *accessLog) Log(r *http.Request, ref blob.Ref, status int, bytesIn, bytesOut int64, start time.Time) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	user := "-"
+	if u := authUser(r); u != "anonymous" {
+		user = u
+	}
+	refS := "-"
+	if !ref.Valid() {
+		if p := strings.TrimPrefix(r.URL.Path, "/"); p != "" && !strings.Contains(p, "/") {
+			if items, err := camutil.ParseBlobNames(nil, []string{p}); err == nil && len(items) != 0 {
+				ref = items[0]
+			}
+		}
+	}
+	if ref.Valid() {
+		refS = ref.String()
+	}
+	line := fmt.Sprintf("%s - %s [%s] %q %d %d %q %q %s %d %.3f\n",
+		host, user, start.Format("02/Jan/2006:15:04:05 -0700"),
+		r.Method+" "+r.RequestURI+" "+r.Proto, status, bytesOut,
+		orDash(r.Referer()), orDash(r.UserAgent()),
+		refS, bytesIn, time.Since(start).Seconds())
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	if _, err := io.WriteString(al.w, line); err != nil {
+		logger.Log("msg", "write access log", "error", err)
+	}
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// Close closes the log file.
+func (al *accessLog) Close() error {
+	if al == nil {
+		return nil
+	}
+	if c, ok := al.w.(io.Closer); ok && al.w != os.Stdout {
+		return c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,388 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"html/template"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tgulacsi/camproxy/camutil"
+	"perkeep.org/pkg/blob"
+)
+
+// recentRequests is the number of requests kept for the dashboard.
+const recentRequests = 50
+
+var (
+	httpVars = expvar.NewMap("http")
+	recent   = &requestLog{}
+	started  = time.Now()
+)
+
+// requestInfo is a served request.
+type requestInfo struct {
+	Time     time.Time     `json:"time"`
+	Method   string        `json:"method"`
+	Path     string        `json:"path"`
+	User     string        `json:"user"`
+	Status   int           `json:"status"`
+	Bytes    int64         `json:"bytes"`
+	Duration time.Duration `json:"duration"`
+}
+
+// requestLog is a ring of the last recentRequests requests.
+type requestLog struct {
+	mu   sync.Mutex
+	ring [recentRequests]requestInfo
+	next int
+	full bool
+}
+
+func (rl *requestLog) Add(ri requestInfo) {
+	rl.mu.Lock()
+	rl.ring[rl.next] = ri
+	if rl.next = (rl.next + 1) % len(rl.ring); rl.next == 0 {
+		rl.full = true
+	}
+	rl.mu.Unlock()
+}
+
+// Last returns the logged requests, newest first.
+func (rl *requestLog) Last() []requestInfo {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	n := rl.next
+	if rl.full {
+		n = len(rl.ring)
+	}
+	last := make([]requestInfo, 0, n)
+	for i := 1; i <= n; i++ {
+		last = append(last, rl.ring[(rl.next-i+len(rl.ring))%len(rl.ring)])
+	}
+	return last
+}
+
+// statusWriter records the status and the size of the response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	if sw.status == 0 {
+		sw.status = code
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *statusWriter) Write(p []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	n, err := sw.ResponseWriter.Write(p)
+	sw.bytes += int64(n)
+	return n, err
+}
+
+func (sw *statusWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// countingReader counts the bytes read.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.ReadCloser.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// statsHandler counts the requests in the "http" expvar,
+// and logs them for the dashboard (and to the access log, if any).
+type statsHandler struct {
+	next http.Handler
+}
+
+func (sh statsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	sw := &statusWriter{ResponseWriter: w}
+	var body *countingReader
+	if r.Body != nil {
+		body = &countingReader{ReadCloser: r.Body}
+		r.Body = body
+	}
+	var ref *blob.Ref
+	if access != nil {
+		r, ref = withRefNote(r)
+	}
+	sh.next.ServeHTTP(sw, r)
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	var bytesIn int64
+	if body != nil {
+		bytesIn = body.n
+	}
+	if access != nil {
+		access.Log(r, *ref, sw.status, bytesIn, sw.bytes, start)
+	}
+	httpVars.Add("requests", 1)
+	httpVars.Add("method."+r.Method, 1)
+	httpVars.Add("status."+strconv.Itoa(sw.status), 1)
+	httpVars.Add("bytesOut", sw.bytes)
+	httpVars.Add("bytesIn", bytesIn)
+	if sw.status >= 500 {
+		httpVars.Add("errors", 1)
+	}
+	if strings.HasPrefix(r.URL.Path, "/admin/") || r.URL.Path == "/debug/vars" {
+		return
+	}
+	recent.Add(requestInfo{Time: start, Method: r.Method, Path: r.URL.Path,
+		User: authUser(r), Status: sw.status, Bytes: sw.bytes, Duration: time.Since(start)})
+}
+
+// upstreamStatus is the result of checking an upstream server.
+type upstreamStatus struct {
+	Server  string        `json:"server"`
+	Latency time.Duration `json:"latency"`
+	Error   string        `json:"error,omitempty"`
+}
+
+// checkUpstreams stats a blob on each upstream server
+// (-server, -servers, -config and -replica).
+func checkUpstreams(ctx context.Context) []upstreamStatus {
+	servers := []string{server}
+	seen := map[string]bool{server: true}
+	add := func(srv string) {
+		if srv = strings.TrimSpace(srv); srv != "" && !seen[srv] {
+			seen[srv] = true
+			servers = append(servers, srv)
+		}
+	}
+	for _, srv := range strings.Split(*flagServers, ",") {
+		add(srv)
+	}
+	for srv := range cfg.Servers {
+		add(srv)
+	}
+	add(*flagReplica)
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	probe := blob.RefFromString("")
+	statuses := make([]upstreamStatus, len(servers))
+	var wg sync.WaitGroup
+	for i, srv := range servers {
+		wg.Add(1)
+		go func(i int, srv string) {
+			defer wg.Done()
+			start := time.Now()
+			d, err := getDownloader(ctx, srv)
+			if err == nil {
+				_, err = d.Stat(ctx, probe)
+			}
+			statuses[i] = upstreamStatus{Server: srv, Latency: time.Since(start)}
+			if err != nil {
+				statuses[i].Error = err.Error()
+			}
+		}(i, srv)
+	}
+	wg.Wait()
+	return statuses
+}
+
+// adminStats is the data of the dashboard, and of /admin/stats.
+type adminStats struct {
+	Uptime    time.Duration    `json:"uptime"`
+	Upstreams []upstreamStatus `json:"upstreams"`
+	Caches    map[string]int64 `json:"caches"`
+	Queues    map[string]int64 `json:"queues"`
+	Requests  int64            `json:"requests"`
+	Errors    int64            `json:"errors"`
+	Methods   map[string]int64 `json:"methods"`
+	Statuses  map[string]int64 `json:"statuses"`
+	BytesIn   int64            `json:"bytesIn"`
+	BytesOut  int64            `json:"bytesOut"`
+	Recent    []requestInfo    `json:"recent"`
+}
+
+// diskStatsTTL is the time the stats walking the disk are cached for.
+const diskStatsTTL = time.Minute
+
+var diskStatsCache struct {
+	mu                       sync.Mutex
+	at                       time.Time
+	thumbs, streams, spooled int64
+}
+
+// diskStats returns the sizes of the thumbnail and stream dirs, and the
+// number of the spooled uploads - cached for diskStatsTTL.
+func diskStats() (thumbs, streams, spooled int64) {
+	c := &diskStatsCache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.at) < diskStatsTTL {
+		return c.thumbs, c.streams, c.spooled
+	}
+	c.thumbs, c.streams, c.spooled = dirSize(*flagThumbDir), dirSize(*flagStreamDir), 0
+	if spool != nil {
+		names, _ := filepath.Glob(filepath.Join(spool.dir, "*.json"))
+		for _, fn := range names {
+			if job, err := spool.Get(strings.TrimSuffix(filepath.Base(fn), ".json")); err == nil && job.State == "queued" {
+				c.spooled++
+			}
+		}
+	}
+	c.at = time.Now()
+	return c.thumbs, c.streams, c.spooled
+}
+
+func gatherStats(ctx context.Context) adminStats {
+	thumbs, streams, spooled := diskStats()
+	st := adminStats{
+		Uptime:    time.Since(started),
+		Upstreams: checkUpstreams(ctx),
+		Caches: map[string]int64{
+			"mimeTypes": int64(mimeCache.Len()),
+			"metadata":  int64(metaCache.Len()),
+			"thumbs":    thumbs,
+			"streams":   streams,
+			"buffers":   camutil.Buffers.Used(),
+		},
+		Queues:   make(map[string]int64),
+		Requests: expvarInt(httpVars, "requests"),
+		Errors:   expvarInt(httpVars, "errors"),
+		Methods:  make(map[string]int64),
+		Statuses: make(map[string]int64),
+		BytesIn:  expvarInt(httpVars, "bytesIn"),
+		BytesOut: expvarInt(httpVars, "bytesOut"),
+		Recent:   recent.Last(),
+	}
+	httpVars.Do(func(kv expvar.KeyValue) {
+		v, ok := kv.Value.(*expvar.Int)
+		if !ok {
+			return
+		}
+		if strings.HasPrefix(kv.Key, "method.") {
+			st.Methods[kv.Key[7:]] = v.Value()
+		} else if strings.HasPrefix(kv.Key, "status.") {
+			st.Statuses[kv.Key[7:]] = v.Value()
+		}
+	})
+	if spool != nil {
+		st.Queues["async"] = int64(len(spool.queue))
+		st.Queues["spooled"] = spooled
+	}
+	for name, rl := range map[string]*requestLimiter{"requests": limiter, "uploads": upLimiter, "downloads": downLimiter} {
+		if rl != nil {
+			st.Queues[name], st.Queues[name+"Waiting"] = rl.Len()
+		}
+	}
+	st.Queues["rejected"] = expvarInt(httpVars, "rejected")
+	if replica != nil {
+		ok, failed, _ := replica.Stats()
+		st.Queues["replica"] = int64(len(replica.queue))
+		st.Queues["replicated"], st.Queues["replicaFailed"] = ok, failed
+	}
+	return st
+}
+
+func expvarInt(m *expvar.Map, key string) int64 {
+	if v, ok := m.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+// isAdmin reports whether the user may see the dashboard (see -admins).
+// Without -admins, just the owner of a proxy without authentication may.
+func isAdmin(user string) bool {
+	if *flagAdmins == "" {
+		return *flagNoAuth
+	}
+	for _, admin := range strings.Split(*flagAdmins, ",") {
+		if strings.TrimSpace(admin) == user {
+			return true
+		}
+	}
+	return false
+}
+
+// serveAdmin serves the dashboard at /admin/, its data as JSON
+// at /admin/stats, and the cache stats at /admin/cache/stats.
+func serveAdmin(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(authUser(r)) {
+		http.Error(w, authUser(r)+" is not an admin", http.StatusForbidden)
+		return
+	}
+	switch r.URL.Path {
+	case "/admin/":
+	case "/admin/cache/stats":
+		serveCacheStats(w, r)
+		return
+	case "/admin/stats":
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(gatherStats(r.Context()))
+		return
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := dashboardTmpl.Execute(w, gatherStats(r.Context())); err != nil {
+		logger.Log("msg", "dashboard", "error", err)
+	}
+}
+
+var dashboardTmpl = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><meta http-equiv="refresh" content="10"><title>camproxy</title>
+<style>body{font-family:sans-serif}table{border-collapse:collapse}td,th{padding:2px 8px;text-align:left}.err{color:#b00}</style>
+</head><body>
+<h1>camproxy</h1>
+<h2>Upstreams</h2>
+<table><tr><th>server</th><th>latency</th><th>status</th></tr>
+{{range .Upstreams}}<tr><td>{{.Server}}</td><td>{{.Latency}}</td>{{if .Error}}<td class="err">{{.Error}}</td>{{else}}<td>OK</td>{{end}}</tr>
+{{end}}</table>
+<h2>Requests</h2>
+<p>{{.Requests}} requests, {{.Errors}} server errors, {{.BytesIn}} bytes in, {{.BytesOut}} bytes out in {{.Uptime}}</p>
+<h2>Caches</h2>
+<table>{{range $k, $v := .Caches}}<tr><td>{{$k}}</td><td>{{$v}}</td></tr>{{end}}</table>
+<h2>Queues</h2>
+<table>{{range $k, $v := .Queues}}<tr><td>{{$k}}</td><td>{{$v}}</td></tr>{{end}}</table>
+<h2>Recent requests</h2>
+<table><tr><th>time</th><th>user</th><th>method</th><th>path</th><th>status</th><th>bytes</th><th>duration</th></tr>
+{{range .Recent}}<tr{{if ge .Status 500}} class="err"{{end}}><td>{{.Time.Format "15:04:05"}}</td><td>{{.User}}</td><td>{{.Method}}</td><td>{{.Path}}</td><td>{{.Status}}</td><td>{{.Bytes}}</td><td>{{.Duration}}</td></tr>
+{{end}}</table>
+</body></html>
+`))
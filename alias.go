@@ -0,0 +1,148 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/sorted"
+	"perkeep.org/pkg/sorted/kvfile"
+)
+
+var aliases *aliasDB
+
+// errAliasOwned is returned by aliasDB.Set for the alias of another user.
+var errAliasOwned = errors.New("the alias belongs to another user")
+
+// aliasDB maps the friendly names to refs, and the users who set them
+// (as "<ref>\t<user>").
+type aliasDB struct {
+	mu sync.Mutex
+	db sorted.KeyValue
+}
+
+func newAliasDB(filename string) (*aliasDB, error) {
+	db, err := kvfile.NewStorage(filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open %q", filename)
+	}
+	return &aliasDB{db: db}, nil
+}
+
+func (a *aliasDB) Close() error {
+	if a == nil || a.db == nil {
+		return nil
+	}
+	return a.db.Close()
+}
+
+// Get returns the ref the name points at.
+func (a *aliasDB) Get(name string) (blob.Ref, bool) {
+	br, _, ok := a.get(name)
+	return br, ok
+}
+
+func (a *aliasDB) get(name string) (br blob.Ref, owner string, ok bool) {
+	v, err := a.db.Get(name)
+	if err != nil {
+		return br, "", false
+	}
+	if i := strings.IndexByte(v, '\t'); i >= 0 {
+		v, owner = v[:i], v[i+1:]
+	}
+	br, ok = blob.Parse(v)
+	return br, owner, ok
+}
+
+// Set points the name at the ref, for the user. The alias of another user
+// cannot be changed (errAliasOwned); the ones without an owner can be.
+func (a *aliasDB) Set(name, user string, br blob.Ref) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, owner, ok := a.get(name); ok && owner != "" && owner != user {
+		return errAliasOwned
+	}
+	return a.db.Set(name, br.String()+"\t"+user)
+}
+
+// serveAlias answers the alias requests:
+//
+//	PUT /alias/<name> with the ref as body points the name at the ref,
+//	GET /alias/<name> returns the ref,
+//	GET /n/<name> serves the ref's content, as GET /<ref> would.
+func serveAlias(w http.ResponseWriter, r *http.Request) {
+	if aliases == nil {
+		http.Error(w, "the aliases need -alias-db", http.StatusNotImplemented)
+		return
+	}
+	var name string
+	if strings.HasPrefix(r.URL.Path, "/n/") {
+		name = strings.TrimPrefix(r.URL.Path, "/n/")
+	} else {
+		name = strings.TrimPrefix(r.URL.Path, "/alias/")
+	}
+	if name == "" {
+		http.Error(w, "a name is needed", 400)
+		return
+	}
+	user := authUser(r)
+	if r.Method == "PUT" {
+		b, err := ioutil.ReadAll(io.LimitReader(r.Body, 1024))
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		items, err := parseRefs(strings.TrimSpace(string(b)))
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if !checkAccess(w, r, items[0]) {
+			return
+		}
+		if err = aliases.Set(name, user, items[0]); err == errAliasOwned {
+			http.Error(w, fmt.Sprintf("%s: %v", name, err), http.StatusForbidden)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		logger.Log("msg", "alias", "name", name, "ref", items[0], "user", user)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	br, ok := aliases.Get(name)
+	if !ok || tenants != nil && !tenants.Allowed(user, br) {
+		http.Error(w, "no such alias "+name, http.StatusNotFound)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/alias/") {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, br.String())
+		return
+	}
+	r.URL.Path = "/" + br.String()
+	handle(w, r)
+}
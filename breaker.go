@@ -0,0 +1,124 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// breakerVars holds the state (closed, open or half-open) of the circuit of
+// each upstream server.
+var breakerVars = expvar.NewMap("breakers")
+
+// breaker is the circuit breaker of the upstreams, nil if disabled.
+var breaker *circuitBreaker
+
+// circuitBreaker opens the circuit of an upstream server after threshold
+// consecutive failures: then the requests are served from the caches, or
+// rejected right away. After cooldown, a request is let through as a probe,
+// and its success closes the circuit.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	circuits map[string]*circuit
+}
+
+type circuit struct {
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown, circuits: make(map[string]*circuit)}
+}
+
+// Allow reports whether the request may go to the server: false while the
+// circuit is open, or another request is probing the server.
+func (cb *circuitBreaker) Allow(server string) bool {
+	if cb == nil {
+		return true
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	c := cb.circuits[server]
+	if c == nil || c.failures < cb.threshold {
+		return true
+	}
+	if c.probing || time.Since(c.openedAt) < cb.cooldown {
+		return false
+	}
+	c.probing = true
+	breakerVars.Set(server, stringVar("half-open"))
+	return true
+}
+
+// Record records the outcome of a request let through.
+func (cb *circuitBreaker) Record(server string, failed bool) {
+	if cb == nil {
+		return
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	c := cb.circuits[server]
+	if c == nil {
+		c = &circuit{}
+		cb.circuits[server] = c
+	}
+	wasOpen := c.failures >= cb.threshold
+	c.probing = false
+	if !failed {
+		c.failures = 0
+		if wasOpen {
+			logger.Log("msg", "circuit closed", "server", server)
+		}
+		breakerVars.Set(server, stringVar("closed"))
+		return
+	}
+	c.failures++
+	if c.failures >= cb.threshold {
+		if !wasOpen {
+			logger.Log("msg", "circuit opened", "server", server, "failures", c.failures)
+		}
+		c.openedAt = time.Now()
+		breakerVars.Set(server, stringVar("open"))
+	}
+}
+
+// RetryAfter returns the seconds till the next probe, for the Retry-After header.
+func (cb *circuitBreaker) RetryAfter(server string) string {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	secs := 1
+	if c := cb.circuits[server]; c != nil {
+		if s := int((cb.cooldown - time.Since(c.openedAt)) / time.Second); s > secs {
+			secs = s
+		}
+	}
+	return strconv.Itoa(secs)
+}
+
+// upstreamFailed reports whether the status is of an upstream failure.
+func upstreamFailed(status int) bool {
+	return status == http.StatusBadGateway || status == http.StatusGatewayTimeout
+}
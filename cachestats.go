@@ -0,0 +1,153 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/tgulacsi/camproxy/camutil"
+)
+
+// dirStat is the disk usage of a cache directory.
+type dirStat struct {
+	Name   string    `json:"name"`
+	Dir    string    `json:"dir"`
+	Files  int       `json:"files"`
+	Bytes  int64     `json:"bytes"`
+	Oldest time.Time `json:"oldest,omitempty"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// statDir walks the directory, counting its files, their size,
+// and the modification time of the oldest.
+func statDir(name, dir string) dirStat {
+	st := dirStat{Name: name, Dir: dir}
+	err := filepath.Walk(dir, func(_ string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		st.Files++
+		st.Bytes += fi.Size()
+		if st.Oldest.IsZero() || fi.ModTime().Before(st.Oldest) {
+			st.Oldest = fi.ModTime()
+		}
+		return nil
+	})
+	if err != nil {
+		st.Error = err.Error()
+	}
+	return st
+}
+
+// dirSize returns the total size of the files under dir.
+func dirSize(dir string) int64 {
+	return statDir("", dir).Bytes
+}
+
+// cacheStats is the report of cache-stats and /admin/cache/stats.
+type cacheStats struct {
+	Dirs      []dirStat               `json:"dirs"`
+	MIMETypes *camutil.MimeCacheStats `json:"mimeTypes,omitempty"`
+	Metadata  *camutil.MimeCacheStats `json:"metadata,omitempty"`
+	Errors    []string                `json:"errors,omitempty"`
+}
+
+// gatherCacheStats summarizes the cache directories, and the mime and
+// metadata caches (the given ones, if not nil).
+func gatherCacheStats(mimes, metas *camutil.MimeCache) cacheStats {
+	var st cacheStats
+	seen := make(map[string]bool)
+	add := func(name, dir string) {
+		if dir != "" && !seen[dir] {
+			seen[dir] = true
+			st.Dirs = append(st.Dirs, statDir(name, dir))
+		}
+	}
+	add("mirror", *flagMirror)
+	for _, dir := range camutil.CacheDirs() {
+		add("blobs", dir)
+	}
+	add("havecache", *flagHaveCacheDir)
+	add("thumbs", *flagThumbDir)
+	add("streams", *flagStreamDir)
+	for _, c := range []struct {
+		name string
+		mc   *camutil.MimeCache
+		dst  **camutil.MimeCacheStats
+	}{{"mime", mimes, &st.MIMETypes}, {"meta", metas, &st.Metadata}} {
+		if c.mc == nil {
+			continue
+		}
+		mst, err := c.mc.Stats()
+		if err != nil {
+			st.Errors = append(st.Errors, fmt.Sprintf("%s cache: %v", c.name, err))
+		}
+		*c.dst = &mst
+	}
+	return st
+}
+
+// cacheStatsCommand prints the cache stats: camproxy cache-stats
+func cacheStatsCommand(ctx context.Context, args []string) error {
+	mimes := camutil.NewMimeCache(mimeCacheFile(), 0)
+	defer mimes.Close()
+	metas := camutil.NewMimeCache(metaCacheFile(), 0)
+	defer metas.Close()
+	st := gatherCacheStats(mimes, metas)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 1, ' ', 0)
+	fmt.Fprintf(tw, "cache\tdir\tfiles\tbytes\toldest\n")
+	for _, d := range st.Dirs {
+		oldest := "-"
+		if !d.Oldest.IsZero() {
+			oldest = d.Oldest.Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%s\n", d.Name, d.Dir, d.Files, d.Bytes, oldest)
+	}
+	fmt.Fprintf(tw, "\ncache\tmemory\tdisk\tevictions\n")
+	for name, mst := range map[string]*camutil.MimeCacheStats{"mime": st.MIMETypes, "meta": st.Metadata} {
+		if mst != nil {
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%d\n", name, mst.MemEntries, mst.DiskEntries, mst.Evictions)
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	for _, e := range st.Errors {
+		logger.Log("msg", "cache-stats", "error", e)
+	}
+	return nil
+}
+
+// serveCacheStats writes the cache stats as JSON.
+func serveCacheStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(gatherCacheStats(mimeCache, metaCache))
+}
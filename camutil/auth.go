@@ -21,6 +21,7 @@ import (
 	"encoding/base64"
 	"io"
 	"net/http"
+	"os"
 	"strings"
 
 	auth "github.com/abbot/go-http-auth"
@@ -54,3 +55,27 @@ func SetupBasicAuthChecker(handler http.HandlerFunc, camliAuth string) http.Hand
 		})
 	return auth.JustCheck(authenticator, handler)
 }
+
+// SetupHtpasswdChecker sets up a HTTP Basic authentication checker with the
+// users of the htpasswd file (with bcrypt, SHA or MD5 hashes), reloaded
+// when it changes.
+// HtpasswdSecret returns the function returning the entry (the password hash)
+// of the user in the htpasswd file, "" for an unknown user. The file is
+// reloaded when it changes.
+func HtpasswdSecret(filename string) (func(user string) string, error) {
+	// the provider panics on a missing file
+	if _, err := os.Stat(filename); err != nil {
+		return nil, err
+	}
+	provider := auth.HtpasswdFileProvider(filename)
+	return func(user string) string { return provider(user, "camproxy") }, nil
+}
+
+func SetupHtpasswdChecker(handler http.HandlerFunc, filename string) (http.HandlerFunc, error) {
+	// the provider panics on a missing file
+	if _, err := os.Stat(filename); err != nil {
+		return nil, err
+	}
+	authenticator := auth.NewBasicAuthenticator("camproxy", auth.HtpasswdFileProvider(filename))
+	return auth.JustCheck(authenticator, handler), nil
+}
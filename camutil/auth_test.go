@@ -31,3 +31,9 @@ func TestSetupBasicAuthChecker(t *testing.T) {
 		}
 	}
 }
+
+func TestSetupHtpasswdChecker(t *testing.T) {
+	if _, err := SetupHtpasswdChecker(nil, "/nonexistent/htpasswd"); err == nil {
+		t.Error("no error for missing htpasswd file")
+	}
+}
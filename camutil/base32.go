@@ -0,0 +1,64 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package camutil
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"strings"
+
+	"github.com/pkg/errors"
+	"perkeep.org/pkg/blob"
+)
+
+// crockford is Crockford's base32 alphabet: no I, L, O, U - safe for
+// case-insensitive systems.
+var crockford = base32.NewEncoding("0123456789ABCDEFGHJKMNPQRSTVWXYZ").WithPadding(base32.NoPadding)
+
+var crockfordNormalizer = strings.NewReplacer("I", "1", "L", "1", "O", "0")
+
+// RefToBase32 returns the ref with its digest encoded in Crockford's base32 (lowercase).
+func RefToBase32(br blob.Ref) string {
+	if !br.Valid() {
+		return ""
+	}
+	data, err := br.MarshalBinary()
+	if err != nil {
+		Log("msg", "error marshaling", "blob", br, "error", err)
+		return ""
+	}
+	hn := br.HashName()
+	return hn + "-" + strings.ToLower(crockford.EncodeToString(data[len(hn)+1:]))
+}
+
+// Base32ToRef decodes a ref encoded by RefToBase32 (case-insensitively).
+func Base32ToRef(arg string) (blob.Ref, error) {
+	i := strings.IndexByte(arg, '-')
+	if i < 0 {
+		return blob.Ref{}, withKind(ErrBadRef, errors.Errorf("no - in %q", arg))
+	}
+	digest, err := crockford.DecodeString(crockfordNormalizer.Replace(strings.ToUpper(arg[i+1:])))
+	if err != nil {
+		return blob.Ref{}, withKind(ErrBadRef, errors.Wrapf(err, "cannot decode %q as base32", arg[i+1:]))
+	}
+	s := strings.ToLower(arg[:i]) + "-" + hex.EncodeToString(digest)
+	br, ok := blob.Parse(s)
+	if !ok {
+		return blob.Ref{}, withKind(ErrBadRef, errors.Errorf("cannot parse %q as blobref", s))
+	}
+	return br, ValidateRef(br)
+}
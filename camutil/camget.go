@@ -28,7 +28,6 @@ import (
 	"os/exec"
 	"path/filepath"
 	"sync"
-	"syscall"
 
 	"github.com/pkg/errors"
 	"perkeep.org/pkg/blob"
@@ -36,11 +35,12 @@ import (
 	"perkeep.org/pkg/schema"
 )
 
+// SchemaSniffSize is the number of bytes of a blob sniffed for a schema blob.
 // A little less than the sniffer will take, so we don't truncate.
-const sniffSize = 900 * 1024
+var SchemaSniffSize int64 = 900 * 1024
 
 // smartFetch the things that blobs point to, not just blobs.
-func smartFetch(ctx context.Context, src blob.Fetcher, targ string, br blob.Ref) error {
+func smartFetch(ctx context.Context, src blob.Fetcher, opts Options, targ string, br blob.Ref) error {
 	rc, err := fetch(ctx, src, br)
 	if err != nil {
 		return errors.Wrap(err, "smartFetch")
@@ -50,7 +50,7 @@ func smartFetch(ctx context.Context, src blob.Fetcher, targ string, br blob.Ref)
 	defer closeRc()
 
 	sniffer := index.NewBlobSniffer(br)
-	_, err = io.CopyN(sniffer, rc, sniffSize)
+	_, err = io.CopyN(sniffer, rc, SchemaSniffSize)
 	if err != nil && err != io.EOF {
 		return errors.Wrap(err, "sniff")
 	}
@@ -59,7 +59,7 @@ func smartFetch(ctx context.Context, src blob.Fetcher, targ string, br blob.Ref)
 	b, ok := sniffer.SchemaBlob()
 
 	if !ok {
-		if Verbose {
+		if opts.Verbose {
 			Log("msg", "Fetching opaque data", "blob", br, "destination", targ)
 		}
 
@@ -75,11 +75,17 @@ func smartFetch(ctx context.Context, src blob.Fetcher, targ string, br blob.Ref)
 		return errors.Wrap(err, "read")
 	}
 	closeRc()
+	return saveBlob(newCamliFS(ctx, src), opts, targ, b)
+}
 
+// saveBlob saves the schema blob (and the things it points to) into targ,
+// reading the directories and files through cfs.
+func saveBlob(cfs *camliFS, opts Options, targ string, b *schema.Blob) error {
+	br := b.BlobRef()
 	switch b.Type() {
 	case "directory":
 		dir := filepath.Join(targ, b.FileName())
-		if Verbose {
+		if opts.Verbose {
 			Log("msg", "Fetching directory", "blob", br, "destination", dir)
 		}
 		if err := os.MkdirAll(dir, b.FileMode()); err != nil {
@@ -88,48 +94,29 @@ func smartFetch(ctx context.Context, src blob.Fetcher, targ string, br blob.Ref)
 		if err := setFileMeta(dir, b); err != nil {
 			Log("msg", "setFileMeta", "error", err)
 		}
-		entries, ok := b.DirectoryEntries()
-		if !ok {
-			return errors.Errorf("bad entries blobref in dir %v", b.BlobRef())
+		entries, err := cfs.entries(b)
+		if err != nil {
+			return err
 		}
-		return smartFetch(ctx, src, dir, entries)
+		return saveAll(cfs, opts, dir, entries)
 	case "static-set":
-		if Verbose {
+		if opts.Verbose {
 			Log("msg", "Fetching directory entries", "blob", br, "destination", targ)
 		}
-
-		// directory entries
-		const numWorkers = 10
-		type work struct {
-			br   blob.Ref
-			errc chan<- error
-		}
 		members := b.StaticSetMembers()
-		workc := make(chan work, len(members))
-		defer close(workc)
-		for i := 0; i < numWorkers; i++ {
-			go func() {
-				for wi := range workc {
-					wi.errc <- smartFetch(ctx, src, targ, wi.br)
-				}
-			}()
-		}
-		var errcs []<-chan error
-		for _, mref := range members {
-			errc := make(chan error, 1)
-			errcs = append(errcs, errc)
-			workc <- work{mref, errc}
-		}
-		for _, errc := range errcs {
-			if err := <-errc; err != nil {
+		blobs := make([]*schema.Blob, 0, len(members))
+		for _, m := range members {
+			mb, err := cfs.schemaBlob(m)
+			if err != nil {
 				return err
 			}
+			blobs = append(blobs, mb)
 		}
-		return nil
+		return saveAll(cfs, opts, targ, blobs)
 	case "file":
-		fr, err := schema.NewFileReader(ctx, src, br)
+		fr, err := openFile(cfs.ctx, cfs.fetcher, br)
 		if err != nil {
-			return errors.Wrap(err, "NewFileReader")
+			return err
 		}
 		fr.LoadAllChunks()
 		defer fr.Close()
@@ -137,15 +124,18 @@ func smartFetch(ctx context.Context, src blob.Fetcher, targ string, br blob.Ref)
 		name := filepath.Join(targ, b.FileName())
 
 		if fi, err := os.Stat(name); err == nil && fi.Size() == fr.Size() {
-			if Verbose {
+			if opts.Verbose {
 				Log("msg", "Skipping (already exists).", "file", name)
 			}
 			return nil
 		}
 
-		if Verbose {
+		if opts.Verbose {
 			Log("msg", "Writing", "blob", br, "destination", name)
 		}
+		if p := opts.Progress; p != nil {
+			p.File(name, fr.Size())
+		}
 
 		f, err := os.Create(name)
 		if err != nil {
@@ -160,7 +150,7 @@ func smartFetch(ctx context.Context, src blob.Fetcher, targ string, br blob.Ref)
 		}
 		return nil
 	case "symlink":
-		if SkipIrregular {
+		if opts.SkipIrregular {
 			return nil
 		}
 		sf, ok := b.AsStaticFile()
@@ -173,7 +163,7 @@ func smartFetch(ctx context.Context, src blob.Fetcher, targ string, br blob.Ref)
 		}
 		name := filepath.Join(targ, sl.FileName())
 		if _, err := os.Lstat(name); err == nil {
-			if Verbose {
+			if opts.Verbose {
 				Log("msg", "Skipping creating symbolic link "+name+": A file with that name exists")
 			}
 			return nil
@@ -192,7 +182,7 @@ func smartFetch(ctx context.Context, src blob.Fetcher, targ string, br blob.Ref)
 		// symlink but its target).
 		return err
 	case "fifo":
-		if SkipIrregular {
+		if opts.SkipIrregular {
 			return nil
 		}
 		name := filepath.Join(targ, b.FileName())
@@ -211,7 +201,7 @@ func smartFetch(ctx context.Context, src blob.Fetcher, targ string, br blob.Ref)
 			return nil
 		}
 
-		err = syscall.Mkfifo(name, 0600)
+		err := mkfifo(name, 0600)
 		if err == ErrNotSupported {
 			Log("msg", "Skipping FIFO "+name+": Unsupported filetype")
 			return nil
@@ -227,7 +217,7 @@ func smartFetch(ctx context.Context, src blob.Fetcher, targ string, br blob.Ref)
 		return nil
 
 	case "socket":
-		if SkipIrregular {
+		if opts.SkipIrregular {
 			return nil
 		}
 		name := filepath.Join(targ, b.FileName())
@@ -246,7 +236,7 @@ func smartFetch(ctx context.Context, src blob.Fetcher, targ string, br blob.Ref)
 			return nil
 		}
 
-		err = mksocket(name)
+		err := mksocket(name)
 		if err == ErrNotSupported {
 			Log("msg", "Skipping socket "+name+": Unsupported filetype")
 			return nil
@@ -266,6 +256,36 @@ func smartFetch(ctx context.Context, src blob.Fetcher, targ string, br blob.Ref)
 	}
 }
 
+// saveAll saves the directory entries into targ, in parallel.
+func saveAll(cfs *camliFS, opts Options, targ string, entries []*schema.Blob) error {
+	const numWorkers = 10
+	type work struct {
+		b    *schema.Blob
+		errc chan<- error
+	}
+	workc := make(chan work, len(entries))
+	defer close(workc)
+	for i := 0; i < numWorkers; i++ {
+		go func() {
+			for wi := range workc {
+				wi.errc <- saveBlob(cfs, opts, targ, wi.b)
+			}
+		}()
+	}
+	var errcs []<-chan error
+	for _, e := range entries {
+		errc := make(chan error, 1)
+		errcs = append(errcs, errc)
+		workc <- work{e, errc}
+	}
+	for _, errc := range errcs {
+		if err := <-errc; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func setFileMeta(name string, blob *schema.Blob) error {
 	err1 := os.Chmod(name, blob.FileMode())
 	var err2 error
@@ -0,0 +1,233 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package camutil
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"math/bits"
+
+	"github.com/pkg/errors"
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/blobserver"
+	"perkeep.org/pkg/schema"
+)
+
+// The bounds of the chunk sizes: perkeep servers refuse blobs above 16MB.
+const (
+	MinChunkSize = 64 << 10
+	MaxChunkSize = 16 << 20
+)
+
+// maxFileParts is the number of parts of a file (or bytes) schema blob,
+// keeping it well under schema.MaxSchemaBlobSize. More parts are grouped
+// into bytes schema blobs.
+const maxFileParts = 4096
+
+// ChunkOptions are the parameters of the content-defined chunking of the
+// uploaded files: a chunk ends where the rolling (gear) hash of the last
+// 64 bytes has its top log2(Size) bits zero - but not before MinSize,
+// and at MaxSize at last.
+//
+// The zero ChunkOptions leaves the chunking to perkeep (~64KB chunks, at
+// most 1MB), as the files uploaded through pk-put are chunked anyway.
+//
+// The chunks are not perkeep's (rollsum) chunks: a file uploaded with
+// a chunk size does not share its chunks with the same file uploaded
+// without one (or with another chunk size). And a chunk is held in
+// memory till it is uploaded, charged to the Buffers budget.
+type ChunkOptions struct {
+	// Size is the target (average) size of the chunks, a power of two
+	// between MinChunkSize and MaxChunkSize/2.
+	Size int
+	// MinSize and MaxSize bound the size of the chunks,
+	// Size/4 and 4*Size (at most MaxChunkSize) by default.
+	MinSize, MaxSize int
+}
+
+// IsZero reports whether the chunking is left to perkeep.
+func (co ChunkOptions) IsZero() bool { return co.Size == 0 }
+
+// Normalize checks the options, and fills the defaults of MinSize and MaxSize.
+func (co ChunkOptions) Normalize() (ChunkOptions, error) {
+	if co.Size == 0 {
+		return co, nil
+	}
+	if co.Size < MinChunkSize || co.Size > MaxChunkSize/2 || co.Size&(co.Size-1) != 0 {
+		return co, errors.Errorf("chunk size %d is not a power of two between %d and %d", co.Size, MinChunkSize, MaxChunkSize/2)
+	}
+	if co.MinSize == 0 {
+		co.MinSize = co.Size / 4
+	}
+	if co.MaxSize == 0 {
+		if co.MaxSize = 4 * co.Size; co.MaxSize > MaxChunkSize {
+			co.MaxSize = MaxChunkSize
+		}
+	}
+	if co.MinSize < 0 || co.MinSize > co.Size {
+		return co, errors.Errorf("min chunk size %d is not between 0 and %d", co.MinSize, co.Size)
+	}
+	if co.MaxSize < co.Size || co.MaxSize > MaxChunkSize {
+		return co, errors.Errorf("max chunk size %d is not between %d and %d", co.MaxSize, co.Size, MaxChunkSize)
+	}
+	return co, nil
+}
+
+// writeFileMap uploads the contents of r as the file, chunked by the
+// ChunkOptions of the Uploader.
+func (u *Uploader) writeFileMap(ctx context.Context, file *schema.Builder, r io.Reader) (blob.Ref, error) {
+	co, err := u.opts.Chunking.Normalize()
+	if err != nil {
+		return blob.Ref{}, err
+	}
+	if co.IsZero() {
+		return schema.WriteFileMap(ctx, u.receiver(ctx), file, r)
+	}
+	return writeFileChunked(ctx, u.receiver(ctx), file, r, co)
+}
+
+// gearTable is the table of the gear hash, from a fixed seed, so the same
+// content is always chunked the same way.
+var gearTable = func() (table [256]uint64) {
+	x := uint64(0x63616d70726f7879) // splitmix64
+	for i := range table {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		table[i] = z ^ z>>31
+	}
+	return table
+}()
+
+// splitChunks calls fn with the chunks of r (by the normalized co).
+// The chunk is reused after fn returns.
+//
+// The chunk buffer grows (up to co.MaxSize) as needed, reserved from
+// the Buffers budget; the error is of kind ErrOutOfMemory if it is full.
+func splitChunks(r io.Reader, co ChunkOptions, fn func(chunk []byte) error) error {
+	shift := uint(64 - bits.TrailingZeros(uint(co.Size)))
+	br := bufio.NewReaderSize(r, 1<<16)
+	var buf []byte
+	defer func() { Buffers.Release(int64(cap(buf))) }()
+	var h uint64
+	for {
+		c, err := br.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "read")
+		}
+		if len(buf) == cap(buf) {
+			n := 2 * cap(buf)
+			if n < 1<<16 {
+				n = 1 << 16
+			}
+			if n > co.MaxSize {
+				n = co.MaxSize
+			}
+			if !Buffers.Reserve(int64(n - cap(buf))) {
+				return withKind(ErrOutOfMemory, errors.Errorf("no room for a chunk buffer of %d bytes", n))
+			}
+			buf = append(make([]byte, 0, n), buf...)
+		}
+		buf = append(buf, c)
+		h = h<<1 + gearTable[c]
+		if len(buf) >= co.MaxSize || len(buf) >= co.MinSize && h>>shift == 0 {
+			if err = fn(buf); err != nil {
+				return err
+			}
+			buf = buf[:0]
+		}
+	}
+	if len(buf) == 0 {
+		return nil
+	}
+	return fn(buf)
+}
+
+// writeFileChunked uploads the chunks of r (normalized co), and the file schema
+// blob of them - grouped into bytes schema blobs, if there are too many.
+func writeFileChunked(ctx context.Context, dst blobserver.StatReceiver, file *schema.Builder, r io.Reader, co ChunkOptions) (blob.Ref, error) {
+	var (
+		parts []schema.BytesPart
+		size  int64
+	)
+	if err := splitChunks(r, co, func(chunk []byte) error {
+		ref := blob.RefFromBytes(chunk)
+		if err := receiveBlob(ctx, dst, ref, chunk); err != nil {
+			return err
+		}
+		parts = append(parts, schema.BytesPart{Size: uint64(len(chunk)), BlobRef: ref})
+		size += int64(len(chunk))
+		return nil
+	}); err != nil {
+		return blob.Ref{}, err
+	}
+	for len(parts) > maxFileParts {
+		grouped := make([]schema.BytesPart, 0, (len(parts)+maxFileParts-1)/maxFileParts)
+		for i := 0; i < len(parts); i += maxFileParts {
+			j := i + maxFileParts
+			if j > len(parts) {
+				j = len(parts)
+			}
+			var n uint64
+			for _, p := range parts[i:j] {
+				n += p.Size
+			}
+			ref, err := writeParts(ctx, dst, schema.NewBuilder().SetType("bytes"), int64(n), parts[i:j])
+			if err != nil {
+				return blob.Ref{}, err
+			}
+			grouped = append(grouped, schema.BytesPart{Size: n, BytesRef: ref})
+		}
+		parts = grouped
+	}
+	return writeParts(ctx, dst, file, size, parts)
+}
+
+// writeParts uploads the schema blob of the parts.
+func writeParts(ctx context.Context, dst blobserver.StatReceiver, bb *schema.Builder, size int64, parts []schema.BytesPart) (blob.Ref, error) {
+	if err := bb.PopulateParts(size, parts); err != nil {
+		return blob.Ref{}, errors.Wrap(err, "populate parts")
+	}
+	s, err := bb.JSON()
+	if err != nil {
+		return blob.Ref{}, errors.Wrap(err, "schema JSON")
+	}
+	ref := blob.RefFromString(s)
+	return ref, receiveBlob(ctx, dst, ref, []byte(s))
+}
+
+// receiveBlob uploads the blob, if the server does not have it yet.
+func receiveBlob(ctx context.Context, dst blobserver.StatReceiver, ref blob.Ref, data []byte) error {
+	var have bool
+	if err := dst.StatBlobs(ctx, []blob.Ref{ref}, func(blob.SizedRef) error {
+		have = true
+		return nil
+	}); err != nil {
+		return errors.Wrapf(err, "stat %s", ref)
+	}
+	if have {
+		return nil
+	}
+	_, err := blobserver.Receive(ctx, dst, ref, bytes.NewReader(data))
+	return errors.Wrapf(err, "upload %s", ref)
+}
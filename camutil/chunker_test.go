@@ -0,0 +1,88 @@
+package camutil
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+func TestSplitChunks(t *testing.T) {
+	co, err := ChunkOptions{Size: MinChunkSize}.Normalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rnd := rand.New(rand.NewSource(1))
+	data := make([]byte, 4<<20)
+	rnd.Read(data)
+	split := func(data []byte) map[[sha1.Size]byte]bool {
+		sums := make(map[[sha1.Size]byte]bool)
+		var n int
+		if err := splitChunks(bytes.NewReader(data), co, func(chunk []byte) error {
+			if len(chunk) > co.MaxSize || len(chunk) < co.MinSize && n+len(chunk) != len(data) {
+				t.Errorf("chunk of %d bytes at %d", len(chunk), n)
+			}
+			n += len(chunk)
+			sums[sha1.Sum(chunk)] = true
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if n != len(data) {
+			t.Errorf("got %d bytes, wanted %d", n, len(data))
+		}
+		return sums
+	}
+	sums := split(data)
+	if len(sums) < 16 || len(sums) > 256 {
+		t.Errorf("%d chunks of %d bytes", len(sums), len(data))
+	}
+	// the chunks after an insertion are the same
+	var same int
+	for sum := range split(append([]byte("inserted"), data...)) {
+		if sums[sum] {
+			same++
+		}
+	}
+	if same < len(sums)-2 {
+		t.Errorf("only %d of %d chunks are the same after an insertion", same, len(sums))
+	}
+
+	for _, bad := range []ChunkOptions{{Size: 1000}, {Size: 1 << 10}, {Size: MaxChunkSize}, {Size: MinChunkSize, MinSize: 2 * MinChunkSize}, {Size: MinChunkSize, MaxSize: MaxChunkSize + 1}} {
+		if _, err := bad.Normalize(); err == nil {
+			t.Errorf("%+v: wanted error", bad)
+		}
+	}
+}
+
+func TestSplitChunksBudget(t *testing.T) {
+	defer func(budget *MemoryBudget) { Buffers = budget }(Buffers)
+	co, err := ChunkOptions{Size: MinChunkSize}.Normalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	Buffers = NewMemoryBudget(int64(co.MaxSize))
+	if err = splitChunks(bytes.NewReader(data), co, func(chunk []byte) error {
+		if used := Buffers.Used(); used < int64(len(chunk)) {
+			t.Errorf("%d bytes reserved for a chunk of %d", used, len(chunk))
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if used := Buffers.Used(); used != 0 {
+		t.Errorf("%d bytes left reserved", used)
+	}
+
+	Buffers = NewMemoryBudget(1<<16 - 1)
+	err = splitChunks(bytes.NewReader(data), co, func([]byte) error { return nil })
+	if !errors.Is(err, ErrOutOfMemory) {
+		t.Errorf("got %v, wanted %v", err, ErrOutOfMemory)
+	}
+	if used := Buffers.Used(); used != 0 {
+		t.Errorf("%d bytes left reserved", used)
+	}
+}
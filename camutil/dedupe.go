@@ -0,0 +1,126 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package camutil
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/blobserver"
+	"perkeep.org/pkg/schema"
+)
+
+// DedupeStats is the result of DedupeReport.
+type DedupeStats struct {
+	Files int
+	// Bytes is the total size of the files.
+	Bytes int64
+	// Blobs and BlobBytes are the number and size of the distinct blobs
+	// (chunks and file schema blobs) the files would be stored as.
+	Blobs     int
+	BlobBytes int64
+	// StoredBlobs and StoredBytes are the number and size of the blobs
+	// already on the server.
+	StoredBlobs int
+	StoredBytes int64
+}
+
+// NewBytes returns the bytes an upload would send.
+func (st DedupeStats) NewBytes() int64 { return st.BlobBytes - st.StoredBytes }
+
+// DedupeReport chunks the files of the directory (filtered by opts) the same
+// way an upload would, without uploading anything, and stats the blobs on dst,
+// to tell how much of the directory is already stored.
+func DedupeReport(ctx context.Context, dst blobserver.BlobStatter, dir string, opts DirOptions) (DedupeStats, error) {
+	var st DedupeStats
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return st, err
+	}
+	var files []*dirNode
+	if fi.IsDir() {
+		if err = walkDir(&dirNode{path: dir, fi: fi}, "", 1, opts, nil, make(map[string]struct{}), &files); err != nil {
+			return st, err
+		}
+	} else {
+		files = append(files, &dirNode{path: dir, fi: fi})
+	}
+	rec := &chunkRecorder{sizes: make(map[blob.Ref]uint32)}
+	for _, n := range files {
+		fh, err := os.Open(n.path)
+		if err != nil {
+			return st, err
+		}
+		_, err = schema.WriteFileFromReader(ctx, rec, filepath.Base(n.path), fh)
+		fh.Close()
+		if err != nil {
+			return st, errors.Wrapf(err, "chunk %q", n.path)
+		}
+		st.Files++
+		st.Bytes += n.fi.Size()
+	}
+
+	refs := make([]blob.Ref, 0, len(rec.sizes))
+	for br, size := range rec.sizes {
+		refs = append(refs, br)
+		st.BlobBytes += int64(size)
+	}
+	st.Blobs = len(refs)
+	for len(refs) > 0 {
+		n := len(refs)
+		if n > 1000 {
+			n = 1000
+		}
+		if err = dst.StatBlobs(ctx, refs[:n], func(sb blob.SizedRef) error {
+			st.StoredBlobs++
+			st.StoredBytes += int64(sb.Size)
+			return nil
+		}); err != nil {
+			return st, withKind(ErrUpstreamUnavailable, errors.Wrap(err, "stat"))
+		}
+		refs = refs[n:]
+	}
+	return st, nil
+}
+
+// chunkRecorder is a StatReceiver having nothing, and
+// recording the sizes of the blobs received.
+type chunkRecorder struct {
+	mu    sync.Mutex
+	sizes map[blob.Ref]uint32
+}
+
+func (rec *chunkRecorder) StatBlobs(ctx context.Context, blobs []blob.Ref, fn func(blob.SizedRef) error) error {
+	return nil
+}
+
+func (rec *chunkRecorder) ReceiveBlob(ctx context.Context, br blob.Ref, source io.Reader) (blob.SizedRef, error) {
+	n, err := io.Copy(ioutil.Discard, source)
+	if err != nil {
+		return blob.SizedRef{}, err
+	}
+	rec.mu.Lock()
+	rec.sizes[br] = uint32(n)
+	rec.mu.Unlock()
+	return blob.SizedRef{Ref: br, Size: uint32(n)}, nil
+}
@@ -0,0 +1,346 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package camutil
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+
+	"github.com/pkg/errors"
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/schema"
+)
+
+// DefaultDeltaBlockSize is the block size of the signatures, if not given.
+const DefaultDeltaBlockSize = 64 << 10
+
+// MinDeltaBlockSize is the smallest block size of the signatures
+// (the largest is MaxChunkSize).
+const MinDeltaBlockSize = 512
+
+// deltaMaxLiteral is the maximum length of the literal data of a delta op.
+const deltaMaxLiteral = 1 << 20
+
+// The ops of a delta: copy a run of blocks of the base, or literal data.
+const (
+	deltaCopy    = 'C'
+	deltaLiteral = 'D'
+)
+
+// Signature is the signature of a file for the rsync-style deltas:
+// the rolling and the strong checksum of each block (the last may be shorter).
+type Signature struct {
+	BlockSize int        `json:"blockSize"`
+	Blocks    []BlockSig `json:"blocks"`
+}
+
+// BlockSig is the signature of a block.
+type BlockSig struct {
+	Weak   uint32 `json:"weak"`
+	Strong string `json:"strong"`
+}
+
+// NewSignature returns the signature of the file read from r.
+func NewSignature(r io.Reader, blockSize int) (Signature, error) {
+	if blockSize <= 0 {
+		blockSize = DefaultDeltaBlockSize
+	} else if blockSize < MinDeltaBlockSize || blockSize > MaxChunkSize {
+		return Signature{}, errors.Errorf("block size %d is not between %d and %d", blockSize, MinDeltaBlockSize, MaxChunkSize)
+	}
+	sig := Signature{BlockSize: blockSize}
+	buf := make([]byte, blockSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			sig.Blocks = append(sig.Blocks, BlockSig{Weak: newRollsum(buf[:n]).digest(), Strong: strongSum(buf[:n])})
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return sig, nil
+		}
+		if err != nil {
+			return sig, errors.Wrap(err, "read")
+		}
+	}
+}
+
+// WriteDelta writes the delta of the file read from r, against the base
+// of the signature, to w: the runs of the blocks of the base found in r
+// (C, uvarint index of the first block, uvarint number of blocks),
+// and the literal data between them (D, uvarint length, data).
+func WriteDelta(w io.Writer, r io.Reader, sig Signature) error {
+	dm, err := newDeltaMatcher(sig)
+	if err != nil {
+		return err
+	}
+	dw := deltaWriter{w: bufio.NewWriter(w), run: -1}
+	if err = dm.write(&dw, r); err != nil {
+		return err
+	}
+	return dw.flush()
+}
+
+// WriteFileDelta writes the delta (see WriteDelta) of the file to w, chunk by
+// chunk: the blocks of the base are looked up within each chunk of the file,
+// so the chunks unchanged since the client's copy are sent as copies, and
+// only the changed ones as literal data.
+func WriteFileDelta(ctx context.Context, w io.Writer, fr *schema.FileReader, sig Signature) error {
+	dm, err := newDeltaMatcher(sig)
+	if err != nil {
+		return err
+	}
+	dw := deltaWriter{w: bufio.NewWriter(w), run: -1}
+	if err = fr.ForeachChunk(ctx, func(_ []blob.Ref, p schema.BytesPart) error {
+		return dm.write(&dw, io.LimitReader(fr, int64(p.Size)))
+	}); err != nil {
+		return errors.Wrap(err, "chunks")
+	}
+	return dw.flush()
+}
+
+// deltaMatcher finds the blocks of the signature.
+type deltaMatcher struct {
+	sig    Signature
+	blocks map[uint32][]int
+	buf    []byte
+}
+
+func newDeltaMatcher(sig Signature) (*deltaMatcher, error) {
+	if bs := sig.BlockSize; bs < MinDeltaBlockSize || bs > MaxChunkSize {
+		return nil, errors.Errorf("block size %d is not between %d and %d", bs, MinDeltaBlockSize, MaxChunkSize)
+	}
+	dm := deltaMatcher{sig: sig, blocks: make(map[uint32][]int, len(sig.Blocks))}
+	for i, b := range sig.Blocks {
+		dm.blocks[b.Weak] = append(dm.blocks[b.Weak], i)
+	}
+	return &dm, nil
+}
+
+// match returns the index of the block of p (with the rolling checksum rs), -1 if none.
+func (dm *deltaMatcher) match(rs rollsum, p []byte) int {
+	var strong string
+	for _, i := range dm.blocks[rs.digest()] {
+		if strong == "" {
+			strong = strongSum(p)
+		}
+		if dm.sig.Blocks[i].Strong == strong {
+			return i
+		}
+	}
+	return -1
+}
+
+// write writes the ops of the data read from r to dw.
+func (dm *deltaMatcher) write(dw *deltaWriter, r io.Reader) error {
+	bs := dm.sig.BlockSize
+	// buf[:lit] is the pending literal data, buf[lit:lit+bs] the window
+	if dm.buf == nil {
+		dm.buf = make([]byte, 0, deltaMaxLiteral+2*bs)
+	}
+	buf := dm.buf[:0]
+	var (
+		lit     int
+		eof     bool
+		rs      rollsum
+		rolling bool
+	)
+	for {
+		// the window, and the byte after it
+		for !eof && len(buf)-lit <= bs {
+			n, err := r.Read(buf[len(buf):cap(buf)])
+			buf = buf[:len(buf)+n]
+			if err == io.EOF {
+				eof = true
+			} else if err != nil {
+				return errors.Wrap(err, "read")
+			}
+		}
+		if len(buf)-lit < bs {
+			// the tail may be the last, short block
+			if tail := buf[lit:]; len(tail) > 0 {
+				if i := dm.match(newRollsum(tail), tail); i >= 0 {
+					if err := dw.literal(buf[:lit]); err != nil {
+						return err
+					}
+					return dw.copy(i)
+				}
+			}
+			return dw.literal(buf)
+		}
+		if !rolling {
+			rs, rolling = newRollsum(buf[lit:lit+bs]), true
+		}
+		if i := dm.match(rs, buf[lit:lit+bs]); i >= 0 {
+			if err := dw.literal(buf[:lit]); err != nil {
+				return err
+			}
+			if err := dw.copy(i); err != nil {
+				return err
+			}
+			buf = buf[:copy(buf, buf[lit+bs:])]
+			lit, rolling = 0, false
+			continue
+		}
+		if len(buf)-lit == bs { // eof
+			return dw.literal(buf)
+		}
+		rs.roll(buf[lit], buf[lit+bs])
+		if lit++; lit >= deltaMaxLiteral {
+			if err := dw.literal(buf[:lit]); err != nil {
+				return err
+			}
+			buf = buf[:copy(buf, buf[lit:])]
+			lit = 0
+		}
+	}
+}
+
+// ApplyDelta writes the file made of the base and the delta (see WriteDelta) to w.
+func ApplyDelta(w io.Writer, base io.ReaderAt, delta io.Reader, blockSize int) error {
+	if blockSize <= 0 {
+		return errors.Errorf("bad block size %d", blockSize)
+	}
+	br := bufio.NewReader(delta)
+	for {
+		op, err := br.ReadByte()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "read op")
+		}
+		switch op {
+		case deltaCopy:
+			first, err := binary.ReadUvarint(br)
+			if err != nil {
+				return errors.Wrap(err, "read copy index")
+			}
+			n, err := binary.ReadUvarint(br)
+			if err != nil {
+				return errors.Wrap(err, "read copy length")
+			}
+			sr := io.NewSectionReader(base, int64(first)*int64(blockSize), int64(n)*int64(blockSize))
+			if _, err = io.Copy(w, sr); err != nil {
+				return errors.Wrapf(err, "copy blocks %d+%d", first, n)
+			}
+		case deltaLiteral:
+			n, err := binary.ReadUvarint(br)
+			if err != nil {
+				return errors.Wrap(err, "read literal length")
+			}
+			if n > deltaMaxLiteral {
+				return errors.Errorf("literal of %d bytes is too long", n)
+			}
+			if _, err = io.CopyN(w, br, int64(n)); err != nil {
+				return errors.Wrap(err, "copy literal")
+			}
+		default:
+			return errors.Errorf("unknown delta op %q", op)
+		}
+	}
+}
+
+// deltaWriter writes the ops of a delta, merging the consecutive blocks.
+type deltaWriter struct {
+	w         *bufio.Writer
+	run, runN int
+	scratch   [binary.MaxVarintLen64]byte
+}
+
+func (dw *deltaWriter) copy(i int) error {
+	if dw.run >= 0 && dw.run+dw.runN == i {
+		dw.runN++
+		return nil
+	}
+	if err := dw.flushRun(); err != nil {
+		return err
+	}
+	dw.run, dw.runN = i, 1
+	return nil
+}
+
+func (dw *deltaWriter) literal(p []byte) error {
+	if err := dw.flushRun(); err != nil {
+		return err
+	}
+	for len(p) != 0 {
+		n := len(p)
+		if n > deltaMaxLiteral {
+			n = deltaMaxLiteral
+		}
+		dw.w.WriteByte(deltaLiteral)
+		dw.uvarint(uint64(n))
+		if _, err := dw.w.Write(p[:n]); err != nil {
+			return errors.Wrap(err, "write literal")
+		}
+		p = p[n:]
+	}
+	return nil
+}
+
+func (dw *deltaWriter) flushRun() error {
+	if dw.run < 0 {
+		return nil
+	}
+	dw.w.WriteByte(deltaCopy)
+	dw.uvarint(uint64(dw.run))
+	_, err := dw.uvarint(uint64(dw.runN))
+	dw.run, dw.runN = -1, 0
+	return errors.Wrap(err, "write copy")
+}
+
+func (dw *deltaWriter) uvarint(x uint64) (int, error) {
+	return dw.w.Write(dw.scratch[:binary.PutUvarint(dw.scratch[:], x)])
+}
+
+func (dw *deltaWriter) flush() error {
+	if err := dw.flushRun(); err != nil {
+		return err
+	}
+	return errors.Wrap(dw.w.Flush(), "flush")
+}
+
+// rollsum is the rolling checksum of rsync.
+type rollsum struct {
+	a, b uint32
+	n    uint32
+}
+
+func newRollsum(p []byte) rollsum {
+	rs := rollsum{n: uint32(len(p))}
+	for i, c := range p {
+		rs.a += uint32(c)
+		rs.b += uint32(len(p)-i) * uint32(c)
+	}
+	return rs
+}
+
+// roll removes out from the beginning of the window, and adds in to its end.
+func (rs *rollsum) roll(out, in byte) {
+	rs.a += uint32(in) - uint32(out)
+	rs.b += rs.a - rs.n*uint32(out)
+}
+
+func (rs rollsum) digest() uint32 { return rs.a&0xffff | rs.b<<16 }
+
+func strongSum(p []byte) string {
+	h := sha256.Sum256(p)
+	return hex.EncodeToString(h[:16])
+}
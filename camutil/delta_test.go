@@ -0,0 +1,53 @@
+package camutil
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestDelta(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	base := make([]byte, 10000)
+	rnd.Read(base)
+	insert := []byte("inserted bytes")
+	for i, target := range [][]byte{
+		base,
+		nil,
+		append(append(append([]byte{}, base[:3000]...), insert...), base[3000:]...),
+		append(append([]byte{}, base[1234:]...), base[:1234]...),
+		base[:9999],
+		append([]byte("prefix"), base[100:]...),
+	} {
+		const bs = 512
+		sig, err := NewSignature(bytes.NewReader(base), bs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var delta bytes.Buffer
+		if err = WriteDelta(&delta, bytes.NewReader(target), sig); err != nil {
+			t.Fatalf("%d. %v", i, err)
+		}
+		var got bytes.Buffer
+		if err = ApplyDelta(&got, bytes.NewReader(base), &delta, bs); err != nil {
+			t.Fatalf("%d. %v", i, err)
+		}
+		if !bytes.Equal(got.Bytes(), target) {
+			t.Errorf("%d. got %d bytes, wanted %d", i, got.Len(), len(target))
+		}
+		if i == 0 && delta.Len() > 10 {
+			t.Errorf("%d. the delta of the same file is %d bytes", i, delta.Len())
+		}
+		if i == 2 && delta.Len() > 2*bs {
+			t.Errorf("%d. the delta of an insertion is %d bytes", i, delta.Len())
+		}
+	}
+}
+
+func TestDeltaBlockSize(t *testing.T) {
+	for _, bs := range []int{1, MinDeltaBlockSize - 1, MaxChunkSize + 1} {
+		if err := WriteDelta(new(bytes.Buffer), bytes.NewReader(nil), Signature{BlockSize: bs}); err == nil {
+			t.Errorf("block size %d is accepted", bs)
+		}
+	}
+}
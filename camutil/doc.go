@@ -19,11 +19,74 @@ Package camutil copies some unexported utilities from camlistore.org/cmd/cam{get
 */
 package camutil
 
+import "time"
+
+// Options are the settings of the Downloaders and Uploaders.
+type Options struct {
+	// Verbose shall be true for verbose HTTP logging
+	Verbose bool
+	// InsecureTLS sets client's InsecureTLS
+	InsecureTLS bool
+	// SkipIrregular makes camget skip not regular files.
+	SkipIrregular bool
+	// MirrorDir is the directory of the local blob store which persists every
+	// fetched blob (read-through mirror). The temporary disk cache is used if empty.
+	MirrorDir string
+	// CapCtime forges ctime to be less or equal to mtime on upload.
+	CapCtime bool
+	// SkipHaveCache skips the have cache on upload.
+	SkipHaveCache bool
+	// HaveCacheType is the type of the have cache of the direct uploads:
+	// "memory" (or "lru"), "kv", "leveldb", "bbolt" or "sqlite" (persistent,
+	// in HaveCacheDir), or "" for none. bbolt needs the with_bbolt, sqlite
+	// the with_sqlite build tag (and cgo).
+	HaveCacheType string
+	// HaveCacheDir is the directory of the have cache - and of pk-put's
+	// have and stat caches (CAMLI_CACHE_DIR).
+	HaveCacheDir string
+	// HaveCacheMaxSize is the maximum number of refs in the have cache
+	// (for the disk caches, 0 is unlimited).
+	HaveCacheMaxSize int
+	// MaxUploads is the maximum number of the concurrent uploads through the
+	// Uploader (default 32, 8 for file://).
+	MaxUploads int
+	// StatBatchWindow is the time the stats of the concurrent uploads are
+	// collected for, to be sent to the server in one batch (0: no batching).
+	StatBatchWindow time.Duration
+	// Chunking is the chunking of the files uploaded directly (not through
+	// pk-put); the zero value leaves it to perkeep.
+	Chunking ChunkOptions
+	// Progress receives the status of the uploads and downloads, if not nil.
+	// The Options are the key of the cached Uploaders and Downloaders, so it
+	// must be comparable (a pointer, for example).
+	Progress Progress
+
+	// Auth is the auth config of the server, in the format of CAMLI_AUTH
+	// (e.g. userpass:alice:secret, token:...). The client config and CAMLI_AUTH
+	// are used if empty.
+	Auth string
+
+	HTTPOptions
+	SignerOptions
+}
+
+// DefaultOptions returns the Options set by the package level variables.
+func DefaultOptions() Options {
+	return Options{Verbose: Verbose, InsecureTLS: InsecureTLS,
+		SkipIrregular: SkipIrregular, MirrorDir: MirrorDir}
+}
+
 // Verbose shall be true for verbose HTTP logging
+//
+// Deprecated: use Options.Verbose.
 var Verbose = false
 
 // InsecureTLS sets client's InsecureTLS
+//
+// Deprecated: use Options.InsecureTLS.
 var InsecureTLS bool
 
 // SkipIrregular makes camget skip not regular files.
+//
+// Deprecated: use Options.SkipIrregular.
 var SkipIrregular bool
@@ -21,7 +21,6 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/hex"
-	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
@@ -30,6 +29,7 @@ import (
 	"sync"
 
 	"github.com/pkg/errors"
+	"perkeep.org/pkg/auth"
 	"perkeep.org/pkg/blob"
 	"perkeep.org/pkg/blobserver/localdisk"
 	"perkeep.org/pkg/cacher"
@@ -44,84 +44,150 @@ type Downloader struct {
 	cl *client.Client
 	blob.Fetcher
 	args []string
+	opts Options
+
+	// local is the disk cache opened for WithCacheOnly.
+	localOnce sync.Once
+	local     blob.Fetcher
+}
+
+// cacheKey is the key of the cached Downloaders and Uploaders.
+type cacheKey struct {
+	server string
+	opts   Options
 }
 
 var (
-	cachedClient    = make(map[string]*client.Client, 1)
+	cachedClient    = make(map[clientKey]*client.Client, 1)
 	cachedClientMtx sync.Mutex
 )
 
+type clientKey struct {
+	server string
+	auth   string
+	http   HTTPOptions
+}
+
 // NewClient returns a new client for the given server. Auth is set up according
 // to the client config (~/.config/camlistore/client-config.json)
 // and the environment variables.
-func NewClient(server string) (*client.Client, error) {
-	if server == "" {
-		server = "localhost:3179"
+// The HTTP transport is tuned by opts.HTTPOptions, and opts.Auth overrides
+// the auth config, if opts is not nil.
+func NewClient(ctx context.Context, server string, opts *Options) (*client.Client, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
+	key := newClientKey(server, opts)
 	cachedClientMtx.Lock()
 	defer cachedClientMtx.Unlock()
-	c, ok := cachedClient[server]
+	c, ok := cachedClient[key]
 	if ok {
 		return c, nil
 	}
+	c, err := newClient(key)
+	if err != nil {
+		return nil, err
+	}
+	cachedClient[key] = c
+	return c, nil
+}
+
+func newClientKey(server string, opts *Options) clientKey {
+	if server == "" {
+		server = "localhost:3179"
+	}
+	key := clientKey{server: server}
+	if opts != nil {
+		key.auth, key.http = opts.Auth, opts.HTTPOptions
+	}
+	return key
+}
+
+// newClient returns a new, not cached client (see NewClient).
+func newClient(key clientKey) (*client.Client, error) {
+	server := key.server
 	if strings.HasPrefix(server, "file://") {
 		bs, err := localdisk.New(server[7:])
 		if err != nil {
 			return nil, err
 		}
-		c, err = client.New(client.OptionUseStorageClient(bs))
-		if err != nil {
-			return nil, err
-		}
-	} else {
-		var err error
-		c, err = client.New(client.OptionServer(server), client.OptionInsecure(true))
+		return client.New(client.OptionUseStorageClient(bs))
+	}
+	copts := []client.ClientOption{client.OptionServer(server), client.OptionInsecure(true)}
+	if key.auth != "" {
+		mode, err := auth.FromConfig(key.auth)
 		if err != nil {
-			return nil, err
+			return nil, errors.Wrapf(err, "auth config of %q", server)
 		}
+		copts = append(copts, client.OptionAuthMode(mode))
+	}
+	c, err := client.New(copts...)
+	if err != nil {
+		return nil, err
+	}
+	if key.auth == "" {
 		if err := c.SetupAuth(); err != nil {
 			return nil, err
 		}
 	}
-	cachedClient[server] = c
+	hc, err := key.http.httpClient()
+	if err != nil {
+		return nil, err
+	}
+	if hc != nil {
+		c.SetHTTPClient(hc)
+	}
 	return c, nil
 }
 
 var (
-	cachedDownloader    = make(map[string]*Downloader, 1)
+	cachedDownloader    = make(map[cacheKey]*Downloader, 1)
 	cachedDownloaderMtx sync.Mutex
 )
 
 // The followings are copied from camlistore.org/cmd/camget
 
 // NewDownloader creates a new Downloader (client + properties + disk cache)
-// for the server
-func NewDownloader(server string) (*Downloader, error) {
+// for the server. The package level variables are used if opts is nil.
+func NewDownloader(ctx context.Context, server string, opts *Options) (*Downloader, error) {
+	if opts == nil {
+		o := DefaultOptions()
+		opts = &o
+	}
+	key := cacheKey{server: server, opts: *opts}
 	cachedDownloaderMtx.Lock()
 	defer cachedDownloaderMtx.Unlock()
-	down, ok := cachedDownloader[server]
+	down, ok := cachedDownloader[key]
 	if ok {
 		return down, nil
 	}
 
-	down = new(Downloader)
+	down = &Downloader{opts: *opts}
 	var err error
-	if down.cl, err = NewClient(server); err != nil {
+	if down.cl, err = NewClient(ctx, server, opts); err != nil {
 		return nil, err
 	}
 
 	if strings.HasPrefix(server, "file://") {
 		down.Fetcher = down.cl
-		cachedDownloader[server] = down
+		cachedDownloader[key] = down
 		return down, nil
 	}
 
-	down.Fetcher, err = cacher.NewDiskCache(down.cl)
-	if err != nil {
-		return nil, errors.Wrap(err, "setup local disk cache")
-	}
-	if Verbose {
-		Log("msg", "Using temp blob cache directory "+down.Fetcher.(*cacher.DiskCache).Root)
+	if opts.MirrorDir != "" {
+		local, err := localdisk.New(opts.MirrorDir)
+		if err != nil {
+			return nil, errors.Wrapf(err, "open mirror %q", opts.MirrorDir)
+		}
+		down.Fetcher = mirrorFetcher{local: local, upstream: down.cl}
+	} else {
+		down.Fetcher, err = cacher.NewDiskCache(down.cl)
+		if err != nil {
+			return nil, errors.Wrap(err, "setup local disk cache")
+		}
+		if opts.Verbose {
+			Log("msg", "Using temp blob cache directory "+down.Fetcher.(*cacher.DiskCache).Root)
+		}
 	}
 	if server != "" {
 		down.args = []string{"-server=" + server}
@@ -129,7 +195,7 @@ func NewDownloader(server string) (*Downloader, error) {
 		down.args = []string{}
 	}
 
-	cachedDownloader[server] = down
+	cachedDownloader[key] = down
 	return down, nil
 }
 
@@ -142,16 +208,45 @@ func (down *Downloader) Close() {
 	}
 }
 
+// CacheDirs returns the directories of the disk caches of the Downloaders,
+// and of the mirrors.
+func CacheDirs() []string {
+	cachedDownloaderMtx.Lock()
+	defer cachedDownloaderMtx.Unlock()
+	var dirs []string
+	seen := make(map[string]bool)
+	for _, down := range cachedDownloader {
+		dir := down.opts.MirrorDir
+		if dc, ok := down.Fetcher.(*cacher.DiskCache); ok {
+			dir = dc.Root
+		}
+		if dir != "" && !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
 // ParseBlobNames parses the blob names, appending to items, and returning
 // the expanded slice, and error if happened.
-// This uses blob.Parse, and can decode base64-encoded refs as a plus.
+// This uses blob.Parse (case-insensitively for the known hashes), and can decode
+// base64- and base32-encoded refs as a plus. The hash of the refs is validated
+// by ValidateRef.
 func ParseBlobNames(items []blob.Ref, names []string) ([]blob.Ref, error) {
 	for _, arg := range names {
-		br, ok := blob.Parse(arg)
-		if !ok {
+		br, ok := parseHexRef(arg)
+		if ok {
+			if err := ValidateRef(br); err != nil {
+				return nil, err
+			}
+		} else {
 			var e error
 			if br, e = Base64ToRef(arg); e != nil {
-				return nil, e
+				var e32 error
+				if br, e32 = Base32ToRef(arg); e32 != nil {
+					return nil, e
+				}
 			}
 		}
 		items = append(items, br)
@@ -159,41 +254,23 @@ func ParseBlobNames(items []blob.Ref, names []string) ([]blob.Ref, error) {
 	return items, nil
 }
 
-// Base64ToRef decodes a base64-encoded blobref
-func Base64ToRef(arg string) (br blob.Ref, err error) {
-	b := make([]byte, 64)
-	t := make([]byte, 2*len(b))
-	var i, n int
-	i = len(arg)
-	if i > cap(t) {
-		i = cap(t)
-	}
-	t = []byte(arg[:i])
-	i = bytes.IndexByte(t, byte('-'))
+// Base64ToRef decodes a base64-encoded blobref (see RefToBase64),
+// with or without padding, for any hash accepted by ValidateRef.
+func Base64ToRef(arg string) (blob.Ref, error) {
+	i := strings.IndexByte(arg, '-')
 	if i < 0 {
-		err = errors.New(fmt.Sprintf("no - in %q", arg))
-		return
+		return blob.Ref{}, withKind(ErrBadRef, errors.Errorf("no - in %q", arg))
 	}
-	n, err = base64.URLEncoding.Decode(b[:cap(b)], t[i+1:])
+	digest, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(arg[i+1:], "="))
 	if err != nil {
-		err = errors.Wrapf(err, "cannot decode %q as base64", t[i+1:])
-		return
+		return blob.Ref{}, withKind(ErrBadRef, errors.Wrapf(err, "cannot decode %q as base64", arg[i+1:]))
 	}
-	b = b[:n]
-	copy(t[:i], bytes.ToLower(t[:i]))
-	t = t[:cap(t)]
-	n = 2*len(b) - len(t) + n + 1
-	if n > 0 {
-		t = append(t, make([]byte, n)...)
-	}
-	n = hex.Encode(t[i+1:], b)
-	arg = string(t[:i+1+n])
-	br, ok := blob.Parse(arg)
+	s := strings.ToLower(arg[:i]) + "-" + hex.EncodeToString(digest)
+	br, ok := blob.Parse(s)
 	if !ok {
-		err = errors.New(fmt.Sprintf("cannot parse %q as blobref", arg))
-		return
+		return blob.Ref{}, withKind(ErrBadRef, errors.Errorf("cannot parse %q as blobref", s))
 	}
-	return br, nil
+	return br, ValidateRef(br)
 }
 
 // Start starts the downloads of the blobrefs.
@@ -205,15 +282,24 @@ func (down *Downloader) Start(ctx context.Context, contents bool, items ...blob.
 		rc  io.ReadCloser
 		err error
 	)
+	fetcher := down.fetcher(ctx)
+	p := down.opts.Progress
 	for _, br := range items {
+		if p != nil {
+			p.File(br.String(), -1)
+		}
 		if contents {
-			rc, err = schema.NewFileReader(ctx, down.Fetcher, br)
-			if err == nil {
-				rc.(*schema.FileReader).LoadAllChunks()
+			var fr *schema.FileReader
+			if fr, err = openFile(ctx, fetcher, br); err == nil {
+				fr.LoadAllChunks()
+				rc = fr
+			} else if errors.Cause(err) == os.ErrNotExist {
+				// pk-get would not find it either
+				return nil, err
 			}
 		} else {
 			var b *blob.Blob
-			b, err = blob.FromFetcher(ctx, down.Fetcher, br)
+			b, err = blob.FromFetcher(ctx, fetcher, br)
 			if err == nil {
 				var r io.Reader
 				r, err = b.ReadAll(ctx)
@@ -222,7 +308,7 @@ func (down *Downloader) Start(ctx context.Context, contents bool, items ...blob.
 					io.Closer
 				}{r, ioutil.NopCloser(nil)}
 			} else if errors.Cause(err) == os.ErrNotExist {
-				return nil, errors.Wrapf(err, "%v", br)
+				return nil, withKind(ErrNotFound, errors.Wrapf(err, "%v", br))
 			} else {
 				Log("error", err)
 			}
@@ -232,24 +318,27 @@ func (down *Downloader) Start(ctx context.Context, contents bool, items ...blob.
 			closers = append(closers, rc)
 			continue
 		}
+		if cacheOnly(ctx) {
+			return nil, withKind(ErrNotCached, errors.Wrapf(err, "%v", br))
+		}
 		Log("msg", "downloading", "blob", br, "error", err)
 		args := append(make([]string, 0, len(down.args)+3), down.args...)
 		if contents {
 			args = append(args, "-contents=true")
 		}
-		if InsecureTLS {
+		if down.opts.InsecureTLS {
 			args = append(args, "-insecure=true")
 		}
 		args = append(args, br.String())
-		c := exec.Command(cmdPkGet, args...)
+		c := exec.CommandContext(ctx, cmdPkGet, args...)
 		var errBuf bytes.Buffer
 		c.Stderr = &errBuf
 		if rc, err = c.StdoutPipe(); err != nil {
-			return nil, errors.Wrapf(err, "create stdout pipe for %s %q: %s", cmdPkGet, args, errBuf.Bytes())
+			return nil, withKind(ErrUpstreamUnavailable, errors.Wrapf(err, "create stdout pipe for %s %q: %s", cmdPkGet, args, errBuf.Bytes()))
 		}
 		Log("msg", "calling "+cmdPkGet, "args", args)
 		if err = c.Run(); err != nil {
-			return nil, errors.Wrapf(err, "call %s %q: %s", cmdPkGet, args, errBuf.Bytes())
+			return nil, withKind(ErrUpstreamUnavailable, errors.Wrapf(err, "call %s %q: %s", cmdPkGet, args, errBuf.Bytes()))
 		}
 		readers = append(readers, rc)
 		closers = append(closers, rc)
@@ -267,10 +356,23 @@ func (down *Downloader) Start(ctx context.Context, contents bool, items ...blob.
 	}, nil
 }
 
+// Stat returns the sizes of the existing blobs from the items.
+func (down *Downloader) Stat(ctx context.Context, items ...blob.Ref) (map[blob.Ref]uint32, error) {
+	sizes := make(map[blob.Ref]uint32, len(items))
+	err := down.cl.StatBlobs(ctx, items, func(sb blob.SizedRef) error {
+		sizes[sb.Ref] = sb.Size
+		return nil
+	})
+	if err != nil {
+		return sizes, withKind(ErrUpstreamUnavailable, errors.Wrapf(err, "stat %v", items))
+	}
+	return sizes, nil
+}
+
 // Save saves contents of the blobs into destDir as files
 func (down *Downloader) Save(ctx context.Context, destDir string, contents bool, items ...blob.Ref) error {
 	for _, br := range items {
-		if err := smartFetch(ctx, down.Fetcher, destDir, br); err != nil {
+		if err := smartFetch(ctx, down.fetcher(ctx), down.opts, destDir, br); err != nil {
 			Log("msg", "Save", "error", err)
 			return err
 		}
@@ -281,7 +383,11 @@ func (down *Downloader) Save(ctx context.Context, destDir string, contents bool,
 func fetch(ctx context.Context, src blob.Fetcher, br blob.Ref) (io.ReadCloser, error) {
 	r, _, err := src.Fetch(ctx, br)
 	if err != nil {
-		return nil, errors.Wrapf(err, "fetch %s", br)
+		kind := ErrUpstreamUnavailable
+		if errors.Cause(err) == os.ErrNotExist {
+			kind = ErrNotFound
+		}
+		return nil, withKind(kind, errors.Wrapf(err, "fetch %s", br))
 	}
 	return r, nil
 }
@@ -1,7 +1,10 @@
 package camutil
 
 import (
+	"strings"
 	"testing"
+
+	"perkeep.org/pkg/blob"
 )
 
 func TestBase64ToHex(t *testing.T) {
@@ -16,3 +19,76 @@ func TestBase64ToHex(t *testing.T) {
 		}
 	}
 }
+
+func TestBase64RoundTrip(t *testing.T) {
+	for i, br := range []blob.Ref{
+		blob.MustParse("sha1-f6c7ce14e91c5013368a0a3c3c24bd696778d823"),
+		blob.MustParse("sha224-d14a028c2a3a2bc9476102bb288234c415a2b01f828ea62ac5b3e42f"),
+		blob.RefFromString("the current default hash"),
+	} {
+		s := RefToBase64(br)
+		if !strings.HasPrefix(s, br.HashName()+"-") {
+			t.Errorf("%d. %s: bad prefix: %q", i, br, s)
+		}
+		for _, enc := range []string{s, strings.TrimRight(s, "=")} {
+			got, err := Base64ToRef(enc)
+			if err != nil {
+				t.Errorf("%d. %q: %v", i, enc, err)
+				continue
+			}
+			if got != br {
+				t.Errorf("%d. %q: got %s, wanted %s", i, enc, got, br)
+			}
+		}
+	}
+	for _, bad := range []string{"sha1", "sha1-!!", "nohash-9sfOFOkcUBM2igo8PCS9aWd42CM=", "sha1-AAAA"} {
+		if br, err := Base64ToRef(bad); err == nil {
+			t.Errorf("%q: got %s, wanted error", bad, br)
+		}
+	}
+}
+
+func TestBase32RoundTrip(t *testing.T) {
+	for i, br := range []blob.Ref{
+		blob.MustParse("sha1-f6c7ce14e91c5013368a0a3c3c24bd696778d823"),
+		blob.RefFromString("the current default hash"),
+	} {
+		s := RefToBase32(br)
+		for _, enc := range []string{s, strings.ToUpper(s)} {
+			got, err := Base32ToRef(enc)
+			if err != nil {
+				t.Errorf("%d. %q: %v", i, enc, err)
+				continue
+			}
+			if got != br {
+				t.Errorf("%d. %q: got %s, wanted %s", i, enc, got, br)
+			}
+		}
+		if got, err := ParseBlobNames(nil, []string{s}); err != nil || len(got) != 1 || got[0] != br {
+			t.Errorf("%d. ParseBlobNames(%q): got %v, %v", i, s, got, err)
+		}
+	}
+}
+
+func TestValidateRef(t *testing.T) {
+	const sha1 = "sha1-f6c7ce14e91c5013368a0a3c3c24bd696778d823"
+	for i, s := range []string{sha1, strings.ToUpper(sha1), "SHA1-f6c7ce14e91c5013368a0a3c3c24bd696778d823"} {
+		got, err := ParseBlobNames(nil, []string{s})
+		if err != nil || len(got) != 1 || got[0].String() != sha1 {
+			t.Errorf("%d. ParseBlobNames(%q): got %v, %v", i, s, got, err)
+		}
+	}
+	for _, bad := range []string{"sha1-f6c7ce14e91c", "sha-f6c7ce14e91c5013368a0a3c3c24bd696778d823", "nohash-9sfOFOkcUBM2igo8PCS9aWd42CM"} {
+		if got, err := ParseBlobNames(nil, []string{bad}); err == nil {
+			t.Errorf("%q: got %v, wanted error", bad, got)
+		}
+	}
+	for _, bad := range []struct {
+		name string
+		size int
+	}{{"Blake", 32}, {"blake2b", 8}, {"", 32}} {
+		if err := RegisterHash(bad.name, bad.size); err == nil {
+			t.Errorf("RegisterHash(%q, %d): wanted error", bad.name, bad.size)
+		}
+	}
+}
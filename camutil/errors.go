@@ -0,0 +1,73 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package camutil
+
+import "github.com/pkg/errors"
+
+// The kinds of the errors returned by the Downloader and the Uploader,
+// to be checked with errors.Is.
+var (
+	// ErrNotFound is returned when the blob does not exist.
+	ErrNotFound = errors.New("not found")
+	// ErrUpstreamUnavailable is returned when the server cannot be reached,
+	// or fails.
+	ErrUpstreamUnavailable = errors.New("upstream unavailable")
+	// ErrBadRef is returned when a blobref cannot be parsed.
+	ErrBadRef = errors.New("bad blobref")
+	// ErrSchema is returned when a schema blob is not what is expected.
+	ErrSchema = errors.New("bad schema blob")
+	// ErrNotCached is returned for the blobs not in the mirror or the disk
+	// cache, when the server must not be reached (see WithCacheOnly).
+	ErrNotCached = errors.New("not cached")
+	// ErrOutOfMemory is returned when the Buffers budget has no room for
+	// the chunk buffer of an upload.
+	ErrOutOfMemory = errors.New("out of memory budget")
+)
+
+// kindError is an error of kind (one of the Err* variables).
+type kindError struct {
+	kind, err error
+}
+
+// withKind marks err as of kind - unless it (or an error it wraps) has a
+// kind already.
+func withKind(kind, err error) error {
+	if err == nil || hasKind(err) {
+		return err
+	}
+	return &kindError{kind: kind, err: err}
+}
+
+// hasKind reports whether err, or any error in its chain of causes, has a kind.
+func hasKind(err error) bool {
+	for err != nil {
+		if _, ok := err.(*kindError); ok {
+			return true
+		}
+		c, ok := err.(interface{ Cause() error })
+		if !ok {
+			return false
+		}
+		err = c.Cause()
+	}
+	return false
+}
+
+func (e *kindError) Error() string        { return e.err.Error() }
+func (e *kindError) Cause() error         { return e.err }
+func (e *kindError) Unwrap() error        { return e.err }
+func (e *kindError) Is(target error) bool { return target == e.kind }
@@ -0,0 +1,34 @@
+package camutil
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	pkgerrors "github.com/pkg/errors"
+)
+
+func TestErrorKinds(t *testing.T) {
+	err := withKind(ErrNotFound, pkgerrors.Wrap(os.ErrNotExist, "fetch"))
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("%v is not ErrNotFound", err)
+	}
+	if errors.Is(err, ErrUpstreamUnavailable) {
+		t.Errorf("%v is ErrUpstreamUnavailable", err)
+	}
+	if pkgerrors.Cause(err) != os.ErrNotExist {
+		t.Errorf("cause of %v is %v", err, pkgerrors.Cause(err))
+	}
+	if withKind(ErrSchema, err) != err {
+		t.Errorf("kind has been overwritten")
+	}
+	if wrapped := pkgerrors.Wrap(err, "wrapped"); withKind(ErrUpstreamUnavailable, wrapped) != wrapped {
+		t.Errorf("kind of the wrapped error has been overwritten")
+	} else if !errors.Is(wrapped, ErrNotFound) {
+		t.Errorf("%v is not ErrNotFound", wrapped)
+	}
+
+	if _, err = Base64ToRef("sha1"); !errors.Is(err, ErrBadRef) {
+		t.Errorf("Base64ToRef: %v is not ErrBadRef", err)
+	}
+}
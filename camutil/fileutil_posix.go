@@ -36,3 +36,8 @@ func LinkOrCopy(src, dst string) error {
 	}
 	return err
 }
+
+// mkfifo creates a named pipe.
+func mkfifo(name string, mode uint32) error {
+	return syscall.Mkfifo(name, mode)
+}
@@ -22,3 +22,8 @@ package camutil
 func LinkOrCopy(src, dst string) error {
 	return CopyFile(src, dst)
 }
+
+// mkfifo is not supported on Windows.
+func mkfifo(name string, mode uint32) error {
+	return ErrNotSupported
+}
@@ -0,0 +1,298 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package camutil
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/schema"
+)
+
+// WriteTo writes the contents of the file blob to w.
+func (down *Downloader) WriteTo(ctx context.Context, br blob.Ref, w io.Writer) (int64, error) {
+	fr, err := openFile(ctx, down.fetcher(ctx), br)
+	if err != nil {
+		return 0, err
+	}
+	defer fr.Close()
+	return io.Copy(w, fr)
+}
+
+// OpenFile opens the file blob for reading and seeking.
+func (down *Downloader) OpenFile(ctx context.Context, br blob.Ref) (*schema.FileReader, error) {
+	return openFile(ctx, down.fetcher(ctx), br)
+}
+
+// openFile opens the file blob. The failure of fetching the file blob keeps
+// its kind (ErrNotFound, ErrUpstreamUnavailable), the rest is ErrSchema.
+func openFile(ctx context.Context, fetcher blob.Fetcher, br blob.Ref) (*schema.FileReader, error) {
+	fr, err := schema.NewFileReader(ctx, fetcher, br)
+	if err == nil {
+		return fr, nil
+	}
+	// NewFileReader hides the cause of a failed fetch
+	rc, fetchErr := fetch(ctx, fetcher, br)
+	if fetchErr != nil {
+		return nil, fetchErr
+	}
+	rc.Close()
+	return nil, withKind(ErrSchema, errors.Wrapf(err, "read file %s", br))
+}
+
+// FS returns the tree under the directory (or the single file) blob
+// as a read-only fs.FS.
+func (down *Downloader) FS(ctx context.Context, br blob.Ref) (fs.FS, error) {
+	cfs := newCamliFS(ctx, down.fetcher(ctx))
+	root, err := cfs.schemaBlob(br)
+	if err != nil {
+		return nil, err
+	}
+	switch root.Type() {
+	case "directory":
+		cfs.root = root
+	case "file":
+		// a directory with just this file in it
+		cfs.single = root
+	default:
+		return nil, withKind(ErrSchema, errors.Errorf("%s is a %q, not a directory or file", br, root.Type()))
+	}
+	return cfs, nil
+}
+
+// Members returns the refs of the files under the directory blob,
+// keyed by their slash-separated path.
+func (down *Downloader) Members(ctx context.Context, br blob.Ref) (map[string]blob.Ref, error) {
+	cfs := newCamliFS(ctx, down.fetcher(ctx))
+	root, err := cfs.schemaBlob(br)
+	if err != nil {
+		return nil, err
+	}
+	members := make(map[string]blob.Ref)
+	if root.Type() == "file" {
+		members[root.FileName()] = br
+		return members, nil
+	}
+	var walk func(prefix string, dir *schema.Blob) error
+	walk = func(prefix string, dir *schema.Blob) error {
+		entries, err := cfs.entries(dir)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			switch e.Type() {
+			case "directory":
+				if err := walk(prefix+e.FileName()+"/", e); err != nil {
+					return err
+				}
+			case "file":
+				members[prefix+e.FileName()] = e.BlobRef()
+			}
+		}
+		return nil
+	}
+	if root.Type() != "directory" {
+		return nil, withKind(ErrSchema, errors.Errorf("%s is a %q, not a directory or file", br, root.Type()))
+	}
+	return members, walk("", root)
+}
+
+// camliFS is a read-only fs.FS over a directory blob.
+type camliFS struct {
+	ctx     context.Context
+	fetcher blob.Fetcher
+	root    *schema.Blob
+	single  *schema.Blob
+
+	mu   sync.Mutex
+	dirs map[blob.Ref][]*schema.Blob
+}
+
+func newCamliFS(ctx context.Context, fetcher blob.Fetcher) *camliFS {
+	return &camliFS{ctx: ctx, fetcher: fetcher, dirs: make(map[blob.Ref][]*schema.Blob)}
+}
+
+func (cfs *camliFS) schemaBlob(br blob.Ref) (*schema.Blob, error) {
+	rc, err := fetch(cfs.ctx, cfs.fetcher, br)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	b, err := schema.BlobFromReader(br, rc)
+	if err != nil {
+		return nil, withKind(ErrSchema, errors.Wrapf(err, "parse %s", br))
+	}
+	return b, nil
+}
+
+// entries returns the (cached) entries of the directory blob.
+func (cfs *camliFS) entries(dir *schema.Blob) ([]*schema.Blob, error) {
+	if dir == nil {
+		return []*schema.Blob{cfs.single}, nil
+	}
+	cfs.mu.Lock()
+	entries, ok := cfs.dirs[dir.BlobRef()]
+	cfs.mu.Unlock()
+	if ok {
+		return entries, nil
+	}
+	ssRef, ok := dir.DirectoryEntries()
+	if !ok {
+		return nil, withKind(ErrSchema, errors.Errorf("bad entries blobref in dir %v", dir.BlobRef()))
+	}
+	ss, err := cfs.schemaBlob(ssRef)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range ss.StaticSetMembers() {
+		b, err := cfs.schemaBlob(m)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, b)
+	}
+	cfs.mu.Lock()
+	cfs.dirs[dir.BlobRef()] = entries
+	cfs.mu.Unlock()
+	return entries, nil
+}
+
+// Open implements fs.FS.
+func (cfs *camliFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	cur := cfs.root
+	if name != "." {
+		for _, elt := range strings.Split(name, "/") {
+			if cur != nil && cur.Type() != "directory" {
+				return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+			}
+			entries, err := cfs.entries(cur)
+			if err != nil {
+				return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+			}
+			var next *schema.Blob
+			for _, e := range entries {
+				if e.FileName() == elt {
+					next = e
+					break
+				}
+			}
+			if next == nil {
+				return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+			}
+			cur = next
+		}
+	}
+	if cur == nil || cur.Type() == "directory" {
+		return &camliDir{cfs: cfs, b: cur, name: path.Base(name)}, nil
+	}
+	if cur.Type() != "file" {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	fr, err := openFile(cfs.ctx, cfs.fetcher, cur.BlobRef())
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return camliFile{FileReader: fr, info: blobInfo{cur}}, nil
+}
+
+// blobInfo is the fs.FileInfo of a file or directory blob.
+type blobInfo struct {
+	b *schema.Blob
+}
+
+func (fi blobInfo) Name() string {
+	if fi.b == nil {
+		return "."
+	}
+	return fi.b.FileName()
+}
+func (fi blobInfo) Size() int64 {
+	if fi.b == nil || fi.b.Type() != "file" {
+		return 0
+	}
+	return fi.b.PartsSize()
+}
+func (fi blobInfo) Mode() fs.FileMode {
+	if fi.b == nil {
+		return fs.ModeDir | 0555
+	}
+	mode := fi.b.FileMode()
+	if fi.b.Type() == "directory" {
+		mode |= fs.ModeDir
+	}
+	return mode
+}
+func (fi blobInfo) ModTime() time.Time {
+	if fi.b == nil {
+		return time.Time{}
+	}
+	return fi.b.ModTime()
+}
+func (fi blobInfo) IsDir() bool      { return fi.Mode().IsDir() }
+func (fi blobInfo) Sys() interface{} { return fi.b }
+
+type camliFile struct {
+	*schema.FileReader
+	info blobInfo
+}
+
+func (f camliFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+
+// camliDir is an opened directory (b is nil for the root of a single file FS).
+type camliDir struct {
+	cfs    *camliFS
+	b      *schema.Blob
+	name   string
+	offset int
+}
+
+func (d *camliDir) Stat() (fs.FileInfo, error) { return blobInfo{d.b}, nil }
+func (d *camliDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+func (d *camliDir) Close() error { return nil }
+
+// ReadDir implements fs.ReadDirFile.
+func (d *camliDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	entries, err := d.cfs.entries(d.b)
+	if err != nil {
+		return nil, err
+	}
+	entries = entries[d.offset:]
+	if n > 0 && len(entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > 0 && n < len(entries) {
+		entries = entries[:n]
+	}
+	d.offset += len(entries)
+	des := make([]fs.DirEntry, len(entries))
+	for i, e := range entries {
+		des[i] = fs.FileInfoToDirEntry(blobInfo{e})
+	}
+	return des, nil
+}
@@ -27,7 +27,7 @@ require (
 	github.com/mattn/go-sqlite3 v1.9.0 // indirect
 	github.com/miekg/dns v1.0.8 // indirect
 	github.com/nf/cr2 v0.0.0-20180623103828-4699471a17ed // indirect
-	github.com/pkg/errors v0.8.0
+	github.com/pkg/errors v0.9.1
 	github.com/pkg/sftp v1.8.2 // indirect
 	github.com/plaid/plaid-go v0.0.0-20180625002317-ef879de0d7bd // indirect
 	github.com/shurcooL/sanitized_anchor_name v0.0.0-20170918181015-86672fcb3f95 // indirect
@@ -51,6 +51,6 @@ require (
 	mvdan.cc/sh v2.5.1+incompatible // indirect
 	myitcv.io v0.0.0-20180810221410-4f4c633003ba // indirect
 	perkeep.org v0.0.0-20180824152313-dd2d82c2500c
-	rsc.io/pdf v0.1.1 // indirect
+	rsc.io/pdf v0.1.1
 	rsc.io/qr v0.2.0 // indirect
 )
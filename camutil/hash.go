@@ -0,0 +1,94 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package camutil
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"perkeep.org/pkg/blob"
+)
+
+var (
+	hashSizesMu sync.RWMutex
+	// hashSizes are the digest sizes (in bytes) of the hash algorithms
+	// accepted in the refs.
+	hashSizes = map[string]int{"sha1": 20, "sha224": 28, "sha256": 32, "sha512": 64}
+)
+
+var hashNameRx = regexp.MustCompile(`^[a-z][a-z0-9]*$`)
+
+// RegisterHash accepts the refs of the hash algorithm (with digests of size
+// bytes), too - as the upstream migrates to a new one.
+func RegisterHash(name string, size int) error {
+	if !hashNameRx.MatchString(name) {
+		return errors.Errorf("bad hash name %q", name)
+	}
+	if size < 16 || size > 64 {
+		return errors.Errorf("bad digest size %d of %q (16-64)", size, name)
+	}
+	hashSizesMu.Lock()
+	hashSizes[name] = size
+	hashSizesMu.Unlock()
+	return nil
+}
+
+// hashSize returns the digest size of the hash algorithm, 0 if it is unknown.
+func hashSize(name string) int {
+	hashSizesMu.RLock()
+	defer hashSizesMu.RUnlock()
+	return hashSizes[name]
+}
+
+// ValidateRef checks that the hash algorithm of the ref is known,
+// and its digest is of the algorithm's size.
+func ValidateRef(br blob.Ref) error {
+	if !br.Valid() {
+		return withKind(ErrBadRef, errors.New("invalid ref"))
+	}
+	name := br.HashName()
+	want := hashSize(name)
+	if want == 0 {
+		return withKind(ErrBadRef, errors.Errorf("%s: unknown hash %q", br, name))
+	}
+	data, err := br.MarshalBinary()
+	if err != nil {
+		return withKind(ErrBadRef, errors.Wrapf(err, "%s", br))
+	}
+	if got := len(data) - len(name) - 1; got != want {
+		return withKind(ErrBadRef, errors.Errorf("%s: %s digest of %d bytes, wanted %d", br, name, got, want))
+	}
+	return nil
+}
+
+// parseHexRef parses the hex ref, case-insensitively for the known hashes.
+func parseHexRef(arg string) (blob.Ref, bool) {
+	if br, ok := blob.Parse(arg); ok {
+		return br, true
+	}
+	i := strings.IndexByte(arg, '-')
+	if i < 0 {
+		return blob.Ref{}, false
+	}
+	name := strings.ToLower(arg[:i])
+	if n := hashSize(name); n == 0 || len(arg)-i-1 != 2*n {
+		return blob.Ref{}, false
+	}
+	return blob.Parse(name + "-" + strings.ToLower(arg[i+1:]))
+}
@@ -0,0 +1,209 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package camutil
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/golang/groupcache/lru"
+	"github.com/pkg/errors"
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/sorted"
+	"perkeep.org/pkg/sorted/kvfile"
+	"perkeep.org/pkg/sorted/leveldb"
+	"perkeep.org/pkg/sorted/sqlite"
+)
+
+// DefaultMaxHaveCacheSize is the maximum number of refs in the memory have cache.
+var DefaultMaxHaveCacheSize = 100000
+
+// haveCache remembers the blobs known to exist on the server,
+// in memory (LRU) or on disk (kv, leveldb, bbolt or sqlite).
+// It implements client.HaveCache.
+type haveCache struct {
+	mu       sync.Mutex
+	mem      *lru.Cache
+	db       sorted.KeyValue
+	filename string
+	max, n   int
+	// refs is the number of the Uploaders sharing the disk cache,
+	// guarded by haveCachesMu
+	refs int
+}
+
+var (
+	haveCachesMu sync.Mutex
+	// haveCaches are the open disk have caches by file name: the Uploaders
+	// of a server with different Options share them, as the file is locked.
+	haveCaches = make(map[string]*haveCache)
+)
+
+// newHaveCache returns a have cache of the type ("memory" or "lru", "kv",
+// "leveldb", "bbolt" or "sqlite") for the server.
+// The disk caches are in dir (the temp dir if empty), and compacted (emptied)
+// when they hold more than max refs. They are shared, till the last Close.
+func newHaveCache(typ, dir, server string, max int) (*haveCache, error) {
+	hc := &haveCache{max: max}
+	var open func(string) (sorted.KeyValue, error)
+	switch typ {
+	case "memory", "lru":
+		if hc.max <= 0 {
+			hc.max = DefaultMaxHaveCacheSize
+		}
+		hc.mem = lru.New(hc.max)
+		return hc, nil
+	case "kv":
+		open = kvfile.NewStorage
+	case "leveldb":
+		open = leveldb.NewStorage
+	case "bbolt":
+		open = newBoltKeyValue
+	case "sqlite":
+		// needs cgo and the with_sqlite build tag
+		open = sqlite.NewStorage
+	default:
+		return nil, errors.Errorf("unknown have cache type %q", typ)
+	}
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	hsh := sha1.Sum([]byte(server))
+	hc.filename = filepath.Join(dir, "camproxy-havecache-"+hex.EncodeToString(hsh[:4])+"."+typ)
+	haveCachesMu.Lock()
+	defer haveCachesMu.Unlock()
+	if shared, ok := haveCaches[hc.filename]; ok {
+		shared.refs++
+		return shared, nil
+	}
+	var err error
+	if hc.db, err = open(hc.filename); err != nil {
+		return nil, errors.Wrapf(err, "open have cache %q", hc.filename)
+	}
+	// count the refs kept from the previous runs, for max
+	it := hc.db.Find("", "")
+	for it.Next() {
+		hc.n++
+	}
+	if err = it.Close(); err != nil {
+		hc.db.Close()
+		return nil, errors.Wrapf(err, "count the refs of have cache %q", hc.filename)
+	}
+	hc.refs = 1
+	haveCaches[hc.filename] = hc
+	return hc, nil
+}
+
+// StatBlobCache implements client.HaveCache.
+func (hc *haveCache) StatBlobCache(br blob.Ref) (uint32, bool) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if hc.mem != nil {
+		if v, ok := hc.mem.Get(br.String()); ok {
+			return v.(uint32), true
+		}
+		return 0, false
+	}
+	s, err := hc.db.Get(br.String())
+	if err != nil {
+		return 0, false
+	}
+	size, err := strconv.ParseUint(s, 10, 32)
+	return uint32(size), err == nil
+}
+
+// NoteBlobExists implements client.HaveCache.
+func (hc *haveCache) NoteBlobExists(br blob.Ref, size uint32) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if hc.mem != nil {
+		hc.mem.Add(br.String(), size)
+		return
+	}
+	if hc.max > 0 && hc.n >= hc.max {
+		if err := hc.flush(); err != nil {
+			Log("msg", "compact have cache", "file", hc.filename, "error", err)
+		}
+	}
+	if err := hc.db.Set(br.String(), strconv.FormatUint(uint64(size), 10)); err != nil {
+		Log("msg", "have cache set", "file", hc.filename, "error", err)
+		return
+	}
+	hc.n++
+}
+
+// Flush empties the cache.
+func (hc *haveCache) Flush() error {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	return hc.flush()
+}
+
+func (hc *haveCache) flush() error {
+	if hc.mem != nil {
+		hc.mem = lru.New(hc.max)
+		return nil
+	}
+	it := hc.db.Find("", "")
+	batch := hc.db.BeginBatch()
+	for it.Next() {
+		batch.Delete(it.Key())
+	}
+	if err := it.Close(); err != nil {
+		return err
+	}
+	hc.n = 0
+	return hc.db.CommitBatch(batch)
+}
+
+// Close closes the disk db, when it is not shared anymore.
+func (hc *haveCache) Close() error {
+	if hc.db == nil {
+		return nil
+	}
+	haveCachesMu.Lock()
+	defer haveCachesMu.Unlock()
+	if hc.refs--; hc.refs > 0 {
+		return nil
+	}
+	delete(haveCaches, hc.filename)
+	return hc.db.Close()
+}
+
+// FlushHaveCache empties the have and stat caches of the Uploader -
+// pk-put's caches in Options.HaveCacheDir, too.
+func (u *Uploader) FlushHaveCache() error {
+	var err error
+	if u.haveCache != nil {
+		err = u.haveCache.Flush()
+	}
+	if u.opts.HaveCacheDir == "" {
+		return err
+	}
+	names, _ := filepath.Glob(filepath.Join(u.opts.HaveCacheDir, "*.havecache*"))
+	statNames, _ := filepath.Glob(filepath.Join(u.opts.HaveCacheDir, "*.statcache*"))
+	for _, fn := range append(names, statNames...) {
+		if rmErr := os.Remove(fn); rmErr != nil && err == nil {
+			err = rmErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,155 @@
+// +build with_bbolt
+
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package camutil
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+	"perkeep.org/pkg/sorted"
+)
+
+// boltBucket is the bucket of the keys in the bbolt database.
+var boltBucket = []byte("sorted")
+
+// newBoltKeyValue opens the bbolt database file as a sorted.KeyValue.
+func newBoltKeyValue(file string) (sorted.KeyValue, error) {
+	db, err := bolt.Open(file, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	if err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return boltKeyValue{db: db}, nil
+}
+
+// boltKeyValue is a sorted.KeyValue in a bbolt database.
+type boltKeyValue struct {
+	db *bolt.DB
+}
+
+func (kv boltKeyValue) Get(key string) (string, error) {
+	var value string
+	err := kv.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(boltBucket).Get([]byte(key))
+		if v == nil {
+			return sorted.ErrNotFound
+		}
+		value = string(v)
+		return nil
+	})
+	return value, err
+}
+
+func (kv boltKeyValue) Set(key, value string) error {
+	return kv.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Put([]byte(key), []byte(value))
+	})
+}
+
+func (kv boltKeyValue) Delete(key string) error {
+	return kv.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Delete([]byte(key))
+	})
+}
+
+// boltBatch is the batch of the mutations, applied in one transaction.
+type boltBatch struct {
+	keys, values []string
+	deletes      []bool
+}
+
+func (b *boltBatch) Set(key, value string) {
+	b.keys, b.values, b.deletes = append(b.keys, key), append(b.values, value), append(b.deletes, false)
+}
+
+func (b *boltBatch) Delete(key string) {
+	b.keys, b.values, b.deletes = append(b.keys, key), append(b.values, ""), append(b.deletes, true)
+}
+
+func (kv boltKeyValue) BeginBatch() sorted.BatchMutation { return &boltBatch{} }
+
+func (kv boltKeyValue) CommitBatch(bm sorted.BatchMutation) error {
+	b, ok := bm.(*boltBatch)
+	if !ok {
+		return errors.Errorf("unexpected batch type %T", bm)
+	}
+	return kv.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		for i, k := range b.keys {
+			var err error
+			if b.deletes[i] {
+				err = bucket.Delete([]byte(k))
+			} else {
+				err = bucket.Put([]byte(k), []byte(b.values[i]))
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Find returns the keys between start and end (all after start if end is
+// empty), read in one transaction.
+func (kv boltKeyValue) Find(start, end string) sorted.Iterator {
+	it := &sliceIterator{i: -1}
+	it.err = kv.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltBucket).Cursor()
+		for k, v := c.Seek([]byte(start)); k != nil; k, v = c.Next() {
+			if end != "" && bytes.Compare(k, []byte(end)) >= 0 {
+				break
+			}
+			it.keys, it.values = append(it.keys, string(k)), append(it.values, string(v))
+		}
+		return nil
+	})
+	return it
+}
+
+func (kv boltKeyValue) Close() error { return kv.db.Close() }
+
+// sliceIterator is a sorted.Iterator of the keys and values read at once.
+type sliceIterator struct {
+	keys, values []string
+	i            int
+	err          error
+}
+
+func (it *sliceIterator) Next() bool {
+	if it.err != nil || it.i+1 >= len(it.keys) {
+		return false
+	}
+	it.i++
+	return true
+}
+
+func (it *sliceIterator) Key() string        { return it.keys[it.i] }
+func (it *sliceIterator) KeyBytes() []byte   { return []byte(it.keys[it.i]) }
+func (it *sliceIterator) Value() string      { return it.values[it.i] }
+func (it *sliceIterator) ValueBytes() []byte { return []byte(it.values[it.i]) }
+func (it *sliceIterator) Close() error       { return it.err }
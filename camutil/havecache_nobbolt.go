@@ -0,0 +1,30 @@
+// +build !with_bbolt
+
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package camutil
+
+import (
+	"github.com/pkg/errors"
+	"perkeep.org/pkg/sorted"
+)
+
+// newBoltKeyValue fails: bbolt is built in with the with_bbolt tag only,
+// so the default build needs no new dependency.
+func newBoltKeyValue(file string) (sorted.KeyValue, error) {
+	return nil, errors.New("the bbolt have cache is not built in (build with -tags with_bbolt)")
+}
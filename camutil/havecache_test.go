@@ -0,0 +1,48 @@
+package camutil
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"perkeep.org/pkg/blob"
+)
+
+func TestHaveCacheShared(t *testing.T) {
+	dir, err := ioutil.TempDir("", "camproxy-havecache-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the Uploaders of the server with different Options
+	hc1, err := newHaveCache("kv", dir, "http://localhost:3179", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hc2, err := newHaveCache("kv", dir, "http://localhost:3179", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	br := blob.RefFromString("shared")
+	hc1.NoteBlobExists(br, 6)
+	if err = hc1.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if size, ok := hc2.StatBlobCache(br); !ok || size != 6 {
+		t.Errorf("got %d, %t, wanted 6, true", size, ok)
+	}
+	if err = hc2.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// reopened after the last Close
+	hc3, err := newHaveCache("kv", dir, "http://localhost:3179", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hc3.Close()
+	if hc3 == hc1 {
+		t.Error("the closed have cache is reused")
+	}
+}
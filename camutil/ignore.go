@@ -0,0 +1,158 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package camutil
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// IgnoreFileName is the name of the ignore files honored by default.
+const IgnoreFileName = ".camignore"
+
+// ignoreRule is a line of an ignore file.
+type ignoreRule struct {
+	// base is the slash-separated directory of the ignore file, relative to the root.
+	base     string
+	pattern  string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+// IgnoreRules are the rules of gitignore-style ignore files: a pattern
+// without a slash matches the name in any subdirectory, a pattern with a
+// slash matches the path relative to the ignore file's directory, "**"
+// matches any number of directories, a trailing "/" matches directories only,
+// and a leading "!" re-includes. The last matching rule wins.
+type IgnoreRules []ignoreRule
+
+// ParseIgnore parses the ignore file of the base directory
+// (slash-separated, relative to the root).
+func ParseIgnore(r io.Reader, base string) (IgnoreRules, error) {
+	var rules IgnoreRules
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule := ignoreRule{base: base}
+		if strings.HasPrefix(line, "!") {
+			rule.negate, line = true, line[1:]
+		} else if strings.HasPrefix(line, "\\") {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly, line = true, strings.TrimRight(line, "/")
+		}
+		if strings.HasPrefix(line, "/") {
+			rule.anchored, line = true, strings.TrimLeft(line, "/")
+		} else if strings.Contains(line, "/") {
+			rule.anchored = true
+		}
+		if line == "" {
+			continue
+		}
+		rule.pattern = line
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+// ReadIgnoreFile appends the rules of the ignore file named name in the
+// directory dir (base relative to the root) to rules.
+// A missing file is not an error.
+func (rules IgnoreRules) ReadIgnoreFile(dir, base, name string) (IgnoreRules, error) {
+	if name == "" {
+		return rules, nil
+	}
+	fh, err := os.Open(filepath.Join(dir, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return rules, nil
+		}
+		return rules, err
+	}
+	defer fh.Close()
+	more, err := ParseIgnore(fh, base)
+	if err != nil {
+		return rules, err
+	}
+	// do not append to the parent's backing array
+	return append(rules[:len(rules):len(rules)], more...), nil
+}
+
+// LoadIgnoreRules reads the ignore files named name in root, and in the
+// directories between root and the file at rel (slash-separated).
+func LoadIgnoreRules(root, rel, name string) (IgnoreRules, error) {
+	rules, err := IgnoreRules(nil).ReadIgnoreFile(root, "", name)
+	if err != nil {
+		return rules, err
+	}
+	elems := strings.Split(rel, "/")
+	for i := 1; i < len(elems); i++ {
+		base := strings.Join(elems[:i], "/")
+		if rules, err = rules.ReadIgnoreFile(filepath.Join(root, filepath.FromSlash(base)), base, name); err != nil {
+			return rules, err
+		}
+	}
+	return rules, nil
+}
+
+// Ignored reports whether the file (or directory, iff isDir) at rel
+// (slash-separated, relative to the root), or any of its parent directories
+// is ignored.
+func (rules IgnoreRules) Ignored(rel string, isDir bool) bool {
+	if len(rules) == 0 {
+		return false
+	}
+	elems := strings.Split(rel, "/")
+	for i := 1; i < len(elems); i++ {
+		if rules.ignored(strings.Join(elems[:i], "/"), true) {
+			return true
+		}
+	}
+	return rules.ignored(rel, isDir)
+}
+
+func (rules IgnoreRules) ignored(rel string, isDir bool) bool {
+	ignored := false
+	for _, rule := range rules {
+		if rule.dirOnly && !isDir || ignored == !rule.negate {
+			continue
+		}
+		name := rel
+		if rule.base != "" {
+			if !strings.HasPrefix(rel, rule.base+"/") {
+				continue
+			}
+			name = rel[len(rule.base)+1:]
+		}
+		if !rule.anchored {
+			name = path.Base(name)
+		}
+		if matchGlob(rule.pattern, name) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
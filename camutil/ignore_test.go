@@ -0,0 +1,48 @@
+package camutil
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIgnoreRules(t *testing.T) {
+	rules, err := ParseIgnore(strings.NewReader(`# comment
+*.tmp
+build/
+/TODO
+docs/**/*.pdf
+!keep.tmp
+`), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := ParseIgnore(strings.NewReader("*.log\n"), "sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules = append(rules, sub...)
+	for _, tc := range []struct {
+		rel     string
+		isDir   bool
+		ignored bool
+	}{
+		{"a.tmp", false, true},
+		{"x/a.tmp", false, true},
+		{"keep.tmp", false, false},
+		{"build", true, true},
+		{"build", false, false},
+		{"build/a.go", false, true},
+		{"TODO", false, true},
+		{"x/TODO", false, false},
+		{"docs/a/b/c.pdf", false, true},
+		{"docs/c.pdf", false, true},
+		{"x/docs/c.pdf", false, false},
+		{"a.log", false, false},
+		{"sub/a.log", false, true},
+		{"sub/x/a.log", false, true},
+	} {
+		if got := rules.Ignored(tc.rel, tc.isDir); got != tc.ignored {
+			t.Errorf("Ignored(%q, %t) = %t, wanted %t", tc.rel, tc.isDir, got, tc.ignored)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package camutil
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/search"
+	"perkeep.org/pkg/types"
+	"perkeep.org/pkg/types/camtypes"
+	"rsc.io/pdf"
+)
+
+// Metadata is the metadata of a file: what the server's index extracted
+// (EXIF for images, ID3 for audio), and the Info dictionary of PDFs.
+type Metadata struct {
+	Ref      blob.Ref            `json:"blobRef"`
+	FileName string              `json:"fileName,omitempty"`
+	Size     int64               `json:"size"`
+	MIMEType string              `json:"mimeType,omitempty"`
+	Time     *types.Time3339     `json:"time,omitempty"`
+	ModTime  *types.Time3339     `json:"modTime,omitempty"`
+	Image    *camtypes.ImageInfo `json:"image,omitempty"`
+	Location *camtypes.Location  `json:"location,omitempty"`
+	Tags     map[string]string   `json:"tags,omitempty"`
+	PDF      map[string]string   `json:"pdf,omitempty"`
+}
+
+// Metadata returns the metadata of the file (or of the camliContent of the permanode).
+func (down *Downloader) Metadata(ctx context.Context, br blob.Ref) (Metadata, error) {
+	var md Metadata
+	res, err := down.cl.Describe(ctx, &search.DescribeRequest{BlobRef: br, Depth: 1})
+	if err != nil {
+		return md, withKind(ErrUpstreamUnavailable, errors.Wrapf(err, "describe %s", br))
+	}
+	db := res.Meta[br.String()]
+	if db != nil && db.Permanode != nil {
+		db = nil
+		if content, ok := blob.Parse(res.Meta[br.String()].Permanode.Attr.Get("camliContent")); ok {
+			db = res.Meta[content.String()]
+		}
+	}
+	if db == nil {
+		return md, withKind(ErrNotFound, errors.Errorf("no description of %s", br))
+	}
+	if db.File == nil {
+		return md, withKind(ErrSchema, errors.Errorf("%s is a %q, not a file", db.BlobRef, db.CamliType))
+	}
+	md = Metadata{
+		Ref:      db.BlobRef,
+		FileName: db.File.FileName,
+		Size:     db.File.Size,
+		MIMEType: db.File.MIMEType,
+		Time:     db.File.Time,
+		ModTime:  db.File.ModTime,
+		Image:    db.Image,
+		Location: db.Location,
+		Tags:     db.MediaTags,
+	}
+	if md.MIMEType == "application/pdf" {
+		if md.PDF, err = down.pdfInfo(ctx, md.Ref); err != nil {
+			Log("msg", "pdf info", "ref", md.Ref, "error", err)
+		}
+	}
+	return md, nil
+}
+
+// pdfInfo returns the Info dictionary and the number of pages of the PDF file.
+func (down *Downloader) pdfInfo(ctx context.Context, br blob.Ref) (info map[string]string, err error) {
+	fr, err := openFile(ctx, down.fetcher(ctx), br)
+	if err != nil {
+		return nil, err
+	}
+	defer fr.Close()
+	// rsc.io/pdf panics on some malformed documents
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.Errorf("parse pdf %s: %v", br, r)
+		}
+	}()
+	r, err := pdf.NewReader(fr, fr.Size())
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse pdf %s", br)
+	}
+	info = map[string]string{"Pages": strconv.Itoa(r.NumPage())}
+	v := r.Trailer().Key("Info")
+	for _, k := range v.Keys() {
+		if s := v.Key(k).Text(); s != "" {
+			info[k] = s
+		}
+	}
+	return info, nil
+}
@@ -19,6 +19,10 @@ package camutil
 import (
 	"bytes"
 	"io"
+	"mime"
+	"path"
+	"strings"
+	"sync/atomic"
 
 	"github.com/golang/groupcache/lru"
 	"gopkg.in/h2non/filetype.v1"
@@ -29,6 +33,9 @@ import (
 // DefaultMaxMemMimeCacheSize is the maximum size of in-memory mime cache
 var DefaultMaxMemMimeCacheSize = 1024
 
+// MIMESniffSize is the number of bytes MIMETypeFromReader sniffs.
+var MIMESniffSize int64 = 1024
+
 // MIMETypeFromReader takes a reader, sniffs the beginning of it,
 // and returns the mime (if sniffed, else "") and a new reader
 // that's the concatenation of the bytes sniffed and the remaining
@@ -38,7 +45,7 @@ func MIMETypeFromReader(r io.Reader) (mime string, reader io.Reader) {
 		return "", nil
 	}
 	var buf bytes.Buffer
-	_, err := io.Copy(&buf, io.LimitReader(r, 1024))
+	_, err := io.Copy(&buf, io.LimitReader(r, MIMESniffSize))
 	mt, _ := filetype.Match(buf.Bytes())
 	mime = mt.MIME.Type + "/" + mt.MIME.Subtype
 	if err != nil {
@@ -47,10 +54,57 @@ func MIMETypeFromReader(r io.Reader) (mime string, reader io.Reader) {
 	return mime, io.MultiReader(bytes.NewReader(buf.Bytes()), r)
 }
 
+// extMIMETypes are the MIME types of the extensions of the formats
+// the magic numbers cannot tell, before the system's table (which may lack them).
+var extMIMETypes = map[string]string{
+	".csv":  "text/csv; charset=utf-8",
+	".tsv":  "text/tab-separated-values; charset=utf-8",
+	".txt":  "text/plain; charset=utf-8",
+	".log":  "text/plain; charset=utf-8",
+	".md":   "text/markdown; charset=utf-8",
+	".srt":  "application/x-subrip",
+	".vtt":  "text/vtt; charset=utf-8",
+	".ics":  "text/calendar; charset=utf-8",
+	".vcf":  "text/vcard; charset=utf-8",
+	".yaml": "application/yaml",
+	".yml":  "application/yaml",
+	".toml": "application/toml",
+	".json": "application/json",
+	".gpx":  "application/gpx+xml",
+	".kml":  "application/vnd.google-earth.kml+xml",
+}
+
+// MIMETypeByExtension returns the MIME type of the extension of the file name,
+// or "" if it is unknown.
+func MIMETypeByExtension(name string) string {
+	ext := strings.ToLower(path.Ext(name))
+	if ext == "" {
+		return ""
+	}
+	if m, ok := extMIMETypes[ext]; ok {
+		return m
+	}
+	return mime.TypeByExtension(ext)
+}
+
+// SniffMIMEType returns the MIME type sniffed from the head of the file,
+// or if that is inconclusive, the one of the extension of the file name,
+// or application/octet-stream.
+func SniffMIMEType(head []byte, name string) string {
+	if m := MatchMime("", head); m != "/" && m != "application/octet-stream" {
+		return m
+	}
+	if m := MIMETypeByExtension(name); m != "" {
+		return m
+	}
+	return "application/octet-stream"
+}
+
 // MimeCache is the in-memory (LRU) and disk-based (kv) cache of mime types
 type MimeCache struct {
-	mem *lru.Cache
-	db  sorted.KeyValue
+	mem       *lru.Cache
+	db        sorted.KeyValue
+	evictions int64
 }
 
 // NewMimeCache creates a new mime cache - in-memory + on-disk (persistent)
@@ -60,6 +114,7 @@ func NewMimeCache(filename string, maxMemCacheSize int) *MimeCache {
 		maxMemCacheSize = DefaultMaxMemMimeCacheSize
 	}
 	mc.mem = lru.New(maxMemCacheSize)
+	mc.mem.OnEvicted = func(lru.Key, interface{}) { atomic.AddInt64(&mc.evictions, 1) }
 
 	var err error
 	if mc.db, err = kvfile.NewStorage(filename); err != nil {
@@ -77,6 +132,32 @@ func (mc *MimeCache) Close() error {
 	return nil
 }
 
+// Len returns the number of the mime types cached in memory.
+func (mc *MimeCache) Len() int {
+	return mc.mem.Len()
+}
+
+// MimeCacheStats are the counters of a MimeCache.
+type MimeCacheStats struct {
+	MemEntries  int   `json:"memEntries"`
+	DiskEntries int   `json:"diskEntries"`
+	Evictions   int64 `json:"evictions"`
+}
+
+// Stats returns the number of entries in memory and on disk, and
+// the number of entries evicted from memory.
+func (mc *MimeCache) Stats() (MimeCacheStats, error) {
+	st := MimeCacheStats{MemEntries: mc.mem.Len(), Evictions: atomic.LoadInt64(&mc.evictions)}
+	if mc.db == nil {
+		return st, nil
+	}
+	it := mc.db.Find("", "")
+	for it.Next() {
+		st.DiskEntries++
+	}
+	return st, it.Close()
+}
+
 // Get returns the stored mimetype for the key - empty string if not found
 func (mc *MimeCache) Get(key string) string {
 	if mti, ok := mc.mem.Get(key); ok {
@@ -103,7 +184,7 @@ func (mc *MimeCache) Set(key, mime string) {
 	}
 }
 
-// MatchMime checks mime from the first 1024 bytes
+// MatchMime checks mime from the first bytes (see MIMESniffSize)
 func MatchMime(_ string, data []byte) string {
 	mt, _ := filetype.Match(data)
 	return mt.MIME.Type + "/" + mt.MIME.Subtype
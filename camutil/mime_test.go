@@ -0,0 +1,20 @@
+package camutil
+
+import "testing"
+
+func TestSniffMIMEType(t *testing.T) {
+	for i, tc := range []struct {
+		head       string
+		name, want string
+	}{
+		{"\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR", "x.csv", "image/png"},
+		{"a,b,c\n1,2,3\n", "data.CSV", "text/csv; charset=utf-8"},
+		{"1\n00:00:01,000 --> 00:00:02,000\nhello\n", "movie.srt", "application/x-subrip"},
+		{"a,b,c\n", "noext", "application/octet-stream"},
+		{"a,b,c\n", "", "application/octet-stream"},
+	} {
+		if got := SniffMIMEType([]byte(tc.head), tc.name); got != tc.want {
+			t.Errorf("%d. %q: got %q, wanted %q", i, tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package camutil
+
+import (
+	"context"
+	"io"
+
+	"github.com/pkg/errors"
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/blobserver"
+	"perkeep.org/pkg/blobserver/localdisk"
+	"perkeep.org/pkg/cacher"
+)
+
+// MirrorDir is the directory of the local blob store which persists every
+// fetched blob (read-through mirror), if not empty.
+//
+// Deprecated: use Options.MirrorDir.
+var MirrorDir string
+
+// mirrorFetcher fetches from the local store first, then from the upstream,
+// saving the fetched blob into the local store.
+// As blobs are immutable, the local copy is always good to serve,
+// even when the upstream is unreachable.
+type mirrorFetcher struct {
+	local    blobserver.Storage
+	upstream blob.Fetcher
+}
+
+func (mf mirrorFetcher) Fetch(ctx context.Context, br blob.Ref) (io.ReadCloser, uint32, error) {
+	if rc, size, err := mf.local.Fetch(ctx, br); err == nil {
+		return rc, size, nil
+	}
+	rc, _, err := mf.upstream.Fetch(ctx, br)
+	if err != nil {
+		return nil, 0, err
+	}
+	sb := NewSpillBuffer()
+	_, err = io.Copy(sb, rc)
+	rc.Close()
+	if err != nil {
+		sb.Close()
+		return nil, 0, errors.Wrapf(err, "read %s", br)
+	}
+	if _, err = mf.local.ReceiveBlob(ctx, br, sb.Reader()); err != nil {
+		Log("msg", "mirror", "blob", br, "error", err)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{sb.Reader(), sb}, uint32(sb.Len()), nil
+}
+
+type cacheOnlyKey struct{}
+
+// WithCacheOnly returns a context which makes the Downloader methods called
+// with it serve only the blobs of the mirror or the disk cache, without
+// reaching the server; the others are ErrNotCached.
+func WithCacheOnly(ctx context.Context) context.Context {
+	return context.WithValue(ctx, cacheOnlyKey{}, true)
+}
+
+func cacheOnly(ctx context.Context) bool {
+	only, _ := ctx.Value(cacheOnlyKey{}).(bool)
+	return only
+}
+
+// localFetcher returns the fetcher of the mirrored or cached blobs.
+func (down *Downloader) localFetcher() blob.Fetcher {
+	switch f := down.Fetcher.(type) {
+	case mirrorFetcher:
+		return cachedFetcher{local: f.local}
+	case *cacher.DiskCache:
+		down.localOnce.Do(func() {
+			local, err := localdisk.New(f.Root)
+			if err != nil {
+				Log("msg", "open disk cache", "dir", f.Root, "error", err)
+				return
+			}
+			down.local = local
+		})
+		if down.local != nil {
+			return cachedFetcher{local: down.local}
+		}
+	}
+	return cachedFetcher{}
+}
+
+// cachedFetcher fetches from the local store only.
+type cachedFetcher struct {
+	local blob.Fetcher
+}
+
+func (cf cachedFetcher) Fetch(ctx context.Context, br blob.Ref) (io.ReadCloser, uint32, error) {
+	if cf.local != nil {
+		if rc, size, err := cf.local.Fetch(ctx, br); err == nil {
+			return rc, size, nil
+		}
+	}
+	return nil, 0, withKind(ErrNotCached, errors.Errorf("%s is not cached", br))
+}
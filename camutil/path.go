@@ -0,0 +1,156 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package camutil
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/schema"
+	"perkeep.org/pkg/search"
+)
+
+// ResolvePath resolves the slash-separated path under root, and returns the
+// file or directory blob at its end.
+//
+// A permanode's camliPath:<name> attribute leads to the next element,
+// a permanode without it stands for its camliContent, and the entries of a
+// directory are matched by their file name.
+func (down *Downloader) ResolvePath(ctx context.Context, root blob.Ref, p string) (*schema.Blob, error) {
+	cfs := newCamliFS(ctx, down.fetcher(ctx))
+	cur, err := cfs.schemaBlob(root)
+	if err != nil {
+		return nil, err
+	}
+	for _, elt := range strings.Split(p, "/") {
+		if elt == "" || elt == "." {
+			continue
+		}
+		if cur.Type() == "permanode" {
+			attr, err := down.PermanodeAttr(ctx, cur.BlobRef())
+			if err != nil {
+				return nil, err
+			}
+			if next, ok := blob.Parse(attr.Get("camliPath:" + elt)); ok {
+				if cur, err = cfs.schemaBlob(next); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if cur, err = permanodeContent(cfs, cur, attr); err != nil {
+				return nil, err
+			}
+		}
+		if cur.Type() != "directory" {
+			return nil, withKind(ErrNotFound, errors.Errorf("%q: %s is a %q, not a directory", p, cur.BlobRef(), cur.Type()))
+		}
+		entries, err := cfs.entries(cur)
+		if err != nil {
+			return nil, err
+		}
+		var next *schema.Blob
+		for _, e := range entries {
+			if e.FileName() == elt {
+				next = e
+				break
+			}
+		}
+		if next == nil {
+			return nil, withKind(ErrNotFound, errors.Errorf("%q: no %q in %s", p, elt, cur.BlobRef()))
+		}
+		cur = next
+	}
+	if cur.Type() == "permanode" {
+		attr, err := down.PermanodeAttr(ctx, cur.BlobRef())
+		if err != nil {
+			return nil, err
+		}
+		if cur, err = permanodeContent(cfs, cur, attr); err != nil {
+			return nil, err
+		}
+	}
+	if t := cur.Type(); t != "file" && t != "directory" {
+		return nil, withKind(ErrSchema, errors.Errorf("%q: %s is a %q, not a file or directory", p, cur.BlobRef(), t))
+	}
+	return cur, nil
+}
+
+// PermanodeAttr returns the current attributes of the permanode.
+func (down *Downloader) PermanodeAttr(ctx context.Context, br blob.Ref) (url.Values, error) {
+	res, err := down.cl.Describe(ctx, &search.DescribeRequest{BlobRef: br})
+	if err != nil {
+		return nil, withKind(ErrUpstreamUnavailable, errors.Wrapf(err, "describe %s", br))
+	}
+	db := res.Meta[br.String()]
+	if db == nil || db.Permanode == nil {
+		return nil, withKind(ErrNotFound, errors.Errorf("no permanode %s", br))
+	}
+	return db.Permanode.Attr, nil
+}
+
+// PermanodeClaims returns the refs of the claims of the permanode.
+func (down *Downloader) PermanodeClaims(ctx context.Context, br blob.Ref) ([]blob.Ref, error) {
+	res, err := down.cl.GetClaims(ctx, &search.ClaimsRequest{Permanode: br})
+	if err != nil {
+		return nil, withKind(ErrUpstreamUnavailable, errors.Wrapf(err, "claims of %s", br))
+	}
+	refs := make([]blob.Ref, 0, len(res.Claims))
+	for _, c := range res.Claims {
+		refs = append(refs, c.BlobRef)
+	}
+	return refs, nil
+}
+
+// maxPermanodeSize is the size limit of the permanodes read by PermanodeContent:
+// a permanode is a small signed JSON, so the bigger blobs are not.
+const maxPermanodeSize = 16 << 10
+
+// PermanodeContent returns the current camliContent of br, if it is a
+// permanode - and br itself (with false), if it is not.
+func (down *Downloader) PermanodeContent(ctx context.Context, br blob.Ref) (blob.Ref, bool, error) {
+	rc, err := fetch(ctx, down.fetcher(ctx), br)
+	if err != nil {
+		return br, false, err
+	}
+	b, err := schema.BlobFromReader(br, io.LimitReader(rc, maxPermanodeSize))
+	rc.Close()
+	if err != nil || b.Type() != "permanode" {
+		return br, false, nil
+	}
+	attr, err := down.PermanodeAttr(ctx, br)
+	if err != nil {
+		return br, true, err
+	}
+	content, ok := blob.Parse(attr.Get("camliContent"))
+	if !ok {
+		return br, true, withKind(ErrNotFound, errors.Errorf("permanode %s has no camliContent", br))
+	}
+	return content, true, nil
+}
+
+// permanodeContent returns the camliContent blob of the permanode.
+func permanodeContent(cfs *camliFS, perma *schema.Blob, attr url.Values) (*schema.Blob, error) {
+	content, ok := blob.Parse(attr.Get("camliContent"))
+	if !ok {
+		return nil, withKind(ErrNotFound, errors.Errorf("permanode %s has no camliContent", perma.BlobRef()))
+	}
+	return cfs.schemaBlob(content)
+}
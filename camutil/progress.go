@@ -0,0 +1,111 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package camutil
+
+import (
+	"context"
+	"io"
+
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/blobserver"
+)
+
+// Progress receives the status of an upload or download.
+// The methods may be called concurrently.
+type Progress interface {
+	// File is called when the transfer of the named file starts
+	// (size is -1 if unknown).
+	File(name string, size int64)
+	// Bytes is called with the number of the bytes transferred since the last call.
+	Bytes(n int64)
+	// Chunk is called when a blob is transferred, or skipped as it's already there.
+	Chunk(skipped bool)
+}
+
+type progressReader struct {
+	io.Reader
+	p Progress
+}
+
+func (r progressReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if n > 0 {
+		r.p.Bytes(int64(n))
+	}
+	return n, err
+}
+
+// progressFetcher reports the fetched blobs.
+type progressFetcher struct {
+	blob.Fetcher
+	p Progress
+}
+
+func (f progressFetcher) Fetch(ctx context.Context, br blob.Ref) (io.ReadCloser, uint32, error) {
+	rc, size, err := f.Fetcher.Fetch(ctx, br)
+	if err != nil {
+		return rc, size, err
+	}
+	f.p.Chunk(false)
+	return struct {
+		io.Reader
+		io.Closer
+	}{progressReader{Reader: rc, p: f.p}, rc}, size, nil
+}
+
+// progressReceiver reports the received blobs, and the ones found by stat
+// (which won't be uploaded).
+type progressReceiver struct {
+	blobserver.StatReceiver
+	p Progress
+}
+
+func (r progressReceiver) StatBlobs(ctx context.Context, blobs []blob.Ref, fn func(blob.SizedRef) error) error {
+	return r.StatReceiver.StatBlobs(ctx, blobs, func(sb blob.SizedRef) error {
+		r.p.Chunk(true)
+		return fn(sb)
+	})
+}
+
+func (r progressReceiver) ReceiveBlob(ctx context.Context, br blob.Ref, source io.Reader) (blob.SizedRef, error) {
+	sb, err := r.StatReceiver.ReceiveBlob(ctx, br, source)
+	if err == nil {
+		r.p.Chunk(false)
+	}
+	return sb, err
+}
+
+// fetcher returns the Fetcher of the Downloader, reporting to its Progress
+// (and fetching only the local blobs, if ctx is WithCacheOnly).
+func (down *Downloader) fetcher(ctx context.Context) blob.Fetcher {
+	f := down.Fetcher
+	if cacheOnly(ctx) {
+		f = down.localFetcher()
+	}
+	if p := down.opts.Progress; p != nil {
+		return progressFetcher{Fetcher: f, p: p}
+	}
+	return f
+}
+
+// receiver returns the StatReceiver of the Uploader, reporting to its Progress.
+func (u *Uploader) receiver(ctx context.Context) blobserver.StatReceiver {
+	if p := u.opts.Progress; p != nil {
+		return progressReceiver{StatReceiver: u.StatReceiver, p: p}
+	}
+	return u.StatReceiver
+}
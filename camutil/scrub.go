@@ -0,0 +1,99 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package camutil
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"perkeep.org/pkg/blob"
+)
+
+// ScrubProblem is a missing or corrupt blob found by Scrub.
+type ScrubProblem struct {
+	Ref blob.Ref
+	// Parent is the schema blob referring to Ref (invalid for the roots).
+	Parent  blob.Ref
+	Problem string // missing or corrupt
+}
+
+// ScrubStats holds the counters of a Scrub.
+type ScrubStats struct {
+	Checked, Missing, Corrupt int
+	Bytes                     int64
+}
+
+// Scrub fetches every blob reachable from the roots (file parts, directory
+// entries, static-set members), and checks its contents against its hash,
+// waiting delay after each blob. The problems are reported to fn.
+//
+// Other fetch errors (e.g. the server is unavailable) stop the scrub.
+func Scrub(ctx context.Context, src blob.Fetcher, roots []blob.Ref, delay time.Duration, fn func(ScrubProblem)) (ScrubStats, error) {
+	var st ScrubStats
+	type item struct{ ref, parent blob.Ref }
+	seen := make(map[blob.Ref]struct{})
+	queue := make([]item, 0, len(roots))
+	for _, br := range roots {
+		queue = append(queue, item{ref: br})
+	}
+	for len(queue) > 0 {
+		it := queue[0]
+		queue = queue[1:]
+		if _, ok := seen[it.ref]; ok {
+			continue
+		}
+		seen[it.ref] = struct{}{}
+		if delay > 0 {
+			select {
+			case <-ctx.Done():
+				return st, ctx.Err()
+			case <-time.After(delay):
+			}
+		}
+
+		st.Checked++
+		rc, err := fetch(ctx, src, it.ref)
+		if err != nil {
+			if errors.Cause(err) != os.ErrNotExist {
+				return st, err
+			}
+			st.Missing++
+			fn(ScrubProblem{Ref: it.ref, Parent: it.parent, Problem: "missing"})
+			continue
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return st, errors.Wrapf(err, "read %s", it.ref)
+		}
+		st.Bytes += int64(len(data))
+		h := it.ref.Hash()
+		h.Write(data)
+		if !it.ref.HashMatches(h) {
+			st.Corrupt++
+			fn(ScrubProblem{Ref: it.ref, Parent: it.parent, Problem: "corrupt"})
+			continue
+		}
+		for _, child := range schemaChildren(it.ref, data) {
+			queue = append(queue, item{ref: child, parent: it.ref})
+		}
+	}
+	return st, nil
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package camutil
+
+import (
+	"context"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/search"
+)
+
+// Permanode is a permanode with its current attributes.
+type Permanode struct {
+	Ref     blob.Ref   `json:"permanode"`
+	Attr    url.Values `json:"attr,omitempty"`
+	ModTime time.Time  `json:"modtime,omitempty"`
+}
+
+// PermanodePage is a page of Permanodes. Continue is the token for
+// the next page, empty at the end.
+type PermanodePage struct {
+	Permanodes []Permanode `json:"permanodes"`
+	Continue   string      `json:"continue,omitempty"`
+}
+
+// Permanodes returns a page of at most limit permanodes (of the server's owner),
+// the last modified first, starting at the cont token from the previous page.
+func (down *Downloader) Permanodes(ctx context.Context, limit int, cont string) (PermanodePage, error) {
+	return down.queryPermanodes(ctx, &search.PermanodeConstraint{SkipHidden: true}, limit, cont)
+}
+
+// Lookup returns a page of the permanodes having the attr attribute with value
+// (with any value if value is empty), like Permanodes.
+func (down *Downloader) Lookup(ctx context.Context, attr, value string, limit int, cont string) (PermanodePage, error) {
+	if attr == "" {
+		return PermanodePage{}, errors.New("attr is needed")
+	}
+	return down.queryPermanodes(ctx, &search.PermanodeConstraint{Attr: attr, Value: value, SkipHidden: true}, limit, cont)
+}
+
+func (down *Downloader) queryPermanodes(ctx context.Context, pc *search.PermanodeConstraint, limit int, cont string) (PermanodePage, error) {
+	var page PermanodePage
+	res, err := down.cl.Query(ctx, &search.SearchQuery{
+		Constraint: &search.Constraint{Permanode: pc},
+		Limit:      limit,
+		Sort:       search.LastModifiedDesc,
+		Continue:   cont,
+		Describe:   &search.DescribeRequest{},
+	})
+	if err != nil {
+		return page, withKind(ErrUpstreamUnavailable, errors.Wrap(err, "query permanodes"))
+	}
+	page.Continue = res.Continue
+	page.Permanodes = make([]Permanode, 0, len(res.Blobs))
+	for _, b := range res.Blobs {
+		p := Permanode{Ref: b.Blob}
+		if res.Describe != nil {
+			if db := res.Describe.Meta[b.Blob.String()]; db != nil && db.Permanode != nil {
+				p.Attr, p.ModTime = db.Permanode.Attr, db.Permanode.ModTime
+			}
+		}
+		page.Permanodes = append(page.Permanodes, p)
+	}
+	return page, nil
+}
@@ -0,0 +1,186 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package camutil
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/client"
+	"perkeep.org/pkg/schema"
+)
+
+// SignerOptions select the identity signing the claims (permanodes, attributes,
+// deletes) of the Uploaders, instead of the one of the client config.
+type SignerOptions struct {
+	// SecretRing is the (armored or binary) GPG secret keyring file.
+	SecretRing string
+	// SecretRingCmd is a command printing the secret keyring,
+	// for loading it from a secrets manager.
+	SecretRingCmd string
+	// KeyID is the hex ID of the key to sign with - the first secret key if empty.
+	KeyID string
+}
+
+// IsZero reports whether no signer is configured.
+func (so SignerOptions) IsZero() bool { return so.SecretRing == "" && so.SecretRingCmd == "" }
+
+// Validate checks the options.
+func (so SignerOptions) Validate() error {
+	if so.SecretRingCmd != "" && strings.TrimSpace(so.SecretRingCmd) == "" {
+		return errors.New("the secret keyring command is blank")
+	}
+	if so.SecretRing != "" && so.SecretRingCmd != "" {
+		return errors.New("both a secret keyring and a secret keyring command is given")
+	}
+	return nil
+}
+
+// load loads the configured secret key, and returns its signer and armored
+// public key, and the keyring itself.
+func (so SignerOptions) load(ctx context.Context) (*schema.Signer, string, []byte, error) {
+	if err := so.Validate(); err != nil {
+		return nil, "", nil, err
+	}
+	var b []byte
+	var err error
+	if so.SecretRingCmd != "" {
+		args := strings.Fields(so.SecretRingCmd)
+		if b, err = exec.CommandContext(ctx, args[0], args[1:]...).Output(); err != nil {
+			return nil, "", nil, errors.Wrapf(err, "run %q", so.SecretRingCmd)
+		}
+	} else if b, err = ioutil.ReadFile(so.SecretRing); err != nil {
+		return nil, "", nil, errors.Wrapf(err, "read %q", so.SecretRing)
+	}
+	var el openpgp.EntityList
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("-----BEGIN")) {
+		el, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(b))
+	} else {
+		el, err = openpgp.ReadKeyRing(bytes.NewReader(b))
+	}
+	if err != nil {
+		return nil, "", nil, errors.Wrap(err, "read secret keyring")
+	}
+	for _, e := range el {
+		if e.PrivateKey == nil {
+			continue
+		}
+		if so.KeyID != "" &&
+			!strings.EqualFold(e.PrimaryKey.KeyIdString(), so.KeyID) &&
+			!strings.EqualFold(e.PrimaryKey.KeyIdShortString(), so.KeyID) {
+			continue
+		}
+		if e.PrivateKey.Encrypted {
+			return nil, "", nil, errors.Errorf("the secret key %s is encrypted", e.PrimaryKey.KeyIdString())
+		}
+		signer, pubKey, err := newSigner(e)
+		return signer, pubKey, b, err
+	}
+	return nil, "", nil, errors.Errorf("no secret key %q in the keyring", so.KeyID)
+}
+
+// writeRing writes the keyring (printed by SecretRingCmd) into a temp file for
+// pk-put, readable only by the owner.
+func writeRing(ring []byte) (string, error) {
+	fh, err := ioutil.TempFile("", "camproxy-secring-")
+	if err != nil {
+		return "", err
+	}
+	if _, err = fh.Write(ring); err == nil {
+		err = fh.Close()
+	} else {
+		fh.Close()
+	}
+	if err != nil {
+		os.Remove(fh.Name())
+		return "", err
+	}
+	return fh.Name(), nil
+}
+
+// newSigner returns the signer of the entity, and its armored public key.
+func newSigner(e *openpgp.Entity) (*schema.Signer, string, error) {
+	var buf bytes.Buffer
+	hsh := blob.RefFromString("").Hash()
+	w, err := armor.Encode(io.MultiWriter(&buf, hsh), "PGP PUBLIC KEY BLOCK", nil)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "armor")
+	}
+	if err = e.PrimaryKey.Serialize(w); err != nil {
+		return nil, "", errors.Wrap(err, "serialize public key")
+	}
+	if err = w.Close(); err != nil {
+		return nil, "", errors.Wrap(err, "armor")
+	}
+	pubKeyRef := blob.RefFromHash(hsh)
+	signer, err := schema.NewSigner(pubKeyRef, bytes.NewReader(buf.Bytes()), e)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "new signer %s", pubKeyRef)
+	}
+	return signer, buf.String(), nil
+}
+
+// signAndUpload signs the claim - with the Uploader's own signer, if it has one,
+// else with the client's -, and uploads it.
+func (u *Uploader) signAndUpload(ctx context.Context, bb *schema.Builder) (blob.Ref, error) {
+	if !u.ownSigner {
+		pRes, err := u.Client.UploadAndSignBlob(ctx, bb)
+		if err != nil {
+			return blob.Ref{}, err
+		}
+		return pRes.BlobRef, nil
+	}
+	signed, err := bb.Sign(ctx, u.Signer)
+	if err != nil {
+		return blob.Ref{}, errors.Wrap(err, "sign")
+	}
+	return u.uploadString(ctx, signed)
+}
+
+// plannedPermanode uploads the planned permanode of the key, signed like signAndUpload.
+func (u *Uploader) plannedPermanode(ctx context.Context, key string, sigTime time.Time) (blob.Ref, error) {
+	if !u.ownSigner {
+		pRes, err := u.Client.UploadPlannedPermanode(ctx, key, sigTime)
+		if err != nil {
+			return blob.Ref{}, err
+		}
+		return pRes.BlobRef, nil
+	}
+	signed, err := schema.NewPlannedPermanode(key).SignAt(ctx, u.Signer, sigTime)
+	if err != nil {
+		return blob.Ref{}, errors.Wrap(err, "sign")
+	}
+	return u.uploadString(ctx, signed)
+}
+
+func (u *Uploader) uploadString(ctx context.Context, s string) (blob.Ref, error) {
+	pRes, err := u.Client.Upload(ctx, client.NewUploadHandleFromString(s))
+	if err != nil {
+		return blob.Ref{}, err
+	}
+	return pRes.BlobRef, nil
+}
@@ -0,0 +1,151 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package camutil
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+)
+
+// MemoryBudget accounts the memory of the buffers, globally.
+type MemoryBudget struct {
+	max, used int64
+}
+
+// NewMemoryBudget returns a budget of max bytes (unlimited if max <= 0).
+func NewMemoryBudget(max int64) *MemoryBudget { return &MemoryBudget{max: max} }
+
+// Buffers is the memory budget of the SpillBuffers.
+var Buffers = NewMemoryBudget(256 << 20)
+
+// SetMax sets the size of the budget.
+func (mb *MemoryBudget) SetMax(max int64) { atomic.StoreInt64(&mb.max, max) }
+
+// Reserve reserves n bytes, iff they fit into the budget.
+func (mb *MemoryBudget) Reserve(n int64) bool {
+	for {
+		used, max := atomic.LoadInt64(&mb.used), atomic.LoadInt64(&mb.max)
+		if max > 0 && used+n > max {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&mb.used, used, used+n) {
+			return true
+		}
+	}
+}
+
+// Release releases the reserved n bytes.
+func (mb *MemoryBudget) Release(n int64) { atomic.AddInt64(&mb.used, -n) }
+
+// Used returns the number of the reserved bytes.
+func (mb *MemoryBudget) Used() int64 { return atomic.LoadInt64(&mb.used) }
+
+// DefaultSpillThreshold is the size above which the SpillBuffers spill to disk.
+var DefaultSpillThreshold int64 = 1 << 20
+
+// SpillDir is the directory the SpillBuffers spill to, the temp dir if empty.
+var SpillDir string
+
+// SpillBuffer is a buffer which keeps the first DefaultSpillThreshold bytes
+// in memory, as long as the Buffers budget allows, and spills everything to a
+// temp file above that.
+//
+// It is to be written first, then read with (any number of) Readers, and
+// then closed.
+type SpillBuffer struct {
+	threshold int64
+	mem       []byte
+	reserved  int64
+	file      *os.File
+	size      int64
+}
+
+// NewSpillBuffer returns an empty SpillBuffer.
+func NewSpillBuffer() *SpillBuffer {
+	return &SpillBuffer{threshold: DefaultSpillThreshold}
+}
+
+// Write implements io.Writer.
+func (sb *SpillBuffer) Write(p []byte) (int, error) {
+	if sb.file == nil {
+		n := int64(len(sb.mem) + len(p))
+		if n <= sb.threshold && (n <= sb.reserved || Buffers.Reserve(n-sb.reserved)) {
+			if n > sb.reserved {
+				sb.reserved = n
+			}
+			sb.mem = append(sb.mem, p...)
+			sb.size += int64(len(p))
+			return len(p), nil
+		}
+		if err := sb.spill(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := sb.file.Write(p)
+	sb.size += int64(n)
+	return n, err
+}
+
+// spill moves the contents into a temp file.
+func (sb *SpillBuffer) spill() error {
+	fh, err := ioutil.TempFile(SpillDir, "camproxy-spill-")
+	if err != nil {
+		return err
+	}
+	if _, err = fh.Write(sb.mem); err != nil {
+		fh.Close()
+		os.Remove(fh.Name())
+		return err
+	}
+	sb.file = fh
+	sb.mem = nil
+	Buffers.Release(sb.reserved)
+	sb.reserved = 0
+	return nil
+}
+
+// Len returns the number of bytes written.
+func (sb *SpillBuffer) Len() int64 { return sb.size }
+
+// Spilled reports whether the contents are on disk.
+func (sb *SpillBuffer) Spilled() bool { return sb.file != nil }
+
+// Reader returns a new reader of the contents.
+func (sb *SpillBuffer) Reader() io.Reader {
+	if sb.file != nil {
+		return io.NewSectionReader(sb.file, 0, sb.size)
+	}
+	return bytes.NewReader(sb.mem)
+}
+
+// Close releases the memory, and removes the temp file.
+func (sb *SpillBuffer) Close() error {
+	Buffers.Release(sb.reserved)
+	sb.reserved, sb.mem = 0, nil
+	if sb.file == nil {
+		return nil
+	}
+	err := sb.file.Close()
+	if rmErr := os.Remove(sb.file.Name()); rmErr != nil && err == nil {
+		err = rmErr
+	}
+	sb.file = nil
+	return err
+}
@@ -0,0 +1,42 @@
+package camutil
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestSpillBuffer(t *testing.T) {
+	defer func(threshold int64, budget *MemoryBudget) {
+		DefaultSpillThreshold, Buffers = threshold, budget
+	}(DefaultSpillThreshold, Buffers)
+	DefaultSpillThreshold, Buffers = 10, NewMemoryBudget(15)
+
+	small, big := NewSpillBuffer(), NewSpillBuffer()
+	small.Write([]byte("01234"))
+	small.Write([]byte("56789"))
+	if small.Spilled() || Buffers.Used() != 10 {
+		t.Errorf("small: spilled=%t used=%d, wanted in memory, 10", small.Spilled(), Buffers.Used())
+	}
+	// over the budget
+	big.Write([]byte("abcdefgh"))
+	if !big.Spilled() {
+		t.Error("big: not spilled over the budget")
+	}
+	// over the threshold
+	small.Write([]byte("x"))
+	if !small.Spilled() || Buffers.Used() != 0 {
+		t.Errorf("small: spilled=%t used=%d, wanted spilled, 0", small.Spilled(), Buffers.Used())
+	}
+	for i := 0; i < 2; i++ {
+		if b, err := ioutil.ReadAll(small.Reader()); err != nil || !bytes.Equal(b, []byte("0123456789x")) {
+			t.Errorf("%d. read %q, %v", i, b, err)
+		}
+	}
+	if err := small.Close(); err != nil {
+		t.Error(err)
+	}
+	if err := big.Close(); err != nil {
+		t.Error(err)
+	}
+}
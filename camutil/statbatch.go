@@ -0,0 +1,173 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package camutil
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/blobserver"
+)
+
+// DefaultStatBatchSize is the maximum number of refs in a batched stat.
+var DefaultStatBatchSize = 1000
+
+// batchStatter coalesces the StatBlobs calls of the concurrent uploads:
+// the refs are collected for window (or until there are DefaultStatBatchSize),
+// and stat'ed with one call.
+type batchStatter struct {
+	blobserver.StatReceiver
+	window time.Duration
+
+	mu      sync.Mutex
+	pending []*statCall
+	n       int
+	timer   *time.Timer
+}
+
+// statCall is a StatBlobs call waiting for its batch.
+type statCall struct {
+	ctx   context.Context
+	refs  []blob.Ref
+	done  chan struct{}
+	sizes map[blob.Ref]uint32
+	err   error
+}
+
+func newBatchStatter(sr blobserver.StatReceiver, window time.Duration) *batchStatter {
+	return &batchStatter{StatReceiver: sr, window: window}
+}
+
+// StatBlobs implements blobserver.BlobStatter, waiting for the batch.
+func (bs *batchStatter) StatBlobs(ctx context.Context, blobs []blob.Ref, fn func(blob.SizedRef) error) error {
+	if len(blobs) == 0 {
+		return nil
+	}
+	if len(blobs) >= DefaultStatBatchSize {
+		return bs.StatReceiver.StatBlobs(ctx, blobs, fn)
+	}
+	call := &statCall{ctx: ctx, refs: blobs, done: make(chan struct{})}
+	bs.mu.Lock()
+	bs.pending = append(bs.pending, call)
+	bs.n += len(blobs)
+	if bs.n >= DefaultStatBatchSize {
+		batch := bs.takeLocked()
+		bs.mu.Unlock()
+		go bs.stat(batch)
+	} else {
+		if bs.timer == nil {
+			bs.timer = time.AfterFunc(bs.window, bs.flush)
+		}
+		bs.mu.Unlock()
+	}
+	select {
+	case <-call.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if call.err != nil {
+		return withKind(ErrUpstreamUnavailable, call.err)
+	}
+	for _, br := range call.refs {
+		if size, ok := call.sizes[br]; ok {
+			if err := fn(blob.SizedRef{Ref: br, Size: size}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// takeLocked returns the pending calls, and stops the timer.
+func (bs *batchStatter) takeLocked() []*statCall {
+	batch := bs.pending
+	bs.pending, bs.n = nil, 0
+	if bs.timer != nil {
+		bs.timer.Stop()
+		bs.timer = nil
+	}
+	return batch
+}
+
+func (bs *batchStatter) flush() {
+	bs.mu.Lock()
+	batch := bs.takeLocked()
+	bs.mu.Unlock()
+	bs.stat(batch)
+}
+
+// stat stats the refs of the calls at once, and releases the calls.
+func (bs *batchStatter) stat(batch []*statCall) {
+	if len(batch) == 0 {
+		return
+	}
+	seen := make(map[blob.Ref]struct{})
+	var refs []blob.Ref
+	for _, call := range batch {
+		for _, br := range call.refs {
+			if _, ok := seen[br]; !ok {
+				seen[br] = struct{}{}
+				refs = append(refs, br)
+			}
+		}
+	}
+	ctx, cancel := batchContext(batch)
+	defer cancel()
+	sizes := make(map[blob.Ref]uint32, len(refs))
+	var mu sync.Mutex
+	err := bs.StatReceiver.StatBlobs(ctx, refs, func(sb blob.SizedRef) error {
+		mu.Lock()
+		sizes[sb.Ref] = sb.Size
+		mu.Unlock()
+		return nil
+	})
+	for _, call := range batch {
+		call.sizes, call.err = sizes, err
+		close(call.done)
+	}
+}
+
+// batchContext returns the context of the batch: the caller's for a single
+// call, else one done when the contexts of all the calls are.
+func batchContext(batch []*statCall) (context.Context, context.CancelFunc) {
+	if len(batch) == 1 {
+		return context.WithCancel(batch[0].ctx)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		for _, call := range batch {
+			select {
+			case <-call.ctx.Done():
+			case <-ctx.Done():
+				return
+			}
+		}
+		cancel()
+	}()
+	return ctx, cancel
+}
+
+// Close closes the underlying StatReceiver, if it is an io.Closer.
+func (bs *batchStatter) Close() error {
+	if cl, ok := bs.StatReceiver.(io.Closer); ok {
+		return cl.Close()
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package camutil
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"perkeep.org/pkg/blob"
+)
+
+// countingStatter has the even-numbered refs, and counts the StatBlobs calls.
+type countingStatter struct {
+	calls int32
+	have  map[blob.Ref]uint32
+}
+
+func (cs *countingStatter) StatBlobs(ctx context.Context, blobs []blob.Ref, fn func(blob.SizedRef) error) error {
+	atomic.AddInt32(&cs.calls, 1)
+	for _, br := range blobs {
+		if size, ok := cs.have[br]; ok {
+			if err := fn(blob.SizedRef{Ref: br, Size: size}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (cs *countingStatter) ReceiveBlob(ctx context.Context, br blob.Ref, source io.Reader) (blob.SizedRef, error) {
+	return blob.SizedRef{Ref: br}, nil
+}
+
+func TestBatchStatter(t *testing.T) {
+	refs := make([]blob.Ref, 10)
+	cs := &countingStatter{have: make(map[blob.Ref]uint32)}
+	for i := range refs {
+		refs[i] = blob.RefFromString(string(rune('a' + i)))
+		if i%2 == 0 {
+			cs.have[refs[i]] = uint32(i + 1)
+		}
+	}
+	bs := newBatchStatter(cs, 50*time.Millisecond)
+	var wg sync.WaitGroup
+	for i, br := range refs {
+		wg.Add(1)
+		go func(i int, br blob.Ref) {
+			defer wg.Done()
+			var got []blob.SizedRef
+			if err := bs.StatBlobs(context.Background(), []blob.Ref{br}, func(sb blob.SizedRef) error {
+				got = append(got, sb)
+				return nil
+			}); err != nil {
+				t.Error(err)
+				return
+			}
+			if i%2 == 0 && (len(got) != 1 || got[0].Size != uint32(i+1)) {
+				t.Errorf("%d. got %v, wanted size %d", i, got, i+1)
+			} else if i%2 == 1 && len(got) != 0 {
+				t.Errorf("%d. got %v, wanted nothing", i, got)
+			}
+		}(i, br)
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&cs.calls); n != 1 {
+		t.Errorf("got %d upstream calls, wanted 1", n)
+	}
+}
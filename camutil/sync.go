@@ -0,0 +1,253 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package camutil
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/blobserver"
+	"perkeep.org/pkg/schema"
+)
+
+// SyncStats holds the counters of a Sync.
+type SyncStats struct {
+	Seen, Copied int
+	Bytes        int64
+}
+
+const syncBatchSize = 100
+
+// Sync copies the blobs missing from dst from src.
+//
+// If roots is empty, all the blobs of src are enumerated, else the blobs
+// reachable from the roots (file parts, directory entries, static-set members,
+// the public key of the signed blobs) are walked. The children of a schema blob are copied before it (bottom-up),
+// so a schema blob already in dst is not descended into, as its children must
+// be there, too - even after an interrupted Sync.
+// Claims pointing to a permanode are not reachable from it, so are not copied:
+// pass them as roots (see Downloader.PermanodeClaims).
+func Sync(ctx context.Context, src blob.Fetcher, dst blobserver.StatReceiver, roots []blob.Ref) (SyncStats, error) {
+	var st SyncStats
+	if len(roots) == 0 {
+		enum, ok := src.(blobserver.BlobEnumerator)
+		if !ok {
+			return st, errors.New("source cannot enumerate blobs, give roots")
+		}
+		batch := make([]blob.Ref, 0, syncBatchSize)
+		err := blobserver.EnumerateAll(ctx, enum, func(sb blob.SizedRef) error {
+			if batch = append(batch, sb.Ref); len(batch) < syncBatchSize {
+				return nil
+			}
+			err := syncBatch(ctx, src, dst, batch, &st)
+			batch = batch[:0]
+			return err
+		})
+		if err == nil {
+			err = syncBatch(ctx, src, dst, batch, &st)
+		}
+		return st, err
+	}
+	err := syncTree(ctx, src, dst, roots, &st, make(map[blob.Ref]struct{}))
+	return st, err
+}
+
+// syncTree copies the blobs of refs missing from dst, each after its children.
+func syncTree(ctx context.Context, src blob.Fetcher, dst blobserver.StatReceiver, refs []blob.Ref, st *SyncStats, seen map[blob.Ref]struct{}) error {
+	for len(refs) > 0 {
+		n := len(refs)
+		if n > syncBatchSize {
+			n = syncBatchSize
+		}
+		batch := make([]blob.Ref, 0, n)
+		for _, br := range refs[:n] {
+			if _, ok := seen[br]; ok {
+				continue
+			}
+			seen[br] = struct{}{}
+			batch = append(batch, br)
+		}
+		refs = refs[n:]
+		if len(batch) == 0 {
+			continue
+		}
+		st.Seen += len(batch)
+		have := make(map[blob.Ref]struct{}, len(batch))
+		if err := dst.StatBlobs(ctx, batch, func(sb blob.SizedRef) error {
+			have[sb.Ref] = struct{}{}
+			return nil
+		}); err != nil {
+			return errors.Wrap(err, "stat")
+		}
+		for _, br := range batch {
+			if _, ok := have[br]; ok {
+				continue
+			}
+			data, err := fetchAll(ctx, src, br)
+			if err != nil {
+				return err
+			}
+			if children := schemaChildren(br, data); len(children) != 0 {
+				if err = syncTree(ctx, src, dst, children, st, seen); err != nil {
+					return err
+				}
+			}
+			if err = receive(ctx, dst, br, data, st); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// syncBatch copies the blobs of the batch missing from dst.
+func syncBatch(ctx context.Context, src blob.Fetcher, dst blobserver.StatReceiver, batch []blob.Ref, st *SyncStats) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	st.Seen += len(batch)
+	have := make(map[blob.Ref]struct{}, len(batch))
+	if err := dst.StatBlobs(ctx, batch, func(sb blob.SizedRef) error {
+		have[sb.Ref] = struct{}{}
+		return nil
+	}); err != nil {
+		return errors.Wrap(err, "stat")
+	}
+	for _, br := range batch {
+		if _, ok := have[br]; ok {
+			continue
+		}
+		data, err := fetchAll(ctx, src, br)
+		if err != nil {
+			return err
+		}
+		if err = receive(ctx, dst, br, data, st); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func fetchAll(ctx context.Context, src blob.Fetcher, br blob.Ref) ([]byte, error) {
+	rc, err := fetch(ctx, src, br)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read %s", br)
+	}
+	return data, nil
+}
+
+func receive(ctx context.Context, dst blobserver.StatReceiver, br blob.Ref, data []byte, st *SyncStats) error {
+	if _, err := dst.ReceiveBlob(ctx, br, bytes.NewReader(data)); err != nil {
+		return errors.Wrapf(err, "receive %s", br)
+	}
+	st.Copied++
+	st.Bytes += int64(len(data))
+	return nil
+}
+
+// schemaChildren returns the refs the schema blob points to
+// (nothing if data is not a schema blob).
+func schemaChildren(br blob.Ref, data []byte) []blob.Ref {
+	b, err := schema.BlobFromReader(br, bytes.NewReader(data))
+	if err != nil {
+		return nil
+	}
+	leaves, nodes := schemaRefs(b)
+	return append(leaves, nodes...)
+}
+
+// schemaRefs returns the refs the schema blob points to: the data chunks
+// and the public key of the signer (leaves), and the schema blobs (nodes).
+func schemaRefs(b *schema.Blob) (leaves, nodes []blob.Ref) {
+	switch b.Type() {
+	case "file", "bytes":
+		for _, part := range b.ByteParts() {
+			if part.BlobRef.Valid() {
+				leaves = append(leaves, part.BlobRef)
+			}
+			if part.BytesRef.Valid() {
+				nodes = append(nodes, part.BytesRef)
+			}
+		}
+	case "directory":
+		if entries, ok := b.DirectoryEntries(); ok {
+			nodes = append(nodes, entries)
+		}
+	case "static-set":
+		nodes = append(nodes, b.StaticSetMembers()...)
+	case "permanode", "claim":
+		var signed struct {
+			Signer string `json:"camliSigner"`
+		}
+		if json.Unmarshal([]byte(b.JSON()), &signed) == nil {
+			if signer, ok := blob.Parse(signed.Signer); ok {
+				leaves = append(leaves, signer)
+			}
+		}
+	}
+	return leaves, nodes
+}
+
+// WalkTree calls fn with root, and with every blob reachable from it (file
+// parts, directory entries, static-set members). Only the schema blobs are
+// fetched, the data chunks are not.
+func WalkTree(ctx context.Context, src blob.Fetcher, root blob.Ref, fn func(blob.Ref) error) error {
+	seen := make(map[blob.Ref]struct{})
+	queue := []blob.Ref{root}
+	for len(queue) > 0 {
+		br := queue[0]
+		queue = queue[1:]
+		if _, ok := seen[br]; ok {
+			continue
+		}
+		seen[br] = struct{}{}
+		if err := fn(br); err != nil {
+			return err
+		}
+		rc, err := fetch(ctx, src, br)
+		if err != nil {
+			return err
+		}
+		b, err := schema.BlobFromReader(br, io.LimitReader(rc, schema.MaxSchemaBlobSize))
+		rc.Close()
+		if err != nil {
+			continue // not a schema blob
+		}
+		leaves, nodes := schemaRefs(b)
+		for _, leaf := range leaves {
+			if _, ok := seen[leaf]; ok {
+				continue
+			}
+			seen[leaf] = struct{}{}
+			if err := fn(leaf); err != nil {
+				return err
+			}
+		}
+		queue = append(queue, nodes...)
+	}
+	return nil
+}
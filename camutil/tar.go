@@ -0,0 +1,206 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package camutil
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/schema"
+)
+
+// WriteTar writes the trees of the file, directory (or permanode, standing
+// for its camliContent) blobs to w as a tar stream, preserving the names,
+// modes and modification times.
+func (down *Downloader) WriteTar(ctx context.Context, w io.Writer, items ...blob.Ref) error {
+	cfs := newCamliFS(ctx, down.fetcher(ctx))
+	tw := tar.NewWriter(w)
+	for _, br := range items {
+		b, err := cfs.schemaBlob(br)
+		if err != nil {
+			return err
+		}
+		if b.Type() == "permanode" {
+			attr, err := down.PermanodeAttr(ctx, br)
+			if err != nil {
+				return err
+			}
+			if b, err = permanodeContent(cfs, b, attr); err != nil {
+				return err
+			}
+		}
+		name := path.Base(b.FileName())
+		if name == "" || name == "." || name == "/" || name == ".." {
+			name = br.String()
+		}
+		if err := writeTarEntry(ctx, tw, cfs, name, b); err != nil {
+			return err
+		}
+	}
+	return errors.Wrap(tw.Close(), "close tar")
+}
+
+// writeTarEntry writes the blob (recursively, for directories) as name.
+func writeTarEntry(ctx context.Context, tw *tar.Writer, cfs *camliFS, name string, b *schema.Blob) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	hdr := &tar.Header{Name: name, Mode: int64(b.FileMode().Perm()), ModTime: b.ModTime()}
+	switch b.Type() {
+	case "directory":
+		hdr.Typeflag, hdr.Name = tar.TypeDir, name+"/"
+		if hdr.Mode == 0 {
+			hdr.Mode = 0755
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return errors.Wrapf(err, "write header of %q", name)
+		}
+		entries, err := cfs.entries(b)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := writeTarEntry(ctx, tw, cfs, path.Join(name, path.Base(e.FileName())), e); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case "file":
+		hdr.Typeflag, hdr.Size = tar.TypeReg, b.PartsSize()
+		if hdr.Mode == 0 {
+			hdr.Mode = 0644
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return errors.Wrapf(err, "write header of %q", name)
+		}
+		fr, err := openFile(ctx, cfs.fetcher, b.BlobRef())
+		if err != nil {
+			return err
+		}
+		defer fr.Close()
+		if _, err = io.Copy(tw, fr); err != nil {
+			return errors.Wrapf(err, "write %q", name)
+		}
+		return nil
+
+	case "symlink":
+		sf, ok := b.AsStaticFile()
+		if !ok {
+			return withKind(ErrSchema, errors.Errorf("bad symlink %s", b.BlobRef()))
+		}
+		sl, ok := sf.AsStaticSymlink()
+		if !ok {
+			return withKind(ErrSchema, errors.Errorf("bad symlink %s", b.BlobRef()))
+		}
+		hdr.Typeflag, hdr.Linkname = tar.TypeSymlink, sl.SymlinkTargetString()
+		if hdr.Mode == 0 {
+			hdr.Mode = 0777
+		}
+		return errors.Wrapf(tw.WriteHeader(hdr), "write header of %q", name)
+
+	default:
+		Log("msg", "skip from tar", "name", name, "ref", b.BlobRef(), "type", b.Type())
+		return nil
+	}
+}
+
+// ExtractTar extracts the directories and regular files of the tar stream
+// into dir, preserving their modes and modification times.
+// Links and special files are skipped, the entries escaping dir are refused.
+func ExtractTar(r io.Reader, dir string) error {
+	type dirAttr struct {
+		path  string
+		mode  os.FileMode
+		mtime time.Time
+	}
+	var dirs []dirAttr
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "read tar")
+		}
+		name := path.Clean(strings.TrimLeft(hdr.Name, "/"))
+		if name == "." {
+			continue
+		}
+		if name == ".." || strings.HasPrefix(name, "../") {
+			return errors.Errorf("%q is outside of the tarball", hdr.Name)
+		}
+		dst := filepath.Join(dir, filepath.FromSlash(name))
+		mode := os.FileMode(hdr.Mode).Perm()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err = os.MkdirAll(dst, 0755); err != nil {
+				return err
+			}
+			if mode == 0 {
+				mode = 0755
+			}
+			// the children are written first
+			dirs = append(dirs, dirAttr{path: dst, mode: mode, mtime: hdr.ModTime})
+		case tar.TypeReg:
+			if err = os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+				return err
+			}
+			if mode == 0 {
+				mode = 0644
+			}
+			fh, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+			if err != nil {
+				return err
+			}
+			if _, err = io.Copy(fh, tr); err != nil {
+				fh.Close()
+				return errors.Wrapf(err, "extract %q", hdr.Name)
+			}
+			if err = fh.Close(); err != nil {
+				return err
+			}
+			if err = os.Chmod(dst, mode); err != nil {
+				return err
+			}
+			if err = os.Chtimes(dst, hdr.ModTime, hdr.ModTime); err != nil {
+				return err
+			}
+		default:
+			Log("msg", "skip from tar", "name", hdr.Name, "type", string(hdr.Typeflag))
+		}
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		d := dirs[i]
+		if err := os.Chmod(d.path, d.mode|0700); err != nil {
+			return err
+		}
+		if err := os.Chtimes(d.path, d.mtime, d.mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package camutil
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExtractTar(t *testing.T) {
+	mtime := time.Date(2018, 8, 26, 10, 0, 0, 0, time.UTC)
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range []*tar.Header{
+		{Name: "a/", Typeflag: tar.TypeDir, Mode: 0750, ModTime: mtime},
+		{Name: "a/b.txt", Typeflag: tar.TypeReg, Mode: 0640, ModTime: mtime, Size: 5},
+		{Name: "a/link", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd", ModTime: mtime},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Size > 0 {
+			tw.Write([]byte("hello"))
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "camutil-tar-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = ExtractTar(bytes.NewReader(buf.Bytes()), dir); err != nil {
+		t.Fatal(err)
+	}
+	fn := filepath.Join(dir, "a", "b.txt")
+	if b, err := ioutil.ReadFile(fn); err != nil || string(b) != "hello" {
+		t.Errorf("read %q: %q, %v", fn, b, err)
+	}
+	for name, mode := range map[string]os.FileMode{"a": 0750, "a/b.txt": 0640} {
+		fi, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != mode {
+			t.Errorf("%s: mode %v, wanted %v", name, fi.Mode().Perm(), mode)
+		}
+		if !fi.ModTime().Equal(mtime) {
+			t.Errorf("%s: mtime %v, wanted %v", name, fi.ModTime(), mtime)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "a", "link")); !os.IsNotExist(err) {
+		t.Errorf("link extracted: %v", err)
+	}
+
+	buf.Reset()
+	tw = tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "../evil", Typeflag: tar.TypeReg, Mode: 0644})
+	tw.Close()
+	if err = ExtractTar(bytes.NewReader(buf.Bytes()), dir); err == nil {
+		t.Error("../evil extracted")
+	}
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package camutil
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// HTTPOptions tune the HTTP transport of the client.
+// The perkeep client's default transport is used if all of them are zero.
+type HTTPOptions struct {
+	// MaxIdleConnsPerHost is the number of the kept-alive connections to the server
+	// (http.DefaultMaxIdleConnsPerHost if zero).
+	MaxIdleConnsPerHost int
+	// DialTimeout is the timeout of connecting to the server.
+	DialTimeout time.Duration
+	// TLSHandshakeTimeout is the timeout of the TLS handshake.
+	TLSHandshakeTimeout time.Duration
+	// Proxy is the URL of the HTTP proxy ("" uses the HTTP_PROXY environment variables).
+	Proxy string
+	// ClientCert and ClientKey are the PEM files of the TLS client certificate.
+	ClientCert, ClientKey string
+}
+
+// httpClient returns a HTTP client with the tuned transport,
+// or nil if there is nothing to tune.
+func (o HTTPOptions) httpClient() (*http.Client, error) {
+	if o == (HTTPOptions{}) {
+		return nil, nil
+	}
+	proxy := http.ProxyFromEnvironment
+	if o.Proxy != "" {
+		u, err := url.Parse(o.Proxy)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse proxy URL %q", o.Proxy)
+		}
+		proxy = http.ProxyURL(u)
+	}
+	// as client.OptionInsecure(true)
+	tlsConfig := &tls.Config{InsecureSkipVerify: true}
+	if o.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(o.ClientCert, o.ClientKey)
+		if err != nil {
+			return nil, errors.Wrapf(err, "load client certificate %q", o.ClientCert)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	dialer := &net.Dialer{Timeout: o.DialTimeout, KeepAlive: 30 * time.Second}
+	return &http.Client{Transport: &http.Transport{
+		Proxy:               proxy,
+		DialContext:         dialer.DialContext,
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: o.MaxIdleConnsPerHost,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: o.TLSHandshakeTimeout,
+		TLSClientConfig:     tlsConfig,
+	}}, nil
+}
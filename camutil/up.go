@@ -32,7 +32,6 @@ import (
 	"github.com/pkg/errors"
 	"go4.org/syncutil"
 	"golang.org/x/crypto/openpgp"
-	"golang.org/x/crypto/openpgp/armor"
 	"perkeep.org/pkg/blob"
 	"perkeep.org/pkg/blobserver"
 	"perkeep.org/pkg/blobserver/localdisk"
@@ -45,26 +44,45 @@ type Uploader struct {
 	*client.Client
 	server        string
 	args          []string
-	opts          []string
+	flags         []string
 	env           []string
 	skipHaveCache bool
 	gate          *syncutil.Gate
 	mtx           sync.Mutex
 	blobserver.StatReceiver
 	*schema.Signer
+	opts      Options
+	haveCache *haveCache
+	ownSigner bool
+	// ringFile is the temp file of the keyring printed by SecretRingCmd, for pk-put.
+	ringFile string
+}
+
+// maxUploads returns n if positive, else the default.
+func maxUploads(n, dflt int) int {
+	if n > 0 {
+		return n
+	}
+	return dflt
 }
 
 // FileIsEmpty is the error for zero length files
 var FileIsEmpty = errors.New("File is empty")
 
-var cachedUploader = make(map[string]*Uploader, 1)
+var cachedUploader = make(map[cacheKey]*Uploader, 1)
 var cachedUploaderMtx = new(sync.Mutex)
+var newUploaderMtx = make(map[cacheKey]*sync.Mutex)
 
 // Close closes the probably opened cached Uploaders and Downloaders
 func Close() error {
+	var err error
 	cachedUploaderMtx.Lock()
 	defer cachedUploaderMtx.Unlock()
-	for k := range cachedUploader {
+	for k, u := range cachedUploader {
+		// removes the ring file, closes (flushes) the have cache, too
+		if closeErr := u.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
 		delete(cachedUploader, k)
 	}
 	cachedDownloaderMtx.Lock()
@@ -73,58 +91,122 @@ func Close() error {
 		cachedDownloader[k].Close()
 		delete(cachedDownloader, k)
 	}
-	return nil
+	return err
 }
 
-// NewUploader returns a new uploader for uploading files to the given server
-func NewUploader(server string, capCtime bool, skipHaveCache bool) *Uploader {
+// NewUploader returns a new uploader for uploading files to the given server.
+// The package level variables are used if opts is nil.
+func NewUploader(ctx context.Context, server string, opts *Options) *Uploader {
+	if opts == nil {
+		o := DefaultOptions()
+		opts = &o
+	}
+	key := cacheKey{server: server, opts: *opts}
 	cachedUploaderMtx.Lock()
-	defer cachedUploaderMtx.Unlock()
-	u, ok := cachedUploader[server]
+	u, ok := cachedUploader[key]
 	if ok {
+		cachedUploaderMtx.Unlock()
 		return u
 	}
+	// creating an Uploader may be slow (loading the signer), so just the
+	// ones of the same key wait for each other
+	mu, ok := newUploaderMtx[key]
+	if !ok {
+		mu = new(sync.Mutex)
+		newUploaderMtx[key] = mu
+	}
+	cachedUploaderMtx.Unlock()
+	mu.Lock()
+	defer mu.Unlock()
+	cachedUploaderMtx.Lock()
+	u, ok = cachedUploader[key]
+	cachedUploaderMtx.Unlock()
+	if ok {
+		return u
+	}
+	if u = newUploader(ctx, server, opts); u != nil {
+		cachedUploaderMtx.Lock()
+		cachedUploader[key] = u
+		cachedUploaderMtx.Unlock()
+	}
+	return u
+}
+
+// newUploader returns a new, not cached Uploader (see NewUploader).
+func newUploader(ctx context.Context, server string, opts *Options) *Uploader {
 	if strings.HasPrefix(server, "file://") {
 		recv, err := localdisk.New(server[7:])
 		if err != nil {
 			Log("msg", "localdisk.New", "server", server, "error", err)
 			return nil
 		}
-		u = &Uploader{
+		return &Uploader{
 			server:        server,
-			gate:          syncutil.NewGate(8),
+			gate:          syncutil.NewGate(maxUploads(opts.MaxUploads, 8)),
 			skipHaveCache: true,
 			StatReceiver:  recv,
 			Signer:        newDummySigner(),
+			opts:          *opts,
 		}
-		cachedUploader[server] = u
-		return u
 	}
-	c, err := NewClient(server)
+	var c *client.Client
+	var err error
+	if opts.HaveCacheType != "" && !opts.SkipHaveCache {
+		// the have cache is set on the client, so it must not be shared
+		if err = ctx.Err(); err == nil {
+			c, err = newClient(newClientKey(server, opts))
+		}
+	} else {
+		c, err = NewClient(ctx, server, opts)
+	}
 	if err != nil || c == nil {
 		Log("msg", "NewClient", "server", server, "error", err)
 		return nil
 	}
-	u = &Uploader{
+	u := &Uploader{
 		server:        server,
 		args:          make([]string, 1, 2),
-		opts:          make([]string, 0, 3),
-		gate:          syncutil.NewGate(32),
-		skipHaveCache: skipHaveCache,
+		flags:         make([]string, 0, 3),
+		gate:          syncutil.NewGate(maxUploads(opts.MaxUploads, 32)),
+		skipHaveCache: opts.SkipHaveCache,
 		Client:        c,
 		StatReceiver:  c,
+		opts:          *opts,
+	}
+	if opts.StatBatchWindow > 0 {
+		u.StatReceiver = newBatchStatter(c, opts.StatBatchWindow)
+	}
+	if opts.HaveCacheType != "" && !opts.SkipHaveCache {
+		if u.haveCache, err = newHaveCache(opts.HaveCacheType, opts.HaveCacheDir, server, opts.HaveCacheMaxSize); err != nil {
+			Log("msg", "newHaveCache", "server", server, "error", err)
+			return nil
+		}
+		c.SetHaveCache(u.haveCache)
+	}
+	var ring []byte
+	if !opts.SignerOptions.IsZero() {
+		var pubKey string
+		if u.Signer, pubKey, ring, err = opts.SignerOptions.load(ctx); err != nil {
+			Log("msg", "load signer", "server", server, "error", err)
+			return nil
+		}
+		if _, err = u.uploadString(ctx, pubKey); err != nil {
+			Log("msg", "upload public key", "server", server, "error", err)
+			return nil
+		}
+		u.ownSigner = true
 	}
 	u.args[0] = cmdPkPut
 	if server != "" {
 		u.args = append(u.args, "-server="+server)
 	}
 	needDebugEnv := false
-	if skipHaveCache {
-		u.opts = append(u.opts, "-havecache=false", "-statcache=false")
+	if opts.SkipHaveCache {
+		u.flags = append(u.flags, "-havecache=false", "-statcache=false")
 		needDebugEnv = true
 	}
-	if capCtime {
-		u.opts = append(u.opts, "-capctime")
+	if opts.CapCtime {
+		u.flags = append(u.flags, "-capctime")
 		needDebugEnv = true
 	}
 	if needDebugEnv {
@@ -132,16 +214,47 @@ func NewUploader(server string, capCtime bool, skipHaveCache bool) *Uploader {
 			u.env = append(os.Environ(), "CAMLI_DEBUG=true")
 		}
 	}
-	cachedUploader[server] = u
+	if opts.HaveCacheDir != "" {
+		if u.env == nil {
+			u.env = os.Environ()
+		}
+		u.env = append(u.env, "CAMLI_CACHE_DIR="+opts.HaveCacheDir)
+	}
+	if u.ownSigner { // pk-put signs with the same key
+		ringFile := opts.SecretRing
+		if ringFile == "" {
+			if ringFile, err = writeRing(ring); err != nil {
+				Log("msg", "write secret keyring for "+cmdPkPut, "error", err)
+				return nil
+			}
+			u.ringFile = ringFile
+		}
+		if u.env == nil {
+			u.env = os.Environ()
+		}
+		u.env = append(u.env, "CAMLI_SECRET_RING="+ringFile)
+		if opts.KeyID != "" {
+			u.env = append(u.env, "CAMLI_KEYID="+opts.KeyID)
+		}
+	}
 	return u
 }
 
 // Close closes the Client/Storage.
-func (u *Uploader) Close() error {
-	var err error
+func (u *Uploader) Close() (err error) {
+	if u.ringFile != "" {
+		os.Remove(u.ringFile)
+		u.ringFile = ""
+	}
+	if u.haveCache != nil {
+		err = u.haveCache.Close()
+		u.haveCache = nil
+	}
 	if u.StatReceiver != nil {
 		if cl, ok := u.StatReceiver.(io.Closer); ok {
-			err = cl.Close()
+			if closeErr := cl.Close(); err == nil {
+				err = closeErr
+			}
 		}
 		u.StatReceiver = nil
 	}
@@ -149,19 +262,26 @@ func (u *Uploader) Close() error {
 		return err
 	}
 	defer func() {
-		if r := recover(); r != nil {
+		if r := recover(); r != nil && err == nil {
 			err = r.(error)
 		}
 	}()
-	err = u.Client.Close()
+	if closeErr := u.Client.Close(); err == nil {
+		err = closeErr
+	}
 	return err
 }
 
 // FromReader uploads the contents of the io.Reader.
 func (u *Uploader) FromReader(ctx context.Context, fileName string, r io.Reader) (blob.Ref, error) {
+	if p := u.opts.Progress; p != nil {
+		p.File(fileName, -1)
+		r = progressReader{Reader: r, p: p}
+	}
 	u.gate.Start()
 	defer u.gate.Done()
-	return schema.WriteFileFromReader(ctx, u.StatReceiver, filepath.Base(fileName), r)
+	br, err := u.writeFileMap(ctx, schema.NewFileMap(filepath.Base(fileName)), r)
+	return br, withKind(ErrUpstreamUnavailable, err)
 }
 
 // FromReaderInfo uploads the contents of r, wrapped with data from fi.
@@ -171,9 +291,55 @@ func (u *Uploader) FromReaderInfo(ctx context.Context, fi os.FileInfo, mime stri
 	file := schema.NewCommonFileMap(filepath.Base(fi.Name()), fi)
 	file = file.CapCreationTime().SetRawStringField("mimeType", mime)
 	file = file.SetType("file")
+	if p := u.opts.Progress; p != nil {
+		p.File(fi.Name(), fi.Size())
+		r = progressReader{Reader: r, p: p}
+	}
 	u.gate.Start()
 	defer u.gate.Done()
-	return schema.WriteFileMap(ctx, u.StatReceiver, file, r)
+	br, err := u.writeFileMap(ctx, file, r)
+	return br, withKind(ErrUpstreamUnavailable, err)
+}
+
+// UploadReader uploads the contents of r as a file named name, with the
+// given modification time (if not zero) and the sniffed MIME type.
+// Returns the content ref, and the permanode ref iff permanode is true.
+//
+// Unlike UploadFile, this needs no file on disk, but does not work with pk-put.
+func (u *Uploader) UploadReader(ctx context.Context, name string, mtime time.Time, r io.Reader, permanode bool) (content, perma blob.Ref, err error) {
+	if u.StatReceiver == nil {
+		return content, perma, errors.New("UploadReader needs a direct connection to the server")
+	}
+	mime, r := MIMETypeFromReader(r)
+	file := schema.NewFileMap(filepath.Base(name))
+	if !mtime.IsZero() {
+		file = file.SetModTime(mtime)
+	}
+	if mime != "" {
+		file = file.SetRawStringField("mimeType", mime)
+	}
+	if p := u.opts.Progress; p != nil {
+		p.File(name, -1)
+		r = progressReader{Reader: r, p: p}
+	}
+	u.gate.Start()
+	content, err = u.writeFileMap(ctx, file, r)
+	u.gate.Done()
+	if err != nil {
+		return content, perma, withKind(ErrUpstreamUnavailable, err)
+	}
+	if !permanode {
+		return content, perma, nil
+	}
+	if u.Client == nil {
+		perma, err = u.NewPermanode(ctx, map[string]string{"camliContent": content.String()})
+		return content, perma, err
+	}
+	if perma, err = u.plannedPermanode(ctx, content.String(), time.Now()); err != nil {
+		return content, perma, withKind(ErrUpstreamUnavailable, err)
+	}
+	_, err = u.signAndUpload(ctx, schema.NewAddAttributeClaim(perma, "camliContent", content.String()))
+	return content, perma, withKind(ErrUpstreamUnavailable, err)
 }
 
 // UploadFile uploads the given path (file or directory, recursively), and
@@ -198,14 +364,12 @@ func (u *Uploader) UploadFile(
 	if content, err = u.UploadFileMIME(ctx, path, mime); !permanode || err != nil {
 		return content, perma, err
 	}
-	pbRes, err := u.Client.UploadPlannedPermanode(ctx, content.String(), time.Now())
-	if err != nil {
-		return content, perma, err
+	if perma, err = u.plannedPermanode(ctx, content.String(), time.Now()); err != nil {
+		return content, perma, withKind(ErrUpstreamUnavailable, err)
 	}
-	perma = pbRes.BlobRef
-	_, err = u.Client.UploadAndSignBlob(ctx, schema.NewAddAttributeClaim(pbRes.BlobRef, "camliContent", content.String()))
+	_, err = u.signAndUpload(ctx, schema.NewAddAttributeClaim(perma, "camliContent", content.String()))
 
-	return content, perma, err
+	return content, perma, withKind(ErrUpstreamUnavailable, err)
 }
 
 // UploadFileLazyAttr uploads the given path (file or directory, recursively), and
@@ -278,15 +442,15 @@ func filterAttrs(skipPrefix string, attrs map[string]string) map[string]string {
 // Returns the permanode, and the error.
 func (u *Uploader) NewPermanode(ctx context.Context, attrs map[string]string) (blob.Ref, error) {
 	if u.Client != nil {
-		pRes, err := u.Client.UploadNewPermanode(ctx)
+		perma, err := u.signAndUpload(ctx, schema.NewUnsignedPermanode())
 		if err != nil {
 			Log("msg", "UploadNewPermanode", "error", err)
 			return blob.Ref{}, err
 		}
 		if len(attrs) > 0 {
-			err = u.SetPermanodeAttrs(ctx, pRes.BlobRef, attrs)
+			err = u.SetPermanodeAttrs(ctx, perma, attrs)
 		}
-		return pRes.BlobRef, err
+		return perma, err
 	}
 	if u.Signer != nil { //nolint:govet
 		signed, err := schema.NewUnsignedPermanode().Sign(ctx, u.Signer)
@@ -309,11 +473,7 @@ func (u *Uploader) SetPermanodeAttrs(ctx context.Context, perma blob.Ref, attrs
 	var setAttr func(k, v string) (blob.Ref, error)
 	if u.Client != nil {
 		setAttr = func(k, v string) (blob.Ref, error) {
-			pRes, err := u.Client.UploadAndSignBlob(ctx, schema.NewSetAttributeClaim(perma, k, v))
-			if err != nil {
-				return blob.Ref{}, err
-			}
-			return pRes.BlobRef, nil
+			return u.signAndUpload(ctx, schema.NewSetAttributeClaim(perma, k, v))
 		}
 	} else {
 		pS := perma.String()
@@ -334,6 +494,36 @@ func (u *Uploader) SetPermanodeAttrs(ctx context.Context, perma blob.Ref, attrs
 	return nil
 }
 
+// AddPermanodeAttr adds the value to the (multi-valued) attribute of the permanode.
+func (u *Uploader) AddPermanodeAttr(ctx context.Context, perma blob.Ref, attr, value string) error {
+	if u.Client != nil {
+		_, err := u.signAndUpload(ctx, schema.NewAddAttributeClaim(perma, attr, value))
+		return err
+	}
+	_, err := u.camput(ctx, "attr", "-add", perma.String(), attr, value)
+	return err
+}
+
+// Delete signs a delete claim of the target (a permanode, or a claim,
+// deleting a delete claim undoes it). Returns the claim's ref.
+func (u *Uploader) Delete(ctx context.Context, target blob.Ref) (blob.Ref, error) {
+	if u.Client != nil {
+		claim, err := u.signAndUpload(ctx, schema.NewDeleteClaim(target))
+		if err != nil {
+			return blob.Ref{}, errors.Wrapf(err, "delete %s", target)
+		}
+		return claim, nil
+	}
+	refs, err := u.camput(ctx, "delete", target.String())
+	if err != nil {
+		return blob.Ref{}, err
+	}
+	if len(refs) == 0 {
+		return blob.Ref{}, errors.Errorf("no claim of deleting %s", target)
+	}
+	return refs[0], nil
+}
+
 // UploadFileMIME uploads a regular file with the given MIME type.
 func (u *Uploader) UploadFileMIME(ctx context.Context, fileName, mimeType string) (content blob.Ref, err error) {
 	fh, err := os.Open(fileName)
@@ -376,7 +566,15 @@ func (u *Uploader) UploadFileExt(ctx context.Context, path string, permanode boo
 	if permanode {
 		args = append(args, "--permanode")
 	}
+	// pk-put reports nothing, so just the file and its size is known
+	p := u.opts.Progress
+	if p != nil && fi.Mode().IsRegular() {
+		p.File(path, fi.Size())
+	}
 	refs, err := u.camput(ctx, "file", args...)
+	if p != nil && err == nil && fi.Mode().IsRegular() {
+		p.Bytes(fi.Size())
+	}
 	if len(refs) > 0 {
 		content = refs[0]
 		if len(refs) > 1 {
@@ -401,8 +599,8 @@ func (u *Uploader) UploadFileExtLazyAttr(ctx context.Context, path string, attrs
 }
 
 func (u *Uploader) camput(ctx context.Context, mode string, modeArgs ...string) ([]blob.Ref, error) {
-	args := make([]string, 0, len(u.args)+1+len(u.opts)+len(modeArgs)+1)
-	args = append(append(append(args, u.args...), mode), u.opts...)
+	args := make([]string, 0, len(u.args)+1+len(u.flags)+len(modeArgs)+1)
+	args = append(append(append(args, u.args...), mode), u.flags...)
 	var dir string
 	if mode == "file" {
 		var base string
@@ -424,10 +622,14 @@ func (u *Uploader) camput(ctx context.Context, mode string, modeArgs ...string)
 	for i := 0; i < 10; i++ {
 		if i > 0 {
 			errbuf.Reset()
-			time.Sleep(time.Duration(i) * time.Second)
+			select {
+			case <-ctx.Done():
+				return refs, ctx.Err()
+			case <-time.After(time.Duration(i) * time.Second):
+			}
 		}
 		Log("msg", cmdPkPut, "args", args)
-		c := exec.Command(cmdPkPut, args[0:]...)
+		c := exec.CommandContext(ctx, cmdPkPut, args[0:]...)
 		c.Dir = dir
 		c.Env = u.env
 		c.Stderr = &errbuf
@@ -441,7 +643,7 @@ func (u *Uploader) camput(ctx context.Context, mode string, modeArgs ...string)
 			u.mtx.Unlock()
 		}
 		if err != nil {
-			lastErr = errors.Wrapf(err, "call %s %q: %s", cmdPkPut, args, errbuf.Bytes())
+			lastErr = withKind(ErrUpstreamUnavailable, errors.Wrapf(err, "call %s %q: %s", cmdPkPut, args, errbuf.Bytes()))
 			continue
 		}
 		// the last line is the permanode ref, the first is the content
@@ -462,7 +664,7 @@ func (u *Uploader) camput(ctx context.Context, mode string, modeArgs ...string)
 			if i > 0 {
 				break
 			}
-			if down, err = NewDownloader(u.server); err != nil {
+			if down, err = NewDownloader(ctx, u.server, &u.opts); err != nil {
 				Log("msg", "cannot get downloader for checking uploads", "error", err)
 				break
 			}
@@ -477,7 +679,7 @@ func (u *Uploader) camput(ctx context.Context, mode string, modeArgs ...string)
 				if len(blb.ByteParts()) > 0 {
 					break
 				}
-				lastErr = errors.New(fmt.Sprintf("blob[%s].parts is empty!", content))
+				lastErr = withKind(ErrSchema, errors.New(fmt.Sprintf("blob[%s].parts is empty!", content)))
 				Log("msg", "blob", blb.JSON())
 			}
 		}
@@ -536,24 +738,9 @@ func newDummySigner() *schema.Signer {
 			return nil
 		}
 	}
-	var buf bytes.Buffer
-	hsh := blob.RefFromString("").Hash()
-	w, err := armor.Encode(io.MultiWriter(&buf, hsh), "PGP PUBLIC KEY BLOCK", nil)
-	if err != nil {
-		Log("msg", "armor", "error", err)
-		return nil
-	}
-	if err = privateKeySource.PrimaryKey.Serialize(w); err != nil {
-		Log("msg", "serialize", "error", err)
-	}
-	_ = w.Close()
-
-	pubKeyRef := blob.RefFromHash(hsh)
-	armoredPubKey := bytes.NewReader(buf.Bytes())
-
-	signer, err := schema.NewSigner(pubKeyRef, armoredPubKey, privateKeySource)
+	signer, _, err := newSigner(privateKeySource)
 	if err != nil {
-		Log("msg", "newDummySigner", "pubkey", pubKeyRef, "pubkey", armoredPubKey, "privatekey", privateKeySource, "error", err)
+		Log("msg", "newDummySigner", "error", err)
 		return nil
 	}
 	return signer
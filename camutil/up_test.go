@@ -15,10 +15,10 @@ func TestNewPermanode(t *testing.T) {
 	}
 	defer os.RemoveAll(tempDir)
 
-	u := NewUploader("file://"+tempDir, true, true)
-	defer u.Close()
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	u := NewUploader(ctx, "file://"+tempDir, &Options{CapCtime: true, SkipHaveCache: true})
+	defer u.Close()
 	contentKey, err := u.FromReader(ctx, "test.txt", strings.NewReader("nothing"))
 	if err != nil {
 		t.Fatal(err)
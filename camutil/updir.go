@@ -0,0 +1,308 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package camutil
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/schema"
+)
+
+// DirOptions are the options of UploadDir.
+type DirOptions struct {
+	// Include is the list of glob patterns (see path.Match, plus "**" matching
+	// any number of directories) of the files to upload - all files if empty.
+	// A pattern is matched against the slash-separated path relative to the
+	// root, and the base name.
+	Include []string
+	// Exclude is the list of glob patterns of the files and directories to skip.
+	Exclude []string
+	// MaxDepth is the maximum depth of the subdirectories descended into
+	// (0 is unlimited, 1 is just the files of the root).
+	MaxDepth int
+	// FollowSymlinks uploads the target of the symlinks, instead of skipping them.
+	FollowSymlinks bool
+	// Workers is the number of files uploaded concurrently (default 8).
+	Workers int
+	// IgnoreFile is the name of the gitignore-style ignore files
+	// (see IgnoreRules) honored in each directory, e.g. IgnoreFileName.
+	IgnoreFile string
+	// Known remembers the refs of the uploaded files: the files unchanged
+	// since (by size and modification time) are not read again.
+	Known KnownFiles
+}
+
+// KnownFiles remembers the refs of the uploaded files.
+type KnownFiles interface {
+	// Get returns the ref of the file, iff it has been uploaded with the same
+	// size and modification time.
+	Get(path string, fi os.FileInfo) (blob.Ref, bool)
+	// Set remembers the ref of the file.
+	Set(path string, fi os.FileInfo, br blob.Ref)
+}
+
+func (opts DirOptions) match(patterns []string, rel string) bool {
+	base := path.Base(rel)
+	for _, pat := range patterns {
+		if matchGlob(pat, rel) || matchGlob(pat, base) {
+			return true
+		}
+	}
+	return false
+}
+
+// Skip reports whether the file at rel (slash-separated, relative to the
+// root) is excluded, or not included.
+func (opts DirOptions) Skip(rel string) bool {
+	return opts.match(opts.Exclude, rel) ||
+		len(opts.Include) > 0 && !opts.match(opts.Include, rel)
+}
+
+// matchGlob matches the slash-separated name against the pattern,
+// where a "**" element matches any number of path elements.
+func matchGlob(pattern, name string) bool {
+	if !strings.Contains(pattern, "**") {
+		ok, _ := path.Match(pattern, name)
+		return ok
+	}
+	return matchElems(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchElems(pattern, elems []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(elems); i++ {
+				if matchElems(pattern[1:], elems[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(elems) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], elems[0]); !ok {
+			return false
+		}
+		pattern, elems = pattern[1:], elems[1:]
+	}
+	return len(elems) == 0
+}
+
+// dirNode is a file or directory to upload.
+type dirNode struct {
+	path     string
+	fi       os.FileInfo
+	children []*dirNode
+	ref      blob.Ref
+}
+
+// UploadDir uploads the files of the directory (filtered by opts) with a pool
+// of workers, then the directory schema blobs, and returns the ref of the
+// directory. Empty files are skipped.
+func (u *Uploader) UploadDir(ctx context.Context, path string, opts DirOptions) (blob.Ref, error) {
+	if u.StatReceiver == nil {
+		return blob.Ref{}, errors.New("UploadDir needs a direct connection to the server")
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return blob.Ref{}, err
+	}
+	if !fi.IsDir() {
+		return blob.Ref{}, errors.Errorf("%s is not a directory", path)
+	}
+	root := &dirNode{path: path, fi: fi}
+	var files []*dirNode
+	if err = walkDir(root, "", 1, opts, nil, make(map[string]struct{}), &files); err != nil {
+		return blob.Ref{}, err
+	}
+
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = 8
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		wg       sync.WaitGroup
+		errMu    sync.Mutex
+		firstErr error
+	)
+	work := make(chan *dirNode)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range work {
+				if opts.Known != nil {
+					if ref, ok := opts.Known.Get(n.path, n.fi); ok {
+						n.ref = ref
+						continue
+					}
+				}
+				ref, err := u.UploadFileMIME(ctx, n.path, "")
+				if err != nil {
+					errMu.Lock()
+					if firstErr == nil {
+						firstErr = errors.Wrapf(err, "upload %q", n.path)
+					}
+					errMu.Unlock()
+					cancel()
+					continue
+				}
+				n.ref = ref
+				if opts.Known != nil {
+					opts.Known.Set(n.path, n.fi, ref)
+				}
+			}
+		}()
+	}
+Loop:
+	for _, n := range files {
+		select {
+		case work <- n:
+		case <-ctx.Done():
+			break Loop
+		}
+	}
+	close(work)
+	wg.Wait()
+	if firstErr != nil {
+		return blob.Ref{}, firstErr
+	}
+	if err = ctx.Err(); err != nil {
+		return blob.Ref{}, err
+	}
+	return u.uploadDirSchema(ctx, root)
+}
+
+// errSymlinkLoop is returned by walkDir for a directory which is its own ancestor.
+var errSymlinkLoop = errors.New("symlink loop")
+
+// walkDir reads the (filtered) children of n, appending the regular files to files.
+// The rules of the ignore files of the parent directories are in rules, and
+// the real paths of the parent directories in ancestors (when following the
+// symlinks, which may lead back to them).
+func walkDir(n *dirNode, rel string, depth int, opts DirOptions, rules IgnoreRules, ancestors map[string]struct{}, files *[]*dirNode) error {
+	if opts.FollowSymlinks {
+		real, err := filepath.EvalSymlinks(n.path)
+		if err != nil {
+			return err
+		}
+		if _, ok := ancestors[real]; ok {
+			return errSymlinkLoop
+		}
+		ancestors[real] = struct{}{}
+		defer delete(ancestors, real)
+	}
+	fis, err := ioutil.ReadDir(n.path)
+	if err != nil {
+		return err
+	}
+	if rules, err = rules.ReadIgnoreFile(n.path, rel, opts.IgnoreFile); err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		path := filepath.Join(n.path, fi.Name())
+		childRel := fi.Name()
+		if rel != "" {
+			childRel = rel + "/" + fi.Name()
+		}
+		if opts.match(opts.Exclude, childRel) || rules.ignored(childRel, fi.IsDir()) {
+			continue
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if !opts.FollowSymlinks {
+				continue
+			}
+			if fi, err = os.Stat(path); err != nil {
+				Log("msg", "follow symlink", "path", path, "error", err)
+				continue
+			}
+		}
+		child := &dirNode{path: path, fi: fi}
+		switch {
+		case fi.IsDir():
+			if opts.MaxDepth > 0 && depth >= opts.MaxDepth {
+				continue
+			}
+			if err = walkDir(child, childRel, depth+1, opts, rules, ancestors, files); err == errSymlinkLoop {
+				Log("msg", "skip symlink loop", "path", path)
+				continue
+			} else if err != nil {
+				return err
+			}
+		case fi.Mode().IsRegular():
+			if fi.Size() == 0 || len(opts.Include) > 0 && !opts.match(opts.Include, childRel) {
+				continue
+			}
+			*files = append(*files, child)
+		default:
+			continue
+		}
+		n.children = append(n.children, child)
+	}
+	return nil
+}
+
+// uploadDirSchema uploads the static-set and directory schema blobs
+// of the directory (and its subdirectories).
+func (u *Uploader) uploadDirSchema(ctx context.Context, n *dirNode) (blob.Ref, error) {
+	members := make([]blob.Ref, 0, len(n.children))
+	for _, child := range n.children {
+		if child.fi.IsDir() {
+			var err error
+			if child.ref, err = u.uploadDirSchema(ctx, child); err != nil {
+				return blob.Ref{}, err
+			}
+		}
+		members = append(members, child.ref)
+	}
+	ss := schema.NewStaticSet()
+	for _, sub := range ss.SetStaticSetMembers(members) {
+		if err := u.receiveJSON(ctx, sub.JSON()); err != nil {
+			return blob.Ref{}, err
+		}
+	}
+	ssJSON, err := ss.JSON()
+	if err != nil {
+		return blob.Ref{}, err
+	}
+	if err = u.receiveJSON(ctx, ssJSON); err != nil {
+		return blob.Ref{}, err
+	}
+	dir := schema.NewCommonFileMap(n.path, n.fi).SetType("directory")
+	dirJSON, err := dir.PopulateDirectoryMap(blob.RefFromString(ssJSON)).JSON()
+	if err != nil {
+		return blob.Ref{}, err
+	}
+	return blob.RefFromString(dirJSON), u.receiveJSON(ctx, dirJSON)
+}
+
+// receiveJSON uploads the schema blob.
+func (u *Uploader) receiveJSON(ctx context.Context, s string) error {
+	_, err := u.receiver(ctx).ReceiveBlob(ctx, blob.RefFromString(s), strings.NewReader(s))
+	return withKind(ErrUpstreamUnavailable, err)
+}
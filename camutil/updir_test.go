@@ -0,0 +1,127 @@
+package camutil
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+
+	"go4.org/syncutil"
+	"perkeep.org/pkg/blob"
+)
+
+func TestDirOptionsSkip(t *testing.T) {
+	opts := DirOptions{Include: []string{"**/*.jpg"}, Exclude: []string{"*.tmp", "build/**"}}
+	for rel, skip := range map[string]bool{
+		"a.jpg":           false,
+		"x/y/a.jpg":       false,
+		"a.png":           true,
+		"a.tmp":           true,
+		"x/a.tmp":         true,
+		"build/a.jpg":     true,
+		"build/sub/a.jpg": true,
+		"builder/a.jpg":   false,
+	} {
+		if got := opts.Skip(rel); got != skip {
+			t.Errorf("Skip(%q) = %t, wanted %t", rel, got, skip)
+		}
+	}
+}
+
+func TestWalkDirSymlinkLoop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "camutil-updir-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = os.Mkdir(filepath.Join(dir, "sub"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "sub", "a.txt"), []byte("a"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Symlink(dir, filepath.Join(dir, "sub", "up")); err != nil {
+		t.Skip(err)
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []*dirNode
+	opts := DirOptions{FollowSymlinks: true}
+	if err = walkDir(&dirNode{path: dir, fi: fi}, "", 1, opts, nil, make(map[string]struct{}), &files); err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].path != filepath.Join(dir, "sub", "a.txt") {
+		t.Errorf("got %d files, wanted just sub/a.txt", len(files))
+	}
+}
+
+// journalStub is a KnownFiles which knows the files in known.
+type journalStub struct {
+	mu    sync.Mutex
+	known map[string]blob.Ref
+	set   []string
+}
+
+func (j *journalStub) Get(path string, fi os.FileInfo) (blob.Ref, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	br, ok := j.known[filepath.Base(path)]
+	return br, ok
+}
+
+func (j *journalStub) Set(path string, fi os.FileInfo, br blob.Ref) {
+	j.mu.Lock()
+	j.set = append(j.set, filepath.Base(path))
+	j.mu.Unlock()
+}
+
+// fileProgress records the names of the files read for the upload.
+type fileProgress struct {
+	mu    sync.Mutex
+	files []string
+}
+
+func (p *fileProgress) File(name string, size int64) {
+	p.mu.Lock()
+	p.files = append(p.files, name)
+	p.mu.Unlock()
+}
+func (p *fileProgress) Bytes(n int64)      {}
+func (p *fileProgress) Chunk(skipped bool) {}
+
+func TestUploadDirKnown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "camutil-updir-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, nm := range []string{"a.txt", "b.txt", "c.txt"} {
+		if err = ioutil.WriteFile(filepath.Join(dir, nm), []byte(nm), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a.txt and c.txt were uploaded by the interrupted run.
+	known := &journalStub{known: map[string]blob.Ref{
+		"a.txt": blob.RefFromString("a.txt"),
+		"c.txt": blob.RefFromString("c.txt"),
+	}}
+	cs := &countingStatter{have: make(map[blob.Ref]uint32)}
+	p := &fileProgress{}
+	u := &Uploader{StatReceiver: cs, gate: syncutil.NewGate(2), opts: Options{Progress: p}}
+	if _, err = u.UploadDir(context.Background(), dir, DirOptions{Known: known}); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(p.files)
+	if len(p.files) != 1 || p.files[0] != "b.txt" {
+		t.Errorf("read %q, wanted only b.txt", p.files)
+	}
+	if len(known.set) != 1 || known.set[0] != "b.txt" {
+		t.Errorf("journalled %q, wanted only b.txt", known.set)
+	}
+}
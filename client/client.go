@@ -0,0 +1,354 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package client is a client of the HTTP API of camproxy.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Client is a client of a camproxy.
+type Client struct {
+	// URL is the base URL of the proxy, as http://localhost:3178
+	URL string
+	// Server selects the upstream server of the proxy (X-Camli-Server),
+	// if not empty.
+	Server string
+	// User and Password are the basic auth credentials, if User is not empty.
+	User, Password string
+	// HTTPClient does the requests, http.DefaultClient if nil.
+	HTTPClient *http.Client
+}
+
+// New returns a new client of the proxy at baseURL.
+func New(baseURL string) *Client {
+	return &Client{URL: strings.TrimSuffix(baseURL, "/")}
+}
+
+// Error is the error answer of the proxy.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// UploadOptions are the options of an upload.
+type UploadOptions struct {
+	// Attrs are the attributes of the permanode created for the upload
+	// (iff there are any).
+	Attrs map[string]string
+	// MIMEType is the MIME type of the file (sniffed by the proxy if empty).
+	MIMEType string
+	// ModTime is the modification time of the file.
+	ModTime time.Time
+	// Include and Exclude filter the files of UploadDir by their names.
+	Include, Exclude []string
+	// Workers is the number of the files of UploadDir uploaded in parallel.
+	Workers int
+}
+
+// UploadResult is the answer of an upload.
+type UploadResult struct {
+	Permanode string     `json:"permanode,omitempty"`
+	Content   string     `json:"content"`
+	Attr      url.Values `json:"attr,omitempty"`
+	Size      int64      `json:"size"`
+	MIMEType  string     `json:"mimeType,omitempty"`
+}
+
+// Upload uploads the file read from r, named name.
+func (c *Client) Upload(ctx context.Context, name string, r io.Reader, opts *UploadOptions) (UploadResult, error) {
+	return c.upload(ctx, opts, func(mw *multipart.Writer) error {
+		return writeFilePart(mw, name, r, opts)
+	})
+}
+
+// UploadDir uploads the regular files of the directory (not its subdirectories,
+// as the proxy stores the files of an upload flat).
+func (c *Client) UploadDir(ctx context.Context, dir string, opts *UploadOptions) (UploadResult, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return UploadResult{}, errors.Wrapf(err, "read %q", dir)
+	}
+	return c.upload(ctx, opts, func(mw *multipart.Writer) error {
+		for _, fi := range fis {
+			if !fi.Mode().IsRegular() {
+				continue
+			}
+			fh, err := os.Open(filepath.Join(dir, fi.Name()))
+			if err != nil {
+				return errors.Wrapf(err, "open %q", fi.Name())
+			}
+			fo := UploadOptions{ModTime: fi.ModTime()}
+			err = writeFilePart(mw, fi.Name(), fh, &fo)
+			fh.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// upload POSTs the multipart form of the parts written by writeParts.
+func (c *Client) upload(ctx context.Context, opts *UploadOptions, writeParts func(*multipart.Writer) error) (UploadResult, error) {
+	var res UploadResult
+	if opts == nil {
+		opts = &UploadOptions{}
+	}
+	q := url.Values{"describe": {"1"}}
+	if len(opts.Include) != 0 {
+		q.Set("include", strings.Join(opts.Include, ","))
+	}
+	if len(opts.Exclude) != 0 {
+		q.Set("exclude", strings.Join(opts.Exclude, ","))
+	}
+	if opts.Workers > 0 {
+		q.Set("workers", strconv.Itoa(opts.Workers))
+	}
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		err := func() error {
+			if len(opts.Attrs) != 0 {
+				fw, err := mw.CreateFormField("attrs")
+				if err != nil {
+					return err
+				}
+				if err = json.NewEncoder(fw).Encode(opts.Attrs); err != nil {
+					return err
+				}
+			}
+			if err := writeParts(mw); err != nil {
+				return err
+			}
+			return mw.Close()
+		}()
+		pw.CloseWithError(err)
+	}()
+	req, err := c.newRequest(ctx, "POST", "/?"+q.Encode(), pr)
+	if err != nil {
+		pr.Close()
+		return res, err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	resp, err := c.do(req)
+	if err != nil {
+		pr.Close()
+		return res, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusAccepted {
+		return res, &Error{StatusCode: resp.StatusCode, Message: "the upload is queued as " + resp.Header.Get("Location")}
+	}
+	return res, errors.Wrap(json.NewDecoder(resp.Body).Decode(&res), "decode upload result")
+}
+
+// writeFilePart writes the file as a part of the form.
+func writeFilePart(mw *multipart.Writer, name string, r io.Reader, opts *UploadOptions) error {
+	h := make(textproto.MIMEHeader, 3)
+	h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="upfile"; filename="%s"`, quoteEscaper.Replace(filepath.Base(name))))
+	if opts != nil && opts.MIMEType != "" {
+		h.Set("Content-Type", opts.MIMEType)
+	} else {
+		h.Set("Content-Type", "application/octet-stream")
+	}
+	if opts != nil && !opts.ModTime.IsZero() {
+		h.Set("Last-Modified", opts.ModTime.UTC().Format(http.TimeFormat))
+	}
+	fw, err := mw.CreatePart(h)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, r)
+	return errors.Wrapf(err, "copy %q", name)
+}
+
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+// Get returns the contents of the file (following its schema).
+func (c *Client) Get(ctx context.Context, ref string) (io.ReadCloser, error) {
+	return c.get(ctx, "/"+url.PathEscape(ref))
+}
+
+// GetRaw returns the exact bytes of the blob.
+func (c *Client) GetRaw(ctx context.Context, ref string) (io.ReadCloser, error) {
+	return c.get(ctx, "/"+url.PathEscape(ref)+"?as=raw")
+}
+
+func (c *Client) get(ctx context.Context, path string) (io.ReadCloser, error) {
+	req, err := c.newRequest(ctx, "GET", path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// StatResult is the existence and the size of a blob.
+type StatResult struct {
+	BlobRef string `json:"blobRef"`
+	Exists  bool   `json:"exists"`
+	Size    uint32 `json:"size,omitempty"`
+}
+
+// Stat returns the existence and the size of the blobs.
+func (c *Client) Stat(ctx context.Context, refs ...string) ([]StatResult, error) {
+	b, err := json.Marshal(refs)
+	if err != nil {
+		return nil, err
+	}
+	req, err := c.newRequest(ctx, "POST", "/stat", bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	var res []StatResult
+	return res, c.doJSON(req, &res)
+}
+
+// Metadata is the metadata of a file, as the server's index knows it.
+type Metadata struct {
+	BlobRef  string            `json:"blobRef"`
+	FileName string            `json:"fileName,omitempty"`
+	Size     int64             `json:"size"`
+	MIMEType string            `json:"mimeType,omitempty"`
+	Time     *time.Time        `json:"time,omitempty"`
+	ModTime  *time.Time        `json:"modTime,omitempty"`
+	Image    json.RawMessage   `json:"image,omitempty"`
+	Location json.RawMessage   `json:"location,omitempty"`
+	Tags     map[string]string `json:"tags,omitempty"`
+	PDF      map[string]string `json:"pdf,omitempty"`
+}
+
+// Describe returns the metadata of the file (or of the content of the permanode).
+func (c *Client) Describe(ctx context.Context, ref string) (Metadata, error) {
+	var md Metadata
+	req, err := c.newRequest(ctx, "GET", "/meta/"+url.PathEscape(ref), nil)
+	if err != nil {
+		return md, err
+	}
+	return md, c.doJSON(req, &md)
+}
+
+// Permanode is a permanode with its attributes.
+type Permanode struct {
+	Ref     string     `json:"permanode"`
+	Attr    url.Values `json:"attr,omitempty"`
+	ModTime time.Time  `json:"modtime,omitempty"`
+}
+
+// PermanodePage is a page of permanodes. Continue is the token for the
+// next page, empty at the end.
+type PermanodePage struct {
+	Permanodes []Permanode `json:"permanodes"`
+	Continue   string      `json:"continue,omitempty"`
+}
+
+// Search returns a page of at most limit permanodes having the attribute
+// with the value (any value, if empty), or all of them if attr is empty,
+// the last modified first, starting at cont (the Continue of the previous page).
+func (c *Client) Search(ctx context.Context, attr, value string, limit int, cont string) (PermanodePage, error) {
+	var page PermanodePage
+	q := url.Values{}
+	path := "/permanodes"
+	if attr != "" {
+		path = "/lookup"
+		q.Set("attr", attr)
+		if value != "" {
+			q.Set("value", value)
+		}
+	}
+	if limit > 0 {
+		q.Set("limit", strconv.Itoa(limit))
+	}
+	if cont != "" {
+		q.Set("continue", cont)
+	}
+	if len(q) != 0 {
+		path += "?" + q.Encode()
+	}
+	req, err := c.newRequest(ctx, "GET", path, nil)
+	if err != nil {
+		return page, err
+	}
+	return page, c.doJSON(req, &page)
+}
+
+func (c *Client) newRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, c.URL+path, body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s %s", method, path)
+	}
+	req = req.WithContext(ctx)
+	if c.Server != "" {
+		req.Header.Set("X-Camli-Server", c.Server)
+	}
+	if c.User != "" {
+		req.SetBasicAuth(c.User, c.Password)
+	}
+	return req, nil
+}
+
+// do does the request, and returns the non-2xx answers as *Error.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	hc := c.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s %s", req.Method, req.URL.Path)
+	}
+	if resp.StatusCode/100 != 2 {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		return nil, &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(b))}
+	}
+	return resp, nil
+}
+
+func (c *Client) doJSON(req *http.Request, v interface{}) error {
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return errors.Wrapf(json.NewDecoder(resp.Body).Decode(v), "decode the answer of %s", req.URL.Path)
+}
@@ -0,0 +1,88 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestClient(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Camli-Server") != "upstream" {
+			http.Error(w, "no server", 400)
+			return
+		}
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/stat":
+			var refs []string
+			json.NewDecoder(r.Body).Decode(&refs)
+			res := make([]StatResult, len(refs))
+			for i, ref := range refs {
+				res[i] = StatResult{BlobRef: ref, Exists: i == 0, Size: 3}
+			}
+			json.NewEncoder(w).Encode(res)
+		case r.Method == "POST" && r.URL.Path == "/":
+			mr, err := r.MultipartReader()
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			res := UploadResult{Content: "sha224-c", Attr: map[string][]string{}}
+			for {
+				part, err := mr.NextPart()
+				if err != nil {
+					break
+				}
+				b, _ := ioutil.ReadAll(part)
+				if part.FormName() == "attrs" {
+					res.Permanode = "sha224-p"
+					continue
+				}
+				res.Size += int64(len(b))
+				res.MIMEType = part.Header.Get("Content-Type")
+			}
+			json.NewEncoder(w).Encode(res)
+		case r.Method == "GET" && r.URL.Path == "/sha224-c":
+			w.Write([]byte("abc"))
+		default:
+			http.Error(w, "not found", 404)
+		}
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	cl := New(srv.URL + "/")
+	cl.Server = "upstream"
+	res, err := cl.Upload(ctx, "a.txt", strings.NewReader("abc"), &UploadOptions{MIMEType: "text/plain", Attrs: map[string]string{"title": "A"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Content != "sha224-c" || res.Permanode != "sha224-p" || res.Size != 3 || res.MIMEType != "text/plain" {
+		t.Errorf("upload: got %+v", res)
+	}
+	sts, err := cl.Stat(ctx, "sha224-c", "sha224-x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sts) != 2 || !sts[0].Exists || sts[1].Exists {
+		t.Errorf("stat: got %+v", sts)
+	}
+	rc, err := cl.Get(ctx, "sha224-c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(rc)
+	rc.Close()
+	if string(b) != "abc" {
+		t.Errorf("get: got %q", b)
+	}
+	if _, err = cl.Get(ctx, "sha224-x"); err == nil {
+		t.Error("get of a missing blob: no error")
+	} else if e, ok := err.(*Error); !ok || e.StatusCode != 404 {
+		t.Errorf("get of a missing blob: got %#v", err)
+	}
+}
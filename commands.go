@@ -0,0 +1,101 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// command is a subcommand of camproxy, getting the arguments after its name.
+// The global flags are given before the name.
+type command struct {
+	run   func(ctx context.Context, args []string) error
+	usage string
+}
+
+var commands = map[string]command{
+	"serve": {run: serveCommand,
+		usage: "run the proxy (the default)"},
+	"cache-stats": {run: cacheStatsCommand,
+		usage: "summarize the sizes, entry counts and ages of the caches"},
+	"dedupe-report": {run: dedupeReportCommand,
+		usage: "report how much of a directory is already stored on the server: dedupe-report [-include glob,...] [-exclude glob,...] dir"},
+	"export": {run: exportCommand,
+		usage: "write the file and directory trees into a tarball: export [-o out.tar] ref..."},
+	"get": {run: getCommand,
+		usage: "fetch the blobs (base64 refs accepted) to stdout or into a directory: get [-raw] [-o dir] ref..."},
+	"put": {run: putCommand,
+		usage: "upload the files and directories: put [-permanode] [-mtime t] [-tag tag] [-attr k=v,...] [-user user] [-journal file] path..."},
+	"watch": {run: watchCommand,
+		usage: "upload the new and changed files of a directory: watch [-debounce 2s] [-include glob,...] [-exclude glob,...] [-delete] [-permanode] dir"},
+	"sync": {run: syncCommand,
+		usage: "copy the missing blobs from one server to another: sync -from A -to B [-ref root1,root2]"},
+	"verify": {run: verifyCommand,
+		usage: "verify the paranoid copies against the server"},
+	"verify-paranoid": {run: verifyCommand,
+		usage: "same as verify"},
+	"gc-paranoid": {run: func(ctx context.Context, args []string) error {
+		return gcParanoidCommand(ctx, os.Stdout, args)
+	},
+		usage: "remove the paranoid copies of the blobs already on the server"},
+	"import": {run: importCommand,
+		usage: "upload the contents of a tarball as a directory tree: import [-permanode] [-attr k=v,...] [-include glob,...] [-exclude glob,...] backup.tar"},
+	"import-s3": {run: importS3Command,
+		usage: "upload the objects of an S3 bucket, resumably: import-s3 [-workers 8] [-journal file] [-endpoint url] [-region r] s3://bucket/prefix"},
+	"install-service": {run: func(ctx context.Context, args []string) error {
+		// the flags before the command are the flags of the service
+		return installService(os.Args[1 : len(os.Args)-flag.NArg()])
+	},
+		usage: "install camproxy as a Windows service, running with the given flags"},
+	"remove-service": {run: func(ctx context.Context, args []string) error {
+		return removeService()
+	},
+		usage: "remove the Windows service"},
+}
+
+func usage() {
+	w := flag.CommandLine.Output()
+	fmt.Fprintf(w, "Usage: %s [flags] [command [args]]\n\nCommands:\n", os.Args[0])
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %s\n\t%s\n", name, commands[name].usage)
+	}
+	fmt.Fprintf(w, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+// verifyCommand verifies the paranoid copies: camproxy -paranoid=dir verify
+func verifyCommand(ctx context.Context, args []string) error {
+	if *flagParanoid == "" {
+		return errors.New("verify needs -paranoid")
+	}
+	problems, err := verifyParanoid(ctx, os.Stdout, *flagParanoid, server)
+	if err == nil && problems > 0 {
+		err = errors.Errorf("%d problems", problems)
+	}
+	return err
+}
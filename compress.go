@@ -1,8 +1,90 @@
 package main
 
+import (
+	"compress/gzip"
+	"io"
+	"os/exec"
+
+	"github.com/pkg/errors"
+)
+
 var archCmd = make(map[string][]string, 2)
 
 func init() {
 	archCmd["tar"] = []string{"tar", "cf", "-", "--remove-files", "./"}
 	archCmd["zip"] = []string{"zip", "-r", "-m", "-2", "-", "./"}
 }
+
+// compressExt is the file extension for each supported compression method.
+var compressExt = map[string]string{"gzip": ".gz", "zstd": ".zst"}
+
+// newCompressWriter returns a WriteCloser compressing into w with the method.
+// Close must be called to flush the compressed stream.
+func newCompressWriter(method string, w io.Writer) (io.WriteCloser, error) {
+	switch method {
+	case "gzip":
+		return gzip.NewWriterLevel(w, gzip.BestCompression)
+	case "zstd":
+		return newCmdWriter(w, "zstd", "-q", "-c", "-19")
+	}
+	return nil, errors.Errorf("unknown compression %q", method)
+}
+
+// newDecompressReader returns a ReadCloser decompressing r with the method.
+func newDecompressReader(method string, r io.Reader) (io.ReadCloser, error) {
+	switch method {
+	case "gzip":
+		return gzip.NewReader(r)
+	case "zstd":
+		c := exec.Command("zstd", "-q", "-d", "-c")
+		c.Stdin = r
+		stdout, err := c.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err = c.Start(); err != nil {
+			return nil, errors.Wrapf(err, "start %q", c.Args)
+		}
+		return cmdReader{ReadCloser: stdout, cmd: c}, nil
+	}
+	return nil, errors.Errorf("unknown compression %q", method)
+}
+
+type cmdWriter struct {
+	io.WriteCloser
+	cmd *exec.Cmd
+}
+
+func newCmdWriter(w io.Writer, name string, args ...string) (cmdWriter, error) {
+	c := exec.Command(name, args...)
+	c.Stdout = w
+	stdin, err := c.StdinPipe()
+	if err != nil {
+		return cmdWriter{}, err
+	}
+	if err = c.Start(); err != nil {
+		return cmdWriter{}, errors.Wrapf(err, "start %q", c.Args)
+	}
+	return cmdWriter{WriteCloser: stdin, cmd: c}, nil
+}
+
+func (cw cmdWriter) Close() error {
+	err := cw.WriteCloser.Close()
+	if waitErr := cw.cmd.Wait(); waitErr != nil && err == nil {
+		err = errors.Wrapf(waitErr, "%q", cw.cmd.Args)
+	}
+	return err
+}
+
+type cmdReader struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+func (cr cmdReader) Close() error {
+	err := cr.ReadCloser.Close()
+	if waitErr := cr.cmd.Wait(); waitErr != nil && err == nil {
+		err = errors.Wrapf(waitErr, "%q", cr.cmd.Args)
+	}
+	return err
+}
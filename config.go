@@ -0,0 +1,149 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"mime"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/tgulacsi/camproxy/camutil"
+)
+
+// config is the -config file.
+type config struct {
+	// Servers are the settings of the upstream servers, keyed by the server
+	// (as given in -server, -servers or X-Camli-Server).
+	// The servers listed here are selectable per request, too.
+	Servers map[string]serverConfig `json:"servers"`
+	// Schedules are the directories uploaded periodically by the proxy.
+	Schedules []scheduleConfig `json:"schedules,omitempty"`
+	// HaveCache is the have cache of the direct uploads, if not set by the flags.
+	HaveCache *haveCacheConfig `json:"haveCache,omitempty"`
+	// MIMETypes override the MIME types of the files served (before the
+	// sniffing), keyed by the extension (".csv") or a path.Match pattern of
+	// the file name ("*.tar.zst"). The longest matching pattern wins.
+	MIMETypes map[string]string `json:"mimeTypes,omitempty"`
+	// Charsets are the charsets of the MIME types served without one,
+	// as "text/csv": "windows-1250".
+	Charsets map[string]string `json:"charsets,omitempty"`
+}
+
+// haveCacheConfig selects the have cache, as the -havecache* flags.
+type haveCacheConfig struct {
+	// Type is memory (or lru), kv, leveldb, bbolt or sqlite.
+	Type string `json:"type"`
+	Dir  string `json:"dir,omitempty"`
+	Max  int    `json:"max,omitempty"`
+}
+
+// serverConfig holds the credentials of an upstream server.
+type serverConfig struct {
+	// Auth is in the format of CAMLI_AUTH: userpass:user:password, token:..., etc.
+	// or a reference to it (file:..., env:..., cmd:..., vault:..., see readSecret).
+	Auth       string `json:"auth,omitempty"`
+	ClientCert string `json:"clientCert,omitempty"`
+	ClientKey  string `json:"clientKey,omitempty"`
+}
+
+var cfg config
+
+func loadConfig(filename string) (config, error) {
+	var c config
+	fh, err := os.Open(filename)
+	if err != nil {
+		return c, err
+	}
+	defer fh.Close()
+	if err = json.NewDecoder(fh).Decode(&c); err != nil {
+		return c, errors.Wrapf(err, "decode %q", filename)
+	}
+	for srv, sc := range c.Servers {
+		if sc.Auth, err = readSecret(sc.Auth); err != nil {
+			return c, errors.Wrapf(err, "auth of %q", srv)
+		}
+		c.Servers[srv] = sc
+	}
+	// match case-insensitively
+	mimeTypes := make(map[string]string, len(c.MIMETypes))
+	for k, v := range c.MIMETypes {
+		k = strings.ToLower(k)
+		if _, err = path.Match(k, ""); err != nil {
+			return c, errors.Wrapf(err, "mimeTypes pattern %q", k)
+		}
+		mimeTypes[k] = v
+	}
+	c.MIMETypes = mimeTypes
+	charsets := make(map[string]string, len(c.Charsets))
+	for k, v := range c.Charsets {
+		charsets[strings.ToLower(k)] = v
+	}
+	c.Charsets = charsets
+	return c, nil
+}
+
+// mimeOverride returns the MIME type of the file name from MIMETypes,
+// or "" if none matches.
+func (c config) mimeOverride(name string) string {
+	if len(c.MIMETypes) == 0 || name == "" {
+		return ""
+	}
+	base := strings.ToLower(path.Base(name))
+	var best, mimeType string
+	for pat, typ := range c.MIMETypes {
+		if strings.HasPrefix(pat, ".") || len(pat) <= len(best) {
+			continue
+		}
+		if ok, _ := path.Match(pat, base); ok {
+			best, mimeType = pat, typ
+		}
+	}
+	if mimeType != "" {
+		return mimeType
+	}
+	return c.MIMETypes[path.Ext(base)]
+}
+
+// withCharset adds the charset from Charsets to the MIME type, if it has none.
+func (c config) withCharset(mimeType string) string {
+	if len(c.Charsets) == 0 || mimeType == "" {
+		return mimeType
+	}
+	mt, params, err := mime.ParseMediaType(mimeType)
+	if err != nil || params["charset"] != "" {
+		return mimeType
+	}
+	cs := c.Charsets[mt]
+	if cs == "" {
+		return mimeType
+	}
+	params["charset"] = cs
+	return mime.FormatMediaType(mt, params)
+}
+
+// serverOpts returns camOpts with the settings of the server from the config.
+func serverOpts(server string) *camutil.Options {
+	opts := camOpts
+	if sc, ok := cfg.Servers[server]; ok {
+		opts.Auth = sc.Auth
+		opts.ClientCert, opts.ClientKey = sc.ClientCert, sc.ClientKey
+	}
+	return &opts
+}
@@ -0,0 +1,207 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// The encrypted stream is the magic, a random nonce prefix, then the
+// plaintext in encSegmentSize segments, each sealed with AES-256-GCM,
+// the nonce being the prefix, the segment counter and a last-segment flag.
+const (
+	encMagic       = "camproxy-enc1\n"
+	encPrefixSize  = 7
+	encSegmentSize = 64 << 10
+)
+
+// loadKey reads the 32-byte AES key from the file, or from the output of
+// the command (e.g. a KMS decrypt call), raw, hex- or base64-encoded.
+func loadKey(file, command string) ([]byte, error) {
+	var b []byte
+	var err error
+	if command != "" {
+		args := strings.Fields(command)
+		if b, err = exec.Command(args[0], args[1:]...).Output(); err != nil {
+			return nil, errors.Wrapf(err, "run %q", command)
+		}
+	} else if b, err = ioutil.ReadFile(file); err != nil {
+		return nil, errors.Wrapf(err, "read %q", file)
+	}
+	if len(b) == 32 {
+		return b, nil
+	}
+	s := strings.TrimSpace(string(b))
+	if k, err := hex.DecodeString(s); err == nil && len(k) == 32 {
+		return k, nil
+	}
+	if k, err := base64.StdEncoding.DecodeString(s); err == nil && len(k) == 32 {
+		return k, nil
+	}
+	return nil, errors.New("key must be 32 bytes (raw, hex or base64)")
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+type encryptWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	nonce  []byte
+	buf    []byte
+	out    []byte
+	seq    uint32
+	closed bool
+}
+
+// newEncryptWriter returns a WriteCloser encrypting into w with the key.
+// Close must be called to write the last segment.
+func newEncryptWriter(key []byte, w io.Writer) (io.WriteCloser, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	ew := &encryptWriter{w: w, aead: aead, nonce: make([]byte, aead.NonceSize()),
+		buf: make([]byte, 0, encSegmentSize)}
+	if _, err = io.ReadFull(rand.Reader, ew.nonce[:encPrefixSize]); err != nil {
+		return nil, err
+	}
+	if _, err = io.WriteString(w, encMagic); err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(ew.nonce[:encPrefixSize]); err != nil {
+		return nil, err
+	}
+	return ew, nil
+}
+
+func (ew *encryptWriter) Write(p []byte) (int, error) {
+	var n int
+	for len(p) > 0 {
+		// keep the full segment until we know whether it is the last one
+		if len(ew.buf) == encSegmentSize {
+			if err := ew.flush(false); err != nil {
+				return n, err
+			}
+		}
+		m := copy(ew.buf[len(ew.buf):encSegmentSize], p)
+		ew.buf = ew.buf[:len(ew.buf)+m]
+		p = p[m:]
+		n += m
+	}
+	return n, nil
+}
+
+func (ew *encryptWriter) flush(last bool) error {
+	setSegmentNonce(ew.nonce, ew.seq, last)
+	ew.seq++
+	ew.out = ew.aead.Seal(ew.out[:0], ew.nonce, ew.buf, nil)
+	ew.buf = ew.buf[:0]
+	_, err := ew.w.Write(ew.out)
+	return err
+}
+
+func (ew *encryptWriter) Close() error {
+	if ew.closed {
+		return nil
+	}
+	ew.closed = true
+	return ew.flush(true)
+}
+
+func setSegmentNonce(nonce []byte, seq uint32, last bool) {
+	binary.BigEndian.PutUint32(nonce[encPrefixSize:encPrefixSize+4], seq)
+	nonce[len(nonce)-1] = 0
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+}
+
+type decryptReader struct {
+	r     *bufio.Reader
+	aead  cipher.AEAD
+	nonce []byte
+	seg   []byte
+	buf   []byte
+	seq   uint32
+	done  bool
+}
+
+// newDecryptReader returns a Reader decrypting r (written by newEncryptWriter).
+func newDecryptReader(key []byte, r io.Reader) (io.Reader, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	dr := &decryptReader{r: bufio.NewReader(r), aead: aead, nonce: make([]byte, aead.NonceSize()),
+		seg: make([]byte, encSegmentSize+aead.Overhead())}
+	magic := make([]byte, len(encMagic))
+	if _, err = io.ReadFull(dr.r, magic); err != nil || !bytes.Equal(magic, []byte(encMagic)) {
+		return nil, errors.New("not an encrypted stream")
+	}
+	if _, err = io.ReadFull(dr.r, dr.nonce[:encPrefixSize]); err != nil {
+		return nil, errors.Wrap(err, "read nonce")
+	}
+	return dr, nil
+}
+
+func (dr *decryptReader) Read(p []byte) (int, error) {
+	for len(dr.buf) == 0 {
+		if dr.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(dr.r, dr.seg)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		last := err == io.ErrUnexpectedEOF
+		if !last {
+			_, peekErr := dr.r.Peek(1)
+			last = peekErr == io.EOF
+		}
+		setSegmentNonce(dr.nonce, dr.seq, last)
+		dr.seq++
+		if dr.buf, err = dr.aead.Open(dr.seg[:0:0], dr.nonce, dr.seg[:n], nil); err != nil {
+			return 0, errors.Wrapf(err, "decrypt segment %d", dr.seq-1)
+		}
+		dr.done = last
+	}
+	n := copy(p, dr.buf)
+	dr.buf = dr.buf[n:]
+	return n, nil
+}
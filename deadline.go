@@ -0,0 +1,127 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// deadlineHandler bounds the time of the request by its X-Deadline-Ms
+// (milliseconds) or Request-Timeout (seconds) header, through its context.
+// An error response written after the deadline is replaced by a
+// 504 Gateway Timeout, with a JSON body.
+type deadlineHandler struct {
+	next http.Handler
+}
+
+func (dh deadlineHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d, err := requestDeadline(r.Header)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if d <= 0 {
+		dh.next.ServeHTTP(w, r)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), d)
+	defer cancel()
+	dh.next.ServeHTTP(&deadlineWriter{ResponseWriter: w, ctx: ctx, deadline: d, start: time.Now()}, r.WithContext(ctx))
+}
+
+// requestDeadline returns the deadline of the request, 0 if there is none.
+func requestDeadline(hdr http.Header) (time.Duration, error) {
+	if s := strings.TrimSpace(hdr.Get("X-Deadline-Ms")); s != "" {
+		ms, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || ms <= 0 {
+			return 0, errors.Errorf("X-Deadline-Ms %q: not a positive number", s)
+		}
+		return time.Duration(ms) * time.Millisecond, nil
+	}
+	if s := strings.TrimSpace(hdr.Get("Request-Timeout")); s != "" {
+		secs, err := strconv.ParseFloat(s, 64)
+		if err != nil || secs <= 0 {
+			return 0, errors.Errorf("Request-Timeout %q: not a positive number", s)
+		}
+		return time.Duration(secs * float64(time.Second)), nil
+	}
+	return 0, nil
+}
+
+// deadlineError is the body of the 504 response of an expired deadline.
+type deadlineError struct {
+	Error      string `json:"error"`
+	Status     int    `json:"status"`
+	DeadlineMs int64  `json:"deadlineMs"`
+	ElapsedMs  int64  `json:"elapsedMs"`
+}
+
+// deadlineWriter replaces the server error written after the deadline
+// (the upstream operation was cancelled) with a deadlineError.
+type deadlineWriter struct {
+	http.ResponseWriter
+	ctx         context.Context
+	deadline    time.Duration
+	start       time.Time
+	wroteHeader bool
+	expired     bool
+}
+
+func (dw *deadlineWriter) WriteHeader(code int) {
+	if dw.wroteHeader {
+		return
+	}
+	dw.wroteHeader = true
+	if code < 500 || dw.ctx.Err() != context.DeadlineExceeded {
+		dw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	dw.expired = true
+	hdr := dw.ResponseWriter.Header()
+	hdr.Del("Content-Length")
+	hdr.Set("Content-Type", "application/json")
+	dw.ResponseWriter.WriteHeader(http.StatusGatewayTimeout)
+	json.NewEncoder(dw.ResponseWriter).Encode(deadlineError{
+		Error: "deadline exceeded", Status: http.StatusGatewayTimeout,
+		DeadlineMs: int64(dw.deadline / time.Millisecond),
+		ElapsedMs:  int64(time.Since(dw.start) / time.Millisecond),
+	})
+}
+
+func (dw *deadlineWriter) Write(p []byte) (int, error) {
+	if !dw.wroteHeader {
+		dw.WriteHeader(http.StatusOK)
+	}
+	if dw.expired {
+		// drop the body of the replaced response
+		return len(p), nil
+	}
+	return dw.ResponseWriter.Write(p)
+}
+
+func (dw *deadlineWriter) Flush() {
+	if f, ok := dw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,63 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/tgulacsi/camproxy/camutil"
+)
+
+// dedupeReportCommand reports how much of the directory is already stored:
+//
+//	camproxy dedupe-report [-include glob,...] [-exclude glob,...] dir
+func dedupeReportCommand(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("dedupe-report", flag.ContinueOnError)
+	flagInclude := fs.String("include", "", "comma-separated globs: check only the matching files")
+	flagExclude := fs.String("exclude", "", "comma-separated globs: skip the matching files and directories")
+	flagIgnore := fs.String("ignore-file", camutil.IgnoreFileName, "honor the gitignore-style ignore files of this name")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("exactly one directory is needed")
+	}
+	cl, err := camutil.NewClient(ctx, server, serverOpts(server))
+	if err != nil {
+		return errors.Wrapf(err, "connect to %q", server)
+	}
+	st, err := camutil.DedupeReport(ctx, cl, fs.Arg(0), camutil.DirOptions{
+		Include: splitGlobs(*flagInclude), Exclude: splitGlobs(*flagExclude), IgnoreFile: *flagIgnore})
+	if err != nil {
+		return err
+	}
+	percent := func(a, b int64) float64 {
+		if b == 0 {
+			return 0
+		}
+		return 100 * float64(a) / float64(b)
+	}
+	fmt.Fprintf(os.Stdout, "files:\t%d\t%d bytes\n", st.Files, st.Bytes)
+	fmt.Fprintf(os.Stdout, "blobs:\t%d\t%d bytes\t(%.1f%% of the files' size)\n", st.Blobs, st.BlobBytes, percent(st.BlobBytes, st.Bytes))
+	fmt.Fprintf(os.Stdout, "stored:\t%d\t%d bytes\t(%.1f%%)\n", st.StoredBlobs, st.StoredBytes, percent(st.StoredBytes, st.BlobBytes))
+	fmt.Fprintf(os.Stdout, "new:\t%d\t%d bytes\t(%.1f%%)\n", st.Blobs-st.StoredBlobs, st.NewBytes(), percent(st.NewBytes(), st.BlobBytes))
+	return nil
+}
@@ -0,0 +1,195 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/sorted"
+	"perkeep.org/pkg/sorted/kvfile"
+)
+
+var deletes *deleteDB
+
+// deleteDB remembers the delete claims signed through the proxy,
+// keyed by their targets, so they can be undone.
+type deleteDB struct {
+	db sorted.KeyValue
+}
+
+func newDeleteDB(filename string) (*deleteDB, error) {
+	db, err := kvfile.NewStorage(filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open %q", filename)
+	}
+	return &deleteDB{db: db}, nil
+}
+
+func (d *deleteDB) Close() error {
+	if d == nil || d.db == nil {
+		return nil
+	}
+	return d.db.Close()
+}
+
+// Add records the delete claim of the target.
+func (d *deleteDB) Add(target, claim blob.Ref) error {
+	claims := d.Claims(target)
+	for _, c := range claims {
+		if c == claim {
+			return nil
+		}
+	}
+	return d.set(target, append(claims, claim))
+}
+
+// Claims returns the recorded delete claims of the target.
+func (d *deleteDB) Claims(target blob.Ref) []blob.Ref {
+	v, err := d.db.Get(target.String())
+	if err != nil {
+		return nil
+	}
+	var claims []blob.Ref
+	for _, s := range strings.Fields(v) {
+		if br, ok := blob.Parse(s); ok {
+			claims = append(claims, br)
+		}
+	}
+	return claims
+}
+
+func (d *deleteDB) set(target blob.Ref, claims []blob.Ref) error {
+	if len(claims) == 0 {
+		return d.db.Delete(target.String())
+	}
+	ss := make([]string, len(claims))
+	for i, c := range claims {
+		ss[i] = c.String()
+	}
+	return d.db.Set(target.String(), strings.Join(ss, " "))
+}
+
+// serveDelete signs a delete claim of the permanode:
+//
+//	DELETE /<permanode>
+func serveDelete(w http.ResponseWriter, r *http.Request, server string) {
+	items, err := parseRefs(r.URL.Path[1:])
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	target, user := items[0], authUser(r)
+	if !checkAccess(w, r, target) {
+		return
+	}
+	u, err := getUploader(r.Context(), server, user)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error getting uploader to %q: %s", server, err), 500)
+		return
+	}
+	claim, err := u.Delete(r.Context(), target)
+	if err != nil {
+		http.Error(w, err.Error(), errStatus(err))
+		return
+	}
+	if deletes != nil {
+		if err = deletes.Add(target, claim); err != nil {
+			logger.Log("msg", "record delete", "target", target, "claim", claim, "error", err)
+		}
+	}
+	logger.Log("msg", "deleted", "target", target, "claim", claim, "user", user)
+	w.Header().Set("Content-Type", "text/plain")
+	io.WriteString(w, claim.String())
+}
+
+// serveUndelete undoes the deletes of the permanode made through the proxy
+// (or just the given delete claim), by deleting the delete claims:
+//
+//	POST /undelete/<permanode>[?claim=<delete claim>]
+func serveUndelete(w http.ResponseWriter, r *http.Request, server string) {
+	if deletes == nil {
+		http.Error(w, "the undeletes need -delete-db", http.StatusNotImplemented)
+		return
+	}
+	items, err := parseRefs(strings.TrimPrefix(r.URL.Path, "/undelete/"))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	target, user := items[0], authUser(r)
+	if !checkAccess(w, r, target) {
+		return
+	}
+	claims := deletes.Claims(target)
+	if s := r.URL.Query().Get("claim"); s != "" {
+		asked, err := parseRefs(s)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		// just the claims deleting target can be undone
+		for _, claim := range asked {
+			known := false
+			for _, c := range claims {
+				if known = c == claim; known {
+					break
+				}
+			}
+			if !known {
+				http.Error(w, fmt.Sprintf("%s is not a known delete claim of %s", claim, target), http.StatusForbidden)
+				return
+			}
+		}
+		claims = asked
+	}
+	if len(claims) == 0 {
+		http.Error(w, "no known delete claim of "+target.String(), http.StatusNotFound)
+		return
+	}
+	u, err := getUploader(r.Context(), server, user)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error getting uploader to %q: %s", server, err), 500)
+		return
+	}
+	remaining := deletes.Claims(target)
+	undos := make([]string, 0, len(claims))
+	for _, claim := range claims {
+		undo, err := u.Delete(r.Context(), claim)
+		if err != nil {
+			http.Error(w, err.Error(), errStatus(err))
+			return
+		}
+		logger.Log("msg", "undeleted", "target", target, "claim", claim, "undo", undo, "user", user)
+		for i, c := range remaining {
+			if c == claim {
+				remaining = append(remaining[:i], remaining[i+1:]...)
+				break
+			}
+		}
+		if err = deletes.set(target, remaining); err != nil {
+			logger.Log("msg", "record undelete", "target", target, "error", err)
+		}
+		undos = append(undos, undo.String())
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	io.WriteString(w, strings.Join(undos, "\n"))
+}
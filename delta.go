@@ -0,0 +1,71 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/tgulacsi/camproxy/camutil"
+)
+
+// serveDelta writes the rsync-style delta of the file against the
+// signature (camutil.Signature as JSON) of the client's copy in the body:
+//
+//	POST /delta/<ref>
+func serveDelta(w http.ResponseWriter, r *http.Request, server string) {
+	items, err := parseRefs(strings.TrimPrefix(r.URL.Path, "/delta/"))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if len(items) != 1 {
+		http.Error(w, "exactly one blobref is needed", 400)
+		return
+	}
+	br := items[0]
+	if !checkAccess(w, r, br) {
+		return
+	}
+	var sig camutil.Signature
+	if err = json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<20)).Decode(&sig); err != nil {
+		http.Error(w, fmt.Sprintf("parse signature: %v", err), 400)
+		return
+	}
+	if sig.BlockSize < camutil.MinDeltaBlockSize || sig.BlockSize > camutil.MaxChunkSize {
+		http.Error(w, fmt.Sprintf("blockSize must be between %d and %d", camutil.MinDeltaBlockSize, camutil.MaxChunkSize), 400)
+		return
+	}
+	d, err := getDownloader(r.Context(), server)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error getting downloader to %q: %s", server, err), 500)
+		return
+	}
+	fr, err := d.OpenFile(r.Context(), br)
+	if err != nil {
+		http.Error(w, err.Error(), errStatus(err))
+		return
+	}
+	defer fr.Close()
+	w.Header().Set("Content-Type", "application/vnd.camproxy.delta")
+	w.Header().Set("ETag", `"`+br.String()+`"`)
+	if err = camutil.WriteFileDelta(r.Context(), w, fr, sig); err != nil {
+		logger.Log("msg", "write delta", "ref", br, "error", err)
+	}
+}
@@ -0,0 +1,104 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// bodyDigest checks the SHA-256 digest of the request body against the one
+// declared by the client in the Digest (sha-256=<base64>) or the
+// X-Content-SHA256 (<hex>) header.
+type bodyDigest struct {
+	want []byte
+	h    hash.Hash
+	// body is the hashing reader of the request body
+	body io.Reader
+}
+
+// newBodyDigest returns the bodyDigest of the request, hashing the body
+// as it is read - nil if the request does not declare a digest.
+func newBodyDigest(r *http.Request) (*bodyDigest, error) {
+	want, err := declaredDigest(r.Header)
+	if err != nil || want == nil {
+		return nil, err
+	}
+	bd := &bodyDigest{want: want, h: sha256.New()}
+	bd.body = io.TeeReader(r.Body, bd.h)
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{bd.body, r.Body}
+	return bd, nil
+}
+
+// declaredDigest returns the SHA-256 digest declared in the headers,
+// nil if there is none.
+func declaredDigest(hdr http.Header) ([]byte, error) {
+	for _, v := range hdr["Digest"] {
+		for _, d := range strings.Split(v, ",") {
+			i := strings.IndexByte(d, '=')
+			if i < 0 || !strings.EqualFold(strings.TrimSpace(d[:i]), "sha-256") {
+				continue
+			}
+			b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(d[i+1:]))
+			if err == nil && len(b) != sha256.Size {
+				err = errors.Errorf("%d bytes", len(b))
+			}
+			if err != nil {
+				return nil, errors.Wrapf(err, "Digest %q", d)
+			}
+			return b, nil
+		}
+	}
+	if v := strings.TrimSpace(hdr.Get("X-Content-SHA256")); v != "" {
+		b, err := hex.DecodeString(v)
+		if err == nil && len(b) != sha256.Size {
+			err = errors.Errorf("%d bytes", len(b))
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "X-Content-SHA256 %q", v)
+		}
+		return b, nil
+	}
+	return nil, nil
+}
+
+// Check reads the rest of the body, and returns the computed digest (as
+// sha-256=<base64>), with an error if it differs from the declared one.
+func (bd *bodyDigest) Check() (string, error) {
+	if _, err := io.Copy(ioutil.Discard, bd.body); err != nil {
+		return "", errors.Wrap(err, "read body")
+	}
+	got := bd.h.Sum(nil)
+	s := "sha-256=" + base64.StdEncoding.EncodeToString(got)
+	if !bytes.Equal(got, bd.want) {
+		return s, fmt.Errorf("digest mismatch: got %s (%x), wanted sha-256=%s", s, got, base64.StdEncoding.EncodeToString(bd.want))
+	}
+	return s, nil
+}
@@ -0,0 +1,57 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import "fmt"
+
+// minFreeSpace is the space kept free in the directories the uploads are
+// written to (-min-free-space).
+var minFreeSpace int64
+
+// checkFreeSpace checks that the directories the upload is written to
+// (-tmpdir, the spool and the paranoid dir) have room for size bytes
+// (the declared length, 0 if unknown), besides minFreeSpace.
+// The directories which cannot be checked are let go.
+func checkFreeSpace(size int64) error {
+	if size < 0 {
+		size = 0
+	}
+	dirs := []string{tmpDir()}
+	if spool != nil {
+		dirs = append(dirs, spool.dir)
+	}
+	if *flagParanoid != "" {
+		dirs = append(dirs, *flagParanoid)
+	}
+	seen := make(map[string]bool, len(dirs))
+	for _, dir := range dirs {
+		if seen[dir] {
+			continue
+		}
+		seen[dir] = true
+		free, err := diskFree(dir)
+		if err != nil {
+			logger.Log("msg", "disk free", "dir", dir, "error", err)
+			continue
+		}
+		if free-minFreeSpace < size {
+			httpVars.Add("noSpace", 1)
+			return fmt.Errorf("not enough space for %d bytes in %q: %d bytes free (%d reserved)", size, dir, free, minFreeSpace)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/tgulacsi/camproxy/camutil"
+)
+
+// exportCommand writes the file and directory trees of the refs into a
+// tarball, as GET /<ref>?format=tar does:
+//
+//	camproxy export [-o out.tar] ref...
+func exportCommand(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	flagOut := fs.String("o", "", "write the tarball into this file (default: stdout)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errors.New("a blobref is needed")
+	}
+	items, err := camutil.ParseBlobNames(nil, fs.Args())
+	if err != nil {
+		return err
+	}
+	d, err := getDownloader(ctx, server)
+	if err != nil {
+		return errors.Wrapf(err, "get downloader to %q", server)
+	}
+	if *flagOut == "" || *flagOut == "-" {
+		return d.WriteTar(ctx, os.Stdout, items...)
+	}
+	fh, err := os.Create(*flagOut + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fh.Name())
+	if err = d.WriteTar(ctx, fh, items...); err != nil {
+		fh.Close()
+		return err
+	}
+	if err = fh.Close(); err != nil {
+		return err
+	}
+	return os.Rename(fh.Name(), *flagOut)
+}
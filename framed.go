@@ -0,0 +1,75 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/tgulacsi/camproxy/camutil"
+	"perkeep.org/pkg/blob"
+)
+
+// serveFramed writes each of the items as a part of a multipart/mixed
+// response, named by its X-Camli-Ref header. A failed item is a part with
+// X-Camli-Error and X-Camli-Status headers and no body - also after a part
+// broken in the middle - so the others are not lost, and not corrupted by it.
+func serveFramed(w http.ResponseWriter, r *http.Request, d *camutil.Downloader, content bool, items []blob.Ref) {
+	mw := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	okMime := "application/json"
+	if content {
+		okMime = "application/octet-stream"
+	}
+	failed := func(br blob.Ref, err error) {
+		logger.Log("msg", "framed download", "ref", br, "error", err)
+		if _, err := mw.CreatePart(textproto.MIMEHeader{
+			"X-Camli-Ref":    {br.String()},
+			"X-Camli-Error":  {err.Error()},
+			"X-Camli-Status": {strconv.Itoa(errStatus(err))},
+		}); err != nil {
+			logger.Log("msg", "write part", "ref", br, "error", err)
+		}
+	}
+	for _, br := range items {
+		if err := r.Context().Err(); err != nil {
+			return
+		}
+		rc, err := d.Start(r.Context(), content, br)
+		if err != nil {
+			failed(br, err)
+			continue
+		}
+		pw, err := mw.CreatePart(textproto.MIMEHeader{
+			"X-Camli-Ref":  {br.String()},
+			"Content-Type": {okMime},
+		})
+		if err == nil {
+			if _, err = io.Copy(pw, rc); err != nil {
+				failed(br, errors.Wrapf(err, "read %s", br))
+			}
+		}
+		rc.Close()
+	}
+	if err := mw.Close(); err != nil {
+		logger.Log("msg", "close multipart", "error", err)
+	}
+}
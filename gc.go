@@ -0,0 +1,151 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+	"perkeep.org/pkg/blob"
+)
+
+// gcParanoidCommand removes the paranoid copies older than -days,
+// whose blobs are present upstream:
+//
+//	camproxy -paranoid=dir gc-paranoid [-days 30] [-verify] [-dry-run]
+//
+// With -verify, the contents are downloaded and checked against the SHA-256
+// of the copy, too.
+func gcParanoidCommand(ctx context.Context, w io.Writer, args []string) error {
+	fs := flag.NewFlagSet("gc-paranoid", flag.ContinueOnError)
+	flagDays := fs.Int("days", 30, "remove the copies older than this many days")
+	flagVerify := fs.Bool("verify", false, "download the contents and check their SHA-256, too")
+	flagDryRun := fs.Bool("dry-run", false, "just print what would be removed")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *flagParanoid == "" {
+		return errors.New("gc-paranoid needs -paranoid")
+	}
+	d, err := getDownloader(ctx, server)
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().AddDate(0, 0, -*flagDays)
+
+	var removed int
+	var freed int64
+	remove := func(pc paranoidCopy) error {
+		if *flagVerify {
+			if err := verifyUpstream(ctx, pc); err != nil {
+				fmt.Fprintf(w, "%s\t%s\tKEPT %v\n", pc.Ref, pc.Path, err)
+				return nil
+			}
+		}
+		if *flagDryRun {
+			fmt.Fprintf(w, "%s\t%s\twould remove\n", pc.Ref, pc.Path)
+		} else if err := removeParanoidCopy(pc); err != nil {
+			return err
+		}
+		removed++
+		freed += pc.Size
+		return nil
+	}
+
+	var batch []paranoidCopy
+	statBatch := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		refs := make([]blob.Ref, len(batch))
+		for i, pc := range batch {
+			refs[i] = pc.Ref
+		}
+		sizes, err := d.Stat(ctx, refs...)
+		if err != nil {
+			return err
+		}
+		for _, pc := range batch {
+			if _, ok := sizes[pc.Ref]; !ok {
+				fmt.Fprintf(w, "%s\t%s\tKEPT missing upstream\n", pc.Ref, pc.Path)
+				continue
+			}
+			if err := remove(pc); err != nil {
+				return err
+			}
+		}
+		batch = batch[:0]
+		return nil
+	}
+	err = walkParanoid(*flagParanoid, func(pc paranoidCopy) error {
+		if !pc.Time.Before(cutoff) {
+			return nil
+		}
+		if batch = append(batch, pc); len(batch) >= 100 {
+			return statBatch()
+		}
+		return nil
+	})
+	if err == nil {
+		err = statBatch()
+	}
+	logger.Log("msg", "gc-paranoid", "removed", removed, "freed", freed, "dry-run", *flagDryRun, "error", err)
+	return err
+}
+
+// verifyUpstream checks that the upstream contents of the copy's blob
+// has the same SHA-256 as the copy.
+func verifyUpstream(ctx context.Context, pc paranoidCopy) error {
+	m, ok := readParanoidManifest(pc)
+	want := m.SHA256
+	if !ok || want == "" {
+		rc, err := openParanoidCopy(pc, m)
+		if err != nil {
+			return err
+		}
+		hsh := sha256.New()
+		_, err = io.Copy(hsh, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+		want = hex.EncodeToString(hsh.Sum(nil))
+	}
+	d, err := getDownloader(ctx, server)
+	if err != nil {
+		return err
+	}
+	rc, err := d.Start(ctx, true, pc.Ref)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	hsh := sha256.New()
+	if _, err = io.Copy(hsh, rc); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(hsh.Sum(nil)); got != want {
+		return errors.Errorf("upstream sha256=%s, copy has %s", got, want)
+	}
+	return nil
+}
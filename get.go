@@ -0,0 +1,63 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/tgulacsi/camproxy/camutil"
+)
+
+// getCommand fetches the blobs to stdout, or into a directory:
+//
+//	camproxy get [-raw] [-o dir] ref...
+func getCommand(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("get", flag.ContinueOnError)
+	flagRaw := fs.Bool("raw", false, "fetch the raw blobs (the schema JSON), not the contents of the files")
+	flagOut := fs.String("o", "", "save the files (and directories) into this directory, instead of writing to stdout")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errors.New("a blobref is needed")
+	}
+	items, err := camutil.ParseBlobNames(nil, fs.Args())
+	if err != nil {
+		return err
+	}
+	d, err := getDownloader(ctx, server)
+	if err != nil {
+		return errors.Wrapf(err, "get downloader to %q", server)
+	}
+	if *flagOut != "" {
+		if err = os.MkdirAll(*flagOut, 0755); err != nil {
+			return err
+		}
+		return d.Save(ctx, *flagOut, !*flagRaw, items...)
+	}
+	rc, err := d.Start(ctx, !*flagRaw, items...)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	_, err = io.Copy(os.Stdout, rc)
+	return err
+}
@@ -0,0 +1,168 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// upstreamVars holds 1 for each upstream server found up by the last
+// health check, 0 for the ones down.
+var upstreamVars = expvar.NewMap("upstreams")
+
+// health is the state of the upstream servers, by the periodic checks.
+var health = &upstreamHealth{}
+
+// upstreamHealth is the result of the last health check of each upstream.
+type upstreamHealth struct {
+	mu       sync.Mutex
+	interval time.Duration
+	last     map[string]upstreamStatus
+	checked  time.Time
+}
+
+// Record stores the result of a health check.
+func (uh *upstreamHealth) Record(statuses []upstreamStatus) {
+	uh.mu.Lock()
+	defer uh.mu.Unlock()
+	uh.last = make(map[string]upstreamStatus, len(statuses))
+	for _, st := range statuses {
+		uh.last[st.Server] = st
+		v := new(expvar.Int)
+		if st.Error == "" {
+			v.Set(1)
+		}
+		upstreamVars.Set(st.Server, v)
+	}
+	uh.checked = time.Now()
+}
+
+// Down reports whether the server has been found down by the last check.
+func (uh *upstreamHealth) Down(server string) bool {
+	if uh == nil {
+		return false
+	}
+	uh.mu.Lock()
+	defer uh.mu.Unlock()
+	st, ok := uh.last[server]
+	return ok && st.Error != ""
+}
+
+// Statuses returns the results of the last check, and its time.
+func (uh *upstreamHealth) Statuses() ([]upstreamStatus, time.Time) {
+	uh.mu.Lock()
+	defer uh.mu.Unlock()
+	statuses := make([]upstreamStatus, 0, len(uh.last))
+	for _, st := range uh.last {
+		statuses = append(statuses, st)
+	}
+	return statuses, uh.checked
+}
+
+// RetryAfter returns the seconds till the next check, for the Retry-After header.
+func (uh *upstreamHealth) RetryAfter() string {
+	uh.mu.Lock()
+	defer uh.mu.Unlock()
+	secs := int((uh.interval - time.Since(uh.checked)) / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	return strconv.Itoa(secs)
+}
+
+// healthLoop checks the upstreams every interval, till ctx is done.
+func healthLoop(ctx context.Context, interval time.Duration) {
+	health.mu.Lock()
+	health.interval = interval
+	health.mu.Unlock()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		statuses := checkUpstreams(ctx)
+		for _, st := range statuses {
+			if st.Error != "" {
+				logger.Log("msg", "upstream down", "server", st.Server, "error", st.Error)
+			}
+		}
+		health.Record(statuses)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// serveReadyz answers 200 iff the default upstream server is up,
+// with the state of each upstream as JSON.
+func serveReadyz(w http.ResponseWriter, r *http.Request) {
+	statuses, checked := health.Statuses()
+	code := http.StatusOK
+	if health.Down(server) {
+		code = http.StatusServiceUnavailable
+		w.Header().Set("Retry-After", health.RetryAfter())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct {
+		Ready     bool             `json:"ready"`
+		Checked   time.Time        `json:"checked"`
+		Upstreams []upstreamStatus `json:"upstreams"`
+	}{Ready: code == http.StatusOK, Checked: checked, Upstreams: statuses})
+}
+
+// spoolable reports whether the request is an upload, to be spooled (with
+// -spool) while its upstream is unavailable.
+func spoolable(r *http.Request) bool {
+	if *flagSpool == "" || r.Method != "POST" {
+		return false
+	}
+	for _, rt := range routes {
+		if rt.serve != nil && rt.match(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// readyzHandler serves /readyz before the authentication, for the probes
+// of the load balancers.
+type readyzHandler struct {
+	next http.Handler
+}
+
+func (rh readyzHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/readyz" && (r.Method == "GET" || r.Method == "HEAD") {
+		serveReadyz(w, r)
+		return
+	}
+	rh.next.ServeHTTP(w, r)
+}
+
+// needsUpstream reports whether the request is served from the upstream server.
+func needsUpstream(r *http.Request) bool {
+	p := r.URL.Path
+	return !(p == "/readyz" || p == "/debug/vars" || p == "/openapi.json" || p == "/login" || p == "/logout" || p == "/csrf" ||
+		strings.HasPrefix(p, "/admin/") || strings.HasPrefix(p, "/jobs/"))
+}
@@ -0,0 +1,160 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/tgulacsi/camproxy/camutil"
+	"perkeep.org/pkg/blob"
+)
+
+// streamFormats are the playlists/manifests of the segmented streams,
+// with the ffmpeg muxer producing them.
+var streamFormats = map[string]string{
+	"index.m3u8":   "hls",
+	"manifest.mpd": "dash",
+}
+
+var streamMIME = map[string]string{
+	".m3u8": "application/vnd.apple.mpegurl",
+	".ts":   "video/mp2t",
+	".mpd":  "application/dash+xml",
+	".m4s":  "video/iso.segment",
+}
+
+// streamLocks serializes the segmenting of the same video.
+var (
+	streamLocksMu sync.Mutex
+	streamLocks   = make(map[string]*sync.Mutex)
+)
+
+// serveStream serves the video file as HLS or DASH stream, segmented
+// (remuxed, not transcoded) by ffmpeg on the first request, into -stream-dir:
+//
+//	GET /hls/<ref>/index.m3u8 (and the segments relative to it)
+//	GET /hls/<ref>/manifest.mpd
+func serveStream(w http.ResponseWriter, r *http.Request, server string) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/hls/"), "/", 2)
+	if len(parts) != 2 || parts[1] == "" || strings.ContainsAny(parts[1], `/\`) || strings.HasPrefix(parts[1], ".") {
+		http.Error(w, "path must be /hls/<ref>/<file>", 400)
+		return
+	}
+	items, err := parseRefs(parts[0])
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	br, name := items[0], parts[1]
+	if !checkAccess(w, r, br) {
+		return
+	}
+	var format string
+	if format = streamFormats[name]; format == "" {
+		// a segment: of the playlist it is listed in
+		format = "hls"
+		if filepath.Ext(name) == ".m4s" || strings.HasPrefix(name, "init-") {
+			format = "dash"
+		}
+	}
+	dir := filepath.Join(*flagStreamDir, camutil.RefToBase64(br), format)
+	if err = segmentVideo(r.Context(), server, br, dir, format); err != nil {
+		http.Error(w, err.Error(), errStatus(err))
+		return
+	}
+	if mt := streamMIME[filepath.Ext(name)]; mt != "" {
+		w.Header().Set("Content-Type", mt)
+	}
+	http.ServeFile(w, r, filepath.Join(dir, name))
+}
+
+// segmentVideo segments the video into dir, if it has not been yet.
+func segmentVideo(ctx context.Context, server string, br blob.Ref, dir, format string) error {
+	streamLocksMu.Lock()
+	mu := streamLocks[dir]
+	if mu == nil {
+		mu = new(sync.Mutex)
+		streamLocks[dir] = mu
+	}
+	streamLocksMu.Unlock()
+	mu.Lock()
+	defer mu.Unlock()
+
+	manifest := "index.m3u8"
+	if format == "dash" {
+		manifest = "manifest.mpd"
+	}
+	if _, err := os.Stat(filepath.Join(dir, manifest)); err == nil {
+		return nil
+	}
+
+	d, err := getDownloader(ctx, server)
+	if err != nil {
+		return errors.Wrapf(err, "get downloader to %q", server)
+	}
+	// ffmpeg needs a seekable input (for the moov atom at the end of MP4s)
+	tmp := dir + ".tmp"
+	os.RemoveAll(tmp)
+	if err = os.MkdirAll(tmp, 0700); err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	src, err := ioutil.TempFile(tmpDir(), "camproxy-hls-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(src.Name())
+	_, err = d.WriteTo(ctx, br, src)
+	if closeErr := src.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	args := []string{"-nostdin", "-loglevel", "error", "-i", src.Name(), "-map", "0", "-c", "copy", "-f", format}
+	segTime := strconv.Itoa(int(flagStreamSegment.Seconds()))
+	if format == "dash" {
+		args = append(args, "-seg_duration", segTime,
+			"-init_seg_name", "init-$RepresentationID$.m4s",
+			"-media_seg_name", "chunk-$RepresentationID$-$Number%05d$.m4s")
+	} else {
+		args = append(args, "-hls_time", segTime, "-hls_playlist_type", "vod",
+			"-hls_segment_filename", "seg%05d.ts")
+	}
+	// relative names, for the playlist to reference the segments relatively
+	args = append(args, manifest)
+	cmd := exec.CommandContext(ctx, *flagFFmpeg, args...)
+	cmd.Dir = tmp
+	var errBuf bytes.Buffer
+	cmd.Stderr = &errBuf
+	if err = cmd.Run(); err != nil {
+		return errors.Wrapf(err, "%s %q: %s", *flagFFmpeg, args, errBuf.String())
+	}
+	os.RemoveAll(dir)
+	return os.Rename(tmp, dir)
+}
@@ -0,0 +1,232 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"perkeep.org/pkg/sorted"
+	"perkeep.org/pkg/sorted/kvfile"
+)
+
+var idempotent *idempotencyDB
+
+// idempotencyDB remembers the responses of the successful uploads by their
+// Idempotency-Key header (per user) for ttl, so a retry gets the original
+// response, and does not upload again.
+type idempotencyDB struct {
+	db  sorted.KeyValue
+	ttl time.Duration
+
+	// mu guards the check and the save of the responses, too
+	mu sync.Mutex
+	// inFlight holds the fingerprints of the requests in flight, by key
+	inFlight map[string]string
+}
+
+// savedResponse is a response remembered by its Idempotency-Key.
+type savedResponse struct {
+	// Fingerprint is the requestFingerprint of the original request.
+	Fingerprint string      `json:"fingerprint"`
+	Status      int         `json:"status"`
+	Header      http.Header `json:"header"`
+	Body        []byte      `json:"body"`
+	Expires     time.Time   `json:"expires"`
+}
+
+// maxSavedBody is the size limit of the remembered response bodies.
+const maxSavedBody = 64 << 10
+
+// savedHeaders are the response headers remembered.
+var savedHeaders = []string{"Content-Type", "Location", "Digest",
+	"X-Camli-Content", "X-Camli-Permanode", "X-Camli-Job"}
+
+var (
+	// errKeyInFlight is returned by Begin for a key already in flight.
+	errKeyInFlight = errors.New("an upload with the same Idempotency-Key is in progress")
+	// errKeyReused is returned by Begin for a key used for another request.
+	errKeyReused = errors.New("the Idempotency-Key was used for another request")
+)
+
+func newIdempotencyDB(filename string, ttl time.Duration) (*idempotencyDB, error) {
+	db, err := kvfile.NewStorage(filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open %q", filename)
+	}
+	idb := &idempotencyDB{db: db, ttl: ttl, inFlight: make(map[string]string)}
+	if err = idb.Purge(time.Now()); err != nil {
+		logger.Log("msg", "purge idempotency keys", "file", filename, "error", err)
+	}
+	return idb, nil
+}
+
+func (idb *idempotencyDB) Close() error {
+	if idb == nil || idb.db == nil {
+		return nil
+	}
+	return idb.db.Close()
+}
+
+// Purge deletes the responses expired before now.
+func (idb *idempotencyDB) Purge(now time.Time) error {
+	var expired []string
+	it := idb.db.Find("", "")
+	for it.Next() {
+		var resp savedResponse
+		if err := json.Unmarshal(it.ValueBytes(), &resp); err != nil || resp.Expires.Before(now) {
+			expired = append(expired, it.Key())
+		}
+	}
+	if err := it.Close(); err != nil {
+		return err
+	}
+	for _, k := range expired {
+		if err := idb.db.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Begin returns the remembered response of the key, if there is one.
+// Otherwise it marks the key as in flight (errKeyInFlight if it already is),
+// till End is called. The key is bound to the fingerprint of the request:
+// errKeyReused is returned for another one.
+func (idb *idempotencyDB) Begin(key, fingerprint string) (*savedResponse, error) {
+	idb.mu.Lock()
+	defer idb.mu.Unlock()
+	if v, err := idb.db.Get(key); err == nil {
+		var saved savedResponse
+		if err = json.Unmarshal([]byte(v), &saved); err == nil && time.Now().Before(saved.Expires) {
+			if saved.Fingerprint != fingerprint {
+				return nil, errKeyReused
+			}
+			return &saved, nil
+		}
+		idb.db.Delete(key)
+	}
+	if fp, busy := idb.inFlight[key]; busy {
+		if fp != fingerprint {
+			return nil, errKeyReused
+		}
+		return nil, errKeyInFlight
+	}
+	idb.inFlight[key] = fingerprint
+	return nil, nil
+}
+
+// End remembers the recorded response of the key (iff it is a success),
+// and releases the key - after the response is saved.
+func (idb *idempotencyDB) End(key string, rec *responseRecorder) {
+	idb.mu.Lock()
+	defer idb.mu.Unlock()
+	fingerprint := idb.inFlight[key]
+	delete(idb.inFlight, key)
+	if rec.status < 200 || rec.status >= 300 || rec.overflow {
+		return
+	}
+	if st := rec.Header().Get("X-Camli-Status"); st != "" && st[0] != '2' {
+		// the failure of a streaming upload, in its trailer
+		return
+	}
+	resp := savedResponse{Fingerprint: fingerprint, Status: rec.status, Header: make(http.Header, len(savedHeaders)),
+		Body: rec.body.Bytes(), Expires: time.Now().Add(idb.ttl)}
+	for _, k := range savedHeaders {
+		if v := rec.Header().Get(k); v != "" {
+			resp.Header.Set(k, v)
+		}
+	}
+	b, err := json.Marshal(resp)
+	if err == nil {
+		err = idb.db.Set(key, string(b))
+	}
+	if err != nil {
+		logger.Log("msg", "save idempotent response", "key", key, "error", err)
+	}
+}
+
+// replay writes the remembered response.
+func (resp *savedResponse) replay(w http.ResponseWriter) {
+	for k, vv := range resp.Header {
+		w.Header()[k] = vv
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(resp.Body)))
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(resp.Status)
+	w.Write(resp.Body)
+}
+
+// idempotencyKey returns the key of the request's Idempotency-Key header
+// in the idempotencyDB (scoped by the user), "" if there is none.
+func idempotencyKey(r *http.Request) string {
+	k := r.Header.Get("Idempotency-Key")
+	if k == "" {
+		return ""
+	}
+	return authUser(r) + "\x00" + k
+}
+
+// requestFingerprint returns the fingerprint of the request the
+// Idempotency-Key is bound to: its method, path and body digest (as
+// declared, or else its length).
+func requestFingerprint(r *http.Request) string {
+	h := sha256.New()
+	io.WriteString(h, r.Method+"\x00"+r.URL.Path+"\x00")
+	if d, err := declaredDigest(r.Header); err == nil && d != nil {
+		h.Write(d)
+	} else {
+		io.WriteString(h, strconv.FormatInt(r.ContentLength, 10))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// responseRecorder records the status and the (first maxSavedBody bytes of)
+// the body of the response, while writing it.
+type responseRecorder struct {
+	http.ResponseWriter
+	status   int
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (rec *responseRecorder) WriteHeader(code int) {
+	if rec.status == 0 {
+		rec.status = code
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *responseRecorder) Write(p []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	if rec.body.Len()+len(p) > maxSavedBody {
+		rec.overflow = true
+	} else {
+		rec.body.Write(p)
+	}
+	return rec.ResponseWriter.Write(p)
+}
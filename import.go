@@ -0,0 +1,136 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tgulacsi/camproxy/camutil"
+)
+
+// importCommand uploads the contents of the tarball as a directory tree,
+// the inverse of export:
+//
+//	camproxy import [-permanode] [-attr k=v,...] [-include glob,...] [-exclude glob,...] [-ignore-file name] backup.tar
+func importCommand(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	flagPerma := fs.Bool("permanode", false, "create a permanode (titled by the tarball's name) even without attributes")
+	flagAttr := fs.String("attr", "", "attributes of the permanode, as k=v,...")
+	flagUser := fs.String("user", "", "upload as this user (for -user-keys and -tenants)")
+	flagInclude := fs.String("include", "", "comma-separated globs: upload only the matching files (** matches any number of directories)")
+	flagExclude := fs.String("exclude", "", "comma-separated globs: skip the matching files and directories")
+	flagIgnore := fs.String("ignore-file", camutil.IgnoreFileName, "honor the gitignore-style ignore files of this name in the tarball (empty to upload everything)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("a tarball is needed")
+	}
+	fn := fs.Arg(0)
+	attrs := make(map[string]string)
+	if *flagAttr != "" {
+		for _, kv := range strings.Split(*flagAttr, ",") {
+			i := strings.IndexByte(kv, '=')
+			if i <= 0 {
+				return errors.Errorf("attr %q is not k=v", kv)
+			}
+			attrs[kv[:i]] = kv[i+1:]
+		}
+	}
+	if *flagReplica != "" {
+		replica = newReplicator(*flagReplica, 0, 0, *flagReplicaFailed)
+	}
+
+	var r io.Reader = os.Stdin
+	if fn != "-" {
+		fh, err := os.Open(fn)
+		if err != nil {
+			return err
+		}
+		defer fh.Close()
+		r = fh
+	}
+	name := tarballName(fn)
+	switch {
+	case strings.HasSuffix(fn, ".gz"), strings.HasSuffix(fn, ".tgz"):
+		rc, err := newDecompressReader("gzip", r)
+		if err != nil {
+			return errors.Wrapf(err, "decompress %q", fn)
+		}
+		defer rc.Close()
+		r = rc
+	case strings.HasSuffix(fn, ".zst"):
+		rc, err := newDecompressReader("zstd", r)
+		if err != nil {
+			return errors.Wrapf(err, "decompress %q", fn)
+		}
+		defer rc.Close()
+		r = rc
+	}
+
+	tmp, err := ioutil.TempDir(tmpDir(), "camproxy-import-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	// the root directory is named after the tarball
+	root := filepath.Join(tmp, name)
+	if err = os.Mkdir(root, 0755); err != nil {
+		return err
+	}
+	if err = camutil.ExtractTar(r, root); err != nil {
+		return errors.Wrapf(err, "extract %q", fn)
+	}
+	if *flagPerma && len(attrs) == 0 {
+		attrs["title"] = name
+	}
+	res, err := putPath(ctx, root, attrs, false, time.Time{}, *flagUser,
+		camutil.DirOptions{Include: splitGlobs(*flagInclude), Exclude: splitGlobs(*flagExclude), IgnoreFile: *flagIgnore})
+	if err != nil {
+		return errors.Wrapf(err, "upload %q", fn)
+	}
+	if res.Perma.Valid() {
+		fmt.Printf("%s\t%s\t%s\n", fn, res.Content, res.Perma)
+	} else {
+		fmt.Printf("%s\t%s\n", fn, res.Content)
+	}
+	return nil
+}
+
+// tarballName returns the name of the tarball without the extensions.
+func tarballName(fn string) string {
+	if fn == "-" {
+		return "import"
+	}
+	name := filepath.Base(fn)
+	for _, ext := range []string{".gz", ".zst", ".tgz", ".tar"} {
+		name = strings.TrimSuffix(name, ext)
+	}
+	if name == "" {
+		return "import"
+	}
+	return name
+}
@@ -0,0 +1,196 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"github.com/tgulacsi/camproxy/camutil"
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/sorted"
+	"perkeep.org/pkg/sorted/kvfile"
+)
+
+// importS3Command uploads the objects of an S3 bucket (under the prefix)
+// concurrently, skipping the ones already in the journal:
+//
+//	camproxy import-s3 [-workers 8] [-journal file] [-endpoint url] [-region r] s3://bucket/prefix
+func importS3Command(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("import-s3", flag.ContinueOnError)
+	flagWorkers := fs.Int("workers", 8, "number of objects uploaded concurrently")
+	flagJournal := fs.String("journal", filepath.Join(os.TempDir(), "camproxy-import-s3.kv"), "journal of the imported objects, to resume an interrupted import")
+	flagEndpoint := fs.String("endpoint", "", "S3 endpoint (default: https://s3.<region>.amazonaws.com)")
+	flagRegion := fs.String("region", "", "S3 region (default: $AWS_REGION or us-east-1)")
+	flagPerma := fs.Bool("permanode", false, "create a permanode for each object")
+	flagUser := fs.String("user", "", "upload as this user (for -user-keys and -tenants)")
+	flagInclude := fs.String("include", "", "comma-separated globs: import only the matching keys (relative to the prefix)")
+	flagExclude := fs.String("exclude", "", "comma-separated globs: skip the matching keys")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("an s3://bucket/prefix URL is needed")
+	}
+	if *flagWorkers <= 0 {
+		return errors.Errorf("-workers must be positive, got %d", *flagWorkers)
+	}
+	bucket, prefix, err := parseS3URL(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	cl, err := newS3Client(*flagEndpoint, *flagRegion)
+	if err != nil {
+		return err
+	}
+	journal, err := newImportJournal(*flagJournal)
+	if err != nil {
+		return err
+	}
+	defer journal.Close()
+	u, err := getUploader(ctx, server, *flagUser)
+	if err != nil {
+		return errors.Wrapf(err, "get uploader to %q", server)
+	}
+	filter := camutil.DirOptions{Include: splitGlobs(*flagInclude), Exclude: splitGlobs(*flagExclude)}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		wg                        sync.WaitGroup
+		outMu                     sync.Mutex
+		imported, skipped, failed int64
+	)
+	objects := make(chan s3Object)
+	for i := 0; i < *flagWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for obj := range objects {
+				jKey := "s3://" + bucket + "/" + obj.Key
+				content, perma, err := importS3Object(ctx, cl, u, bucket, obj, *flagPerma)
+				if err != nil {
+					logger.Log("msg", "import", "key", obj.Key, "error", err)
+					atomic.AddInt64(&failed, 1)
+					continue
+				}
+				if err = journal.Set(jKey, obj.ETag, content, perma); err != nil {
+					logger.Log("msg", "journal", "key", obj.Key, "error", err)
+				}
+				atomic.AddInt64(&imported, 1)
+				outMu.Lock()
+				if perma.Valid() {
+					fmt.Printf("%s\t%s\t%s\n", jKey, content, perma)
+				} else {
+					fmt.Printf("%s\t%s\n", jKey, content)
+				}
+				outMu.Unlock()
+			}
+		}()
+	}
+	err = cl.List(ctx, bucket, prefix, func(obj s3Object) error {
+		if strings.HasSuffix(obj.Key, "/") || filter.Skip(strings.TrimPrefix(strings.TrimPrefix(obj.Key, prefix), "/")) {
+			return nil
+		}
+		if _, _, ok := journal.Get("s3://"+bucket+"/"+obj.Key, obj.ETag); ok {
+			atomic.AddInt64(&skipped, 1)
+			return nil
+		}
+		select {
+		case objects <- obj:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	close(objects)
+	wg.Wait()
+	logger.Log("msg", "import-s3", "bucket", bucket, "prefix", prefix,
+		"imported", imported, "skipped", skipped, "failed", failed, "error", err)
+	if err != nil {
+		return err
+	}
+	if failed > 0 {
+		return errors.Errorf("%d objects failed (run again to retry them)", failed)
+	}
+	return nil
+}
+
+// importS3Object streams the object into the uploader.
+func importS3Object(ctx context.Context, cl *s3Client, u *camutil.Uploader, bucket string, obj s3Object, perma bool) (content, permanode blob.Ref, err error) {
+	body, err := cl.Get(ctx, bucket, obj.Key)
+	if err != nil {
+		return content, permanode, err
+	}
+	defer body.Close()
+	return u.UploadReader(ctx, path.Base(obj.Key), obj.LastModified, body, perma)
+}
+
+// importJournal records the imported items with their versions (e.g. ETags),
+// so an interrupted import can be resumed.
+type importJournal struct {
+	db sorted.KeyValue
+}
+
+func newImportJournal(filename string) (*importJournal, error) {
+	db, err := kvfile.NewStorage(filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open %q", filename)
+	}
+	return &importJournal{db: db}, nil
+}
+
+func (j *importJournal) Close() error {
+	if j == nil || j.db == nil {
+		return nil
+	}
+	return j.db.Close()
+}
+
+// Get returns the refs of the item, iff it is imported with the same version.
+func (j *importJournal) Get(key, version string) (content, perma blob.Ref, ok bool) {
+	v, err := j.db.Get(key)
+	if err != nil {
+		return content, perma, false
+	}
+	fields := strings.Split(v, "\t")
+	if len(fields) != 3 || fields[0] != version {
+		return content, perma, false
+	}
+	if content, ok = blob.Parse(fields[1]); !ok {
+		return content, perma, false
+	}
+	perma, _ = blob.Parse(fields[2])
+	return content, perma, true
+}
+
+// Set records the refs of the item with its version.
+func (j *importJournal) Set(key, version string, content, perma blob.Ref) error {
+	p := ""
+	if perma.Valid() {
+		p = perma.String()
+	}
+	return j.db.Set(key, version+"\t"+content.String()+"\t"+p)
+}
@@ -0,0 +1,182 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The limiters of the requests to the upstreams, nil if unlimited:
+// of all the requests, of the uploads and of the downloads.
+var limiter, upLimiter, downLimiter *requestLimiter
+
+// requestLimiter bounds the concurrently served requests (and the requests
+// of each identity), queueing the excess up to a limit for a while,
+// and rejecting the rest.
+type requestLimiter struct {
+	max, perIdentity int
+	maxQueue         int
+	timeout          time.Duration
+
+	mu         sync.Mutex
+	active     int
+	byIdentity map[string]int
+	waiting    int
+	// released is closed (and replaced) at each Release, to wake the waiters.
+	released chan struct{}
+}
+
+func newRequestLimiter(max, perIdentity, queue int, timeout time.Duration) *requestLimiter {
+	return &requestLimiter{max: max, perIdentity: perIdentity, maxQueue: queue, timeout: timeout,
+		byIdentity: make(map[string]int), released: make(chan struct{})}
+}
+
+// tryLocked takes a slot for id, if there is one free.
+func (rl *requestLimiter) tryLocked(id string) bool {
+	if rl.active >= rl.max || rl.perIdentity > 0 && rl.byIdentity[id] >= rl.perIdentity {
+		return false
+	}
+	rl.active++
+	rl.byIdentity[id]++
+	return true
+}
+
+// Acquire waits for a free slot for the identity, and reports whether it got
+// one: false if the queue is full, or the wait timed out (or ctx is done).
+// The slot must be released with Release.
+func (rl *requestLimiter) Acquire(ctx context.Context, id string) bool {
+	if rl == nil {
+		return true
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if rl.tryLocked(id) {
+		return true
+	}
+	if rl.waiting >= rl.maxQueue {
+		return false
+	}
+	rl.waiting++
+	defer func() { rl.waiting-- }()
+	timer := time.NewTimer(rl.timeout)
+	defer timer.Stop()
+	for {
+		released := rl.released
+		rl.mu.Unlock()
+		select {
+		case <-released:
+		case <-timer.C:
+			rl.mu.Lock()
+			return false
+		case <-ctx.Done():
+			rl.mu.Lock()
+			return false
+		}
+		rl.mu.Lock()
+		if rl.tryLocked(id) {
+			return true
+		}
+	}
+}
+
+// Release frees the slot of the identity got by Acquire.
+func (rl *requestLimiter) Release(id string) {
+	if rl == nil {
+		return
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.active--
+	if rl.byIdentity[id]--; rl.byIdentity[id] <= 0 {
+		delete(rl.byIdentity, id)
+	}
+	close(rl.released)
+	rl.released = make(chan struct{})
+}
+
+// Len returns the number of the served and the waiting requests.
+func (rl *requestLimiter) Len() (active, waiting int64) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return int64(rl.active), int64(rl.waiting)
+}
+
+// RetryAfter returns the Retry-After header of the rejected requests.
+func (rl *requestLimiter) RetryAfter() string {
+	secs := int(rl.timeout / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	return strconv.Itoa(secs)
+}
+
+// authVerified tells whether the basic auth of the requests is checked.
+var authVerified bool
+
+// requestIdentity returns the user of the request (by basic auth or session),
+// or the remote address for the anonymous ones.
+// The limitHandler is inside the authentication, so the user is a verified
+// one - unless there is no authentication at all.
+func requestIdentity(r *http.Request) string {
+	if user, ok := r.Context().Value(sessionUserKey{}).(string); ok && user != "" {
+		return user
+	}
+	if authVerified {
+		if user := authUser(r); user != "anonymous" {
+			return user
+		}
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// limitHandler rejects the requests to the upstreams with 503, when their
+// limiters are full: the uploads and the downloads are limited separately,
+// and both by the limiter of all the requests.
+type limitHandler struct {
+	all, up, down *requestLimiter
+	next          http.Handler
+}
+
+func (lh limitHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !needsUpstream(r) {
+		lh.next.ServeHTTP(w, r)
+		return
+	}
+	kind := lh.down
+	if r.Method != "GET" && r.Method != "HEAD" {
+		kind = lh.up
+	}
+	id := requestIdentity(r)
+	for _, rl := range []*requestLimiter{kind, lh.all} {
+		if !rl.Acquire(r.Context(), id) {
+			httpVars.Add("rejected", 1)
+			w.Header().Set("Retry-After", rl.RetryAfter())
+			http.Error(w, "too many requests in progress", http.StatusServiceUnavailable)
+			return
+		}
+		defer rl.Release(id)
+	}
+	lh.next.ServeHTTP(w, r)
+}
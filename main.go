@@ -18,8 +18,11 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
 	"encoding/base64"
+	"encoding/json"
+	stderrors "errors"
 	"flag"
 	"fmt"
 	"io"
@@ -29,13 +32,17 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
 
 	"perkeep.org/pkg/blob"
 	"perkeep.org/pkg/client"
+	"perkeep.org/pkg/schema"
 
 	"github.com/go-kit/kit/log"
 	"github.com/pkg/errors"
@@ -46,55 +53,267 @@ var logger = log.NewLogfmtLogger(os.Stderr)
 
 var (
 	flagVerbose       = flag.Bool("v", false, "verbose logging")
-	flagInsecureTLS   = flag.Bool("k", camutil.InsecureTLS, "allow insecure TLS")
-	flagSkipIrregular = flag.Bool("skip-irregular", camutil.SkipIrregular, "skip irregular files")
+	flagInsecureTLS   = flag.Bool("k", false, "allow insecure TLS")
+	flagSkipIrregular = flag.Bool("skip-irregular", false, "skip irregular files")
 	//flagServer      = flag.String("server", ":3179", "Camlistore server address")
-	flagCapCtime      = flag.Bool("capctime", false, "forge ctime to be less or equal to mtime")
-	flagNoAuth        = flag.Bool("noauth", false, "no HTTP Basic Authentication, even if CAMLI_AUTH is set")
-	flagListen        = flag.String("listen", ":3178", "listen on")
-	flagParanoid      = flag.String("paranoid", "", "Paranoid mode: save uploaded files also under this dir")
-	flagSkipHaveCache = flag.Bool("skiphavecache", false, "Skip have cache? (more stress on camlistored)")
+	flagCapCtime         = flag.Bool("capctime", false, "forge ctime to be less or equal to mtime")
+	flagNoAuth           = flag.Bool("noauth", false, "no HTTP Basic Authentication, even if CAMLI_AUTH is set")
+	flagListen           = flag.String("listen", ":3178", "listen on")
+	flagParanoid         = flag.String("paranoid", "", "Paranoid mode: save uploaded files also under this dir")
+	flagParanoidCompress = flag.String("paranoid-compress", "", "compress the paranoid copies with this method (gzip or zstd)")
+	flagParanoidKey      = flag.String("paranoid-key", "", "encrypt the paranoid copies with the 32-byte AES key in this file")
+	flagParanoidKeyCmd   = flag.String("paranoid-key-cmd", "", "encrypt the paranoid copies with the 32-byte AES key printed by this command (e.g. a KMS decrypt)")
+	flagParanoidMaxAge   = flag.Duration("paranoid-max-age", 0, "remove paranoid copies older than this")
+	flagParanoidMaxSize  = flag.String("paranoid-max-size", "", "remove the oldest paranoid copies when their total size exceeds this (e.g. 100G)")
+	flagParanoidPrune    = flag.Duration("paranoid-prune-interval", time.Hour, "check the paranoid retention limits this often")
+	flagSkipHaveCache    = flag.Bool("skiphavecache", false, "Skip have cache? (more stress on camlistored)")
+	flagHaveCache        = flag.String("havecache", "", "have cache of the direct uploads: memory (or lru), kv, leveldb, bbolt or sqlite (persistent)")
+	flagHaveCacheDir     = flag.String("havecache-dir", "", "directory of the have and stat caches (of pk-put, too)")
+	flagHaveCacheMax     = flag.Int("havecache-max", 0, "maximum number of refs in the have cache")
+	flagMaxIdleConns     = flag.Int("max-idle-conns", 0, "number of kept-alive connections per server (default 2)")
+	flagDialTimeout      = flag.Duration("dial-timeout", 0, "timeout of connecting to the server")
+	flagTLSTimeout       = flag.Duration("tls-handshake-timeout", 0, "timeout of the TLS handshake with the server")
+	flagProxy            = flag.String("proxy", "", "HTTP proxy URL for connecting to the server (default is from HTTP_PROXY)")
+	flagQuota            = flag.String("quota", "", "per-user upload quotas as user=size,... (* is the default, 0 is unlimited), e.g. *=10G,admin=0")
+	flagQuotaDB          = flag.String("quota-db", "", "file to persist the per-user upload sizes in (needed by -quota)")
+	flagTenants          = flag.String("tenants", "", "per-user root permanodes as user=permanode,... (* is the default): uploads are attached under the root, GETs are restricted to them")
+	flagTenantDB         = flag.String("tenant-db", "", "file to persist the tenants' refs in (needed by -tenants)")
+	flagReplica          = flag.String("replica", "", "secondary server to replicate each upload to")
+	flagReplicaWorkers   = flag.Int("replica-workers", 0, "replicate in the background with this many workers (0: synchronously)")
+	flagReplicaFailed    = flag.String("replica-failed", "", "append the refs failed to replicate to this file")
+	flagMirror           = flag.String("mirror", "", "persist every fetched blob in this local blob store, and serve from it (read-through mirror)")
+	flagSpool            = flag.String("spool", "", "when the server is unavailable, spool the uploads in this dir (answering 202 with a job id), and replay them later")
+	flagSpoolInterval    = flag.Duration("spool-interval", 30*time.Second, "try to replay the spooled uploads this often")
+	flagAsyncWorkers     = flag.Int("async-workers", 4, "number of workers uploading the ?async=1 POSTs")
+	flagUploadWorkers    = flag.Int("upload-workers", 0, "number of the files of a multi-file POST or a directory uploaded in parallel, unless the workers parameter says otherwise (0: pk-put for the POSTs, 8 for the directories)")
+	flagChunkSize        = flag.String("chunk-size", "0", "target size of the chunks of the uploaded files, a power of two between 64KB and 8MB (0: perkeep's own chunking); the chunk parameter overrides it per upload")
+	flagStatBatch        = flag.Duration("stat-batch", 0, "collect the stats of the concurrent uploads for this long, and send them to the server in one batch (0: one by one)")
+	flagMaxUploads       = flag.Int("max-uploads", 32, "maximum number of the concurrent file uploads of all the requests")
+	flagScrubRoots       = flag.String("scrub-roots", "", "comma-separated root refs to scrub (re-verify the hashes of all the blobs reachable from them) continuously")
+	flagScrubDelay       = flag.Duration("scrub-delay", 100*time.Millisecond, "wait this much after each scrubbed blob")
+	flagScrubInterval    = flag.Duration("scrub-interval", 24*time.Hour, "pause between the scrub passes")
+	flagScrubWebhook     = flag.String("scrub-webhook", "", "POST the missing or corrupt blobs found by the scrubber as JSON to this URL")
+	flagHealthInterval   = flag.Duration("health-interval", 30*time.Second, "check the upstream servers this often, and fail fast while they are down (0: never)")
+	flagBreakerFailures  = flag.Int("breaker-failures", 0, "open the circuit of an upstream after this many consecutive failures: serve from the caches, or answer 503 (0: never)")
+	flagBreakerCooldown  = flag.Duration("breaker-cooldown", 30*time.Second, "probe an upstream with an open circuit after this long")
+	flagMaxRequests      = flag.Int("max-requests", 0, "maximum number of the requests to the upstreams served concurrently (0: unlimited)")
+	flagMaxUpRequests    = flag.Int("max-upload-requests", 0, "maximum number of the uploads (POST, PUT, DELETE) served concurrently (0: unlimited)")
+	flagMaxDownRequests  = flag.Int("max-download-requests", 0, "maximum number of the downloads (GET, HEAD) served concurrently (0: unlimited)")
+	flagMaxPerUser       = flag.Int("max-requests-per-user", 0, "maximum number of the concurrent requests of a user (or anonymous address) within each of the limits above (0: no such limit)")
+	flagMaxQueue         = flag.Int("max-queue", 64, "maximum number of the requests waiting for each of the -max-*requests limits; the others are rejected with 503")
+	flagQueueTimeout     = flag.Duration("queue-timeout", 10*time.Second, "reject the requests waiting for a -max-*requests limit this long with 503")
+	flagBufferMemory     = flag.String("max-buffer-memory", "256MB", "memory of the transfer buffers of all the requests; the buffers spill to temp files above it, the chunk-size uploads fail")
+	flagSpillThreshold   = flag.String("spill-threshold", "1MB", "the transfer buffers above this size spill to temp files")
+	flagMinFreeSpace     = flag.String("min-free-space", "64MB", "keep this much space free in the -tmpdir, spool and paranoid dirs: reject the uploads not fitting with 507")
+	flagSniffSize        = flag.String("sniff-size", "1KB", "the MIME type of a download is sniffed from this many bytes of its head")
+	flagSchemaSniffSize  = flag.String("schema-sniff-size", "900KB", "a fetched blob is sniffed for a schema blob from this many bytes of its head")
+	flagHashes           = flag.String("hashes", "", "accept the refs of these hashes, too (besides sha1, sha224, sha256 and sha512), as name:digest-bytes,...")
+	flagServers          = flag.String("servers", "", "comma-separated list of the servers selectable per request with the X-Camli-Server header or the server query parameter")
+	flagSites            = flag.String("sites", "", "serve the trees of root permanodes as public websites, as hostname=permanode,...")
+	flagSyslog           = flag.String("syslog", "", "log to syslog instead of stderr: local, or network://host:port (udp, tcp or unix)")
+	flagSyslogFacility   = flag.String("syslog-facility", "daemon", "syslog facility")
+	flagAccessLog        = flag.String("access-log", "", "write the requests to this file (- for stdout, syslog for -syslog) in Apache combined log format, extended with the blobref, the bytes received and the duration")
+	flagAdmins           = flag.String("admins", "", "comma-separated users allowed to see the /admin/ dashboard (default: nobody, but everyone with -noauth)")
+	flagSessionTTL       = flag.Duration("session-ttl", 0, "enable the session cookies issued by /login, valid for this long")
+	flagSessionKey       = flag.String("session-key", "", "HMAC key of the session cookies, or a reference to it (file:..., env:..., cmd:..., vault:...); random if empty")
+	flagSessionDB        = flag.String("session-db", "", "file to persist the ids of the sessions ended by /logout in (default is in the temp dir)")
+	flagHtpasswd         = flag.String("htpasswd", "", "authenticate the users of this htpasswd file (bcrypt hashes, reloaded on change) instead of CAMLI_AUTH")
+	flagFileStateDB      = flag.String("file-state-db", "", "file to persist the size, mtime and ref of the files uploaded by the schedules in, to skip the unchanged ones (default is in the temp dir)")
+	flagConfig           = flag.String("config", "", "JSON config file with the per-server credentials")
+	flagUserKeys         = flag.String("user-keys", "", "sign the claims of the users with their own keys of -secret-ring, as user=keyID,...")
+	flagSecretRing       = flag.String("secret-ring", "", "sign the claims with a key of this GPG secret keyring, instead of the client config's")
+	flagSecretRingCmd    = flag.String("secret-ring-cmd", "", "sign the claims with a key of the GPG secret keyring printed by this command (e.g. a secrets manager)")
+	flagKeyID            = flag.String("key-id", "", "ID of the signing key in -secret-ring (default is the first)")
+	flagDeleteDB         = flag.String("delete-db", "", "file to persist the delete claims signed through the proxy in, for undeleting (no undelete without it)")
+	flagIdempotencyTTL   = flag.Duration("idempotency-ttl", 24*time.Hour, "remember the responses of the uploads with an Idempotency-Key header this long, for the retries (0: ignore the header)")
+	flagIdempotencyDB    = flag.String("idempotency-db", "", "file to persist the responses of the uploads with an Idempotency-Key in (default is in the temp dir)")
+	flagShortRefDB       = flag.String("short-ref-db", "", "file to persist the short hex refs (short=hex) in (default is in the temp dir)")
+	flagAliasDB          = flag.String("alias-db", "", "file to persist the friendly-name aliases in (no aliases without it)")
+	flagTmpDir           = flag.String("tmpdir", "", "directory of the received uploads and the other temporary files (default is the temp dir)")
+	flagTmpDirMaxAge     = flag.Duration("tmpdir-max-age", time.Hour, "remove the temporary files of the uploads not written for this long (left by a crash) at startup (0: never)")
+	flagThumbDir         = flag.String("thumb-dir", filepath.Join(os.TempDir(), "camproxy-thumbs"), "directory of the cached previews")
+	flagPdftoppm         = flag.String("pdftoppm", "pdftoppm", "pdftoppm command for rendering the previews of PDFs")
+	flagThumbConvert     = flag.String("thumb-convert", "", "command for rendering the previews of other documents, called with the source file, the PNG to write, the size and the MIME type")
+	flagFFmpeg           = flag.String("ffmpeg", "ffmpeg", "ffmpeg command for segmenting the videos to HLS/DASH streams")
+	flagStreamDir        = flag.String("stream-dir", filepath.Join(os.TempDir(), "camproxy-streams"), "directory of the segmented HLS/DASH streams")
+	flagStreamSegment    = flag.Duration("stream-segment", 6*time.Second, "target duration of the HLS/DASH segments")
+	flagIndexNames       = flag.String("index-names", "index.html,index.htm", "comma-separated names of the index documents served instead of the listing of a directory (empty to always list)")
 
-	server string
+	server   string
+	camOpts  camutil.Options
+	userKeys map[string]string
 )
 
 func main() {
 	Log := logger.Log
 
 	client.AddFlags() // add -server flag
+	flag.Usage = usage
 	flag.Parse()
 
+	if *flagSyslog != "" {
+		w, err := dialSyslog(*flagSyslog, *flagSyslogFacility, "camproxy")
+		if err != nil {
+			Log("msg", "syslog", "error", err)
+			os.Exit(1)
+		}
+		logger = log.NewLogfmtLogger(w)
+		Log = logger.Log
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt)
+	go func() {
+		<-sigCh
+		cancel()
+		signal.Stop(sigCh)
+	}()
+	if stopService, err := startService(cancel); err != nil {
+		Log("msg", "start service", "error", err)
+		os.Exit(1)
+	} else {
+		defer stopService()
+		Log = logger.Log
+	}
+
 	if *flagVerbose {
 		camutil.Log = log.With(logger, "lib", "camutil").Log
 	}
 
+	var chunkSize int
+	for _, sf := range []struct {
+		name, value string
+		set         func(int64)
+	}{
+		{"max-buffer-memory", *flagBufferMemory, camutil.Buffers.SetMax},
+		{"spill-threshold", *flagSpillThreshold, func(n int64) { camutil.DefaultSpillThreshold = n }},
+		{"sniff-size", *flagSniffSize, func(n int64) { sniffLen, camutil.MIMESniffSize = int(n), n }},
+		{"schema-sniff-size", *flagSchemaSniffSize, func(n int64) { camutil.SchemaSniffSize = n }},
+		{"chunk-size", *flagChunkSize, func(n int64) { chunkSize = int(n) }},
+		{"min-free-space", *flagMinFreeSpace, func(n int64) { minFreeSpace = n }},
+	} {
+		n, err := parseSize(sf.value)
+		if err != nil {
+			Log("msg", "parse "+sf.name, "value", sf.value, "error", err)
+			os.Exit(2)
+		}
+		sf.set(n)
+	}
+	camutil.SpillDir = tmpDir()
+	for _, h := range splitGlobs(*flagHashes) {
+		i := strings.IndexByte(h, ':')
+		size, err := strconv.Atoi(h[i+1:])
+		if err == nil && i < 0 {
+			err = stderrors.New("no :digest-bytes")
+		}
+		if err == nil {
+			err = camutil.RegisterHash(h[:i], size)
+		}
+		if err != nil {
+			Log("msg", "parse hashes", "value", h, "error", err)
+			os.Exit(2)
+		}
+	}
+
 	server = client.ExplicitServer()
-	camutil.Verbose = *flagVerbose
-	camutil.InsecureTLS = *flagInsecureTLS
-	camutil.SkipIrregular = *flagSkipIrregular
-	s := &http.Server{
-		Addr:           *flagListen,
-		Handler:        http.HandlerFunc(handle),
-		ReadTimeout:    300 * time.Second,
-		WriteTimeout:   300 * time.Second,
-		MaxHeaderBytes: 1 << 20,
-	}
-	if !*flagNoAuth {
-		camliAuth := os.Getenv("CAMLI_AUTH")
-		if camliAuth != "" {
-			s.Handler = camutil.SetupBasicAuthChecker(handle, camliAuth)
-		}
-	}
-	defer func() {
-		camutil.Close()
-	}()
-	mimeCache = camutil.NewMimeCache(filepath.Join(os.TempDir(),
-		"mimecache-"+os.Getenv("BRUNO_CUS")+"_"+os.Getenv("BRUNO_ENV")+".kv"),
-		0)
-	defer mimeCache.Close()
-	Log("msg", "Listening", "http", s.Addr, "camlistore", server)
-	if err := s.ListenAndServe(); err != nil {
-		Log("msg", "finish", "error", err)
+	camOpts = camutil.Options{
+		Verbose:       *flagVerbose,
+		InsecureTLS:   *flagInsecureTLS,
+		SkipIrregular: *flagSkipIrregular,
+		MirrorDir:     *flagMirror,
+		CapCtime:      *flagCapCtime,
+		SkipHaveCache: *flagSkipHaveCache,
+
+		HaveCacheType:    *flagHaveCache,
+		HaveCacheDir:     *flagHaveCacheDir,
+		HaveCacheMaxSize: *flagHaveCacheMax,
+		MaxUploads:       *flagMaxUploads,
+		StatBatchWindow:  *flagStatBatch,
+		Chunking:         camutil.ChunkOptions{Size: chunkSize},
+
+		HTTPOptions: camutil.HTTPOptions{
+			MaxIdleConnsPerHost: *flagMaxIdleConns,
+			DialTimeout:         *flagDialTimeout,
+			TLSHandshakeTimeout: *flagTLSTimeout,
+			Proxy:               *flagProxy,
+		},
+		SignerOptions: camutil.SignerOptions{
+			SecretRing:    *flagSecretRing,
+			SecretRingCmd: *flagSecretRingCmd,
+			KeyID:         *flagKeyID,
+		},
+	}
+	if _, err := camOpts.Chunking.Normalize(); err != nil {
+		Log("msg", "chunk-size", "error", err)
+		os.Exit(2)
+	}
+	if err := camOpts.SignerOptions.Validate(); err != nil {
+		Log("msg", "secret-ring", "error", err)
+		os.Exit(2)
+	}
+	if *flagConfig != "" {
+		var err error
+		if cfg, err = loadConfig(*flagConfig); err != nil {
+			Log("msg", "load config", "file", *flagConfig, "error", err)
+			os.Exit(1)
+		}
+		if hc := cfg.HaveCache; hc != nil && camOpts.HaveCacheType == "" {
+			camOpts.HaveCacheType = hc.Type
+			if camOpts.HaveCacheDir == "" {
+				camOpts.HaveCacheDir = hc.Dir
+			}
+			if camOpts.HaveCacheMaxSize == 0 {
+				camOpts.HaveCacheMaxSize = hc.Max
+			}
+		}
+	}
+	if *flagUserKeys != "" {
+		if camOpts.SignerOptions.IsZero() {
+			Log("msg", "-user-keys needs -secret-ring or -secret-ring-cmd")
+			os.Exit(2)
+		}
+		userKeys = make(map[string]string)
+		for _, part := range strings.Split(*flagUserKeys, ",") {
+			if part = strings.TrimSpace(part); part == "" {
+				continue
+			}
+			i := strings.IndexByte(part, '=')
+			if i < 0 {
+				Log("msg", "no = in user key "+part)
+				os.Exit(2)
+			}
+			userKeys[part[:i]] = part[i+1:]
+		}
+	}
+	if *flagParanoidCompress != "" {
+		if _, ok := compressExt[*flagParanoidCompress]; !ok {
+			Log("msg", "unknown compression", "paranoid-compress", *flagParanoidCompress)
+			os.Exit(1)
+		}
+	}
+	if *flagParanoidKey != "" || *flagParanoidKeyCmd != "" {
+		var err error
+		if paranoidKey, err = loadKey(*flagParanoidKey, *flagParanoidKeyCmd); err != nil {
+			Log("msg", "load paranoid key", "error", err)
+			os.Exit(1)
+		}
+	}
+	defer camutil.Close()
+
+	cmd, args := "serve", []string(nil)
+	if flag.NArg() > 0 {
+		cmd, args = flag.Arg(0), flag.Args()[1:]
+	}
+	c, ok := commands[cmd]
+	if !ok {
+		Log("msg", "unknown command "+cmd)
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := c.run(ctx, args); err != nil {
+		Log("msg", cmd, "error", err)
 		os.Exit(1)
 	}
 }
@@ -110,11 +329,58 @@ func handle(w http.ResponseWriter, r *http.Request) {
 		defer r.Body.Close()
 	}
 	values := r.URL.Query()
+	server, err := requestServer(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	// the uploads are spooled while the upstream is unavailable
+	spoolNow := false
+	if health.Down(server) && needsUpstream(r) {
+		if !spoolable(r) {
+			// fail fast, instead of timing out
+			w.Header().Set("Retry-After", health.RetryAfter())
+			http.Error(w, fmt.Sprintf("upstream %q is down", server), http.StatusServiceUnavailable)
+			return
+		}
+		spoolNow = true
+	}
+	if breaker != nil && needsUpstream(r) && !spoolNow {
+		if !breaker.Allow(server) {
+			switch {
+			case r.Method == "GET":
+				// serve what is cached
+				w.Header().Set("Retry-After", breaker.RetryAfter(server))
+				r = r.WithContext(camutil.WithCacheOnly(r.Context()))
+			case spoolable(r):
+				spoolNow = true
+			default:
+				w.Header().Set("Retry-After", breaker.RetryAfter(server))
+				http.Error(w, fmt.Sprintf("the circuit of upstream %q is open", server), http.StatusServiceUnavailable)
+				return
+			}
+		} else {
+			sw := &statusWriter{ResponseWriter: w}
+			w = sw
+			// the requests cut by their own deadline (or gone) are not failures of the upstream
+			defer func() { breaker.Record(server, upstreamFailed(sw.status) && r.Context().Err() == nil) }()
+		}
+	}
+
+	if r.URL.Path == "/login" || r.URL.Path == "/logout" || r.URL.Path == "/csrf" {
+		serveLogin(w, r)
+		return
+	}
+
+	if serveRoute(w, r, server) {
+		return
+	}
 
 	switch r.Method {
 	case "GET":
-		// the path is treated as a blobname
-		items, err := camutil.ParseBlobNames(nil, []string{r.URL.Path[1:]})
+		// the path is treated as a blobname (or comma-separated blobnames)
+		items, err := parseRefs(strings.Split(r.URL.Path[1:], ",")...)
 		if err != nil {
 			http.Error(w, err.Error(), 400)
 			return
@@ -123,40 +389,122 @@ func handle(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "a blobref is needed!", 400)
 			return
 		}
-		content := values.Get("raw") != "1"
+		if !checkAccess(w, r, items...) {
+			return
+		}
+		mode, err := getMode(values)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		content := mode == "content"
+		d, err := getDownloader(r.Context(), server)
+		if err != nil {
+			http.Error(w,
+				fmt.Sprintf("error getting downloader to %q: %s", server, err),
+				500)
+			return
+		}
+		if content && len(items) == 1 && values.Get("meta") != "1" &&
+			values.Get("framed") != "1" && values.Get("format") != "tar" {
+			// a permanode stands for its current content
+			c, perma, err := d.PermanodeContent(r.Context(), items[0])
+			if err != nil {
+				http.Error(w, err.Error(), errStatus(err))
+				return
+			}
+			if perma {
+				items[0] = c
+				w.Header().Set("Cache-Control", "no-cache")
+				w.Header().Set("X-Camli-Content", c.String())
+			}
+		}
 		okMime, nm := "application/json", ""
-		if content {
+		switch mode {
+		case "content":
 			okMime = values.Get("mimeType")
 			if okMime == "" && 1 == len(items) {
 				nm = camutil.RefToBase64(items[0])
 				okMime = mimeCache.Get(nm)
 			}
+		case "raw":
+			okMime = "application/octet-stream"
 		}
-		d, err := getDownloader()
-		if err != nil {
-			http.Error(w,
-				fmt.Sprintf("error getting downloader to %q: %s", server, err),
-				500)
+		// the raw bytes are served as they are
+		nosniff := values.Get("nosniff") == "1" || mode == "raw"
+		if nosniff {
+			// the caller knows the type (or does not care)
+			if okMime == "" {
+				okMime = "application/octet-stream"
+			}
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+		}
+		if values.Get("meta") == "1" && content && len(items) == 1 {
+			serveFileMeta(w, r, d, items[0])
+			return
+		}
+		if values.Get("chunks") == "1" && content && len(items) == 1 {
+			serveChunks(w, r, d, items[0])
+			return
+		}
+		if values.Get("framed") == "1" {
+			serveFramed(w, r, d, content, items)
 			return
 		}
+		if values.Get("format") == "tar" {
+			w.Header().Set("Content-Type", "application/x-tar")
+			if len(items) == 1 {
+				w.Header().Set("Content-Disposition", `attachment; filename="`+camutil.RefToBase64(items[0])+`.tar"`)
+			}
+			sw := &statusWriter{ResponseWriter: w}
+			if err = d.WriteTar(r.Context(), sw, items...); err != nil {
+				Log("msg", "write tar", "items", items, "error", err)
+				if sw.status == 0 {
+					http.Error(w, err.Error(), errStatus(err))
+				}
+			}
+			return
+		}
+		if content && len(items) == 1 && values.Get("render") == "" {
+			// a file is served seekable, for the media players
+			if fr, err := d.OpenFile(r.Context(), items[0]); err == nil {
+				defer fr.Close()
+				serveFile(w, r, items[0], values.Get("mimeType"), fr)
+				return
+			}
+		}
 		rc, err := d.Start(r.Context(), content, items...)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("download error: %v", err), 500)
+			http.Error(w, fmt.Sprintf("download error: %v", err), errStatus(err))
 			return
 		}
 		defer rc.Close()
+		if !content && len(items) == 1 && (mode == "schema" || values.Get("pretty") == "1") {
+			serveSchema(w, r, items[0], rc, values.Get("pretty") == "1")
+			return
+		}
+		if content && values.Get("render") == "md" {
+			serveMarkdown(w, rc)
+			return
+		}
 
 		if okMime == "" {
 			// must sniff
 			var rr io.Reader
-			okMime, rr = camutil.MIMETypeFromReader(rc)
+			if okMime, rr = camutil.MIMETypeFromReader(rc); okMime == "/" {
+				okMime = "application/octet-stream"
+			}
 			rc = struct {
 				io.Reader
 				io.Closer
 			}{rr, rc}
 		}
 
+		if content {
+			setDisposition(w, r, "")
+		}
 		rw := newRespWriter(w, nm, okMime)
+		rw.nosniff = nosniff
 		defer rw.Close()
 		if _, err = io.Copy(rw, rc); err != nil {
 			http.Error(w, fmt.Sprintf("error downloading %q: %s", items, err), 500)
@@ -164,29 +512,120 @@ func handle(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 
-	case "POST":
-		u, err := getUploader()
+	case "HEAD":
+		// existence check of a raw blob
+		if mode, _ := getMode(values); mode == "content" {
+			http.Error(w, "HEAD is supported only with as=raw (raw=1) or as=schema", 405)
+			return
+		}
+		items, err := parseRefs(r.URL.Path[1:])
 		if err != nil {
-			http.Error(w, fmt.Sprintf("error getting uploader to %q: %s", server, err), 500)
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		br := items[0]
+		if !checkAccess(w, r, br) {
+			return
+		}
+		d, err := getDownloader(r.Context(), server)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("error getting downloader to %q: %s", server, err), 500)
+			return
+		}
+		sizes, err := d.Stat(r.Context(), br)
+		if err != nil {
+			http.Error(w, err.Error(), errStatus(err))
+			return
+		}
+		size, ok := sizes[br]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.FormatUint(uint64(size), 10))
+		w.WriteHeader(http.StatusOK)
+		return
+
+	case "POST":
+		user := authUser(r)
+		if key := idempotencyKey(r); key != "" && idempotent != nil {
+			saved, err := idempotent.Begin(key, requestFingerprint(r))
+			switch {
+			case err == errKeyInFlight:
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			case err == errKeyReused:
+				http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+				return
+			case saved != nil:
+				saved.replay(w)
+				return
+			}
+			rec := &responseRecorder{ResponseWriter: w}
+			defer idempotent.End(key, rec)
+			w = rec
+		}
+		if quotas != nil {
+			if err = quotas.Check(user, r.ContentLength); err != nil {
+				http.Error(w, err.Error(), http.StatusInsufficientStorage)
+				return
+			}
+		}
+		if tenants != nil {
+			if _, ok := tenants.Root(user); !ok {
+				http.Error(w, "no tenant for "+user, http.StatusForbidden)
+				return
+			}
+		}
+		if err = checkFreeSpace(r.ContentLength); err != nil {
+			http.Error(w, err.Error(), http.StatusInsufficientStorage)
 			return
 		}
-		dn, err := ioutil.TempDir("", "camproxy")
+		dn, err := ioutil.TempDir(tmpDir(), "camproxy")
 		if err != nil {
 			http.Error(w, fmt.Sprintf("cannot create temporary directory: %s", err), 500)
 			return
 		}
-		var paraSource, paraDest string
+		var res uploadResult
 		defer func() {
-			if paraSource != "" && paraDest != "" { // save at last
-				os.MkdirAll(filepath.Dir(paraDest), 0700)
-				Log("msg", "Paranoid copying", "src", paraSource, "dst", paraDest)
-				if err = camutil.LinkOrCopy(paraSource, paraDest); err != nil {
-					Log("msg", "copying", "src", paraSource, "dst", paraDest, "error", err)
-				}
-			}
+			res.saveParanoid() // save at last
 			os.RemoveAll(dn)
 		}()
 
+		var attrs map[string]string
+		if values.Get("noperma") != "1" { // create permanode, iff attrs present
+			attrs = make(map[string]string, len(values))
+			for k, vv := range values {
+				if !strings.HasPrefix(k, "a.") {
+					continue
+				}
+				k = k[2:]
+				if strings.HasPrefix(k, "camli") {
+					continue
+				}
+				for _, v := range vv {
+					attrs[k] = v
+					break
+				}
+			}
+			for _, kv := range r.Header["X-Camli-Attr"] {
+				i := strings.IndexByte(kv, '=')
+				if i <= 0 {
+					http.Error(w, fmt.Sprintf("X-Camli-Attr %q is not key=value", kv), 400)
+					return
+				}
+				if k := strings.TrimSpace(kv[:i]); !strings.HasPrefix(k, "camli") {
+					attrs[k] = strings.TrimSpace(kv[i+1:])
+				}
+			}
+		}
+
+		digest, err := newBodyDigest(r)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
 		var filenames, mimetypes []string
 
 		ct := r.Header.Get("Content-Type")
@@ -209,7 +648,7 @@ func handle(w http.ResponseWriter, r *http.Request) {
 			if qmtime == "" {
 				qmtime = r.Header.Get("Last-Modified")
 			}
-			filenames, mimetypes, err = saveMultipartTo(dn, mr, qmtime)
+			filenames, mimetypes, err = saveMultipartTo(dn, mr, qmtime, attrs)
 		default: // legacy direct upload
 			var fn, mime string
 			fn, mime, err = saveDirectTo(dn, r)
@@ -222,75 +661,149 @@ func handle(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, err.Error(), 500)
 			return
 		}
+		if digest != nil {
+			got, err := digest.Check()
+			if got != "" {
+				w.Header().Set("Digest", got)
+			}
+			if err != nil {
+				code := http.StatusUnprocessableEntity
+				if got == "" {
+					code = 500
+				}
+				http.Error(w, err.Error(), code)
+				return
+			}
+		}
+
+		include, exclude := globParam(values, "include"), globParam(values, "exclude")
+		filenames, mimetypes = filterFiles(camutil.DirOptions{Include: include, Exclude: exclude}, filenames, mimetypes)
 
 		Log("msg", "uploading", "files", filenames, "mime-types", mimetypes)
 
-		short := values.Get("short") == "1"
-		var attrs map[string]string
-		if values.Get("noperma") != "1" { // create permanode, iff attrs present
-			attrs = make(map[string]string, len(values))
-			for k, vv := range values {
-				if !strings.HasPrefix(k, "a.") {
-					continue
-				}
-				k = k[2:]
-				if strings.HasPrefix(k, "camli") {
-					continue
-				}
-				for _, v := range vv {
-					attrs[k] = v
-					break
+		short := values.Get("short")
+
+		if len(filenames) == 0 {
+			http.Error(w, "no files in request", 400)
+			return
+		}
+		var chunkSize int
+		if s := values.Get("chunk"); s != "" {
+			n, err := parseSize(s)
+			if err == nil {
+				_, err = camutil.ChunkOptions{Size: int(n)}.Normalize()
+			}
+			if err != nil {
+				http.Error(w, fmt.Sprintf("chunk=%q: %s", s, err), 400)
+				return
+			}
+			chunkSize = int(n)
+		}
+		workers := *flagUploadWorkers
+		if s := values.Get("workers"); s != "" {
+			if workers, err = strconv.Atoi(s); err != nil || workers <= 0 {
+				http.Error(w, fmt.Sprintf("workers=%q: not a positive number", s), 400)
+				return
+			}
+			if workers > *flagMaxUploads {
+				workers = *flagMaxUploads
+			}
+		}
+		var size int64
+		if quotas != nil {
+			for _, fn := range filenames {
+				if fi, statErr := os.Stat(fn); statErr == nil {
+					size += fi.Size()
 				}
 			}
+			// reserved at once (so the concurrent uploads cannot overrun
+			// the quota), and released if the upload fails
+			if err = quotas.Reserve(user, size); err != nil {
+				http.Error(w, err.Error(), http.StatusInsufficientStorage)
+				return
+			}
 		}
 
-		var content, perma blob.Ref
-		switch len(filenames) {
-		case 0:
-			http.Error(w, "no files in request", 400)
+		up := upload{Server: server, User: user, Dir: dn,
+			Files: filenames, MIMETypes: mimetypes, Attrs: attrs, Size: size,
+			Include: include, Exclude: exclude, Workers: workers, ChunkSize: chunkSize}
+		if values.Get("async") == "1" {
+			id, err := spool.Enqueue(up)
+			if err != nil {
+				up.releaseQuota()
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+			acceptJob(w, id)
 			return
-		case 1:
-			content, perma, err = u.UploadFileLazyAttr(r.Context(), filenames[0], mimetypes[0], attrs)
-		default:
-			content, perma, err = u.UploadFileLazyAttr(r.Context(), dn, "", attrs)
 		}
-		if err != nil {
-			http.Error(w, fmt.Sprintf("error uploading %q: %s", filenames, err), 500)
+		if spoolNow {
+			id, err := spool.Add(up)
+			if err != nil {
+				up.releaseQuota()
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+			Log("msg", "spooled", "id", id, "server", server)
+			acceptJob(w, id)
 			return
 		}
-		// store mime types
-		shortKey := camutil.RefToBase64(content)
-		if len(filenames) == 1 {
-			if len(mimetypes) == 1 && mimetypes[0] != "" {
-				mimeCache.Set(shortKey, mimetypes[0])
-			}
-			if *flagParanoid != "" {
-				paraSource, paraDest = filenames[0], getParanoidPath(content)
+		if wantTrailers(r) {
+			w = newTrailerWriter(w)
+		}
+		if res, err = up.Do(r.Context()); err != nil {
+			if _, ok := err.(upstreamError); ok && *flagSpool != "" {
+				id, spoolErr := spool.Add(up)
+				if spoolErr == nil {
+					Log("msg", "spooled", "id", id, "error", err)
+					acceptJob(w, id)
+					return
+				}
+				Log("msg", "spool", "files", filenames, "error", spoolErr)
 			}
+			up.releaseQuota()
+			http.Error(w, fmt.Sprintf("error uploading %q: %s", filenames, err), 500)
+			return
+		}
+		content, perma := res.Content, res.Perma
+		noteRef(r, content)
+		w.Header().Set("X-Camli-Content", formatRef(content, short))
+		if perma.Valid() {
+			w.Header().Set("X-Camli-Permanode", formatRef(perma, short))
+		}
+		if values.Get("describe") == "1" {
+			writeUploadDescription(w, r, up, res, short)
+			return
 		}
 		w.Header().Add("Content-Type", "text/plain")
 		b := bytes.NewBuffer(make([]byte, 0, 128))
-		if short {
-			b.WriteString(shortKey)
-		} else {
-			b.WriteString(content.String())
-		}
+		b.WriteString(formatRef(content, short))
 		if perma.Valid() {
 			b.Write([]byte{'\n'})
-			if short {
-				b.WriteString(camutil.RefToBase64(perma))
-			} else {
-				b.WriteString(perma.String())
-			}
+			b.WriteString(formatRef(perma, short))
 		}
 		w.Header().Add("Content-Length", strconv.Itoa(len(b.Bytes())))
 		w.WriteHeader(201)
 		w.Write(b.Bytes())
+	case "PUT":
+		http.Error(w, "PUT is supported only for /alias/", 405)
 	default:
-		http.Error(w, "Method must be GET/POST", 405)
+		http.Error(w, "Method must be GET/HEAD/POST", 405)
 	}
 }
 
+// authUser returns the HTTP Basic Auth user name of the request,
+// "anonymous" if there is none.
+func authUser(r *http.Request) string {
+	if user, ok := r.Context().Value(sessionUserKey{}).(string); ok && user != "" {
+		return user
+	}
+	if user, _, ok := r.BasicAuth(); ok && user != "" {
+		return user
+	}
+	return "anonymous"
+}
+
 func saveDirectTo(destDir string, r *http.Request) (filename, mimeType string, err error) {
 	Log := logger.Log
 	mimeType = r.Header.Get("Content-Type")
@@ -334,7 +847,9 @@ func saveDirectTo(destDir string, r *http.Request) (filename, mimeType string, e
 	return
 }
 
-func saveMultipartTo(destDir string, mr *multipart.Reader, qmtime string) (filenames, mimetypes []string, err error) {
+// saveMultipartTo saves the files of the form into destDir.
+// The "attrs" field is decoded (as a JSON object) into attrs, if that is not nil.
+func saveMultipartTo(destDir string, mr *multipart.Reader, qmtime string, attrs map[string]string) (filenames, mimetypes []string, err error) {
 	Log := logger.Log
 
 	var fn string
@@ -349,6 +864,18 @@ func saveMultipartTo(destDir string, mr *multipart.Reader, qmtime string) (filen
 					qmtime = b.String()
 				}
 			}
+			if part.FormName() == "attrs" && attrs != nil {
+				var m map[string]string
+				if err = json.NewDecoder(io.LimitReader(part, 1<<20)).Decode(&m); err != nil {
+					part.Close()
+					return nil, nil, errors.Wrap(err, "decode attrs")
+				}
+				for k, v := range m {
+					if !strings.HasPrefix(k, "camli") {
+						attrs[k] = v
+					}
+				}
+			}
 			part.Close()
 			continue
 		}
@@ -454,15 +981,113 @@ func parseLastModified(lastModHeader, mtimeHeader string) time.Time {
 	return lastmod
 }
 
-var mimeCache *camutil.MimeCache
+var (
+	mimeCache *camutil.MimeCache
+	shortRefs *shortRefDB
+	quotas    *quotaDB
+	tenants   *tenantSet
+	replica   *replicator
+	spool     *uploadSpool
+)
 
 type respWriter struct {
 	http.ResponseWriter
 	name, okMime  string
 	headerWritten bool
+	nosniff       bool
 	buf           []byte
 }
 
+// serveFile serves the file with Range support, and with the MIME type of the
+// config's overrides, or cached, or sniffed from its head (or guessed from the
+// file name if that is inconclusive) if not given.
+func serveFile(w http.ResponseWriter, r *http.Request, br blob.Ref, okMime string, fr *schema.FileReader) {
+	nm := camutil.RefToBase64(br)
+	if okMime == "" {
+		okMime = cfg.mimeOverride(fr.FileName())
+	}
+	if okMime == "" {
+		okMime = mimeCache.Get(nm)
+	}
+	if okMime == "" && r.URL.Query().Get("nosniff") == "1" {
+		okMime = "application/octet-stream"
+	}
+	if okMime == "" {
+		head := make([]byte, sniffLen)
+		n, _ := fr.ReadAt(head, 0)
+		if okMime = camutil.SniffMIMEType(head[:n], fr.FileName()); okMime != "application/octet-stream" {
+			mimeCache.Set(nm, okMime)
+		}
+	}
+	w.Header().Set("Content-Type", cfg.withCharset(okMime))
+	w.Header().Set("ETag", `"`+br.String()+`"`)
+	setDisposition(w, r, fr.FileName())
+	http.ServeContent(w, r, fr.FileName(), fr.ModTime(), fr)
+}
+
+// getMode returns the mode of a GET, from ?as=: "content" (the default) follows
+// the file schemas, "schema" returns the JSON of the schema blob, and "raw"
+// the exact bytes of the blob. raw=1 is the same as as=raw.
+func getMode(values url.Values) (string, error) {
+	switch as := values.Get("as"); as {
+	case "":
+		if values.Get("raw") == "1" {
+			return "raw", nil
+		}
+		return "content", nil
+	case "content", "schema", "raw":
+		return as, nil
+	default:
+		return "", errors.Errorf("unknown as=%q (content, schema or raw)", as)
+	}
+}
+
+// setDisposition sets the Content-Disposition as asked by ?download=1
+// (attachment) or ?inline=1, with the file name if known.
+// ?filename= overrides the file name (an attachment, if not inline).
+func setDisposition(w http.ResponseWriter, r *http.Request, filename string) {
+	values := r.URL.Query()
+	var disp string
+	switch {
+	case values.Get("download") == "1":
+		disp = "attachment"
+	case values.Get("inline") == "1":
+		disp = "inline"
+	}
+	if fn := sanitizeFilename(values.Get("filename")); fn != "" {
+		filename = fn
+		if disp == "" {
+			disp = "attachment"
+		}
+	}
+	if disp == "" {
+		return
+	}
+	var params map[string]string
+	if filename != "" {
+		params = map[string]string{"filename": filename}
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disp, params))
+}
+
+// sanitizeFilename returns the base name of the file name without the
+// control characters, or "" if nothing usable remains.
+func sanitizeFilename(filename string) string {
+	if filename == "" {
+		return ""
+	}
+	filename = strings.TrimSpace(strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, safeBaseFn(filename)))
+	if filename == "." || filename == ".." {
+		return ""
+	}
+	return filename
+}
+
 func newRespWriter(w http.ResponseWriter, name, okMime string) *respWriter {
 	if name != "" && (okMime == "" || okMime == "application/octet-stream") {
 		m := mimeCache.Get(name)
@@ -470,61 +1095,137 @@ func newRespWriter(w http.ResponseWriter, name, okMime string) *respWriter {
 			okMime = m
 		}
 	}
-	return &respWriter{w, name, okMime, false, nil}
+	return &respWriter{ResponseWriter: w, name: name, okMime: okMime}
 }
 
+// sniffLen is the number of bytes the MIME type is sniffed from (-sniff-size).
+var sniffLen = 1024
+
+// sniffBufs are the buffers of the sniffed bytes.
+var sniffBufs = sync.Pool{New: func() interface{} { return make([]byte, 0, sniffLen) }}
+
 func (w *respWriter) Write(p []byte) (int, error) {
-	var i int
+	n := len(p)
 	if !w.headerWritten {
-		if w.okMime == "" || w.okMime == "application/octet-stream" {
-			i = len(w.buf)
-			w.buf = append(w.buf, p...)
-			if len(w.buf) < 1024 {
-				return len(p), nil
-			}
-			w.okMime = camutil.MatchMime(w.okMime, w.buf)
-			if w.name != "" && w.okMime != "" {
+		if !w.nosniff && (w.okMime == "" || w.okMime == "application/octet-stream") {
+			if w.buf == nil {
+				w.buf = sniffBufs.Get().([]byte)[:0]
+			}
+			// buffer just the sniffed bytes, not the whole p
+			k := sniffLen - len(w.buf)
+			if k > len(p) {
+				k = len(p)
+			}
+			w.buf, p = append(w.buf, p[:k]...), p[k:]
+			if len(w.buf) < sniffLen {
+				return n, nil
+			}
+			w.okMime = camutil.SniffMIMEType(w.buf, "")
+			if w.name != "" && w.okMime != "application/octet-stream" {
 				mimeCache.Set(w.name, w.okMime)
 			}
-			p, w.buf = w.buf, nil
 		}
 		if w.okMime != "" {
-			w.ResponseWriter.Header().Add("Content-Type", w.okMime)
+			w.ResponseWriter.Header().Add("Content-Type", cfg.withCharset(w.okMime))
 		}
 		w.ResponseWriter.WriteHeader(200)
 		w.headerWritten = true
+		if err := w.flushBuf(); err != nil {
+			return 0, err
+		}
 	}
-	n, err := w.ResponseWriter.Write(p)
-	return n - i, err
+	written, err := w.ResponseWriter.Write(p)
+	return n - len(p) + written, err
 }
 
-func (w *respWriter) Close() (err error) {
-	if w.buf != nil && len(w.buf) > 0 {
+// flushBuf writes the sniffed bytes, and returns the buffer to the pool.
+func (w *respWriter) flushBuf() error {
+	if w.buf == nil {
+		return nil
+	}
+	var err error
+	if len(w.buf) > 0 {
 		_, err = w.ResponseWriter.Write(w.buf)
 	}
-	return
+	sniffBufs.Put(w.buf[:0])
+	w.buf = nil
+	return err
 }
 
-func getUploader() (*camutil.Uploader, error) {
-	return camutil.NewUploader(server, *flagCapCtime, *flagSkipHaveCache), nil
+func (w *respWriter) Close() error {
+	return w.flushBuf()
 }
 
-func getDownloader() (*camutil.Downloader, error) {
-	return camutil.NewDownloader(server)
+// requestServer returns the upstream server selected by the X-Camli-Server
+// header or the server query parameter - iff it is in the -servers allowlist,
+// or in the config.
+func requestServer(r *http.Request) (string, error) {
+	srv := r.Header.Get("X-Camli-Server")
+	if srv == "" {
+		srv = r.URL.Query().Get("server")
+	}
+	if srv == "" || srv == server {
+		return server, nil
+	}
+	if _, ok := cfg.Servers[srv]; ok {
+		return srv, nil
+	}
+	for _, allowed := range strings.Split(*flagServers, ",") {
+		if strings.TrimSpace(allowed) == srv {
+			return srv, nil
+		}
+	}
+	return "", errors.Errorf("server %q is not allowed", srv)
 }
 
-func getParanoidPath(br blob.Ref) string {
-	if *flagParanoid == "" || !br.Valid() {
-		return ""
+// getUploader returns the uploader to the server, signing with the key of
+// the user (see -user-keys), or the default one if user is empty.
+func getUploader(ctx context.Context, server, user string) (*camutil.Uploader, error) {
+	return newUploader(ctx, server, uploaderOpts(server, user))
+}
+
+// uploaderOpts returns the options of the uploader of the user to the server.
+func uploaderOpts(server, user string) *camutil.Options {
+	opts := serverOpts(server)
+	if keyID, ok := userKeys[user]; ok && user != "" {
+		opts.KeyID = keyID
 	}
-	txt := br.String()
-	for i := 0; i < len(txt); i++ {
-		if txt[i] == '-' {
-			hsh := txt[i+1:]
-			return filepath.Join(*flagParanoid, hsh[:3], hsh[3:6], txt+".dat")
-		}
+	return opts
+}
+
+// newUploader returns the (cached) uploader to the server with opts.
+func newUploader(ctx context.Context, server string, opts *camutil.Options) (*camutil.Uploader, error) {
+	u := camutil.NewUploader(ctx, server, opts)
+	if u == nil {
+		return nil, errors.Errorf("cannot create uploader for %q", server)
+	}
+	return u, nil
+}
+
+func getDownloader(ctx context.Context, server string) (*camutil.Downloader, error) {
+	return camutil.NewDownloader(ctx, server, serverOpts(server))
+}
+
+// errStatus returns the HTTP status code for the kind of the camutil error.
+func errStatus(err error) int {
+	switch {
+	case stderrors.Is(err, camutil.ErrNotCached):
+		// the circuit of the upstream is open
+		return http.StatusServiceUnavailable
+	case stderrors.Is(err, camutil.ErrNotFound):
+		return http.StatusNotFound
+	case stderrors.Is(err, camutil.ErrBadRef):
+		return http.StatusBadRequest
+	case stderrors.Is(err, camutil.ErrUpstreamUnavailable):
+		return http.StatusBadGateway
+	case stderrors.Is(err, camutil.ErrSchema):
+		return http.StatusUnprocessableEntity
+	case stderrors.Is(err, camutil.ErrOutOfMemory):
+		return http.StatusServiceUnavailable
+	case stderrors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
 	}
-	return ""
+	return http.StatusInternalServerError
 }
 
 func timeParse(text string) (time.Time, bool) {
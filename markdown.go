@@ -0,0 +1,179 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// serveMarkdown renders the markdown read from r as a HTML page.
+//
+// The renderer knows just the common subset (headings, paragraphs, lists,
+// quotes, fenced code, emphasis, code spans and links), and escapes everything
+// else, so no HTML of the source gets through.
+func serveMarkdown(w http.ResponseWriter, r io.Reader) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'")
+	io.WriteString(w, "<!DOCTYPE html>\n<meta charset=\"utf-8\">\n")
+	if err := renderMarkdown(w, r); err != nil {
+		logger.Log("msg", "render markdown", "error", err)
+	}
+}
+
+var (
+	mdOrdered = regexp.MustCompile(`^[0-9]+[.)]\s+`)
+	mdLink    = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)\)`)
+	mdStrong  = regexp.MustCompile(`\*\*([^*]+)\*\*`)
+	mdEm      = regexp.MustCompile(`\*([^*]+)\*`)
+)
+
+func renderMarkdown(w io.Writer, r io.Reader) error {
+	var (
+		para   []string
+		list   string
+		inCode bool
+	)
+	flush := func() {
+		if len(para) != 0 {
+			fmt.Fprintf(w, "<p>%s</p>\n", mdInline(strings.Join(para, " ")))
+			para = para[:0]
+		}
+	}
+	closeList := func() {
+		if list != "" {
+			fmt.Fprintf(w, "</%s>\n", list)
+			list = ""
+		}
+	}
+	listItem := func(typ, text string) {
+		flush()
+		if list != typ {
+			closeList()
+			fmt.Fprintf(w, "<%s>\n", typ)
+			list = typ
+		}
+		fmt.Fprintf(w, "<li>%s</li>\n", mdInline(text))
+	}
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64<<10), 1<<20)
+	for sc.Scan() {
+		line := sc.Text()
+		trimmed := strings.TrimSpace(line)
+		if inCode {
+			if strings.HasPrefix(trimmed, "```") {
+				io.WriteString(w, "</code></pre>\n")
+				inCode = false
+			} else {
+				io.WriteString(w, html.EscapeString(line)+"\n")
+			}
+			continue
+		}
+		switch {
+		case strings.HasPrefix(trimmed, "```"):
+			flush()
+			closeList()
+			io.WriteString(w, "<pre><code>")
+			inCode = true
+		case trimmed == "":
+			flush()
+			closeList()
+		case trimmed == "---" || trimmed == "***" || trimmed == "___":
+			flush()
+			closeList()
+			io.WriteString(w, "<hr>\n")
+		case strings.HasPrefix(trimmed, "#"):
+			n := len(trimmed) - len(strings.TrimLeft(trimmed, "#"))
+			if n > 6 || (len(trimmed) > n && trimmed[n] != ' ') {
+				para = append(para, trimmed)
+				continue
+			}
+			flush()
+			closeList()
+			fmt.Fprintf(w, "<h%d>%s</h%d>\n", n, mdInline(strings.TrimSpace(trimmed[n:])), n)
+		case strings.HasPrefix(trimmed, "- ") || strings.HasPrefix(trimmed, "* ") || strings.HasPrefix(trimmed, "+ "):
+			listItem("ul", strings.TrimSpace(trimmed[2:]))
+		case mdOrdered.MatchString(trimmed):
+			listItem("ol", mdOrdered.ReplaceAllString(trimmed, ""))
+		case strings.HasPrefix(trimmed, ">"):
+			flush()
+			closeList()
+			fmt.Fprintf(w, "<blockquote><p>%s</p></blockquote>\n", mdInline(strings.TrimSpace(trimmed[1:])))
+		default:
+			closeList()
+			para = append(para, trimmed)
+		}
+	}
+	flush()
+	closeList()
+	if inCode {
+		io.WriteString(w, "</code></pre>\n")
+	}
+	return sc.Err()
+}
+
+// mdInline renders the code spans, and the rest with mdSpan.
+func mdInline(s string) string {
+	var buf strings.Builder
+	for s != "" {
+		i := strings.IndexByte(s, '`')
+		if i < 0 {
+			buf.WriteString(mdSpan(s))
+			break
+		}
+		j := strings.IndexByte(s[i+1:], '`')
+		if j < 0 {
+			buf.WriteString(mdSpan(s))
+			break
+		}
+		buf.WriteString(mdSpan(s[:i]))
+		buf.WriteString("<code>" + html.EscapeString(s[i+1:i+1+j]) + "</code>")
+		s = s[i+2+j:]
+	}
+	return buf.String()
+}
+
+// mdSpan renders the links and emphasis of the text, escaping the rest.
+func mdSpan(s string) string {
+	var buf strings.Builder
+	for {
+		loc := mdLink.FindStringSubmatchIndex(s)
+		if loc == nil {
+			buf.WriteString(mdEmphasis(html.EscapeString(s)))
+			return buf.String()
+		}
+		buf.WriteString(mdEmphasis(html.EscapeString(s[:loc[0]])))
+		text, href := s[loc[2]:loc[3]], s[loc[4]:loc[5]]
+		if u, err := url.Parse(href); err == nil && (u.Scheme == "" || u.Scheme == "http" || u.Scheme == "https" || u.Scheme == "mailto") {
+			fmt.Fprintf(&buf, "<a href=\"%s\">%s</a>", html.EscapeString(href), mdEmphasis(html.EscapeString(text)))
+		} else {
+			buf.WriteString(html.EscapeString(s[loc[0]:loc[1]]))
+		}
+		s = s[loc[1]:]
+	}
+}
+
+func mdEmphasis(s string) string {
+	return mdEm.ReplaceAllString(mdStrong.ReplaceAllString(s, "<strong>$1</strong>"), "<em>$1</em>")
+}
@@ -0,0 +1,158 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tgulacsi/camproxy/camutil"
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/schema"
+)
+
+// metaCache caches the JSON metadata of the files, keyed like the mimeCache.
+var metaCache *camutil.MimeCache
+
+// serveMeta writes the metadata of the file as JSON:
+//
+//	GET /meta/<ref>
+func serveMeta(w http.ResponseWriter, r *http.Request, server string) {
+	items, err := parseRefs(strings.TrimPrefix(r.URL.Path, "/meta/"))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	br := items[0]
+	if !checkAccess(w, r, br) {
+		return
+	}
+	key := camutil.RefToBase64(br)
+	if s := metaCache.Get(key); s != "" {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, s)
+		return
+	}
+	d, err := getDownloader(r.Context(), server)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error getting downloader to %q: %s", server, err), 500)
+		return
+	}
+	md, err := d.Metadata(r.Context(), br)
+	if err != nil {
+		http.Error(w, err.Error(), errStatus(err))
+		return
+	}
+	b, err := json.Marshal(md)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if md.Ref == br { // the content of a permanode may change
+		metaCache.Set(key, string(b))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// fileMeta is the answer of GET /<ref>?meta=1.
+type fileMeta struct {
+	Size     int64  `json:"size"`
+	ModTime  string `json:"mtime,omitempty"`
+	MIMEType string `json:"mimeType,omitempty"`
+	FileName string `json:"fileName,omitempty"`
+	Chunks   int    `json:"chunks"`
+}
+
+// serveFileMeta writes the size, modification time, MIME type, name and
+// number of chunks of the file as JSON, from its schema blobs and the mimeCache,
+// without reading (and sniffing) the contents:
+//
+//	GET /<ref>?meta=1
+func serveFileMeta(w http.ResponseWriter, r *http.Request, d *camutil.Downloader, br blob.Ref) {
+	fr, err := d.OpenFile(r.Context(), br)
+	if err != nil {
+		http.Error(w, err.Error(), errStatus(err))
+		return
+	}
+	defer fr.Close()
+	fm := fileMeta{Size: fr.Size(), FileName: fr.FileName()}
+	if t := fr.ModTime(); !t.IsZero() {
+		fm.ModTime = t.UTC().Format(time.RFC3339)
+	}
+	if fm.MIMEType = cfg.mimeOverride(fm.FileName); fm.MIMEType == "" {
+		if fm.MIMEType = mimeCache.Get(camutil.RefToBase64(br)); fm.MIMEType == "" {
+			fm.MIMEType = camutil.MIMETypeByExtension(fm.FileName)
+		}
+	}
+	if err = fr.ForeachChunk(r.Context(), func(_ []blob.Ref, _ schema.BytesPart) error {
+		fm.Chunks++
+		return nil
+	}); err != nil {
+		http.Error(w, fmt.Sprintf("walk the chunks of %s: %v", br, err), errStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fm)
+}
+
+// chunkManifest is the answer of GET /<ref>?chunks=1.
+type chunkManifest struct {
+	BlobRef string      `json:"blobRef"`
+	Size    int64       `json:"size"`
+	Chunks  []fileChunk `json:"chunks"`
+}
+
+// fileChunk is a chunk of a file: Size bytes at Offset of the file are
+// at BlobOffset of the (raw) blob Ref.
+type fileChunk struct {
+	Ref        string `json:"ref"`
+	Offset     int64  `json:"offset"`
+	Size       uint64 `json:"size"`
+	BlobOffset uint64 `json:"blobOffset,omitempty"`
+}
+
+// serveChunks writes the chunks of the file with their offsets as JSON,
+// so the clients can download them (with as=raw) in parallel, resume and
+// verify them one by one:
+//
+//	GET /<ref>?chunks=1
+func serveChunks(w http.ResponseWriter, r *http.Request, d *camutil.Downloader, br blob.Ref) {
+	fr, err := d.OpenFile(r.Context(), br)
+	if err != nil {
+		http.Error(w, err.Error(), errStatus(err))
+		return
+	}
+	defer fr.Close()
+	cm := chunkManifest{BlobRef: br.String(), Size: fr.Size()}
+	var off int64
+	if err = fr.ForeachChunk(r.Context(), func(_ []blob.Ref, p schema.BytesPart) error {
+		cm.Chunks = append(cm.Chunks, fileChunk{Ref: p.BlobRef.String(), Offset: off, Size: p.Size, BlobOffset: p.Offset})
+		off += int64(p.Size)
+		return nil
+	}); err != nil {
+		http.Error(w, fmt.Sprintf("walk the chunks of %s: %v", br, err), errStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", `"`+br.String()+`"`)
+	json.NewEncoder(w).Encode(cm)
+}
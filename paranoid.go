@@ -0,0 +1,262 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tgulacsi/camproxy/camutil"
+	"perkeep.org/pkg/blob"
+)
+
+// paranoidManifest is the sidecar written next to each paranoid copy,
+// to be able to verify and inventory the paranoid tree independently.
+type paranoidManifest struct {
+	BlobRef  string    `json:"blobRef"`
+	SHA256   string    `json:"sha256"`
+	Size     int64     `json:"size"`
+	FileName string    `json:"fileName"`
+	Time     time.Time `json:"time"`
+	// Compression is the compression method of the saved copy, if any.
+	Compression string `json:"compression,omitempty"`
+	// Encrypted is true iff the saved copy is encrypted with the paranoid key.
+	Encrypted bool `json:"encrypted,omitempty"`
+}
+
+// paranoidKey is the encryption key of the paranoid copies, if set.
+var paranoidKey []byte
+
+func getParanoidPath(br blob.Ref) string {
+	if *flagParanoid == "" || !br.Valid() {
+		return ""
+	}
+	txt := br.String()
+	for i := 0; i < len(txt); i++ {
+		if txt[i] == '-' {
+			hsh := txt[i+1:]
+			if len(hsh) < 6 {
+				return ""
+			}
+			return filepath.Join(*flagParanoid, hsh[:3], hsh[3:6], txt+".dat")
+		}
+	}
+	return ""
+}
+
+// saveParanoid saves the uploaded src under the paranoid dir (compressed
+// if -paranoid-compress is set, encrypted if there is a paranoid key),
+// with a ".json" sidecar manifest.
+func saveParanoid(src string, br blob.Ref) error {
+	dst := getParanoidPath(br)
+	if dst == "" {
+		return nil
+	}
+	os.MkdirAll(filepath.Dir(dst), 0700)
+	method := *flagParanoidCompress
+	logger.Log("msg", "Paranoid copying", "src", src, "dst", dst, "compress", method)
+	if method == "" && paranoidKey == nil {
+		if err := camutil.LinkOrCopy(src, dst); err != nil {
+			return errors.Wrapf(err, "copy %q to %q", src, dst)
+		}
+	} else if err := writeParanoidCopy(src, dst+paranoidExt(method, paranoidKey != nil), method, paranoidKey); err != nil {
+		return err
+	}
+	m, err := newParanoidManifest(src, br)
+	if err != nil {
+		return err
+	}
+	m.Compression, m.Encrypted = method, paranoidKey != nil
+	return writeParanoidManifest(dst+".json", m)
+}
+
+// paranoidExt returns the extension appended to the ".dat" of the copies.
+func paranoidExt(compression string, encrypted bool) string {
+	ext := compressExt[compression]
+	if encrypted {
+		ext += ".enc"
+	}
+	return ext
+}
+
+// writeParanoidCopy copies src to dst, compressing then encrypting it.
+func writeParanoidCopy(src, dst, compression string, key []byte) error {
+	sfh, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer sfh.Close()
+	dfh, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer dfh.Close()
+	closers := make([]io.Closer, 0, 2)
+	w := io.Writer(dfh)
+	if key != nil {
+		ew, err := newEncryptWriter(key, w)
+		if err != nil {
+			return err
+		}
+		closers = append(closers, ew)
+		w = ew
+	}
+	if compression != "" {
+		cw, err := newCompressWriter(compression, w)
+		if err != nil {
+			return err
+		}
+		closers = append(closers, cw)
+		w = cw
+	}
+	if _, err = io.Copy(w, sfh); err != nil {
+		return errors.Wrapf(err, "write %q to %q", src, dst)
+	}
+	for i := len(closers) - 1; i >= 0; i-- {
+		if err = closers[i].Close(); err != nil {
+			return errors.Wrapf(err, "write %q", dst)
+		}
+	}
+	return dfh.Close()
+}
+
+func newParanoidManifest(src string, br blob.Ref) (paranoidManifest, error) {
+	m := paranoidManifest{BlobRef: br.String(), FileName: filepath.Base(src), Time: time.Now()}
+	fh, err := os.Open(src)
+	if err != nil {
+		return m, err
+	}
+	defer fh.Close()
+	hsh := sha256.New()
+	if m.Size, err = io.Copy(hsh, fh); err != nil {
+		return m, errors.Wrapf(err, "hash %q", src)
+	}
+	m.SHA256 = hex.EncodeToString(hsh.Sum(nil))
+	return m, nil
+}
+
+func writeParanoidManifest(fn string, m paranoidManifest) error {
+	fh, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+	if err = json.NewEncoder(fh).Encode(m); err != nil {
+		fh.Close()
+		return errors.Wrapf(err, "write %q", fn)
+	}
+	return fh.Close()
+}
+
+// paranoidCopy is a saved copy found in the paranoid dir.
+type paranoidCopy struct {
+	Ref blob.Ref
+	// Path is the path of the (possibly compressed/encrypted) copy,
+	// Manifest is the path of the sidecar (may not exist).
+	Path, Manifest string
+	Size           int64
+	Time           time.Time
+}
+
+// walkParanoid calls fn for each copy under the paranoid dir.
+func walkParanoid(dir string, fn func(paranoidCopy) error) error {
+	return filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() || strings.HasSuffix(path, ".json") {
+			return nil
+		}
+		base := filepath.Base(path)
+		i := strings.Index(base, ".dat")
+		if i < 0 {
+			return nil
+		}
+		br, ok := blob.Parse(base[:i])
+		if !ok {
+			return nil
+		}
+		pc := paranoidCopy{Ref: br, Path: path, Size: fi.Size(), Time: fi.ModTime(),
+			Manifest: filepath.Join(filepath.Dir(path), base[:i+4]+".json")}
+		// the copy may be hard linked, so its mtime is the original file's
+		if mfi, err := os.Stat(pc.Manifest); err == nil {
+			pc.Time = mfi.ModTime()
+		}
+		return fn(pc)
+	})
+}
+
+// pruneParanoid removes the copies older than maxAge, then the oldest ones
+// till the total size is under maxSize. Zero values mean no limit.
+func pruneParanoid(dir string, maxAge time.Duration, maxSize int64) (removed int, freed int64, err error) {
+	var copies []paranoidCopy
+	var total int64
+	if err = walkParanoid(dir, func(pc paranoidCopy) error {
+		copies = append(copies, pc)
+		total += pc.Size
+		return nil
+	}); err != nil {
+		return 0, 0, err
+	}
+	sort.Slice(copies, func(i, j int) bool { return copies[i].Time.Before(copies[j].Time) })
+	deadline := time.Now().Add(-maxAge)
+	for _, pc := range copies {
+		if !(maxAge > 0 && pc.Time.Before(deadline) || maxSize > 0 && total > maxSize) {
+			break
+		}
+		if err = removeParanoidCopy(pc); err != nil {
+			return removed, freed, err
+		}
+		removed++
+		freed += pc.Size
+		total -= pc.Size
+	}
+	return removed, freed, nil
+}
+
+func removeParanoidCopy(pc paranoidCopy) error {
+	if err := os.Remove(pc.Path); err != nil {
+		return err
+	}
+	if err := os.Remove(pc.Manifest); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// pruneParanoidLoop prunes the paranoid dir in every interval, till ctx is done.
+func pruneParanoidLoop(ctx context.Context, dir string, interval, maxAge time.Duration, maxSize int64) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		removed, freed, err := pruneParanoid(dir, maxAge, maxSize)
+		logger.Log("msg", "paranoid prune", "dir", dir, "removed", removed, "freed", freed, "error", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
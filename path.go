@@ -0,0 +1,137 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	stderrors "errors"
+	"fmt"
+	"html"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/tgulacsi/camproxy/camutil"
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/schema"
+)
+
+// servePathRequest serves GET /path/<root-ref>/docs/2024/report.pdf.
+func servePathRequest(w http.ResponseWriter, r *http.Request, server string) {
+	rest := strings.TrimPrefix(r.URL.Path, "/path/")
+	var p string
+	if i := strings.IndexByte(rest, '/'); i >= 0 {
+		rest, p = rest[:i], rest[i:]
+	}
+	items, err := parseRefs(rest)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if !checkAccess(w, r, items[0]) {
+		return
+	}
+	servePath(w, r, server, items[0], p)
+}
+
+// servePath resolves the path under the root, and streams the file found,
+// or lists the directory.
+func servePath(w http.ResponseWriter, r *http.Request, server string, root blob.Ref, p string) {
+	d, err := getDownloader(r.Context(), server)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error getting downloader to %q: %s", server, err), 500)
+		return
+	}
+	b, err := d.ResolvePath(r.Context(), root, p)
+	if err != nil {
+		http.Error(w, err.Error(), errStatus(err))
+		return
+	}
+	if b.Type() == "directory" {
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			http.Redirect(w, r, path.Base(r.URL.Path)+"/", http.StatusMovedPermanently)
+			return
+		}
+		if b = indexDocument(r, d, b); b.Type() == "directory" {
+			serveDirList(w, r, d, b)
+			return
+		}
+	}
+
+	if r.URL.Query().Get("render") == "md" {
+		rc, err := d.Start(r.Context(), true, b.BlobRef())
+		if err != nil {
+			http.Error(w, err.Error(), errStatus(err))
+			return
+		}
+		defer rc.Close()
+		serveMarkdown(w, rc)
+		return
+	}
+
+	fr, err := d.OpenFile(r.Context(), b.BlobRef())
+	if err != nil {
+		http.Error(w, err.Error(), errStatus(err))
+		return
+	}
+	defer fr.Close()
+	serveFile(w, r, b.BlobRef(), "", fr)
+}
+
+// indexDocument returns the first member of the directory named as one of
+// the -index-names, or the directory itself.
+func indexDocument(r *http.Request, d *camutil.Downloader, dir *schema.Blob) *schema.Blob {
+	for _, name := range strings.Split(*flagIndexNames, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		b, err := d.ResolvePath(r.Context(), dir.BlobRef(), name)
+		if err == nil && b.Type() == "file" {
+			return b
+		}
+		if err != nil && !stderrors.Is(err, camutil.ErrNotFound) {
+			logger.Log("msg", "index document", "dir", dir.BlobRef(), "name", name, "error", err)
+		}
+	}
+	return dir
+}
+
+// serveDirList writes a simple HTML listing of the directory.
+func serveDirList(w http.ResponseWriter, r *http.Request, d *camutil.Downloader, dir *schema.Blob) {
+	fsys, err := d.FS(r.Context(), dir.BlobRef())
+	if err != nil {
+		http.Error(w, err.Error(), errStatus(err))
+		return
+	}
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		http.Error(w, err.Error(), errStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, "<!DOCTYPE html>\n<title>%s</title>\n<ul>\n", html.EscapeString(dir.FileName()))
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() {
+			name += "/"
+		}
+		fmt.Fprintf(w, "<li><a href=\"%s\">%s</a></li>\n",
+			html.EscapeString((&url.URL{Path: name}).String()), html.EscapeString(name))
+	}
+	fmt.Fprintf(w, "</ul>\n")
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/tgulacsi/camproxy/camutil"
+)
+
+// maxPermanodePage is the maximum of the limit parameter of /permanodes.
+const maxPermanodePage = 1000
+
+// servePermanodes lists the permanodes as JSON pages:
+//
+//	GET /permanodes?limit=50&continue=<token of the previous page>
+//
+// or just those having the attribute (with the value, if given):
+//
+//	GET /lookup?attr=camliPath:foo&value=bar&limit=50&continue=...
+func servePermanodes(w http.ResponseWriter, r *http.Request, server string) {
+	values := r.URL.Query()
+	limit := 50
+	if s := values.Get("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil || limit <= 0 {
+			http.Error(w, fmt.Sprintf("bad limit %q", s), 400)
+			return
+		}
+		if limit > maxPermanodePage {
+			limit = maxPermanodePage
+		}
+	}
+	d, err := getDownloader(r.Context(), server)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error getting downloader to %q: %s", server, err), 500)
+		return
+	}
+	var page camutil.PermanodePage
+	if r.URL.Path == "/lookup" {
+		if values.Get("attr") == "" {
+			http.Error(w, "attr is needed", 400)
+			return
+		}
+		page, err = d.Lookup(r.Context(), values.Get("attr"), values.Get("value"), limit, values.Get("continue"))
+	} else {
+		page, err = d.Permanodes(r.Context(), limit, values.Get("continue"))
+	}
+	if err != nil {
+		http.Error(w, err.Error(), errStatus(err))
+		return
+	}
+	if tenants != nil {
+		user := authUser(r)
+		pns := page.Permanodes[:0]
+		for _, p := range page.Permanodes {
+			if tenants.Allowed(user, p.Ref) {
+				pns = append(pns, p)
+			}
+		}
+		page.Permanodes = pns
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
@@ -0,0 +1,88 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/schema"
+)
+
+// prettyRef matches the blobrefs in the JSON of a schema blob.
+var prettyRef = regexp.MustCompile(`\b[a-z][a-z0-9]*-[0-9a-f]{16,}\b`)
+
+// serveSchema writes the schema blob br read from rc as JSON, or if pretty,
+// re-indented: as HTML with the refs linked to their own pretty view,
+// if the client accepts HTML.
+func serveSchema(w http.ResponseWriter, r *http.Request, br blob.Ref, rc io.Reader, pretty bool) {
+	b, err := ioutil.ReadAll(io.LimitReader(rc, schema.MaxSchemaBlobSize+1))
+	if err != nil {
+		http.Error(w, err.Error(), errStatus(err))
+		return
+	}
+	if len(b) > schema.MaxSchemaBlobSize {
+		http.Error(w, fmt.Sprintf("%s is not a schema blob", br), http.StatusUnsupportedMediaType)
+		return
+	}
+	if sb, err := schema.BlobFromReader(br, bytes.NewReader(b)); err != nil || sb.Type() == "" {
+		http.Error(w, fmt.Sprintf("%s is not a schema blob", br), http.StatusUnsupportedMediaType)
+		return
+	}
+	if !pretty {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+		return
+	}
+	var buf bytes.Buffer
+	if err = json.Indent(&buf, b, "", "  "); err != nil {
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	buf.WriteByte('\n')
+	if !strings.Contains(r.Header.Get("Accept"), "text/html") {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(buf.Bytes())
+		return
+	}
+	// keep the selected server on the links
+	q := url.Values{"as": {"schema"}, "pretty": {"1"}}
+	if srv := r.URL.Query().Get("server"); srv != "" {
+		q.Set("server", srv)
+	}
+	query := "?" + q.Encode()
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'")
+	io.WriteString(w, "<!DOCTYPE html>\n<meta charset=\"utf-8\">\n<pre>")
+	io.WriteString(w, prettyRef.ReplaceAllStringFunc(html.EscapeString(buf.String()), func(s string) string {
+		br, ok := blob.Parse(s)
+		if !ok {
+			return s
+		}
+		return fmt.Sprintf("<a href=\"%s\">%s</a>", html.EscapeString(br.String()+query), s)
+	}))
+	io.WriteString(w, "</pre>\n")
+}
@@ -0,0 +1,138 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tgulacsi/camproxy/camutil"
+)
+
+// putCommand uploads the files and directories, as the POSTs do:
+//
+//	camproxy put [-permanode] [-mtime t] [-tag tag] [-attr k=v,...] [-include glob,...] [-exclude glob,...] [-ignore-file name] [-journal file] [-workers n] path...
+func putCommand(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("put", flag.ContinueOnError)
+	flagPerma := fs.Bool("permanode", false, "create a permanode (titled by the file name) even without attributes")
+	flagMtime := fs.String("mtime", "", "modification time of the (regular) files, as in the mtime parameter")
+	flagTag := fs.String("tag", "", "tag of the permanode")
+	flagAttr := fs.String("attr", "", "attributes of the permanode, as k=v,...")
+	flagUser := fs.String("user", "", "upload as this user (for -user-keys and -tenants)")
+	flagInclude := fs.String("include", "", "comma-separated globs: upload only the matching files of the directories (** matches any number of directories)")
+	flagExclude := fs.String("exclude", "", "comma-separated globs: skip the matching files and directories of the directories")
+	flagIgnore := fs.String("ignore-file", camutil.IgnoreFileName, "honor the gitignore-style ignore files of this name in the directories (empty to upload everything)")
+	flagWorkers := fs.Int("workers", *flagUploadWorkers, "number of the files of the directories uploaded in parallel (0: 8)")
+	flagJournal := fs.String("journal", "", "journal of the uploaded files of the directories: an interrupted put resumes where it left off")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errors.New("a file or directory is needed")
+	}
+	mtime := parseLastModified("", *flagMtime)
+	if *flagMtime != "" && mtime.IsZero() {
+		return errors.Errorf("cannot parse mtime %q", *flagMtime)
+	}
+	attrs := make(map[string]string)
+	if *flagAttr != "" {
+		for _, kv := range strings.Split(*flagAttr, ",") {
+			i := strings.IndexByte(kv, '=')
+			if i <= 0 {
+				return errors.Errorf("attr %q is not k=v", kv)
+			}
+			attrs[kv[:i]] = kv[i+1:]
+		}
+	}
+	if *flagTag != "" {
+		attrs["tag"] = *flagTag
+	}
+	if *flagReplica != "" {
+		replica = newReplicator(*flagReplica, 0, 0, *flagReplicaFailed)
+	}
+
+	dirOpts := camutil.DirOptions{Include: splitGlobs(*flagInclude), Exclude: splitGlobs(*flagExclude), IgnoreFile: *flagIgnore, Workers: *flagWorkers}
+	if *flagJournal != "" {
+		journal, err := newFileStateDB(*flagJournal)
+		if err != nil {
+			return err
+		}
+		defer journal.Close()
+		dirOpts.Known = journal.For(server)
+	}
+
+	for _, fn := range fs.Args() {
+		res, err := putPath(ctx, fn, attrs, *flagPerma, mtime, *flagUser, dirOpts)
+		if err != nil {
+			return errors.Wrapf(err, "upload %q", fn)
+		}
+		if res.Perma.Valid() {
+			fmt.Printf("%s\t%s\t%s\n", fn, res.Content, res.Perma)
+		} else {
+			fmt.Printf("%s\t%s\n", fn, res.Content)
+		}
+	}
+	return nil
+}
+
+// putPath uploads the file or directory, with a permanode iff there are
+// attributes or perma is true. A non-zero mtime overrides the modification
+// time of a regular file (on a copy). The files of a directory are filtered by dirOpts.
+func putPath(ctx context.Context, fn string, attrs map[string]string, perma bool, mtime time.Time, user string, dirOpts camutil.DirOptions) (uploadResult, error) {
+	fi, err := os.Stat(fn)
+	if err != nil {
+		return uploadResult{}, err
+	}
+	up := upload{Server: server, User: user, Dir: fn,
+		Files: []string{fn}, MIMETypes: []string{""}, Attrs: attrs,
+		Include: dirOpts.Include, Exclude: dirOpts.Exclude, IgnoreFile: dirOpts.IgnoreFile,
+		Known: dirOpts.Known, Workers: dirOpts.Workers}
+	if fi.Mode().IsRegular() {
+		up.Size = fi.Size()
+		up.Dir = filepath.Dir(fn)
+	}
+	if perma && len(attrs) == 0 {
+		up.Attrs = map[string]string{"title": filepath.Base(fn)}
+	}
+	if !mtime.IsZero() && fi.Mode().IsRegular() {
+		// do not touch the original
+		tmp, err := ioutil.TempDir(tmpDir(), "camproxy-put-")
+		if err != nil {
+			return uploadResult{}, err
+		}
+		defer os.RemoveAll(tmp)
+		up.Dir, up.Files[0] = tmp, filepath.Join(tmp, filepath.Base(fn))
+		if err = camutil.CopyFile(fn, up.Files[0]); err == nil {
+			err = os.Chtimes(up.Files[0], mtime, mtime)
+		}
+		if err != nil {
+			return uploadResult{}, err
+		}
+	}
+	res, err := up.Do(ctx)
+	if err == nil {
+		res.saveParanoid()
+	}
+	return res, err
+}
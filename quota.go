@@ -0,0 +1,169 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"perkeep.org/pkg/sorted"
+	"perkeep.org/pkg/sorted/kvfile"
+)
+
+// errQuotaExceeded is returned when an upload would exceed the user's quota.
+var errQuotaExceeded = errors.New("quota exceeded")
+
+// quotaDB tracks the uploaded bytes per auth identity, persisted in a kv file.
+type quotaDB struct {
+	mu     sync.Mutex
+	db     sorted.KeyValue
+	limits map[string]int64
+}
+
+// newQuotaDB opens (or creates) the usage db, with the limits given as
+// "user=size,..." - the "*" user is the default limit, 0 means unlimited.
+func newQuotaDB(filename, spec string) (*quotaDB, error) {
+	limits, err := parseQuotaSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+	db, err := kvfile.NewStorage(filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open %q", filename)
+	}
+	return &quotaDB{db: db, limits: limits}, nil
+}
+
+func parseQuotaSpec(spec string) (map[string]int64, error) {
+	limits := make(map[string]int64)
+	for _, part := range strings.Split(spec, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		i := strings.IndexByte(part, '=')
+		if i < 0 {
+			return nil, errors.Errorf("no = in quota %q", part)
+		}
+		size, err := parseSize(part[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		limits[part[:i]] = size
+	}
+	return limits, nil
+}
+
+// parseSize parses a byte size with an optional K, M, G or T suffix.
+func parseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	s = strings.TrimSuffix(s, "B")
+	mul := int64(1)
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'K':
+			mul = 1 << 10
+		case 'M':
+			mul = 1 << 20
+		case 'G':
+			mul = 1 << 30
+		case 'T':
+			mul = 1 << 40
+		}
+		if mul != 1 {
+			s = s[:n-1]
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "parse size %q", s)
+	}
+	return n * mul, nil
+}
+
+// Close closes the underlying db.
+func (q *quotaDB) Close() error {
+	if q == nil || q.db == nil {
+		return nil
+	}
+	return q.db.Close()
+}
+
+// Limit returns the quota of the user, 0 means unlimited.
+func (q *quotaDB) Limit(user string) int64 {
+	if limit, ok := q.limits[user]; ok {
+		return limit
+	}
+	return q.limits["*"]
+}
+
+// Used returns the bytes uploaded by the user so far.
+func (q *quotaDB) Used(user string) int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.used(user)
+}
+
+func (q *quotaDB) used(user string) int64 {
+	s, err := q.db.Get(user)
+	if err != nil {
+		if err != sorted.ErrNotFound {
+			logger.Log("msg", "quota get", "user", user, "error", err)
+		}
+		return 0
+	}
+	n, _ := strconv.ParseInt(s, 10, 64)
+	return n
+}
+
+// Check returns errQuotaExceeded iff uploading size more bytes would exceed
+// the user's quota.
+func (q *quotaDB) Check(user string, size int64) error {
+	limit := q.Limit(user)
+	if limit <= 0 {
+		return nil
+	}
+	if used := q.Used(user); used+size > limit {
+		return errors.Wrapf(errQuotaExceeded, "%s: used %d + %d > %d", user, used, size, limit)
+	}
+	return nil
+}
+
+// Reserve adds size to the user's used bytes, iff it fits into the quota -
+// errQuotaExceeded otherwise. The bytes of a failed upload must be Released.
+func (q *quotaDB) Reserve(user string, size int64) error {
+	limit := q.Limit(user)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	used := q.used(user)
+	if limit > 0 && used+size > limit {
+		return errors.Wrapf(errQuotaExceeded, "%s: used %d + %d > %d", user, used, size, limit)
+	}
+	return q.db.Set(user, strconv.FormatInt(used+size, 10))
+}
+
+// Release gives back the size reserved for a failed upload.
+func (q *quotaDB) Release(user string, size int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	used := q.used(user) - size
+	if used < 0 {
+		used = 0
+	}
+	return q.db.Set(user, strconv.FormatInt(used, 10))
+}
@@ -0,0 +1,148 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tgulacsi/camproxy/camutil"
+	"perkeep.org/pkg/blob"
+)
+
+// replicator writes the uploaded files to a secondary server as well.
+type replicator struct {
+	server    string
+	queue     chan replicaJob
+	failedLog string
+
+	mu      sync.Mutex
+	ok      int64
+	failed  int64
+	lastErr error
+}
+
+type replicaJob struct {
+	// src is the server the content has been uploaded to.
+	src     string
+	content blob.Ref
+	// perma is the permanode of the content, if valid.
+	perma blob.Ref
+}
+
+// newReplicator returns a replicator to the server. With zero workers the
+// replication is synchronous, else queued (up to queueLen jobs).
+// The refs failed to replicate are appended to failedLog, if given.
+func newReplicator(server string, workers, queueLen int, failedLog string) *replicator {
+	rp := &replicator{server: server, failedLog: failedLog}
+	if workers <= 0 {
+		return rp
+	}
+	rp.queue = make(chan replicaJob, queueLen)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for job := range rp.queue {
+				rp.do(context.Background(), job)
+			}
+		}()
+	}
+	return rp
+}
+
+// Replicate copies the blobs of content (already uploaded to src) to the
+// replica, so the replica has the very same refs - and the permanode (if
+// valid) with its claims, and the public key of their signer.
+func (rp *replicator) Replicate(ctx context.Context, src string, content, perma blob.Ref) error {
+	job := replicaJob{src: src, content: content, perma: perma}
+	if rp.queue == nil {
+		return rp.do(ctx, job)
+	}
+	select {
+	case rp.queue <- job:
+		return nil
+	default:
+		err := errors.Errorf("replica queue is full")
+		rp.note(job, err)
+		return err
+	}
+}
+
+func (rp *replicator) do(ctx context.Context, job replicaJob) error {
+	err := rp.sync(ctx, job)
+	rp.note(job, err)
+	return err
+}
+
+// sync copies the blobs of the job: the content first, then the permanode,
+// and the claims pointing to it.
+func (rp *replicator) sync(ctx context.Context, job replicaJob) error {
+	roots := []blob.Ref{job.content}
+	if job.perma.Valid() {
+		d, err := getDownloader(ctx, job.src)
+		if err != nil {
+			return err
+		}
+		claims, err := d.PermanodeClaims(ctx, job.perma)
+		if err != nil {
+			return err
+		}
+		roots = append(append(roots, job.perma), claims...)
+	}
+	from, err := getUploader(ctx, job.src, "")
+	if err != nil {
+		return err
+	}
+	to, err := getUploader(ctx, rp.server, "")
+	if err != nil {
+		return err
+	}
+	_, err = camutil.Sync(ctx, from.Client, to.Client, roots)
+	return err
+}
+
+func (rp *replicator) note(job replicaJob, err error) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if err == nil {
+		rp.ok++
+		return
+	}
+	rp.failed++
+	rp.lastErr = err
+	logger.Log("msg", "replicate", "replica", rp.server, "ref", job.content, "permanode", job.perma, "error", err)
+	if rp.failedLog == "" {
+		return
+	}
+	fh, openErr := os.OpenFile(rp.failedLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if openErr != nil {
+		logger.Log("msg", "open", "file", rp.failedLog, "error", openErr)
+		return
+	}
+	fmt.Fprintf(fh, "%s\t%s\t%s\n", time.Now().Format(time.RFC3339), job.content, err)
+	fh.Close()
+}
+
+// Stats returns the number of succeeded and failed replications, and the last error.
+func (rp *replicator) Stats() (ok, failed int64, lastErr error) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	return rp.ok, rp.failed, rp.lastErr
+}
@@ -0,0 +1,207 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// route is a route of the API: the requests with the method and the path
+// (a prefix, if it ends with "/") are served by serve - or by handle itself,
+// if serve is nil. The rest describes the route in /openapi.json.
+type route struct {
+	method, path string
+	serve        func(w http.ResponseWriter, r *http.Request, server string)
+
+	// doc is the path with its parameters ("/meta/{ref}"), path if empty.
+	doc, summary, produces string
+	params                 []routeParam
+}
+
+// routeParam is a (query or header) parameter of a route.
+type routeParam struct {
+	name, in, desc string
+}
+
+func (rt route) match(r *http.Request) bool {
+	if rt.method != r.Method {
+		return false
+	}
+	if strings.HasSuffix(rt.path, "/") {
+		return strings.HasPrefix(r.URL.Path, rt.path)
+	}
+	return r.URL.Path == rt.path
+}
+
+// routes are the routes of the API, in the order of matching.
+var routes []route
+
+func init() {
+	blobParams := []routeParam{
+		{"as", "query", "content (follow the file schemas, the default), schema (the JSON of the schema blob) or raw (the exact bytes)"},
+		{"raw", "query", "1 is the same as as=raw"},
+		{"mimeType", "query", "the MIME type of the content"},
+		{"nosniff", "query", "1 skips the MIME type sniffing"},
+		{"download", "query", "1 serves the content as attachment"},
+		{"inline", "query", "1 serves the content inline"},
+		{"filename", "query", "the file name of the Content-Disposition"},
+		{"meta", "query", "1 returns the size, mtime, MIME type, name and number of chunks of the file as JSON"},
+		{"chunks", "query", "1 returns the chunks of the file as JSON"},
+		{"framed", "query", "1 returns the refs as the parts of a multipart/mixed"},
+		{"format", "query", "tar returns the files and directories as a tar"},
+		{"render", "query", "md renders the markdown file as HTML"},
+		{"pretty", "query", "1 re-indents the schema blob (as HTML, if accepted)"},
+	}
+	uploadParams := []routeParam{
+		{"describe", "query", "1 returns the refs, attributes, size and MIME type as JSON"},
+		{"short", "query", "1 (base64), base32 or hex returns the short forms of the refs"},
+		{"noperma", "query", "1 creates no permanode"},
+		{"mtime", "query", "the modification time of the files, in seconds since the epoch"},
+		{"include", "query", "comma-separated globs of the files to upload"},
+		{"exclude", "query", "comma-separated globs of the files to skip"},
+		{"workers", "query", "the number of the files uploaded in parallel"},
+		{"async", "query", "1 queues the upload as a job"},
+		{"X-Camli-Attr", "header", "key=value attribute of the permanode (also a.<key>=<value> query parameters)"},
+	}
+	routes = []route{
+		{method: "GET", path: "/readyz", summary: "Readiness of the upstream servers", produces: "application/json"},
+		{method: "GET", path: "/login", summary: "Exchange the basic auth credentials for a session cookie"},
+		{method: "GET", path: "/logout", summary: "Clear the session cookie"},
+		{method: "GET", path: "/csrf", summary: "The CSRF token of the session", produces: "text/plain"},
+		{method: "GET", path: "/openapi.json", serve: serveOpenAPI, summary: "This API description", produces: "application/json"},
+		{method: "GET", path: "/debug/vars", summary: "The expvar counters", produces: "application/json",
+			serve: func(w http.ResponseWriter, r *http.Request, _ string) { expvar.Handler().ServeHTTP(w, r) }},
+		{method: "GET", path: "/admin/", doc: "/admin/{page}", summary: "The dashboard", produces: "text/html",
+			serve: func(w http.ResponseWriter, r *http.Request, _ string) { serveAdmin(w, r) }},
+		{method: "GET", path: "/permanodes", serve: servePermanodes, summary: "The permanodes, the last modified first", produces: "application/json",
+			params: []routeParam{{"limit", "query", "the size of the page"}, {"continue", "query", "the token of the next page"}}},
+		{method: "GET", path: "/lookup", serve: servePermanodes, summary: "The permanodes having the attribute", produces: "application/json",
+			params: []routeParam{{"attr", "query", "the attribute"}, {"value", "query", "the value of the attribute"}, {"limit", "query", "the size of the page"}, {"continue", "query", "the token of the next page"}}},
+		{method: "GET", path: "/n/", doc: "/n/{name}", summary: "The content of the aliased ref",
+			serve: func(w http.ResponseWriter, r *http.Request, _ string) { serveAlias(w, r) }},
+		{method: "GET", path: "/alias/", doc: "/alias/{name}", summary: "The aliased ref", produces: "text/plain",
+			serve: func(w http.ResponseWriter, r *http.Request, _ string) { serveAlias(w, r) }},
+		{method: "GET", path: "/hls/", doc: "/hls/{ref}/{file}", serve: serveStream, summary: "The video as a HLS (index.m3u8) or DASH (manifest.mpd) stream"},
+		{method: "GET", path: "/thumb/", doc: "/thumb/{ref}", serve: serveThumb, summary: "The PNG preview of the file", produces: "image/png",
+			params: []routeParam{{"size", "query", "the maximum width and height"}}},
+		{method: "GET", path: "/meta/", doc: "/meta/{ref}", serve: serveMeta, summary: "The metadata of the file", produces: "application/json"},
+		{method: "GET", path: "/size/", doc: "/size/{ref}", serve: serveSize, summary: "The size of the file (or of the blob)", produces: "text/plain",
+			params: []routeParam{{"as", "query", "raw returns the size of the blob"}, {"raw", "query", "1 is the same as as=raw"}, {"format", "query", "json returns the size as JSON"}}},
+		{method: "GET", path: "/path/", doc: "/path/{ref}/{path}", serve: servePathRequest, summary: "The file (or directory listing) at the path under the root"},
+		{method: "GET", path: "/jobs/", doc: "/jobs/{id}", summary: "The state of the queued upload", produces: "application/json",
+			serve: func(w http.ResponseWriter, r *http.Request, _ string) {
+				serveJob(w, r, strings.TrimPrefix(r.URL.Path, "/jobs/"))
+			}},
+		{method: "GET", path: "/", doc: "/{ref}", summary: "The content of the file, or the blob (comma-separated refs are concatenated)", params: blobParams},
+		{method: "HEAD", path: "/", doc: "/{ref}", summary: "The existence and size of the blob",
+			params: []routeParam{{"as", "query", "raw or schema"}, {"raw", "query", "1 is the same as as=raw"}}},
+		{method: "POST", path: "/stat", serve: serveStat, summary: "The existence and size of the refs in the body", produces: "application/json"},
+		{method: "POST", path: "/delta/", doc: "/delta/{ref}", serve: serveDelta, summary: "The rsync-style delta of the file against the signature in the body", produces: "application/vnd.camproxy.delta"},
+		{method: "POST", path: "/undelete/", doc: "/undelete/{ref}", serve: serveUndelete, summary: "Undo the deletion of the permanode"},
+		{method: "POST", path: "/", summary: "Upload the files of the multipart form (or the body)", produces: "text/plain", params: uploadParams},
+		{method: "PUT", path: "/alias/", doc: "/alias/{name}", summary: "Point the name at the ref in the body",
+			serve: func(w http.ResponseWriter, r *http.Request, _ string) { serveAlias(w, r) }},
+		{method: "DELETE", path: "/", doc: "/{ref}", summary: "Delete the permanode", serve: serveDelete},
+	}
+}
+
+// serveRoute serves the request by its route, and reports whether there was such.
+func serveRoute(w http.ResponseWriter, r *http.Request, server string) bool {
+	for _, rt := range routes {
+		if rt.serve != nil && rt.match(r) {
+			rt.serve(w, r, server)
+			return true
+		}
+	}
+	return false
+}
+
+var routeParamRx = regexp.MustCompile(`\{([^}]+)\}`)
+
+// serveOpenAPI writes the OpenAPI description of the routes.
+func serveOpenAPI(w http.ResponseWriter, r *http.Request, _ string) {
+	paths := make(map[string]map[string]interface{})
+	for _, rt := range routes {
+		p := rt.doc
+		if p == "" {
+			p = rt.path
+		}
+		var params []map[string]interface{}
+		for _, m := range routeParamRx.FindAllStringSubmatch(p, -1) {
+			params = append(params, map[string]interface{}{
+				"name": m[1], "in": "path", "required": true, "schema": map[string]string{"type": "string"},
+			})
+		}
+		params = append(params, map[string]interface{}{
+			"name": "X-Camli-Server", "in": "header", "description": "the upstream server (also the server query parameter)", "schema": map[string]string{"type": "string"},
+		})
+		for _, rp := range rt.params {
+			params = append(params, map[string]interface{}{
+				"name": rp.name, "in": rp.in, "description": rp.desc, "schema": map[string]string{"type": "string"},
+			})
+		}
+		ok := map[string]interface{}{"description": "OK"}
+		if rt.produces != "" {
+			ok["content"] = map[string]interface{}{rt.produces: map[string]interface{}{}}
+		}
+		if paths[p] == nil {
+			paths[p] = make(map[string]interface{})
+		}
+		paths[p][strings.ToLower(rt.method)] = map[string]interface{}{
+			"summary":    rt.summary,
+			"parameters": params,
+			"responses":  map[string]interface{}{"200": ok},
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"openapi": "3.0.3",
+		"info":    map[string]string{"title": "camproxy", "version": "1"},
+		"servers": []map[string]string{{"url": "/"}},
+		"paths":   paths,
+	})
+}
+
+// apiVersionHandler serves the versioned (/v1) API by the legacy (root) paths:
+// /v1/blob/<ref> is /<ref>, /v1/upload is /, and /v1/<path> is /<path>.
+type apiVersionHandler struct {
+	next http.Handler
+}
+
+func (ah apiVersionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := r.URL.Path
+	if !strings.HasPrefix(p, "/v1/") {
+		ah.next.ServeHTTP(w, r)
+		return
+	}
+	switch p = strings.TrimPrefix(p, "/v1"); {
+	case strings.HasPrefix(p, "/blob/"):
+		p = "/" + strings.TrimPrefix(p, "/blob/")
+	case p == "/upload":
+		p = "/"
+	}
+	r2 := new(http.Request)
+	*r2 = *r
+	u := *r.URL
+	u.Path, u.RawPath = p, ""
+	r2.URL = &u
+	ah.next.ServeHTTP(w, r2)
+}
@@ -0,0 +1,254 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// s3Client is a minimal S3 client (listing and getting objects, with
+// path-style URLs and AWS signature v4), enough for import-s3.
+type s3Client struct {
+	endpoint                         *url.URL
+	region                           string
+	accessKey, secretKey, sessionKey string
+	hc                               *http.Client
+}
+
+// newS3Client returns a client for the endpoint (https://s3.<region>.amazonaws.com
+// if empty), with the credentials of the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY
+// and AWS_SESSION_TOKEN environment variables.
+func newS3Client(endpoint, region string) (*s3Client, error) {
+	if region == "" {
+		if region = os.Getenv("AWS_REGION"); region == "" {
+			region = "us-east-1"
+		}
+	}
+	if endpoint == "" {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse %q", endpoint)
+	}
+	cl := &s3Client{endpoint: u, region: region,
+		accessKey:  os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:  os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionKey: os.Getenv("AWS_SESSION_TOKEN"),
+		hc:         &http.Client{},
+	}
+	if cl.accessKey == "" || cl.secretKey == "" {
+		return nil, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are needed")
+	}
+	return cl, nil
+}
+
+// parseS3URL splits s3://bucket/prefix.
+func parseS3URL(s string) (bucket, prefix string, err error) {
+	if !strings.HasPrefix(s, "s3://") {
+		return "", "", errors.Errorf("%q is not an s3://bucket/prefix URL", s)
+	}
+	s = s[5:]
+	if i := strings.IndexByte(s, '/'); i >= 0 {
+		bucket, prefix = s[:i], s[i+1:]
+	} else {
+		bucket = s
+	}
+	if bucket == "" {
+		return "", "", errors.Errorf("no bucket in %q", s)
+	}
+	return bucket, prefix, nil
+}
+
+// s3Object is an entry of a bucket listing.
+type s3Object struct {
+	Key          string    `xml:"Key"`
+	LastModified time.Time `xml:"LastModified"`
+	ETag         string    `xml:"ETag"`
+	Size         int64     `xml:"Size"`
+}
+
+// List calls fn with the objects under the prefix, in key order.
+func (cl *s3Client) List(ctx context.Context, bucket, prefix string, fn func(s3Object) error) error {
+	var token string
+	for {
+		q := url.Values{"list-type": {"2"}}
+		if prefix != "" {
+			q.Set("prefix", prefix)
+		}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		resp, err := cl.do(ctx, bucket, "", q)
+		if err != nil {
+			return err
+		}
+		var res struct {
+			IsTruncated           bool       `xml:"IsTruncated"`
+			NextContinuationToken string     `xml:"NextContinuationToken"`
+			Contents              []s3Object `xml:"Contents"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if err != nil {
+			return errors.Wrapf(err, "decode the listing of %q", bucket)
+		}
+		for _, obj := range res.Contents {
+			if err = fn(obj); err != nil {
+				return err
+			}
+		}
+		if !res.IsTruncated || res.NextContinuationToken == "" {
+			return nil
+		}
+		token = res.NextContinuationToken
+	}
+}
+
+// Get returns the body of the object.
+func (cl *s3Client) Get(ctx context.Context, bucket, key string) (io.ReadCloser, error) {
+	resp, err := cl.do(ctx, bucket, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// emptySHA256 is the hex SHA256 of the empty payload of the GETs.
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// do does a signed GET of the object (or the bucket, if key is empty),
+// and returns the response iff its status is 200.
+func (cl *s3Client) do(ctx context.Context, bucket, key string, q url.Values) (*http.Response, error) {
+	u := *cl.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = ""
+	u.RawQuery = s3Query(q)
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	cl.sign(req, time.Now().UTC())
+	resp, err := cl.hc.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "GET %s", u.Path)
+	}
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		return nil, errors.Errorf("GET %s: %s: %s", u.Path, resp.Status, b)
+	}
+	return resp, nil
+}
+
+// sign signs the (body-less) request with AWS signature v4.
+func (cl *s3Client) sign(req *http.Request, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	day := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", emptySHA256)
+	if cl.sessionKey != "" {
+		req.Header.Set("X-Amz-Security-Token", cl.sessionKey)
+	}
+	names := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	if cl.sessionKey != "" {
+		names = append(names, "x-amz-security-token")
+	}
+	var canonHeaders strings.Builder
+	for _, name := range names {
+		v := req.Header.Get(name)
+		if name == "host" {
+			v = req.URL.Host
+		}
+		canonHeaders.WriteString(name + ":" + strings.TrimSpace(v) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonRequest := strings.Join([]string{
+		req.Method, s3Escape(req.URL.Path, false), req.URL.RawQuery,
+		canonHeaders.String(), signedHeaders, emptySHA256,
+	}, "\n")
+	scope := day + "/" + cl.region + "/s3/aws4_request"
+	reqHash := sha256.Sum256([]byte(canonRequest))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(reqHash[:])
+	key := hmacSHA256([]byte("AWS4"+cl.secretKey), day)
+	for _, s := range []string{cl.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, s)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		cl.accessKey, scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, toSign))))
+	// the path must be sent as signed
+	req.URL.RawPath = s3Escape(req.URL.Path, false)
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(s))
+	return mac.Sum(nil)
+}
+
+// s3Query returns the canonical (sorted, strictly escaped) query string.
+func s3Query(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		for _, v := range q[k] {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Escape escapes everything but the unreserved characters (and the slashes,
+// unless escapeSlash).
+func s3Escape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !escapeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,157 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tgulacsi/camproxy/camutil"
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/sorted"
+	"perkeep.org/pkg/sorted/kvfile"
+)
+
+// scheduleConfig is a directory to be uploaded periodically, as
+//
+//	{"dir": "/var/backups", "every": "daily"}
+type scheduleConfig struct {
+	Dir string `json:"dir"`
+	// Every is hourly, daily, weekly or a duration (e.g. 30m).
+	Every string `json:"every"`
+	// Server is the server to upload to (default is -server).
+	Server  string   `json:"server,omitempty"`
+	Include []string `json:"include,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+// Interval returns the period of the schedule.
+func (sc scheduleConfig) Interval() (time.Duration, error) {
+	switch strings.ToLower(sc.Every) {
+	case "hourly":
+		return time.Hour, nil
+	case "daily":
+		return 24 * time.Hour, nil
+	case "weekly":
+		return 7 * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(sc.Every)
+	if err == nil && d <= 0 {
+		err = errors.Errorf("not positive")
+	}
+	return d, errors.Wrapf(err, "schedule of %q: every %q", sc.Dir, sc.Every)
+}
+
+// scheduleVars holds the ref of the last upload of each scheduled directory.
+var scheduleVars = expvar.NewMap("schedules")
+
+// scheduleLoop uploads the directory of the schedule in every interval,
+// skipping the files known to be unchanged.
+func scheduleLoop(ctx context.Context, sc scheduleConfig, interval time.Duration, files *fileStateDB) {
+	srv := sc.Server
+	if srv == "" {
+		srv = server
+	}
+	known := files.For(srv)
+	for {
+		start := time.Now()
+		u, err := getUploader(ctx, srv, "")
+		var ref blob.Ref
+		if err == nil {
+			ref, err = u.UploadDir(ctx, sc.Dir, camutil.DirOptions{
+				Include: sc.Include, Exclude: sc.Exclude, IgnoreFile: camutil.IgnoreFileName, Known: known})
+		}
+		if err != nil {
+			logger.Log("msg", "scheduled upload", "dir", sc.Dir, "server", srv, "error", err)
+		} else {
+			logger.Log("msg", "scheduled upload", "dir", sc.Dir, "server", srv, "ref", ref, "took", time.Since(start))
+			scheduleVars.Set(sc.Dir, stringVar(ref.String()))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+type stringVar string
+
+func (s stringVar) String() string { return strconv.Quote(string(s)) }
+
+// fileStateDB remembers the files uploaded to the servers.
+type fileStateDB struct {
+	db sorted.KeyValue
+}
+
+// serverFiles is the kv-backed camutil.KnownFiles of a server.
+type serverFiles struct {
+	*fileStateDB
+	server string
+}
+
+func newFileStateDB(filename string) (*fileStateDB, error) {
+	db, err := kvfile.NewStorage(filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open %q", filename)
+	}
+	return &fileStateDB{db: db}, nil
+}
+
+func (fs *fileStateDB) Close() error {
+	if fs == nil || fs.db == nil {
+		return nil
+	}
+	return fs.db.Close()
+}
+
+// For returns the files uploaded to the server - as a file uploaded to one
+// server is not on the others.
+func (fs *fileStateDB) For(server string) camutil.KnownFiles {
+	return serverFiles{fileStateDB: fs, server: server}
+}
+
+func (sf serverFiles) key(path string) string { return sf.server + "\x00" + path }
+
+// Get returns the ref of the path, iff it is stored with the same size and mtime.
+func (sf serverFiles) Get(path string, fi os.FileInfo) (blob.Ref, bool) {
+	v, err := sf.db.Get(sf.key(path))
+	if err != nil {
+		return blob.Ref{}, false
+	}
+	var size, mtime int64
+	var ref string
+	if _, err = fmt.Sscanf(v, "%d %d %s", &size, &mtime, &ref); err != nil ||
+		size != fi.Size() || mtime != fi.ModTime().UnixNano() {
+		return blob.Ref{}, false
+	}
+	return blob.Parse(ref)
+}
+
+// Set stores the ref of the path, with its size and mtime.
+func (sf serverFiles) Set(path string, fi os.FileInfo, br blob.Ref) {
+	v := fmt.Sprintf("%d %d %s", fi.Size(), fi.ModTime().UnixNano(), br)
+	if err := sf.db.Set(sf.key(path), v); err != nil {
+		logger.Log("msg", "store file state", "path", path, "error", err)
+	}
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tgulacsi/camproxy/camutil"
+	"perkeep.org/pkg/blob"
+)
+
+var scrubVars = expvar.NewMap("scrub")
+
+// scrubLoop scrubs the blobs reachable from the roots continuously,
+// pausing interval between the passes. The problems are counted in the
+// "scrub" expvar, and POSTed as JSON to the webhook (if given).
+func scrubLoop(ctx context.Context, server string, roots []blob.Ref, delay, interval time.Duration, webhook string) {
+	report := func(p camutil.ScrubProblem) {
+		logger.Log("msg", "scrub", "ref", p.Ref, "parent", p.Parent, "problem", p.Problem)
+		scrubVars.Add(p.Problem, 1)
+		if webhook != "" {
+			if err := postScrubProblem(ctx, webhook, server, p); err != nil {
+				logger.Log("msg", "scrub webhook", "url", webhook, "error", err)
+			}
+		}
+	}
+	for {
+		cl, err := camutil.NewClient(ctx, server, serverOpts(server))
+		if err == nil {
+			var st camutil.ScrubStats
+			st, err = camutil.Scrub(ctx, cl, roots, delay, report)
+			scrubVars.Add("checked", int64(st.Checked))
+			scrubVars.Add("bytes", st.Bytes)
+			logger.Log("msg", "scrub pass", "checked", st.Checked, "bytes", st.Bytes, "missing", st.Missing, "corrupt", st.Corrupt, "error", err)
+		}
+		if err != nil {
+			scrubVars.Add("errors", 1)
+			logger.Log("msg", "scrub", "server", server, "error", err)
+		} else {
+			scrubVars.Add("passes", 1)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+func postScrubProblem(ctx context.Context, webhook, server string, p camutil.ScrubProblem) error {
+	msg := struct {
+		Server  string    `json:"server"`
+		BlobRef string    `json:"blobRef"`
+		Parent  string    `json:"parent,omitempty"`
+		Problem string    `json:"problem"`
+		Time    time.Time `json:"time"`
+	}{Server: server, BlobRef: p.Ref.String(), Problem: p.Problem, Time: time.Now()}
+	if p.Parent.Valid() {
+		msg.Parent = p.Parent.String()
+	}
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", webhook, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return errors.Errorf("POST %s: %s", webhook, resp.Status)
+	}
+	return nil
+}
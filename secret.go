@@ -0,0 +1,123 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// readSecret resolves the secret reference:
+//
+//	file:<path>            the content of the file
+//	env:<name>             the environment variable
+//	cmd:<command args...>  the output of the command (e.g. aws secretsmanager get-secret-value ...)
+//	vault:<path>#<field>   the field of the Vault secret (VAULT_ADDR, VAULT_TOKEN)
+//
+// anything else is the secret itself. The surrounding whitespace is trimmed.
+func readSecret(ref string) (string, error) {
+	i := strings.IndexByte(ref, ':')
+	if i < 0 {
+		return ref, nil
+	}
+	arg := ref[i+1:]
+	switch ref[:i] {
+	case "file":
+		b, err := ioutil.ReadFile(arg)
+		if err != nil {
+			return "", errors.Wrapf(err, "read %q", arg)
+		}
+		return strings.TrimSpace(string(b)), nil
+	case "env":
+		return strings.TrimSpace(os.Getenv(arg)), nil
+	case "cmd":
+		args := strings.Fields(arg)
+		if len(args) == 0 {
+			return "", errors.New("empty secret command")
+		}
+		b, err := exec.Command(args[0], args[1:]...).Output()
+		if err != nil {
+			return "", errors.Wrapf(err, "run %q", arg)
+		}
+		return strings.TrimSpace(string(b)), nil
+	case "vault":
+		return readVaultSecret(arg)
+	}
+	return ref, nil
+}
+
+// envSecret returns the value of the environment variable, or the content
+// of the file named by <name>_FILE.
+func envSecret(name string) (string, error) {
+	if fn := os.Getenv(name + "_FILE"); fn != "" {
+		return readSecret("file:" + fn)
+	}
+	return os.Getenv(name), nil
+}
+
+// readVaultSecret reads the field of the secret at path (path#field) from
+// the Vault at VAULT_ADDR, with VAULT_TOKEN. Both the KV v1 and v2 engines' answers are understood.
+func readVaultSecret(arg string) (string, error) {
+	i := strings.LastIndexByte(arg, '#')
+	if i < 0 {
+		return "", errors.Errorf("vault secret %q: no #field", arg)
+	}
+	path, field := strings.Trim(arg[:i], "/"), arg[i+1:]
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		return "", errors.New("VAULT_ADDR is not set")
+	}
+	token, err := envSecret("VAULT_TOKEN")
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest("GET", strings.TrimRight(addr, "/")+"/v1/"+path, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	resp, err := (&http.Client{Timeout: 30 * time.Second}).Do(req)
+	if err != nil {
+		return "", errors.Wrapf(err, "get %q from vault", path)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("get %q from vault: %s", path, resp.Status)
+	}
+	var v struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		return "", errors.Wrapf(err, "decode %q from vault", path)
+	}
+	data := v.Data
+	if inner, ok := data["data"].(map[string]interface{}); ok { // KV v2
+		data = inner
+	}
+	s, ok := data[field].(string)
+	if !ok {
+		return "", errors.Errorf("no field %q in vault secret %q", field, path)
+	}
+	return s, nil
+}
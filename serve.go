@@ -0,0 +1,266 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tgulacsi/camproxy/camutil"
+)
+
+// serveCommand runs the proxy: camproxy [serve]
+func serveCommand(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return errors.Errorf("serve accepts no arguments, got %q", args)
+	}
+	if *flagTmpDir != "" {
+		if err := os.MkdirAll(*flagTmpDir, 0700); err != nil {
+			return errors.Wrapf(err, "create tmpdir %q", *flagTmpDir)
+		}
+	}
+	if *flagTmpDirMaxAge > 0 {
+		cleanTempDirs(tmpDir(), *flagTmpDirMaxAge)
+	}
+	if *flagMaxRequests > 0 {
+		limiter = newRequestLimiter(*flagMaxRequests, *flagMaxPerUser, *flagMaxQueue, *flagQueueTimeout)
+	}
+	if *flagMaxUpRequests > 0 {
+		upLimiter = newRequestLimiter(*flagMaxUpRequests, *flagMaxPerUser, *flagMaxQueue, *flagQueueTimeout)
+	}
+	if *flagMaxDownRequests > 0 {
+		downLimiter = newRequestLimiter(*flagMaxDownRequests, *flagMaxPerUser, *flagMaxQueue, *flagQueueTimeout)
+	}
+	// the limits are applied after the authentication, to the verified users
+	inner := http.HandlerFunc(handle)
+	if limiter != nil || upLimiter != nil || downLimiter != nil {
+		inner = limitHandler{all: limiter, up: upLimiter, down: downLimiter, next: http.HandlerFunc(handle)}.ServeHTTP
+	}
+	s := &http.Server{
+		Addr:           *flagListen,
+		Handler:        inner,
+		ReadTimeout:    300 * time.Second,
+		WriteTimeout:   300 * time.Second,
+		MaxHeaderBytes: 1 << 20,
+	}
+	// the credentials of the user, binding the sessions to them
+	var secret func(user string) string
+	if !*flagNoAuth && *flagHtpasswd != "" {
+		var err error
+		if s.Handler, err = camutil.SetupHtpasswdChecker(inner, *flagHtpasswd); err != nil {
+			return errors.Wrapf(err, "htpasswd %q", *flagHtpasswd)
+		}
+		authVerified = true
+		if secret, err = camutil.HtpasswdSecret(*flagHtpasswd); err != nil {
+			return errors.Wrapf(err, "htpasswd %q", *flagHtpasswd)
+		}
+	} else if !*flagNoAuth {
+		camliAuth, err := envSecret("CAMLI_AUTH")
+		if err != nil {
+			return errors.Wrap(err, "read CAMLI_AUTH_FILE")
+		}
+		if camliAuth != "" && os.Getenv("CAMLI_AUTH") == "" {
+			// for the perkeep client, too
+			os.Setenv("CAMLI_AUTH", camliAuth)
+		}
+		if camliAuth != "" {
+			s.Handler = camutil.SetupBasicAuthChecker(inner, camliAuth)
+			authVerified = true
+			secret = func(string) string { return camliAuth }
+		}
+	}
+	if *flagSessionTTL > 0 {
+		key, err := readSecret(*flagSessionKey)
+		if err != nil {
+			return errors.Wrap(err, "read session-key")
+		}
+		fn := *flagSessionDB
+		if fn == "" {
+			fn = filepath.Join(os.TempDir(), "camproxy-sessions.kv")
+		}
+		if sessions, err = newSessionIssuer(key, *flagSessionTTL, fn, secret); err != nil {
+			return errors.Wrap(err, "session issuer")
+		}
+		defer sessions.Close()
+		s.Handler = sessionHandler{authed: s.Handler, open: inner}
+	}
+	s.Handler = readyzHandler{next: s.Handler}
+	if *flagSites != "" {
+		roots, err := parseSites(*flagSites)
+		if err != nil {
+			return errors.Wrap(err, "parse sites")
+		}
+		s.Handler = siteHandler{roots: roots, next: s.Handler}
+	}
+	if *flagAccessLog != "" {
+		var err error
+		if access, err = openAccessLog(*flagAccessLog); err != nil {
+			return errors.Wrapf(err, "open access log %q", *flagAccessLog)
+		}
+		defer access.Close()
+	}
+	s.Handler = deadlineHandler{next: s.Handler}
+	s.Handler = statsHandler{next: s.Handler}
+	s.Handler = apiVersionHandler{next: s.Handler}
+	mimeCache = camutil.NewMimeCache(mimeCacheFile(), 0)
+	defer mimeCache.Close()
+	metaCache = camutil.NewMimeCache(metaCacheFile(), 0)
+	defer metaCache.Close()
+	shortRefsFn := *flagShortRefDB
+	if shortRefsFn == "" {
+		shortRefsFn = filepath.Join(os.TempDir(), "camproxy-shortrefs.kv")
+	}
+	var err error
+	if shortRefs, err = newShortRefDB(shortRefsFn); err != nil {
+		logger.Log("msg", "open short ref db", "file", shortRefsFn, "error", err)
+	}
+	defer shortRefs.Close()
+	// the aliases and the delete claims are kept for good, so not in the temp dir
+	if aliasFn := *flagAliasDB; aliasFn != "" {
+		if aliases, err = newAliasDB(aliasFn); err != nil {
+			return errors.Wrapf(err, "open alias db %q", aliasFn)
+		}
+		defer aliases.Close()
+	}
+	if deleteFn := *flagDeleteDB; deleteFn != "" {
+		if deletes, err = newDeleteDB(deleteFn); err != nil {
+			return errors.Wrapf(err, "open delete db %q", deleteFn)
+		}
+		defer deletes.Close()
+	}
+	if *flagIdempotencyTTL > 0 {
+		fn := *flagIdempotencyDB
+		if fn == "" {
+			fn = filepath.Join(os.TempDir(), "camproxy-idempotency.kv")
+		}
+		if idempotent, err = newIdempotencyDB(fn, *flagIdempotencyTTL); err != nil {
+			return errors.Wrapf(err, "open idempotency db %q", fn)
+		}
+		defer idempotent.Close()
+	}
+	if *flagParanoid != "" && (*flagParanoidMaxAge > 0 || *flagParanoidMaxSize != "") {
+		var maxSize int64
+		if *flagParanoidMaxSize != "" {
+			if maxSize, err = parseSize(*flagParanoidMaxSize); err != nil {
+				return errors.Wrap(err, "parse paranoid-max-size")
+			}
+		}
+		if *flagParanoidPrune <= 0 {
+			return errors.Errorf("paranoid-prune-interval must be positive, got %s", *flagParanoidPrune)
+		}
+		go pruneParanoidLoop(ctx, *flagParanoid, *flagParanoidPrune, *flagParanoidMaxAge, maxSize)
+	}
+	if *flagQuota != "" {
+		// the usage must survive the cleanups of the temp dir
+		fn := *flagQuotaDB
+		if fn == "" {
+			return errors.New("-quota needs -quota-db")
+		}
+		if quotas, err = newQuotaDB(fn, *flagQuota); err != nil {
+			return errors.Wrapf(err, "open quota db %q", fn)
+		}
+		defer quotas.Close()
+	}
+	if *flagTenants != "" {
+		// not in the (world-writable) temp dir: the grants are kept there
+		fn := *flagTenantDB
+		if fn == "" {
+			return errors.New("-tenants needs -tenant-db")
+		}
+		if tenants, err = newTenantSet(fn, *flagTenants); err != nil {
+			return errors.Wrapf(err, "open tenant db %q", fn)
+		}
+		defer tenants.Close()
+	}
+	if *flagReplica != "" {
+		replica = newReplicator(*flagReplica, *flagReplicaWorkers, 1024, *flagReplicaFailed)
+	}
+	spoolDir := *flagSpool
+	if spoolDir == "" {
+		spoolDir = filepath.Join(tmpDir(), "camproxy-jobs")
+	}
+	if spool, err = newUploadSpool(spoolDir); err != nil {
+		return errors.Wrap(err, "open spool")
+	}
+	spool.Start(ctx, *flagAsyncWorkers, 1024)
+	if *flagSpool != "" {
+		go spool.replayLoop(ctx, *flagSpoolInterval)
+	} else {
+		// resume the async uploads interrupted by the restart
+		go func() {
+			if err := spool.Replay(ctx); err != nil {
+				logger.Log("msg", "replay spool", "dir", spoolDir, "error", err)
+			}
+		}()
+	}
+	if len(cfg.Schedules) != 0 {
+		intervals := make([]time.Duration, len(cfg.Schedules))
+		for i, sc := range cfg.Schedules {
+			if intervals[i], err = sc.Interval(); err != nil {
+				return err
+			}
+		}
+		fn := *flagFileStateDB
+		if fn == "" {
+			fn = filepath.Join(os.TempDir(), "camproxy-files.kv")
+		}
+		known, err := newFileStateDB(fn)
+		if err != nil {
+			return errors.Wrap(err, "open file state db")
+		}
+		defer known.Close()
+		for i, sc := range cfg.Schedules {
+			go scheduleLoop(ctx, sc, intervals[i], known)
+		}
+	}
+	if *flagBreakerFailures > 0 {
+		breaker = newCircuitBreaker(*flagBreakerFailures, *flagBreakerCooldown)
+	}
+	if *flagHealthInterval > 0 {
+		go healthLoop(ctx, *flagHealthInterval)
+	}
+	if *flagScrubRoots != "" {
+		roots, err := camutil.ParseBlobNames(nil, strings.Split(*flagScrubRoots, ","))
+		if err != nil {
+			return errors.Wrap(err, "parse scrub-roots")
+		}
+		go scrubLoop(ctx, server, roots, *flagScrubDelay, *flagScrubInterval, *flagScrubWebhook)
+	}
+	logger.Log("msg", "Listening", "http", s.Addr, "camlistore", server)
+	go func() {
+		<-ctx.Done()
+		s.Shutdown(context.Background())
+	}()
+	if err := s.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+func mimeCacheFile() string {
+	return filepath.Join(os.TempDir(),
+		"mimecache-"+os.Getenv("BRUNO_CUS")+"_"+os.Getenv("BRUNO_ENV")+".kv")
+}
+
+func metaCacheFile() string {
+	return filepath.Join(os.TempDir(), "camproxy-meta.kv")
+}
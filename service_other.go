@@ -0,0 +1,38 @@
+// +build !windows
+
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+// startService is a no-op: camproxy runs as a Windows service only on Windows.
+func startService(cancel context.CancelFunc) (func(), error) {
+	return func() {}, nil
+}
+
+func installService(args []string) error {
+	return errors.New("services are supported on Windows only")
+}
+
+func removeService() error {
+	return errors.New("services are supported on Windows only")
+}
@@ -0,0 +1,164 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+const serviceName = "camproxy"
+
+// startService reports to the service control manager, if run as a Windows
+// service: the logs go to the event log, the working directory is the
+// directory of the executable (so relative paths in the flags are resolved
+// from there), and cancel is called when the service is stopped.
+// The returned function must be called when the serving is finished.
+func startService(cancel context.CancelFunc) (func(), error) {
+	interactive, err := svc.IsAnInteractiveSession()
+	if err != nil {
+		return nil, errors.Wrap(err, "determine session type")
+	}
+	if interactive {
+		return func() {}, nil
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chdir(filepath.Dir(exe)); err != nil {
+		return nil, err
+	}
+	el, err := eventlog.Open(serviceName)
+	if err != nil {
+		return nil, errors.Wrap(err, "open event log")
+	}
+	logger = log.NewLogfmtLogger(eventLogWriter{el})
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		if err := svc.Run(serviceName, winService{cancel: cancel, done: done}); err != nil {
+			el.Error(1, "run service: "+err.Error())
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+		el.Close()
+	}, nil
+}
+
+// winService is the handler of the service control requests.
+type winService struct {
+	cancel context.CancelFunc
+	done   <-chan struct{}
+}
+
+func (ws winService) Execute(args []string, r <-chan svc.ChangeRequest, s chan<- svc.Status) (bool, uint32) {
+	const accepts = svc.AcceptStop | svc.AcceptShutdown
+	s <- svc.Status{State: svc.StartPending}
+	s <- svc.Status{State: svc.Running, Accepts: accepts}
+	for {
+		select {
+		case <-ws.done:
+			s <- svc.Status{State: svc.StopPending}
+			return false, 0
+		case c := <-r:
+			switch c.Cmd {
+			case svc.Interrogate:
+				s <- c.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				s <- svc.Status{State: svc.StopPending}
+				ws.cancel()
+			}
+		}
+	}
+}
+
+// eventLogWriter writes each log line as an event.
+type eventLogWriter struct {
+	el *eventlog.Log
+}
+
+func (w eventLogWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimSpace(string(p))
+	var err error
+	if strings.Contains(msg, " error=") {
+		err = w.el.Error(1, msg)
+	} else {
+		err = w.el.Info(1, msg)
+	}
+	return len(p), err
+}
+
+// installService installs camproxy as an automatically started service,
+// running with the args, and registers it as an event log source.
+func installService(args []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return errors.Wrap(err, "connect to the service manager")
+	}
+	defer m.Disconnect()
+	if s, err := m.OpenService(serviceName); err == nil {
+		s.Close()
+		return errors.Errorf("service %s already exists", serviceName)
+	}
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: "camproxy",
+		Description: "Perkeep upload/download proxy",
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return errors.Wrapf(err, "create service %s", serviceName)
+	}
+	defer s.Close()
+	if err = eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		s.Delete()
+		return errors.Wrap(err, "install event log source")
+	}
+	return nil
+}
+
+// removeService removes the service and its event log source.
+func removeService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return errors.Wrap(err, "connect to the service manager")
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return errors.Wrapf(err, "open service %s", serviceName)
+	}
+	defer s.Close()
+	if err = s.Delete(); err != nil {
+		return errors.Wrapf(err, "delete service %s", serviceName)
+	}
+	return eventlog.Remove(serviceName)
+}
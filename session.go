@@ -0,0 +1,263 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"perkeep.org/pkg/sorted"
+	"perkeep.org/pkg/sorted/kvfile"
+)
+
+const (
+	sessionCookie = "camproxy_session"
+	// csrfCookie holds the CSRF token of the session, readable by scripts,
+	// to be sent back in the X-CSRF-Token header (or the csrf parameter).
+	csrfCookie = "camproxy_csrf"
+)
+
+var sessions *sessionIssuer
+
+// sessionIssuer issues and checks the HMAC-signed session cookies.
+//
+// The signature covers the user's current credentials (secret), so changing
+// or removing them ends the sessions of the user, and the ids of the sessions
+// ended by /logout are kept (till they would expire) in revoked.
+type sessionIssuer struct {
+	key     []byte
+	ttl     time.Duration
+	secret  func(user string) string
+	revoked sorted.KeyValue
+}
+
+type sessionUserKey struct{}
+
+// newSessionIssuer returns a sessionIssuer with the key, or with a random
+// one (invalidating the sessions on restart) if key is empty.
+// The ids of the revoked sessions are kept in the revokedDB file, and the
+// sessions are bound to the credentials returned by secret, if not nil.
+func newSessionIssuer(key string, ttl time.Duration, revokedDB string, secret func(user string) string) (*sessionIssuer, error) {
+	si := &sessionIssuer{key: []byte(key), ttl: ttl, secret: secret}
+	if key == "" {
+		si.key = make([]byte, 32)
+		if _, err := rand.Read(si.key); err != nil {
+			return nil, err
+		}
+	}
+	var err error
+	if si.revoked, err = kvfile.NewStorage(revokedDB); err != nil {
+		return nil, errors.Wrapf(err, "open %q", revokedDB)
+	}
+	// forget the revoked sessions expired since
+	now := time.Now().Unix()
+	it := si.revoked.Find("", "")
+	batch := si.revoked.BeginBatch()
+	for it.Next() {
+		if exp, err := strconv.ParseInt(it.Value(), 10, 64); err != nil || exp < now {
+			batch.Delete(it.Key())
+		}
+	}
+	if err = it.Close(); err == nil {
+		err = si.revoked.CommitBatch(batch)
+	}
+	if err != nil {
+		si.revoked.Close()
+		return nil, errors.Wrapf(err, "purge %q", revokedDB)
+	}
+	return si, nil
+}
+
+func (si *sessionIssuer) Close() error {
+	if si == nil || si.revoked == nil {
+		return nil
+	}
+	return si.revoked.Close()
+}
+
+func (si *sessionIssuer) sign(payload string) string {
+	mac := hmac.New(sha256.New, si.key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// signSession signs the payload of the user's session cookie,
+// with the user's current credentials.
+func (si *sessionIssuer) signSession(payload, user string) string {
+	if si.secret == nil {
+		return si.sign(payload)
+	}
+	return si.sign(payload + "|" + si.secret(user))
+}
+
+// Issue sets the session cookie of the user.
+func (si *sessionIssuer) Issue(w http.ResponseWriter, r *http.Request, user string) {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	expires := time.Now().Add(si.ttl)
+	payload := base64.RawURLEncoding.EncodeToString([]byte(user)) + "." + strconv.FormatInt(expires.Unix(), 10) +
+		"." + base64.RawURLEncoding.EncodeToString(id[:])
+	value := payload + "." + si.signSession(payload, user)
+	http.SetCookie(w, &http.Cookie{
+		Name: sessionCookie, Value: value,
+		Path: "/", Expires: expires,
+		HttpOnly: true, Secure: r.TLS != nil, SameSite: http.SameSiteLaxMode,
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name: csrfCookie, Value: si.csrfToken(value),
+		Path: "/", Expires: expires,
+		Secure: r.TLS != nil, SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// csrfToken returns the CSRF token bound to the session cookie's value.
+func (si *sessionIssuer) csrfToken(session string) string {
+	return si.sign("csrf|" + session)
+}
+
+// CheckCSRF reports whether the request (authenticated by its session
+// cookie) carries the CSRF token of its session.
+func (si *sessionIssuer) CheckCSRF(r *http.Request) bool {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return false
+	}
+	token := r.Header.Get("X-CSRF-Token")
+	if token == "" {
+		token = r.URL.Query().Get("csrf")
+	}
+	return token != "" && hmac.Equal([]byte(token), []byte(si.csrfToken(c.Value)))
+}
+
+// User returns the user of the valid session cookie of the request.
+func (si *sessionIssuer) User(r *http.Request) (string, bool) {
+	user, _, _, ok := si.session(r)
+	return user, ok
+}
+
+// session returns the user, the id and the expiry of the valid session
+// cookie of the request.
+func (si *sessionIssuer) session(r *http.Request) (user, id string, exp int64, ok bool) {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return "", "", 0, false
+	}
+	i := strings.LastIndexByte(c.Value, '.')
+	if i < 0 {
+		return "", "", 0, false
+	}
+	payload := c.Value[:i]
+	parts := strings.SplitN(payload, ".", 3)
+	if len(parts) != 3 {
+		return "", "", 0, false
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", "", 0, false
+	}
+	user, id = string(b), parts[2]
+	if !hmac.Equal([]byte(c.Value[i+1:]), []byte(si.signSession(payload, user))) {
+		return "", "", 0, false
+	}
+	if exp, err = strconv.ParseInt(parts[1], 10, 64); err != nil || time.Now().Unix() > exp {
+		return "", "", 0, false
+	}
+	if _, err = si.revoked.Get(id); err != sorted.ErrNotFound {
+		return "", "", 0, false // revoked, or cannot be checked
+	}
+	return user, id, exp, true
+}
+
+// Revoke ends the session of the request's cookie, if it has a valid one.
+func (si *sessionIssuer) Revoke(r *http.Request) error {
+	_, id, exp, ok := si.session(r)
+	if !ok {
+		return nil
+	}
+	return si.revoked.Set(id, strconv.FormatInt(exp, 10))
+}
+
+// sessionHandler serves the requests with a valid session cookie (and no
+// Authorization header) with open, the others with authed.
+type sessionHandler struct {
+	authed http.Handler
+	open   http.HandlerFunc
+}
+
+func (sh sessionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") == "" {
+		if user, ok := sessions.User(r); ok {
+			switch r.Method {
+			case "GET", "HEAD", "OPTIONS":
+			default:
+				if !sessions.CheckCSRF(r) {
+					http.Error(w, "missing or bad CSRF token", http.StatusForbidden)
+					return
+				}
+			}
+			sh.open(w, r.WithContext(context.WithValue(r.Context(), sessionUserKey{}, user)))
+			return
+		}
+	}
+	sh.authed.ServeHTTP(w, r)
+}
+
+// serveLogin exchanges the (already checked) credentials of the request
+// for a session cookie on /login, clears it on /logout, and writes the
+// CSRF token of the session on /csrf.
+func serveLogin(w http.ResponseWriter, r *http.Request) {
+	if sessions == nil {
+		http.Error(w, "sessions are not enabled", http.StatusNotFound)
+		return
+	}
+	switch r.URL.Path {
+	case "/logout":
+		if err := sessions.Revoke(r); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		for _, name := range []string{sessionCookie, csrfCookie} {
+			http.SetCookie(w, &http.Cookie{Name: name, Value: "", Path: "/", MaxAge: -1})
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case "/csrf":
+		c, err := r.Cookie(sessionCookie)
+		if _, ok := sessions.User(r); err != nil || !ok {
+			http.Error(w, "no session", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Cache-Control", "no-store")
+		io.WriteString(w, sessions.csrfToken(c.Value))
+		return
+	}
+	sessions.Issue(w, r, authUser(r))
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,127 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/tgulacsi/camproxy/camutil"
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/sorted"
+	"perkeep.org/pkg/sorted/kvfile"
+)
+
+// shortHexLen is the number of the digest's hex digits kept in a short hex ref.
+const shortHexLen = 16
+
+// shortRefDB maps the short hex refs to the full ones, as those cannot be decoded.
+type shortRefDB struct {
+	mu sync.Mutex
+	db sorted.KeyValue
+}
+
+func newShortRefDB(filename string) (*shortRefDB, error) {
+	db, err := kvfile.NewStorage(filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open %q", filename)
+	}
+	return &shortRefDB{db: db}, nil
+}
+
+func (s *shortRefDB) Close() error {
+	if s == nil || s.db == nil {
+		return nil
+	}
+	return s.db.Close()
+}
+
+// Resolve returns the full ref of the short hex ref.
+func (s *shortRefDB) Resolve(name string) (blob.Ref, bool) {
+	if s == nil {
+		return blob.Ref{}, false
+	}
+	v, err := s.db.Get(name)
+	if err != nil {
+		return blob.Ref{}, false
+	}
+	return blob.Parse(v)
+}
+
+// Shorten returns the short hex ref of br: the first shortHexLen digits of
+// its digest, lengthened while it collides with the short ref of another ref.
+func (s *shortRefDB) Shorten(br blob.Ref) (string, error) {
+	full := br.String()
+	digest := strings.TrimPrefix(full, br.HashName()+"-")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for n := shortHexLen; n < len(digest); n += 4 {
+		short := br.HashName() + "-" + digest[:n]
+		v, err := s.db.Get(short)
+		if err == sorted.ErrNotFound {
+			return short, s.db.Set(short, full)
+		}
+		if err != nil {
+			return full, err
+		}
+		if v == full {
+			return short, nil
+		}
+	}
+	return full, nil
+}
+
+// formatRef returns the ref in the short encoding asked for by the short
+// parameter: "1" or "base64", "base32" (Crockford), "hex" (a prefix of the digest),
+// or the full ref if empty.
+func formatRef(br blob.Ref, short string) string {
+	switch short {
+	case "", "0":
+		return br.String()
+	case "base32":
+		return camutil.RefToBase32(br)
+	case "hex":
+		if shortRefs == nil {
+			return br.String()
+		}
+		s, err := shortRefs.Shorten(br)
+		if err != nil {
+			logger.Log("msg", "store short ref", "ref", br, "error", err)
+			return br.String()
+		}
+		return s
+	default:
+		return camutil.RefToBase64(br)
+	}
+}
+
+// parseRefs parses the names as refs - full, base64, base32 or short hex.
+func parseRefs(names ...string) ([]blob.Ref, error) {
+	items := make([]blob.Ref, 0, len(names))
+	for _, name := range names {
+		var err error
+		if items, err = camutil.ParseBlobNames(items, []string{name}); err != nil {
+			br, ok := shortRefs.Resolve(name)
+			if !ok {
+				return nil, err
+			}
+			items = append(items, br)
+		}
+	}
+	return items, nil
+}
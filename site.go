@@ -0,0 +1,71 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/tgulacsi/camproxy/camutil"
+	"perkeep.org/pkg/blob"
+)
+
+// siteHandler serves the trees of the root permanodes as public websites
+// for their hostnames, and passes the other requests to next.
+type siteHandler struct {
+	roots map[string]blob.Ref
+	next  http.Handler
+}
+
+// parseSites parses the "hostname=permanode,..." spec.
+func parseSites(spec string) (map[string]blob.Ref, error) {
+	roots := make(map[string]blob.Ref)
+	for _, part := range strings.Split(spec, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		i := strings.IndexByte(part, '=')
+		if i < 0 {
+			return nil, errors.Errorf("no = in site %q", part)
+		}
+		items, err := camutil.ParseBlobNames(nil, []string{part[i+1:]})
+		if err != nil {
+			return nil, errors.Wrapf(err, "site %q", part)
+		}
+		roots[strings.ToLower(part[:i])] = items[0]
+	}
+	return roots, nil
+}
+
+func (sh siteHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	root, ok := sh.roots[strings.ToLower(host)]
+	if !ok {
+		sh.next.ServeHTTP(w, r)
+		return
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Method must be GET/HEAD", http.StatusMethodNotAllowed)
+		return
+	}
+	servePath(w, r, server, root, r.URL.Path)
+}
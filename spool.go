@@ -0,0 +1,310 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tgulacsi/camproxy/camutil"
+)
+
+// spoolKeepDone is the time the journal of a replayed upload is kept for,
+// to be queryable under /jobs/<id>.
+const spoolKeepDone = 24 * time.Hour
+
+// uploadSpool holds the asynchronous uploads, and the uploads failed for the
+// upstream being unavailable, to be replayed later.
+//
+// Each upload has its files under <dir>/<id>/, and its journal in <dir>/<id>.json,
+// rewritten atomically on every state change.
+type uploadSpool struct {
+	dir   string
+	queue chan string
+
+	mu      sync.Mutex
+	running map[string]struct{}
+}
+
+// spoolJob is the journal of a spooled upload.
+type spoolJob struct {
+	ID       string    `json:"id"`
+	State    string    `json:"state"` // queued, running, done or failed
+	Upload   upload    `json:"upload"`
+	Content  string    `json:"content,omitempty"`
+	Perma    string    `json:"permanode,omitempty"`
+	Attempts int       `json:"attempts"`
+	Error    string    `json:"error,omitempty"`
+	Created  time.Time `json:"created"`
+	Updated  time.Time `json:"updated"`
+}
+
+func newUploadSpool(dir string) (*uploadSpool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrapf(err, "create spool dir %q", dir)
+	}
+	return &uploadSpool{dir: dir}, nil
+}
+
+// Start starts the workers of the asynchronous uploads.
+func (sp *uploadSpool) Start(ctx context.Context, workers, queueLen int) {
+	sp.queue = make(chan string, queueLen)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for id := range sp.queue {
+				job, err := sp.Get(id)
+				if err == nil {
+					err = sp.run(ctx, job)
+				}
+				if err != nil {
+					logger.Log("msg", "async upload", "id", id, "error", err)
+				}
+			}
+		}()
+	}
+}
+
+// Enqueue adds the upload to the spool, and queues it for the workers.
+func (sp *uploadSpool) Enqueue(up upload) (string, error) {
+	id, err := sp.Add(up)
+	if err != nil {
+		return "", err
+	}
+	select {
+	case sp.queue <- id:
+		return id, nil
+	default:
+		sp.remove(id)
+		return "", errors.New("upload queue is full")
+	}
+}
+
+// Add moves the files of the upload into the spool, and returns the job's id.
+// The files are linked, so the caller may remove its own.
+func (sp *uploadSpool) Add(up upload) (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(b[:])
+	dn := filepath.Join(sp.dir, id)
+	if err := os.Mkdir(dn, 0700); err != nil {
+		return "", err
+	}
+	files := make([]string, len(up.Files))
+	for i, fn := range up.Files {
+		files[i] = filepath.Join(dn, filepath.Base(fn))
+		if err := camutil.LinkOrCopy(fn, files[i]); err != nil {
+			os.RemoveAll(dn)
+			return "", errors.Wrapf(err, "copy %q to the spool", fn)
+		}
+	}
+	up.Dir, up.Files = dn, files
+	now := time.Now()
+	job := spoolJob{ID: id, State: "queued", Upload: up, Created: now, Updated: now}
+	if err := sp.save(job); err != nil {
+		os.RemoveAll(dn)
+		return "", err
+	}
+	return id, nil
+}
+
+// Get returns the journal of the job.
+func (sp *uploadSpool) Get(id string) (spoolJob, error) {
+	var job spoolJob
+	if id == "" || strings.ContainsAny(id, `/\.`) {
+		return job, os.ErrNotExist
+	}
+	b, err := ioutil.ReadFile(filepath.Join(sp.dir, id+".json"))
+	if err != nil {
+		return job, err
+	}
+	return job, json.Unmarshal(b, &job)
+}
+
+func (sp *uploadSpool) remove(id string) {
+	os.RemoveAll(filepath.Join(sp.dir, id))
+	os.Remove(filepath.Join(sp.dir, id+".json"))
+}
+
+func (sp *uploadSpool) save(job spoolJob) error {
+	b, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	fn := filepath.Join(sp.dir, job.ID+".json")
+	if err = ioutil.WriteFile(fn+".tmp", b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(fn+".tmp", fn)
+}
+
+// Replay uploads the queued jobs, oldest first, stopping at the first
+// upstream error - the upstream is still unavailable.
+func (sp *uploadSpool) Replay(ctx context.Context) error {
+	names, err := filepath.Glob(filepath.Join(sp.dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	var jobs []spoolJob
+	for _, fn := range names {
+		job, err := sp.Get(strings.TrimSuffix(filepath.Base(fn), ".json"))
+		if err != nil {
+			logger.Log("msg", "read spool journal", "file", fn, "error", err)
+			continue
+		}
+		if job.State != "queued" && job.State != "running" {
+			if time.Since(job.Updated) > spoolKeepDone {
+				os.Remove(fn)
+			}
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Created.Before(jobs[j].Created) })
+
+	for _, job := range jobs {
+		if err := sp.run(ctx, job); err != nil {
+			if _, ok := err.(upstreamError); ok {
+				return err
+			}
+			logger.Log("msg", "replay", "id", job.ID, "error", err)
+		}
+	}
+	return nil
+}
+
+// run uploads the job, if it is not running already, and has not finished
+// since job was read. After an upstream error the job stays queued, else its
+// files are removed.
+func (sp *uploadSpool) run(ctx context.Context, job spoolJob) error {
+	sp.mu.Lock()
+	if _, ok := sp.running[job.ID]; ok {
+		sp.mu.Unlock()
+		return nil
+	}
+	if sp.running == nil {
+		sp.running = make(map[string]struct{})
+	}
+	sp.running[job.ID] = struct{}{}
+	sp.mu.Unlock()
+	defer func() {
+		sp.mu.Lock()
+		delete(sp.running, job.ID)
+		sp.mu.Unlock()
+	}()
+
+	// job may be a stale snapshot (of Replay): another worker may have
+	// finished it since, before it has been claimed above.
+	job, err := sp.Get(job.ID)
+	if err != nil {
+		return err
+	}
+	if job.State != "queued" && job.State != "running" {
+		return nil
+	}
+	if _, err = os.Stat(job.Upload.Dir); err != nil {
+		// the files are gone, so this will never succeed
+		job.State, job.Error, job.Updated = "failed", err.Error(), time.Now()
+		job.Upload.releaseQuota()
+		return sp.save(job)
+	}
+
+	job.State, job.Updated = "running", time.Now()
+	if err := sp.save(job); err != nil {
+		return err
+	}
+	res, err := job.Upload.Do(ctx)
+	job.Attempts++
+	job.Updated = time.Now()
+	if err != nil {
+		job.State, job.Error = "failed", err.Error()
+		_, upstream := err.(upstreamError)
+		if upstream && *flagSpool != "" {
+			job.State = "queued"
+		}
+		if saveErr := sp.save(job); saveErr != nil {
+			return saveErr
+		}
+		if job.State == "failed" {
+			job.Upload.releaseQuota()
+			os.RemoveAll(job.Upload.Dir)
+		}
+		return err
+	}
+	res.saveParanoid()
+	job.State, job.Error = "done", ""
+	job.Content, job.Perma = res.Content.String(), ""
+	if res.Perma.Valid() {
+		job.Perma = res.Perma.String()
+	}
+	os.RemoveAll(job.Upload.Dir)
+	if err = sp.save(job); err != nil {
+		return err
+	}
+	logger.Log("msg", "uploaded", "id", job.ID, "content", res.Content, "permanode", res.Perma)
+	return nil
+}
+
+// replayLoop replays the spool in every interval.
+func (sp *uploadSpool) replayLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := sp.Replay(ctx); err != nil {
+			logger.Log("msg", "replay spool", "dir", sp.dir, "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// acceptJob answers 202 Accepted with the job id.
+func acceptJob(w http.ResponseWriter, id string) {
+	w.Header().Set("Location", "/jobs/"+id)
+	w.Header().Set("X-Camli-Job", id)
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusAccepted)
+	io.WriteString(w, id)
+}
+
+// serveJob writes the journal of the spooled upload as JSON.
+func serveJob(w http.ResponseWriter, r *http.Request, id string) {
+	job, err := spool.Get(id)
+	if err != nil || job.Upload.User != authUser(r) {
+		http.Error(w, "no such job "+id, http.StatusNotFound)
+		return
+	}
+	job.Upload.Dir, job.Upload.Files = "", nil
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
@@ -0,0 +1,154 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/tgulacsi/camproxy/camutil"
+)
+
+// statBatchSize is the number of refs statted upstream at once.
+const statBatchSize = 1000
+
+// statResult is an element of the answer of POST /stat.
+type statResult struct {
+	BlobRef string `json:"blobRef"`
+	Exists  bool   `json:"exists"`
+	Size    uint32 `json:"size,omitempty"`
+}
+
+// serveStat answers the existence and size of the blobrefs in the body:
+// a JSON array of strings (with application/json Content-Type),
+// or whitespace separated refs.
+func serveStat(w http.ResponseWriter, r *http.Request, server string) {
+	b, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 16<<20))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	var names []string
+	if ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); ct == "application/json" {
+		if err = json.Unmarshal(b, &names); err != nil {
+			http.Error(w, fmt.Sprintf("parse body as JSON array: %v", err), 400)
+			return
+		}
+	} else {
+		names = strings.Fields(string(b))
+	}
+	items, err := camutil.ParseBlobNames(nil, names)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	d, err := getDownloader(r.Context(), server)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error getting downloader to %q: %s", server, err), 500)
+		return
+	}
+	user := authUser(r)
+	results := make([]statResult, len(items))
+	for start := 0; start < len(items); start += statBatchSize {
+		end := start + statBatchSize
+		if end > len(items) {
+			end = len(items)
+		}
+		sizes, err := d.Stat(r.Context(), items[start:end]...)
+		if err != nil {
+			http.Error(w, err.Error(), errStatus(err))
+			return
+		}
+		for i, br := range items[start:end] {
+			res := statResult{BlobRef: br.String()}
+			// hide the existence of the blobs of other tenants
+			if tenants == nil || tenants.Allowed(user, br) {
+				res.Size, res.Exists = sizes[br]
+			}
+			results[start+i] = res
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+// sizeResult is the answer of GET /size/<ref>?format=json.
+type sizeResult struct {
+	BlobRef string `json:"blobRef"`
+	Size    int64  `json:"size"`
+}
+
+// serveSize writes the size of the blob (with as=raw or raw=1), or of the file,
+// as plain text, or as JSON with format=json:
+//
+//	GET /size/<ref>
+func serveSize(w http.ResponseWriter, r *http.Request, server string) {
+	items, err := parseRefs(strings.TrimPrefix(r.URL.Path, "/size/"))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if len(items) != 1 {
+		http.Error(w, "exactly one blobref is needed", 400)
+		return
+	}
+	br := items[0]
+	if !checkAccess(w, r, br) {
+		return
+	}
+	d, err := getDownloader(r.Context(), server)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error getting downloader to %q: %s", server, err), 500)
+		return
+	}
+	var size int64
+	values := r.URL.Query()
+	if mode, _ := getMode(values); mode != "content" {
+		sizes, err := d.Stat(r.Context(), br)
+		if err != nil {
+			http.Error(w, err.Error(), errStatus(err))
+			return
+		}
+		n, ok := sizes[br]
+		if !ok {
+			http.Error(w, fmt.Sprintf("%s not found", br), http.StatusNotFound)
+			return
+		}
+		size = int64(n)
+	} else {
+		fr, err := d.OpenFile(r.Context(), br)
+		if err != nil {
+			http.Error(w, err.Error(), errStatus(err))
+			return
+		}
+		size = fr.Size()
+		fr.Close()
+	}
+	if values.Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sizeResult{BlobRef: br.String(), Size: size})
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, strconv.FormatInt(size, 10)+"\n")
+}
@@ -0,0 +1,61 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/tgulacsi/camproxy/camutil"
+	"perkeep.org/pkg/blob"
+)
+
+// syncCommand copies the missing blobs from one server to another:
+//
+//	camproxy sync -from A -to B [-ref root1,root2]
+func syncCommand(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("sync", flag.ContinueOnError)
+	flagFrom := fs.String("from", server, "source server")
+	flagTo := fs.String("to", "", "destination server")
+	flagRef := fs.String("ref", "", "comma-separated root refs to walk (default: enumerate all the blobs)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *flagTo == "" {
+		return errors.New("-to is needed")
+	}
+	var roots []blob.Ref
+	if *flagRef != "" {
+		var err error
+		if roots, err = camutil.ParseBlobNames(nil, strings.Split(*flagRef, ",")); err != nil {
+			return err
+		}
+	}
+	src, err := camutil.NewClient(ctx, *flagFrom, serverOpts(*flagFrom))
+	if err != nil {
+		return errors.Wrapf(err, "connect to %q", *flagFrom)
+	}
+	dst, err := camutil.NewClient(ctx, *flagTo, serverOpts(*flagTo))
+	if err != nil {
+		return errors.Wrapf(err, "connect to %q", *flagTo)
+	}
+	st, err := camutil.Sync(ctx, src, dst, roots)
+	logger.Log("msg", "sync", "from", *flagFrom, "to", *flagTo, "seen", st.Seen, "copied", st.Copied, "bytes", st.Bytes, "error", err)
+	return err
+}
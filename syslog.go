@@ -0,0 +1,61 @@
+// +build !windows
+
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io"
+	"log/syslog"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var syslogFacilities = map[string]syslog.Priority{
+	"kern": syslog.LOG_KERN, "user": syslog.LOG_USER, "mail": syslog.LOG_MAIL,
+	"daemon": syslog.LOG_DAEMON, "auth": syslog.LOG_AUTH, "syslog": syslog.LOG_SYSLOG,
+	"lpr": syslog.LOG_LPR, "news": syslog.LOG_NEWS, "uucp": syslog.LOG_UUCP,
+	"cron": syslog.LOG_CRON, "authpriv": syslog.LOG_AUTHPRIV, "ftp": syslog.LOG_FTP,
+	"local0": syslog.LOG_LOCAL0, "local1": syslog.LOG_LOCAL1, "local2": syslog.LOG_LOCAL2,
+	"local3": syslog.LOG_LOCAL3, "local4": syslog.LOG_LOCAL4, "local5": syslog.LOG_LOCAL5,
+	"local6": syslog.LOG_LOCAL6, "local7": syslog.LOG_LOCAL7,
+}
+
+// dialSyslog connects to the syslog at addr: "local" is the local daemon,
+// else network://host:port (udp, tcp or unix).
+func dialSyslog(addr, facility, tag string) (io.Writer, error) {
+	prio, ok := syslogFacilities[strings.ToLower(facility)]
+	if !ok {
+		return nil, errors.Errorf("unknown syslog facility %q", facility)
+	}
+	var network string
+	if addr != "local" {
+		i := strings.Index(addr, "://")
+		if i < 0 {
+			return nil, errors.Errorf("syslog address %q is not local or network://host:port", addr)
+		}
+		network, addr = addr[:i], addr[i+3:]
+	} else {
+		addr = ""
+	}
+	w, err := syslog.Dial(network, addr, prio|syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, errors.Wrapf(err, "dial syslog %s %q", network, addr)
+	}
+	return w, nil
+}
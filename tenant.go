@@ -0,0 +1,146 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/tgulacsi/camproxy/camutil"
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/sorted"
+	"perkeep.org/pkg/sorted/kvfile"
+)
+
+// tenantSet maps auth identities to their root permanodes, and remembers
+// which refs have been attached under each root.
+type tenantSet struct {
+	roots map[string]blob.Ref
+	db    sorted.KeyValue
+}
+
+// newTenantSet parses the "user=permanode,..." spec and opens the db of the
+// attached refs. The "*" user is the tenant of the not listed users.
+func newTenantSet(filename, spec string) (*tenantSet, error) {
+	ts := &tenantSet{roots: make(map[string]blob.Ref)}
+	for _, part := range strings.Split(spec, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		i := strings.IndexByte(part, '=')
+		if i < 0 {
+			return nil, errors.Errorf("no = in tenant %q", part)
+		}
+		items, err := camutil.ParseBlobNames(nil, []string{strings.TrimSpace(part[i+1:])})
+		if err == nil && len(items) != 1 {
+			err = errors.New("one root permanode is needed")
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "tenant %q", part)
+		}
+		ts.roots[part[:i]] = items[0]
+	}
+	var err error
+	if ts.db, err = kvfile.NewStorage(filename); err != nil {
+		return nil, errors.Wrapf(err, "open %q", filename)
+	}
+	return ts, nil
+}
+
+// Close closes the underlying db.
+func (ts *tenantSet) Close() error {
+	if ts == nil || ts.db == nil {
+		return nil
+	}
+	return ts.db.Close()
+}
+
+// Root returns the root permanode of the user's tenant.
+func (ts *tenantSet) Root(user string) (blob.Ref, bool) {
+	if root, ok := ts.roots[user]; ok {
+		return root, true
+	}
+	root, ok := ts.roots["*"]
+	return root, ok
+}
+
+// checkAccess answers 403 Forbidden, and returns false, if any of the refs is
+// not accessible for the user of the request.
+func checkAccess(w http.ResponseWriter, r *http.Request, refs ...blob.Ref) bool {
+	if tenants == nil {
+		return true
+	}
+	user := authUser(r)
+	for _, br := range refs {
+		if !tenants.Allowed(user, br) {
+			http.Error(w, fmt.Sprintf("%s is not accessible for %s", br, user), http.StatusForbidden)
+			return false
+		}
+	}
+	return true
+}
+
+// Allowed reports whether the ref is reachable from the user's root.
+func (ts *tenantSet) Allowed(user string, br blob.Ref) bool {
+	root, ok := ts.Root(user)
+	if !ok {
+		return false
+	}
+	if br == root {
+		return true
+	}
+	_, err := ts.db.Get(root.String() + "|" + br.String())
+	return err == nil
+}
+
+// Attach records the refs as members of the user's tenant (with the file
+// parts and directory members under content), and adds the member (the
+// permanode if valid, the content otherwise) as a camliMember of the
+// tenant's root permanode.
+func (ts *tenantSet) Attach(ctx context.Context, u *camutil.Uploader, user string, content, perma blob.Ref) error {
+	root, ok := ts.Root(user)
+	if !ok {
+		return errors.Errorf("no tenant for %q", user)
+	}
+	member := content
+	if perma.Valid() {
+		member = perma
+	}
+	if err := u.AddPermanodeAttr(ctx, root, "camliMember", member.String()); err != nil {
+		return errors.Wrapf(err, "add %s to %s", member, root)
+	}
+	batch := ts.db.BeginBatch()
+	add := func(br blob.Ref) error {
+		batch.Set(root.String()+"|"+br.String(), user)
+		return nil
+	}
+	if perma.Valid() {
+		add(perma)
+	}
+	if u.Client != nil {
+		// so the chunks and the members are accessible, too
+		if err := camutil.WalkTree(ctx, u.Client, content, add); err != nil {
+			return errors.Wrapf(err, "walk %s", content)
+		}
+	} else {
+		add(content)
+	}
+	return ts.db.CommitBatch(batch)
+}
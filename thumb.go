@@ -0,0 +1,198 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/tgulacsi/camproxy/camutil"
+	"perkeep.org/pkg/schema"
+)
+
+const maxThumbSize = 1024
+
+// serveThumb serves a PNG preview of the image, the first page of the PDF,
+// or (with -thumb-convert) of any document, at most size pixels wide and high,
+// cached in -thumb-dir:
+//
+//	GET /thumb/<ref>?size=256
+func serveThumb(w http.ResponseWriter, r *http.Request, server string) {
+	items, err := parseRefs(strings.TrimPrefix(r.URL.Path, "/thumb/"))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	br := items[0]
+	if !checkAccess(w, r, br) {
+		return
+	}
+	size := 256
+	if s := r.URL.Query().Get("size"); s != "" {
+		if size, err = strconv.Atoi(s); err != nil || size <= 0 || size > maxThumbSize {
+			http.Error(w, fmt.Sprintf("size must be between 1 and %d", maxThumbSize), 400)
+			return
+		}
+	}
+	nm := camutil.RefToBase64(br)
+	fn := filepath.Join(*flagThumbDir, nm+"-"+strconv.Itoa(size)+".png")
+	if _, err = os.Stat(fn); err != nil {
+		d, err := getDownloader(r.Context(), server)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("error getting downloader to %q: %s", server, err), 500)
+			return
+		}
+		fr, err := d.OpenFile(r.Context(), br)
+		if err != nil {
+			http.Error(w, err.Error(), errStatus(err))
+			return
+		}
+		okMime := cfg.mimeOverride(fr.FileName())
+		if okMime == "" {
+			okMime = mimeCache.Get(nm)
+		}
+		err = makeThumb(r.Context(), fn, fr, okMime, size)
+		fr.Close()
+		if err != nil {
+			if _, ok := errors.Cause(err).(unsupportedError); ok {
+				http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+				return
+			}
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "image/png")
+	http.ServeFile(w, r, fn)
+}
+
+// unsupportedError is returned for the files no preview can be made of.
+type unsupportedError string
+
+func (e unsupportedError) Error() string { return "no preview of " + string(e) }
+
+// makeThumb writes the PNG preview of the file to fn.
+func makeThumb(ctx context.Context, fn string, fr *schema.FileReader, okMime string, size int) error {
+	if okMime == "" {
+		head := make([]byte, sniffLen)
+		n, _ := fr.ReadAt(head, 0)
+		okMime = camutil.SniffMIMEType(head[:n], fr.FileName())
+	}
+	if err := os.MkdirAll(*flagThumbDir, 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(*flagThumbDir, "thumb-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	switch {
+	case strings.HasPrefix(okMime, "image/"):
+		img, _, err := image.Decode(fr)
+		if err != nil {
+			tmp.Close()
+			return unsupportedError(okMime + ": " + err.Error())
+		}
+		err = png.Encode(tmp, scaleImage(img, size))
+		if closeErr := tmp.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+		return os.Rename(tmp.Name(), fn)
+
+	case okMime == "application/pdf" || *flagThumbConvert != "":
+		tmp.Close()
+		dn, err := ioutil.TempDir(*flagThumbDir, "thumb-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dn)
+		src := filepath.Join(dn, "src"+path.Ext(fr.FileName()))
+		fh, err := os.Create(src)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(fh, fr)
+		if closeErr := fh.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+		out := filepath.Join(dn, "thumb")
+		var cmd *exec.Cmd
+		if okMime == "application/pdf" {
+			cmd = exec.CommandContext(ctx, *flagPdftoppm, "-png", "-singlefile", "-f", "1", "-l", "1",
+				"-scale-to", strconv.Itoa(size), src, out)
+		} else {
+			cmd = exec.CommandContext(ctx, *flagThumbConvert, src, out+".png", strconv.Itoa(size), okMime)
+		}
+		var errBuf bytes.Buffer
+		cmd.Stderr = &errBuf
+		if err = cmd.Run(); err != nil {
+			return errors.Wrapf(err, "%q: %s", cmd.Args, errBuf.String())
+		}
+		return os.Rename(out+".png", fn)
+	}
+	return unsupportedError(okMime)
+}
+
+// scaleImage returns the image scaled down (by nearest neighbour) to fit into
+// size*size, or img itself if it is not bigger.
+func scaleImage(img image.Image, size int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= size && h <= size {
+		return img
+	}
+	tw, th := size, h*size/w
+	if h > w {
+		tw, th = w*size/h, size
+	}
+	if tw < 1 {
+		tw = 1
+	}
+	if th < 1 {
+		th = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, tw, th))
+	for y := 0; y < th; y++ {
+		sy := b.Min.Y + y*h/th
+		for x := 0; x < tw; x++ {
+			dst.Set(x, y, img.At(b.Min.X+x*w/tw, sy))
+		}
+	}
+	return dst
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// tmpDir returns the directory of the received uploads (-tmpdir),
+// the temp dir by default.
+func tmpDir() string {
+	if *flagTmpDir != "" {
+		return *flagTmpDir
+	}
+	return os.TempDir()
+}
+
+// orphanRx matches the names of the temporary directories of the uploads
+// and of the spilled buffers and HLS sources, as created by ioutil.TempDir
+// and ioutil.TempFile.
+var orphanRx = regexp.MustCompile(`^camproxy(-(put|import|replica|spill|hls)-)?[0-9]+$`)
+
+// cleanTempDirs removes the temporary directories and files of the uploads
+// from dir left by a crash: those not written for maxAge.
+func cleanTempDirs(dir string, maxAge time.Duration) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		logger.Log("msg", "read temp dir", "dir", dir, "error", err)
+		return
+	}
+	old := time.Now().Add(-maxAge)
+	var removed, size int64
+	for _, fi := range fis {
+		if !orphanRx.MatchString(fi.Name()) {
+			continue
+		}
+		path := filepath.Join(dir, fi.Name())
+		var n int64
+		last := fi.ModTime()
+		filepath.Walk(path, func(_ string, fi os.FileInfo, err error) error {
+			if err == nil {
+				n += fi.Size()
+				if fi.ModTime().After(last) {
+					last = fi.ModTime()
+				}
+			}
+			return nil
+		})
+		if last.After(old) {
+			continue // maybe in use
+		}
+		if err := os.RemoveAll(path); err != nil {
+			logger.Log("msg", "remove orphaned temp file", "path", path, "error", err)
+			continue
+		}
+		removed++
+		size += n
+	}
+	if removed > 0 {
+		logger.Log("msg", "removed orphaned temp files", "dir", dir, "count", removed, "bytes", size)
+	}
+}
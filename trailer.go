@@ -0,0 +1,88 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// uploadTrailers are the trailers of a streaming upload's response,
+// the headers of the result of a normal upload.
+const uploadTrailers = "X-Camli-Status, X-Camli-Content, X-Camli-Permanode, X-Camli-Job"
+
+// wantTrailers reports whether the result of the upload is to be returned in
+// trailers: the body is streamed (chunked, of unknown length), and the client
+// accepts trailers (TE: trailers, or ?trailers=1).
+func wantTrailers(r *http.Request) bool {
+	if r.ContentLength >= 0 {
+		return false
+	}
+	if r.URL.Query().Get("trailers") == "1" {
+		return true
+	}
+	for _, te := range r.Header["Te"] {
+		for _, v := range strings.Split(te, ",") {
+			if i := strings.IndexByte(v, ';'); i >= 0 {
+				v = v[:i]
+			}
+			if strings.EqualFold(strings.TrimSpace(v), "trailers") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// trailerWriter answers 200 OK right away, announcing the uploadTrailers,
+// and moves the status written later to the X-Camli-Status trailer - so the
+// client gets an answer while the files are uploaded to the server.
+type trailerWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func newTrailerWriter(w http.ResponseWriter) *trailerWriter {
+	w.Header().Set("Trailer", uploadTrailers)
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return &trailerWriter{ResponseWriter: w}
+}
+
+func (tw *trailerWriter) WriteHeader(code int) {
+	if tw.status == 0 {
+		tw.status = code
+		tw.Header().Set("X-Camli-Status", strconv.Itoa(code))
+	}
+}
+
+func (tw *trailerWriter) Write(p []byte) (int, error) {
+	if tw.status == 0 {
+		tw.WriteHeader(http.StatusOK)
+	}
+	return tw.ResponseWriter.Write(p)
+}
+
+func (tw *trailerWriter) Flush() {
+	if f, ok := tw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
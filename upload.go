@@ -0,0 +1,273 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	stderrors "errors"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/tgulacsi/camproxy/camutil"
+	"perkeep.org/pkg/blob"
+)
+
+// upload is the received files (in Dir) of a POST, to be uploaded.
+type upload struct {
+	Server    string            `json:"server,omitempty"`
+	User      string            `json:"user"`
+	Dir       string            `json:"dir"`
+	Files     []string          `json:"files"`
+	MIMETypes []string          `json:"mimeTypes"`
+	Attrs     map[string]string `json:"attrs,omitempty"`
+	Size      int64             `json:"size"`
+	// Include and Exclude filter the files of an uploaded directory,
+	// as the ignore files named IgnoreFile in it.
+	Include    []string `json:"include,omitempty"`
+	Exclude    []string `json:"exclude,omitempty"`
+	IgnoreFile string   `json:"ignoreFile,omitempty"`
+	// Workers is the number of the files of the directory uploaded in parallel.
+	Workers int `json:"workers,omitempty"`
+	// ChunkSize is the target size of the chunks of the files (see
+	// camutil.ChunkOptions), the uploader's if 0.
+	ChunkSize int `json:"chunkSize,omitempty"`
+	// Known is the journal of the files of the directory already uploaded.
+	Known camutil.KnownFiles `json:"-"`
+}
+
+type uploadResult struct {
+	Content, Perma blob.Ref
+
+	paraSources []string
+	paraRefs    []blob.Ref
+}
+
+// upstreamError is an error of talking to the upstream server,
+// so the upload may succeed later.
+type upstreamError struct {
+	error
+}
+
+func (e upstreamError) Cause() error { return e.error }
+
+// Do uploads the files, and does the bookkeeping (replication, tenant,
+// quota, mime cache). The paranoid copies are left for saveParanoid.
+// The failure of the upload due to an unavailable server is returned as an
+// upstreamError, the others (a bad file, a schema error) are permanent.
+func (up upload) Do(ctx context.Context) (uploadResult, error) {
+	var res uploadResult
+	opts := uploaderOpts(up.Server, up.User)
+	if up.ChunkSize > 0 {
+		opts.Chunking = camutil.ChunkOptions{Size: up.ChunkSize}
+	}
+	u, err := newUploader(ctx, up.Server, opts)
+	if err != nil {
+		return res, upstreamError{errors.Wrapf(err, "get uploader to %q", up.Server)}
+	}
+	switch len(up.Files) {
+	case 0:
+		return res, errors.New("no files in request")
+	case 1:
+		// pk-put (for the directories) does not chunk by ChunkSize
+		if fi, statErr := os.Stat(up.Files[0]); statErr == nil && fi.IsDir() && (len(up.Include)+len(up.Exclude) != 0 || up.IgnoreFile != "" || up.Known != nil || up.Workers > 0 || up.ChunkSize > 0) {
+			res.Content, res.Perma, err = up.uploadDir(ctx, u, up.Files[0])
+			break
+		}
+		res.Content, res.Perma, err = u.UploadFileLazyAttr(ctx, up.Files[0], up.MIMETypes[0], up.Attrs)
+	default:
+		if up.Workers > 0 || len(up.Include)+len(up.Exclude) != 0 || up.ChunkSize > 0 {
+			res.Content, res.Perma, err = up.uploadDir(ctx, u, up.Dir)
+			break
+		}
+		res.Content, res.Perma, err = u.UploadFileLazyAttr(ctx, up.Dir, "", up.Attrs)
+	}
+	if err != nil {
+		if stderrors.Is(err, camutil.ErrUpstreamUnavailable) {
+			return res, upstreamError{errors.Wrapf(err, "upload %q", up.Files)}
+		}
+		return res, errors.Wrapf(err, "upload %q", up.Files)
+	}
+	if replica != nil {
+		if err = replica.Replicate(ctx, up.Server, res.Content, res.Perma); err != nil {
+			logger.Log("msg", "replicate", "ref", res.Content, "error", err)
+		}
+	}
+	if tenants != nil {
+		if err = tenants.Attach(ctx, u, up.User, res.Content, res.Perma); err != nil {
+			return res, errors.Wrapf(err, "attach %s to the tenant of %s", res.Content, up.User)
+		}
+	}
+	// store mime types
+	if len(up.Files) == 1 {
+		if len(up.MIMETypes) == 1 && up.MIMETypes[0] != "" {
+			mimeCache.Set(camutil.RefToBase64(res.Content), up.MIMETypes[0])
+		}
+		if *flagParanoid != "" {
+			res.paraSources, res.paraRefs = up.Files[:1], []blob.Ref{res.Content}
+		}
+	} else if *flagParanoid != "" {
+		// key each file by its own content ref, as in the uploaded directory
+		res.paraSources, res.paraRefs = up.memberRefs(ctx, res.Content)
+	}
+	return res, nil
+}
+
+// memberRefs returns the files of the upload with the refs of their members
+// in the uploaded directory (content).
+func (up upload) memberRefs(ctx context.Context, content blob.Ref) ([]string, []blob.Ref) {
+	d, err := getDownloader(ctx, up.Server)
+	if err != nil {
+		logger.Log("msg", "members for paranoid copy", "dir", content, "error", err)
+		return nil, nil
+	}
+	members, err := d.Members(ctx, content)
+	if err != nil {
+		logger.Log("msg", "members for paranoid copy", "dir", content, "error", err)
+		return nil, nil
+	}
+	var files []string
+	var refs []blob.Ref
+	for _, fn := range up.Files {
+		rel, err := filepath.Rel(up.Dir, fn)
+		if err != nil {
+			continue
+		}
+		ref, ok := members[filepath.ToSlash(rel)]
+		if !ok { // filtered out
+			continue
+		}
+		files, refs = append(files, fn), append(refs, ref)
+	}
+	return files, refs
+}
+
+// releaseQuota gives back the quota reserved for the failed upload.
+func (up upload) releaseQuota() {
+	if quotas == nil || up.Size == 0 {
+		return
+	}
+	if err := quotas.Release(up.User, up.Size); err != nil {
+		logger.Log("msg", "quota release", "user", up.User, "size", up.Size, "error", err)
+	}
+}
+
+// uploadDir uploads the directory filtered by Include, Exclude and the ignore
+// files (Workers files at a time), and creates a permanode for it iff there are attributes.
+func (up upload) uploadDir(ctx context.Context, u *camutil.Uploader, dir string) (content, perma blob.Ref, err error) {
+	if content, err = u.UploadDir(ctx, dir, camutil.DirOptions{Include: up.Include, Exclude: up.Exclude, IgnoreFile: up.IgnoreFile, Known: up.Known, Workers: up.Workers}); err != nil {
+		return content, perma, err
+	}
+	attrs := make(map[string]string, len(up.Attrs)+1)
+	for k, v := range up.Attrs {
+		if !strings.HasPrefix(k, "camli") {
+			attrs[k] = v
+		}
+	}
+	if len(attrs) == 0 {
+		return content, perma, nil
+	}
+	attrs["camliContent"] = content.String()
+	if perma, err = u.NewPermanode(ctx, attrs); err != nil {
+		logger.Log("msg", "NewPermanode", "attrs", attrs, "error", err)
+	}
+	return content, perma, nil
+}
+
+// filterFiles returns the files (and their MIME types) of a multi-file
+// upload not skipped by opts (matched against the file names).
+func filterFiles(opts camutil.DirOptions, files, mimeTypes []string) ([]string, []string) {
+	if len(opts.Include)+len(opts.Exclude) == 0 {
+		return files, mimeTypes
+	}
+	var keptFiles, keptMIMETypes []string
+	for i, fn := range files {
+		if !opts.Skip(filepath.Base(fn)) {
+			keptFiles, keptMIMETypes = append(keptFiles, fn), append(keptMIMETypes, mimeTypes[i])
+		}
+	}
+	return keptFiles, keptMIMETypes
+}
+
+// globParam returns the comma-separated globs of the (repeatable) parameter.
+func globParam(values url.Values, key string) []string {
+	var globs []string
+	for _, v := range values[key] {
+		globs = append(globs, splitGlobs(v)...)
+	}
+	return globs
+}
+
+// splitGlobs splits the comma-separated globs.
+func splitGlobs(s string) []string {
+	var globs []string
+	for _, g := range strings.Split(s, ",") {
+		if g = strings.TrimSpace(g); g != "" {
+			globs = append(globs, g)
+		}
+	}
+	return globs
+}
+
+// saveParanoid saves the paranoid copies of the uploaded files.
+func (res uploadResult) saveParanoid() {
+	for i, src := range res.paraSources {
+		if err := saveParanoid(src, res.paraRefs[i]); err != nil {
+			logger.Log("msg", "paranoid save", "src", src, "ref", res.paraRefs[i], "error", err)
+		}
+	}
+}
+
+// uploadDescription is the JSON response of an upload with ?describe=1.
+type uploadDescription struct {
+	Permanode string     `json:"permanode,omitempty"`
+	Content   string     `json:"content"`
+	Attr      url.Values `json:"attr,omitempty"`
+	Size      int64      `json:"size"`
+	MIMEType  string     `json:"mimeType,omitempty"`
+}
+
+// writeUploadDescription writes the refs of the upload, with the current
+// attributes of the permanode (as set by the request, if the server cannot
+// describe it), as JSON.
+func writeUploadDescription(w http.ResponseWriter, r *http.Request, up upload, res uploadResult, short string) {
+	desc := uploadDescription{Content: formatRef(res.Content, short), Size: up.Size}
+	if len(up.Files) == 1 && len(up.MIMETypes) == 1 {
+		desc.MIMEType = up.MIMETypes[0]
+	}
+	if res.Perma.Valid() {
+		desc.Permanode = formatRef(res.Perma, short)
+		d, err := getDownloader(r.Context(), up.Server)
+		if err == nil {
+			desc.Attr, err = d.PermanodeAttr(r.Context(), res.Perma)
+		}
+		if err != nil {
+			logger.Log("msg", "describe", "permanode", res.Perma, "error", err)
+			desc.Attr = url.Values{"camliContent": {res.Content.String()}}
+			for k, v := range up.Attrs {
+				desc.Attr.Set(k, v)
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(201)
+	json.NewEncoder(w).Encode(desc)
+}
@@ -0,0 +1,213 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/tgulacsi/camproxy/camutil"
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/schema"
+)
+
+// readParanoidManifest reads the sidecar of the copy. If there's no sidecar,
+// the compression and encryption is guessed from the file extension.
+func readParanoidManifest(pc paranoidCopy) (paranoidManifest, bool) {
+	var m paranoidManifest
+	if b, err := ioutil.ReadFile(pc.Manifest); err == nil {
+		if err = json.Unmarshal(b, &m); err == nil {
+			return m, true
+		}
+	}
+	m.BlobRef = pc.Ref.String()
+	m.Encrypted = strings.HasSuffix(pc.Path, ".enc")
+	for method, ext := range compressExt {
+		if strings.HasSuffix(strings.TrimSuffix(pc.Path, ".enc"), ext) {
+			m.Compression = method
+		}
+	}
+	return m, false
+}
+
+// openParanoidCopy returns the original content of the paranoid copy.
+func openParanoidCopy(pc paranoidCopy, m paranoidManifest) (io.ReadCloser, error) {
+	fh, err := os.Open(pc.Path)
+	if err != nil {
+		return nil, err
+	}
+	r := io.Reader(fh)
+	if m.Encrypted {
+		if paranoidKey == nil {
+			fh.Close()
+			return nil, errors.Errorf("%s is encrypted, but no paranoid key is given", pc.Path)
+		}
+		if r, err = newDecryptReader(paranoidKey, r); err != nil {
+			fh.Close()
+			return nil, err
+		}
+	}
+	if m.Compression == "" {
+		return struct {
+			io.Reader
+			io.Closer
+		}{r, fh}, nil
+	}
+	dr, err := newDecompressReader(m.Compression, r)
+	if err != nil {
+		fh.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{dr, multiCloser{dr, fh}}, nil
+}
+
+// verifyChunks recomputes the refs of the chunks of the copy, comparing them
+// with the parts of the file upstream. ok is false if the ref is not a file
+// upstream (or cannot be read), so there is nothing to compare with.
+//
+// The parts are expected to be whole blobs, as perkeep writes them.
+func verifyChunks(ctx context.Context, d *camutil.Downloader, pc paranoidCopy, m paranoidManifest) (problem string, ok bool) {
+	fr, err := d.OpenFile(ctx, pc.Ref)
+	if err != nil {
+		return "", false
+	}
+	defer fr.Close()
+	rc, err := openParanoidCopy(pc, m)
+	if err != nil {
+		return fmt.Sprintf("UNREADABLE %v", err), true
+	}
+	defer rc.Close()
+	var off int64
+	errMismatch := errors.New("mismatch")
+	err = fr.ForeachChunk(ctx, func(_ []blob.Ref, p schema.BytesPart) error {
+		if !p.BlobRef.Valid() { // a hole of zeros
+			n, err := io.CopyN(ioutil.Discard, rc, int64(p.Size))
+			off += n
+			return err
+		}
+		h := p.BlobRef.Hash()
+		n, err := io.CopyN(h, rc, int64(p.Size))
+		if err == nil && !p.BlobRef.HashMatches(h) {
+			problem, err = fmt.Sprintf("MISMATCH chunk %s at %d", p.BlobRef, off), errMismatch
+		}
+		off += n
+		return err
+	})
+	if err == nil {
+		if n, _ := io.Copy(ioutil.Discard, rc); n != 0 {
+			problem = fmt.Sprintf("MISMATCH size %d, upstream has %d", off+n, off)
+		}
+	} else if err != errMismatch {
+		problem = fmt.Sprintf("MISMATCH at %d: %v", off, err)
+	}
+	return problem, true
+}
+
+type multiCloser []io.Closer
+
+func (mc multiCloser) Close() error {
+	var err error
+	for _, c := range mc {
+		if closeErr := c.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// verifyParanoid walks the paranoid dir, recomputes the refs of the chunks of
+// each copy (see verifyChunks; the SHA-256 of the manifest is checked for the
+// directories), and checks that the blob still exists upstream.
+// Prints the problems to w, and returns the number of them.
+func verifyParanoid(ctx context.Context, w io.Writer, dir, server string) (int, error) {
+	d, err := getDownloader(ctx, server)
+	if err != nil {
+		return 0, err
+	}
+	var problems int
+	report := func(pc paranoidCopy, format string, args ...interface{}) {
+		problems++
+		fmt.Fprintf(w, "%s\t%s\t%s\n", pc.Ref, pc.Path, fmt.Sprintf(format, args...))
+	}
+	var batch []paranoidCopy
+	statBatch := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		refs := make([]blob.Ref, len(batch))
+		for i, pc := range batch {
+			refs[i] = pc.Ref
+		}
+		sizes, err := d.Stat(ctx, refs...)
+		if err != nil {
+			return err
+		}
+		for _, pc := range batch {
+			if _, ok := sizes[pc.Ref]; !ok {
+				report(pc, "MISSING upstream")
+			}
+		}
+		batch = batch[:0]
+		return nil
+	}
+	err = walkParanoid(dir, func(pc paranoidCopy) error {
+		m, ok := readParanoidManifest(pc)
+		if !ok {
+			report(pc, "NO MANIFEST")
+		} else if m.BlobRef != pc.Ref.String() {
+			report(pc, "MISMATCH manifest is for %s", m.BlobRef)
+		} else if problem, ok := verifyChunks(ctx, d, pc, m); ok {
+			if problem != "" {
+				report(pc, "%s", problem)
+			}
+		} else if m.SHA256 != "" {
+			// not a file upstream (or not reachable): check the manifest's hash
+			rc, err := openParanoidCopy(pc, m)
+			if err != nil {
+				report(pc, "UNREADABLE %v", err)
+			} else {
+				hsh := sha256.New()
+				size, err := io.Copy(hsh, rc)
+				rc.Close()
+				if err != nil {
+					report(pc, "UNREADABLE %v", err)
+				} else if got := hex.EncodeToString(hsh.Sum(nil)); got != m.SHA256 || size != m.Size {
+					report(pc, "MISMATCH sha256=%s size=%d, manifest has sha256=%s size=%d", got, size, m.SHA256, m.Size)
+				}
+			}
+		}
+		if batch = append(batch, pc); len(batch) >= 100 {
+			return statBatch()
+		}
+		return nil
+	})
+	if err == nil {
+		err = statBatch()
+	}
+	return problems, err
+}
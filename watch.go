@@ -0,0 +1,151 @@
+/*
+Copyright 2018 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+	"github.com/tgulacsi/camproxy/camutil"
+)
+
+// watchCommand uploads the new and changed files under dir:
+//
+//	camproxy watch [-debounce 2s] [-include glob,...] [-exclude glob,...] [-delete] [-permanode] dir
+func watchCommand(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("watch", flag.ContinueOnError)
+	flagDebounce := fs.Duration("debounce", 2*time.Second, "upload a file after it has not changed for this long")
+	flagInclude := fs.String("include", "", "comma-separated globs: upload only the matching files (matched against the name and the path relative to dir, ** matches any number of directories)")
+	flagExclude := fs.String("exclude", "", "comma-separated globs: do not upload the matching files")
+	flagDelete := fs.Bool("delete", false, "delete the files after a successful upload")
+	flagPerma := fs.Bool("permanode", false, "create a permanode (titled by the file name) for each file")
+	flagExisting := fs.Bool("existing", false, "upload the files already in dir at start, too")
+	flagUser := fs.String("user", "", "upload as this user (for -user-keys and -tenants)")
+	flagIgnore := fs.String("ignore-file", camutil.IgnoreFileName, "honor the gitignore-style ignore files of this name in the directories (empty to upload everything)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("exactly one directory is needed")
+	}
+	if *flagDebounce <= 0 {
+		return errors.New("debounce must be positive")
+	}
+	root := fs.Arg(0)
+	dirOpts := camutil.DirOptions{Include: splitGlobs(*flagInclude), Exclude: splitGlobs(*flagExclude)}
+	if *flagReplica != "" {
+		replica = newReplicator(*flagReplica, 0, 0, *flagReplicaFailed)
+	}
+
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return errors.Wrap(err, "create watcher")
+	}
+	defer w.Close()
+
+	pending := make(map[string]time.Time)
+	// addDir watches the dir and its subdirectories,
+	// and marks the files in them as pending iff mark is true.
+	addDir := func(dir string, mark bool) error {
+		return filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if fi.IsDir() {
+				return errors.Wrapf(w.Add(path), "watch %q", path)
+			}
+			if mark && fi.Mode().IsRegular() {
+				pending[path] = time.Now()
+			}
+			return nil
+		})
+	}
+	if err = addDir(root, *flagExisting); err != nil {
+		return err
+	}
+
+	wanted := func(path string) bool {
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			rel = path
+		}
+		rel = filepath.ToSlash(rel)
+		if dirOpts.Skip(rel) {
+			return false
+		}
+		rules, err := camutil.LoadIgnoreRules(root, rel, *flagIgnore)
+		if err != nil {
+			logger.Log("msg", "read ignore files", "file", path, "error", err)
+		}
+		return !rules.Ignored(rel, false)
+	}
+	upload := func(path string) {
+		fi, err := os.Stat(path)
+		if err != nil || !fi.Mode().IsRegular() || !wanted(path) {
+			return
+		}
+		res, err := putPath(ctx, path, nil, *flagPerma, time.Time{}, *flagUser, camutil.DirOptions{})
+		if err != nil {
+			logger.Log("msg", "watch upload", "file", path, "error", err)
+			return
+		}
+		logger.Log("msg", "uploaded", "file", path, "content", res.Content, "permanode", res.Perma)
+		if *flagDelete {
+			if err = os.Remove(path); err != nil {
+				logger.Log("msg", "delete uploaded", "file", path, "error", err)
+			}
+		}
+	}
+
+	logger.Log("msg", "watching", "dir", root)
+	ticker := time.NewTicker(*flagDebounce / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-w.Errors:
+			logger.Log("msg", "watch", "dir", root, "error", err)
+		case ev := <-w.Events:
+			if ev.Op&(fsnotify.Create|fsnotify.Write) == 0 {
+				continue
+			}
+			if fi, err := os.Stat(ev.Name); err == nil && fi.IsDir() {
+				if ev.Op&fsnotify.Create != 0 {
+					if err = addDir(ev.Name, true); err != nil {
+						logger.Log("msg", "watch", "dir", ev.Name, "error", err)
+					}
+				}
+				continue
+			}
+			pending[ev.Name] = time.Now()
+		case now := <-ticker.C:
+			for path, t := range pending {
+				if now.Sub(t) < *flagDebounce {
+					continue
+				}
+				delete(pending, path)
+				upload(path)
+			}
+		}
+	}
+}